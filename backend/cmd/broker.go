@@ -0,0 +1,40 @@
+package cmd
+
+import (
+	"sync"
+
+	"github.com/murraystewart96/token-swap/internal/config"
+	"github.com/murraystewart96/token-swap/pkg/kafka"
+)
+
+// memoryBroker is shared by every producer and consumer in the process
+// configured with kafka.broker: memory
+var memoryBroker = sync.OnceValue(func() *kafka.MemoryBroker {
+	return kafka.NewMemoryBroker(0)
+})
+
+// newProducer creates a producer for the configured broker, redisCfg is only
+// used with kafka.broker: redis
+func newProducer(cfg *config.KafkaProducer, redisCfg *config.Redis) (kafka.IProducer, error) {
+	switch cfg.Broker {
+	case config.BrokerMemory:
+		return memoryBroker().NewProducer(cfg), nil
+	case config.BrokerRedis:
+		return kafka.NewRedisStreamProducer(redisCfg, cfg), nil
+	default:
+		return kafka.NewProducer(cfg)
+	}
+}
+
+// newConsumer creates a consumer for the configured broker, redisCfg is only
+// used with kafka.broker: redis
+func newConsumer(cfg *config.KafkaConsumer, redisCfg *config.Redis) (kafka.IConsumer, error) {
+	switch cfg.Broker {
+	case config.BrokerMemory:
+		return memoryBroker().NewConsumer(cfg), nil
+	case config.BrokerRedis:
+		return kafka.NewRedisStreamConsumer(redisCfg, cfg), nil
+	default:
+		return kafka.NewConsumer(cfg)
+	}
+}
@@ -2,14 +2,15 @@ package cmd
 
 import (
 	"context"
+	"fmt"
 	"os"
 	"os/signal"
 	"syscall"
 
 	"github.com/murraystewart96/token-swap/internal/config"
 	"github.com/murraystewart96/token-swap/internal/events"
-	"github.com/murraystewart96/token-swap/pkg/kafka"
 	"github.com/murraystewart96/token-swap/internal/storage/postgres"
+	"github.com/murraystewart96/token-swap/pkg/kafka"
 	"github.com/murraystewart96/token-swap/pkg/tracing"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
@@ -35,7 +36,7 @@ func createEventListenerCmd() *cobra.Command { //nolint:gocognit
 			tracingConfig := tracing.TracingConfig{
 				ServiceName:  "token-swap-event-listener",
 				Environment:  "development", // TODO: Make this configurable
-				OTLPEndpoint: "", // Will use default for development
+				OTLPEndpoint: "",            // Will use default for development
 			}
 			shutdown, err := tracing.InitTracer(tracingConfig)
 			if err != nil {
@@ -43,27 +44,55 @@ func createEventListenerCmd() *cobra.Command { //nolint:gocognit
 			}
 			defer shutdown()
 
-			producer, err := kafka.NewProducer(&cfg.Kafka)
+			producer, err := newProducer(&cfg.Kafka, &cfg.Redis)
 			if err != nil {
 				log.Fatal().Err(err).Msg("failed to create kafka producer")
 			}
+			defer func() {
+				// Deliver anything still queued before exiting
+				if err := producer.Close(); err != nil {
+					log.Error().Err(err).Msg("failed to flush kafka producer")
+				}
+			}()
 
-			db, err := postgres.NewDB(&cfg.DB)
-			if err != nil {
-				log.Fatal().Err(err).Msg("failed to create database connection")
-			}
-			defer db.Close()
-
-			events, err := events.NewClient(&cfg.Listener, producer, db)
-			if err != nil {
-				log.Fatal().Err(err).Msg("failed to create event service")
+			if err := provisionTopics(producer, cfg); err != nil {
+				log.Fatal().Err(err).Msg("failed to provision kafka topics")
 			}
 
 			ctx, _ := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM, syscall.SIGINT)
 
-			events.Listen(ctx)
+			if err := runEventListener(ctx, cfg, producer); err != nil {
+				log.Fatal().Err(err).Msg("event listener failed")
+			}
 		},
 	}
 
 	return eventsCmd
 }
+
+// provisionTopics creates the topics the listener publishes to if they don't
+// exist. Redis streams are created by the first event added to them.
+func provisionTopics(producer kafka.IProducer, cfg *config.Events) error {
+	kafkaProducer, ok := producer.(*kafka.Producer)
+	if !ok || cfg.Kafka.TopicPartitions <= 0 {
+		return nil
+	}
+
+	return kafkaProducer.EnsureTopics(context.Background(), cfg.Listener.Topics(), cfg.Kafka.TopicPartitions, cfg.Kafka.TopicReplicationFactor)
+}
+
+// runEventListener publishes pool events with producer until ctx is done
+func runEventListener(ctx context.Context, cfg *config.Events, producer kafka.IProducer) error {
+	db, err := postgres.NewDB(&cfg.DB)
+	if err != nil {
+		return fmt.Errorf("failed to create database connection: %w", err)
+	}
+	defer db.Close()
+
+	events, err := events.NewClient(&cfg.Listener, producer, db)
+	if err != nil {
+		return fmt.Errorf("failed to create event service: %w", err)
+	}
+
+	return events.Run(ctx)
+}
@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/murraystewart96/token-swap/internal/config"
+	"github.com/murraystewart96/token-swap/pkg/tracing"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+func createPipelineCmd() *cobra.Command {
+	pipelineCmd := &cobra.Command{
+		Use:   "pipeline",
+		Short: "runs the event listener and worker",
+		Long: `Runs the event listener and worker in one process. With kafka.broker: memory in both
+configs, events go through an in-process broker so no Kafka cluster is needed.`,
+
+		Run: func(cmd *cobra.Command, _ []string) {
+			configPath, err := cmd.Flags().GetString(configFlag)
+			if err != nil {
+				log.Fatal().Err(err).Msg("failed to parse command flag")
+			}
+			workerConfigPath, _ := cmd.Flags().GetString(workerConfigFlag)
+
+			eventsCfg := &config.Events{}
+			config.ReadEnvironment(configPath, eventsCfg)
+			workerCfg := &config.Worker{}
+			config.ReadEnvironment(workerConfigPath, workerCfg)
+
+			if eventsCfg.Kafka.Broker != workerCfg.Kafka.Broker {
+				log.Fatal().Str("listener_broker", eventsCfg.Kafka.Broker).Str("worker_broker", workerCfg.Kafka.Broker).
+					Msg("the listener and worker must use the same kafka.broker")
+			}
+
+			tracingConfig := tracing.TracingConfig{
+				ServiceName:  "token-swap-pipeline",
+				Environment:  "development", // TODO: Make this configurable
+				OTLPEndpoint: "",            // Will use default for development
+			}
+			shutdown, err := tracing.InitTracer(tracingConfig)
+			if err != nil {
+				log.Fatal().Err(err).Msg("failed to initialize tracing")
+			}
+			defer shutdown()
+
+			producer, err := newProducer(&eventsCfg.Kafka, &eventsCfg.Redis)
+			if err != nil {
+				log.Fatal().Err(err).Msg("failed to create kafka producer")
+			}
+			defer func() {
+				if err := producer.Close(); err != nil {
+					log.Error().Err(err).Msg("failed to flush kafka producer")
+				}
+			}()
+
+			// Before the worker subscribes, so the topics get the configured partitions
+			if err := provisionTopics(producer, eventsCfg); err != nil {
+				log.Fatal().Err(err).Msg("failed to provision kafka topics")
+			}
+
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM, syscall.SIGINT)
+			defer stop()
+			ctx, cancel := context.WithCancel(ctx)
+
+			// Stop both once either of them stops
+			listenerErr := make(chan error, 1)
+			workerErr := make(chan error, 1)
+			go func() {
+				defer cancel()
+				listenerErr <- runEventListener(ctx, eventsCfg, producer)
+			}()
+			go func() {
+				defer cancel()
+				workerErr <- runWorker(ctx, workerCfg)
+			}()
+
+			if err := errors.Join(<-listenerErr, <-workerErr); err != nil {
+				log.Fatal().Err(err).Msg("pipeline failed")
+			}
+		},
+	}
+
+	pipelineCmd.Flags().String(workerConfigFlag, "", "Path to the worker config, --config is the event listener's")
+
+	return pipelineCmd
+}
@@ -7,7 +7,10 @@ import (
 
 const (
 	// flags.
-	configFlag = "config"
+	configFlag       = "config"
+	topicFlag        = "topic"
+	idleTimeoutFlag  = "idle-timeout"
+	workerConfigFlag = "worker-config"
 )
 
 func createRootCmd() *cobra.Command {
@@ -27,6 +30,7 @@ func createRootCmd() *cobra.Command {
 func addSubcmds(rootCmd *cobra.Command) {
 	rootCmd.AddCommand(createEventListenerCmd())
 	rootCmd.AddCommand(createWorkerCmd())
+	rootCmd.AddCommand(createPipelineCmd())
 	rootCmd.AddCommand(createServerCmd())
 	rootCmd.AddCommand(createSyncCmd())
 	rootCmd.AddCommand(createMigrateCmd())
@@ -2,15 +2,17 @@ package cmd
 
 import (
 	"context"
+	"fmt"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/murraystewart96/token-swap/internal/config"
-	"github.com/murraystewart96/token-swap/pkg/kafka"
 	"github.com/murraystewart96/token-swap/internal/storage/postgres"
 	"github.com/murraystewart96/token-swap/internal/storage/redis"
 	"github.com/murraystewart96/token-swap/internal/worker"
+	"github.com/murraystewart96/token-swap/pkg/kafka"
 	"github.com/murraystewart96/token-swap/pkg/tracing"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
@@ -35,7 +37,7 @@ func createWorkerCmd() *cobra.Command { //nolint:gocognit
 			tracingConfig := tracing.TracingConfig{
 				ServiceName:  "token-swap-worker",
 				Environment:  "development", // TODO: Make this configurable
-				OTLPEndpoint: "", // Will use default for development
+				OTLPEndpoint: "",            // Will use default for development
 			}
 			shutdown, err := tracing.InitTracer(tracingConfig)
 			if err != nil {
@@ -43,24 +45,118 @@ func createWorkerCmd() *cobra.Command { //nolint:gocognit
 			}
 			defer shutdown()
 
-			// Worker dependencies
-			consumer, err := kafka.NewConsumer(&cfg.Kafka)
-			poolCache := redis.NewCache(&cfg.Redis)
-			db, err := postgres.NewDB(&cfg.DB)
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM, syscall.SIGINT)
+			// The worker drains its messages on the first signal, a second one kills it
+			context.AfterFunc(ctx, stop)
+
+			if err := runWorker(ctx, cfg); err != nil {
+				log.Fatal().Err(err).Msg("worker failed")
+			}
+		},
+	}
+
+	workerCmd.AddCommand(createDLQCmd())
+
+	return workerCmd
+}
+
+func createDLQCmd() *cobra.Command {
+	dlqCmd := &cobra.Command{
+		Use:   "dlq",
+		Short: "manages dead-letter topics",
+	}
+
+	replayCmd := &cobra.Command{
+		Use:   "replay",
+		Short: "replays dead-lettered messages",
+		Long:  `Re-publishes the messages in a topic's dead-letter topic to the topic they failed on`,
+
+		Run: func(cmd *cobra.Command, _ []string) {
+			configPath, err := cmd.Flags().GetString(configFlag)
 			if err != nil {
-				log.Fatal().Err(err).Msg("failed to connect to DB")
+				log.Fatal().Err(err).Msg("failed to parse command flag")
 			}
+			cfg := &config.Worker{}
+			config.ReadEnvironment(configPath, cfg)
+
+			if cfg.Kafka.Broker == config.BrokerRedis {
+				log.Fatal().Msg("dead-letter replay isn't supported with kafka.broker: redis")
+			}
+
+			topic, _ := cmd.Flags().GetString(topicFlag)
+			idleTimeout, _ := cmd.Flags().GetDuration(idleTimeoutFlag)
+
+			// Separate group so replaying doesn't depend on the worker's offsets
+			consumerCfg := cfg.Kafka
+			consumerCfg.GroupID = cfg.Kafka.GroupID + "-dlq-replay"
+			consumerCfg.OffsetReset = "earliest"
 
-			// Create and start worker
-			worker, err := worker.New(consumer, cfg.Topics, poolCache, db)
+			consumer, err := newConsumer(&consumerCfg, &cfg.Redis)
 			if err != nil {
-				log.Fatal().Err(err).Msg("failed to create worker")
+				log.Fatal().Err(err).Msg("failed to create kafka consumer")
 			}
+			defer consumer.Close()
 
 			ctx, _ := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM, syscall.SIGINT)
-			worker.Start(ctx)
+
+			replayed, err := consumer.(*kafka.Consumer).ReplayDeadLetters(ctx, topic, idleTimeout)
+			if err != nil {
+				log.Fatal().Err(err).Int("replayed", replayed).Msg("failed to replay dead-letter messages")
+			}
+
+			log.Info().Int("replayed", replayed).Str("topic", topic).Msg("dead-letter replay complete")
 		},
 	}
 
-	return workerCmd
+	replayCmd.Flags().String(topicFlag, "", "Topic whose dead-letter messages are replayed (e.g. trade-history)")
+	replayCmd.Flags().Duration(idleTimeoutFlag, 10*time.Second, "Stop once no message has been read for this long")
+	_ = replayCmd.MarkFlagRequired(topicFlag)
+
+	dlqCmd.AddCommand(replayCmd)
+
+	return dlqCmd
+}
+
+// runWorker consumes the configured topics until ctx is done
+func runWorker(ctx context.Context, cfg *config.Worker) error {
+	if cfg.Kafka.OffsetStorage == config.OffsetStoragePostgres && cfg.Kafka.Broker == config.BrokerRedis {
+		return fmt.Errorf("kafka.offset_storage: postgres isn't supported with kafka.broker: redis")
+	}
+
+	poolCache := redis.NewCache(&cfg.Redis)
+	db, err := postgres.NewDB(&cfg.DB)
+	if err != nil {
+		return fmt.Errorf("failed to connect to DB: %w", err)
+	}
+	defer db.Close()
+
+	consumer, err := newConsumer(&cfg.Kafka, &cfg.Redis)
+	if err != nil {
+		return fmt.Errorf("failed to create kafka consumer: %w", err)
+	}
+	// Closed when it stops consuming too, in case the worker fails to start
+	defer consumer.Close()
+
+	if cfg.Kafka.OffsetStorage == config.OffsetStoragePostgres {
+		consumer.(*kafka.Consumer).StoreOffsetsIn(db)
+	}
+
+	worker, err := worker.New(consumer, cfg.Topics, poolCache, db)
+	if err != nil {
+		return fmt.Errorf("failed to create worker: %w", err)
+	}
+
+	if cfg.Kafka.BatchSize > 1 {
+		worker.EnableBatching()
+	}
+
+	if cfg.SchemaRegistry != "" {
+		schemas, err := kafka.OpenSchemaRegistry(cfg.SchemaRegistry)
+		if err != nil {
+			return fmt.Errorf("failed to open schema registry: %w", err)
+		}
+		worker.CheckSchemas(schemas)
+	}
+
+	return worker.Start(ctx)
 }
@@ -1,23 +1,149 @@
 package config
 
-import "github.com/spf13/viper"
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+
+	"github.com/spf13/viper"
+)
 
 type Events struct {
 	Listener Listener      `mapstructure:"listener" validate:"required"`
 	Kafka    KafkaProducer `mapstructure:"kafka"    validate:"required"`
 	DB       DB            `mapstructure:"db"       validate:"required"`
+
+	// Only used with kafka.broker: redis
+	Redis Redis `mapstructure:"redis"`
 }
 
 type Listener struct {
-	RPCUrl       string `mapstructure:"rpc_url"        validate:"required"`
-	ContractAddr string `mapstructure:"contract_addr"  validate:"required"`
+	// http(s)://, ws(s):// or IPC path. A bare host:port is dialled over WebSocket.
+	RPCUrl string `mapstructure:"rpc_url"        validate:"required"`
+
+	// Pools to index. Any combination of a single address, a list of addresses
+	// and a pools file (YAML or JSON with a "pools" list) can be used.
+	ContractAddr  string   `mapstructure:"contract_addr"  validate:"required_without_all=ContractAddrs PoolsFile"`
+	ContractAddrs []string `mapstructure:"contract_addrs"`
+	PoolsFile     string   `mapstructure:"pools_file"`
+
+	// StartBlock is where the backfill begins when no checkpoint has been persisted yet.
+	// Zero means "start from the current head" (no historical backfill).
+	StartBlock        uint64 `mapstructure:"start_block"`
+	BackfillBatchSize uint64 `mapstructure:"backfill_batch_size"`
+
+	// Exponential backoff bounds used when reconnecting after the subscription drops
+	ReconnectMinBackoff time.Duration `mapstructure:"reconnect_min_backoff"`
+	ReconnectMaxBackoff time.Duration `mapstructure:"reconnect_max_backoff"`
+
+	// Polling used instead of a subscription when the transport cannot
+	// subscribe (HTTP). Each poll fetches logs up to the head in ranges of
+	// at most PollBlockRange blocks.
+	PollInterval   time.Duration `mapstructure:"poll_interval"`
+	PollBlockRange uint64        `mapstructure:"poll_block_range"`
+
+	// Confirmation gated publishing. When ConfirmationDepth is set (or WaitForFinalized
+	// is true) events go to the ".unconfirmed" topics straight away and are only
+	// published to the history topics once they are ConfirmationDepth blocks deep
+	// (or finalized). Zero depth without WaitForFinalized publishes immediately.
+	ConfirmationDepth        uint64        `mapstructure:"confirmation_depth"`
+	WaitForFinalized         bool          `mapstructure:"wait_for_finalized"`
+	ConfirmationPollInterval time.Duration `mapstructure:"confirmation_poll_interval"`
+
+	// Event field trade and reserve messages are keyed by. Kafka only orders
+	// messages within a partition, so keying by pool address (the default)
+	// keeps each pool's events in order.
+	MessageKey string `mapstructure:"message_key" validate:"omitempty,oneof=pool_address tx_hash"`
+
+	// Codec events are encoded with (json or protobuf). The worker decodes
+	// either, so topics can be migrated one producer at a time.
+	Codec string `mapstructure:"codec" validate:"omitempty,oneof=json protobuf"`
+
+	// JSON file the event schemas are registered in. When set, the listener
+	// registers the schemas at startup (failing if a change isn't backward
+	// compatible) and records each event's schema ID in a header.
+	SchemaRegistry string `mapstructure:"schema_registry"`
 }
 
+// Supported values of Listener.MessageKey
+const (
+	MessageKeyPoolAddress = "pool_address"
+	MessageKeyTxHash      = "tx_hash"
+)
+
 func (e *Events) Defaults() {
 	// Binds ENV vars to struct
 	// ENV vars, if defined, take precedence over defaults and config.yaml
 	viper.SetDefault("listener.rpc_url", "127.0.0.1:8545")
 	viper.SetDefault("listener.contract_addr", "")
+	viper.SetDefault("listener.start_block", 0)
+	viper.SetDefault("listener.backfill_batch_size", 1000)
+	viper.SetDefault("listener.reconnect_min_backoff", time.Second)
+	viper.SetDefault("listener.reconnect_max_backoff", time.Minute)
+	viper.SetDefault("listener.poll_interval", 4*time.Second)
+	viper.SetDefault("listener.poll_block_range", 100)
+	viper.SetDefault("listener.confirmation_depth", 0)
+	viper.SetDefault("listener.wait_for_finalized", false)
+	viper.SetDefault("listener.confirmation_poll_interval", 12*time.Second)
+	viper.SetDefault("listener.message_key", MessageKeyPoolAddress)
+	viper.SetDefault("listener.codec", "json")
+	viper.SetDefault("listener.schema_registry", "")
+	viper.SetDefault("kafka.broker", BrokerKafka)
 	viper.SetDefault("kafka.bootstrap_servers", "localhost:9092")
 	viper.SetDefault("kafka.acks", "all")
+	viper.SetDefault("kafka.flush_timeout", 10*time.Second)
+	viper.SetDefault("kafka.topic_partitions", 6)
+	viper.SetDefault("kafka.topic_replication_factor", 1)
+	viper.SetDefault("kafka.stream_max_len", 0)
+	viper.SetDefault("redis.addr", "localhost:6379")
+}
+
+// Topics returns the topics the listener publishes to
+func (l *Listener) Topics() []string {
+	topics := []string{TradeHistoryTopic, ReserveHistoryTopic, ChainReorgTopic}
+	if l.ConfirmationDepth > 0 || l.WaitForFinalized {
+		topics = append(topics, TradeHistoryUnconfirmedTopic, ReserveHistoryUnconfirmedTopic)
+	}
+
+	return topics
+}
+
+// PoolAddresses returns the de-duplicated addresses of every configured pool.
+func (l *Listener) PoolAddresses() ([]common.Address, error) {
+	addrs := append([]string{}, l.ContractAddrs...)
+	if l.ContractAddr != "" {
+		addrs = append([]string{l.ContractAddr}, addrs...)
+	}
+
+	if l.PoolsFile != "" {
+		registry := viper.New()
+		registry.SetConfigFile(l.PoolsFile)
+		if err := registry.ReadInConfig(); err != nil {
+			return nil, fmt.Errorf("failed to read pools file: %w", err)
+		}
+		addrs = append(addrs, registry.GetStringSlice("pools")...)
+	}
+
+	seen := make(map[common.Address]bool)
+	var pools []common.Address
+	for _, addr := range addrs {
+		addr = strings.TrimSpace(addr)
+		if !common.IsHexAddress(addr) {
+			return nil, fmt.Errorf("invalid pool address: %q", addr)
+		}
+
+		pool := common.HexToAddress(addr)
+		if !seen[pool] {
+			seen[pool] = true
+			pools = append(pools, pool)
+		}
+	}
+
+	if len(pools) == 0 {
+		return nil, fmt.Errorf("no pool addresses configured")
+	}
+
+	return pools, nil
 }
@@ -1,12 +1,83 @@
 package config
 
+import "time"
+
+// Supported values of KafkaProducer.Broker and KafkaConsumer.Broker
+const (
+	BrokerKafka  = "kafka"
+	BrokerMemory = "memory"
+	BrokerRedis  = "redis"
+)
+
+// Supported values of KafkaConsumer.OffsetStorage
+const (
+	OffsetStorageKafka    = "kafka"
+	OffsetStoragePostgres = "postgres"
+)
+
 type KafkaProducer struct {
+	// "kafka", "memory" for an in-process broker that only reaches consumers
+	// in the same process (see the pipeline command), or "redis" to publish to
+	// Redis Streams (one stream per topic)
+	Broker string `mapstructure:"broker" validate:"omitempty,oneof=kafka memory redis"`
+
 	BootstrapServers string `mapstructure:"bootstrap_servers" validate:"required"`
 	Acks             string `mapstructure:"acks" validate:"required"`
+
+	// How long Close waits for queued messages to be delivered
+	FlushTimeout time.Duration `mapstructure:"flush_timeout"`
+	// How long messages produced asynchronously are batched before sending (0 uses the client default)
+	Linger time.Duration `mapstructure:"linger"`
+
+	// Missing topics are created with these settings when the listener starts
+	// (0 disables provisioning)
+	TopicPartitions        int `mapstructure:"topic_partitions"`
+	TopicReplicationFactor int `mapstructure:"topic_replication_factor"`
+
+	// Streams are trimmed to roughly this many entries when publishing to
+	// Redis (0 keeps every entry)
+	StreamMaxLen int64 `mapstructure:"stream_max_len"`
 }
 
 type KafkaConsumer struct {
+	// "kafka", "memory" or "redis", see KafkaProducer.Broker
+	Broker string `mapstructure:"broker" validate:"omitempty,oneof=kafka memory redis"`
+
 	BootstrapServers string `mapstructure:"bootstrap_servers" validate:"required"`
 	GroupID          string `mapstructure:"group_id" validate:"required"`
 	OffsetReset      string `mapstructure:"offset_reset" validate:"required"`
+
+	// A message is attempted MaxAttempts times, with exponential backoff
+	// between attempts, before it is published to the dead-letter topic
+	MaxAttempts     int           `mapstructure:"max_attempts"`
+	RetryMinBackoff time.Duration `mapstructure:"retry_min_backoff"`
+	RetryMaxBackoff time.Duration `mapstructure:"retry_max_backoff"`
+
+	// A BatchSize above 1 makes the worker write messages in batches of up to
+	// BatchSize, waiting at most BatchLinger for a batch to fill
+	BatchSize   int           `mapstructure:"batch_size"`
+	BatchLinger time.Duration `mapstructure:"batch_linger"`
+
+	// Messages are handled by up to Concurrency goroutines when not batching.
+	// Messages with the same key are always handled in order, by one goroutine.
+	// Not used with the redis broker.
+	Concurrency int `mapstructure:"concurrency"`
+
+	// When the worker stops, or partitions are revoked in a rebalance, the
+	// messages being handled are given DrainTimeout to finish and be committed
+	DrainTimeout time.Duration `mapstructure:"drain_timeout"`
+
+	// Redis Streams only. Entries a consumer read but didn't acknowledge for
+	// ClaimMinIdle (e.g. because it crashed) are claimed by another consumer of
+	// the group. ConsumerName identifies this consumer within the group and
+	// defaults to the hostname, so a restarted worker picks up its own entries.
+	ClaimMinIdle time.Duration `mapstructure:"claim_min_idle"`
+	ConsumerName string        `mapstructure:"consumer_name"`
+
+	// "postgres" stores consumed offsets in Postgres, in the same transaction
+	// as the trades and reserves written for them, and starts assigned
+	// partitions from those offsets, so a message's writes are applied exactly
+	// once. Offsets are still committed to Kafka. Not supported with the redis
+	// broker.
+	OffsetStorage string `mapstructure:"offset_storage" validate:"omitempty,oneof=kafka postgres"`
 }
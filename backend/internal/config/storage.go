@@ -1,6 +1,8 @@
 package config
 
 import (
+	"time"
+
 	"github.com/spf13/viper"
 )
 
@@ -15,6 +17,11 @@ type DB struct {
 	Name     string `mapstructure:"name"     validate:"required"`
 	User     string `mapstructure:"user"     validate:"required"`
 	Password string `mapstructure:"password" validate:"omitempty"`
+
+	// Queries are cancelled after QueryTimeout, or AnalyticsQueryTimeout for the
+	// analytics queries behind the API (0 uses the defaults, 5s and 30s)
+	QueryTimeout          time.Duration `mapstructure:"query_timeout"`
+	AnalyticsQueryTimeout time.Duration `mapstructure:"analytics_query_timeout"`
 }
 
 type Redis struct {
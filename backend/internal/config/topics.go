@@ -3,4 +3,17 @@ package config
 const (
 	TradeHistoryTopic   = "trade-history"
 	ReserveHistoryTopic = "reserve-history"
+	ChainReorgTopic     = "chain-reorgs"
+
+	// Events published before they reach the confirmation depth (confirmation gated mode only)
+	TradeHistoryUnconfirmedTopic   = TradeHistoryTopic + ".unconfirmed"
+	ReserveHistoryUnconfirmedTopic = ReserveHistoryTopic + ".unconfirmed"
 )
+
+// Suffix of the topic that messages are moved to once the worker gives up on them
+const DeadLetterSuffix = ".dlq"
+
+// DeadLetterTopic returns the dead-letter topic for topic
+func DeadLetterTopic(topic string) string {
+	return topic + DeadLetterSuffix
+}
@@ -1,16 +1,35 @@
 package config
 
-import "github.com/spf13/viper"
+import (
+	"time"
+
+	"github.com/spf13/viper"
+)
 
 type Worker struct {
 	Kafka  KafkaConsumer `mapstructure:"kafka"    validate:"required"`
 	Redis  `mapstructure:"redis"    validate:"required"`
 	DB     `mapstructure:"db"       validate:"required"`
 	Topics []string `mapstructure:"topics" validate:"required"`
+
+	// JSON file the listener registers event schemas in. When set, the schema
+	// ID each message is sent with must be registered for its event type and
+	// schema version, otherwise the message is dead-lettered.
+	SchemaRegistry string `mapstructure:"schema_registry"`
 }
 
 func (w *Worker) Defaults() {
+	viper.SetDefault("kafka.broker", BrokerKafka)
 	viper.SetDefault("kafka.bootstrap_servers", "localhost:9092")
 	viper.SetDefault("kafka.offset_reset", "earliest")
+	viper.SetDefault("kafka.max_attempts", 5)
+	viper.SetDefault("kafka.retry_min_backoff", 500*time.Millisecond)
+	viper.SetDefault("kafka.retry_max_backoff", 30*time.Second)
+	viper.SetDefault("kafka.concurrency", 4)
+	viper.SetDefault("kafka.drain_timeout", 30*time.Second)
+	viper.SetDefault("kafka.claim_min_idle", time.Minute)
+	viper.SetDefault("kafka.consumer_name", "")
+	viper.SetDefault("kafka.offset_storage", OffsetStorageKafka)
 	viper.SetDefault("redis.addr", "localhost:6379")
+	viper.SetDefault("schema_registry", "")
 }
@@ -0,0 +1,246 @@
+package events
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/rs/zerolog/log"
+)
+
+// Number of blocks below the backfill head whose hashes are remembered so that
+// live logs already covered by the backfill can be recognised and skipped.
+const backfillOverlapWindow = 64
+
+// backfill publishes every log between the persisted checkpoints (or the
+// configured start block) and the current head, persisting the checkpoints
+// after each batch so an interrupted backfill resumes where it stopped.
+// Pools are checkpointed individually, so a newly added pool is backfilled
+// without republishing the events of pools that are already up to date.
+func (ec *EventClient) backfill(ctx context.Context) error {
+	head, err := ec.ethClient.BlockNumber(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get current block number: %w", err)
+	}
+
+	from, err := ec.resumeBlock(ctx, head)
+	if err != nil {
+		return err
+	}
+
+	if from <= head {
+		log.Info().Uint64("from_block", from).Uint64("to_block", head).Msg("backfilling events")
+	}
+
+	clear(ec.backfilledBlocks)
+
+	// Everything still buffered is above the checkpoint and is picked up again by the backfill
+	if ec.confirmations != nil {
+		ec.confirmations.pending = nil
+	}
+
+	if err := ec.processBlockRange(ctx, from, head, ec.batchSize); err != nil {
+		return err
+	}
+
+	ec.backfilledHead = head
+	ec.lastBlock = max(ec.lastBlock, head)
+
+	return nil
+}
+
+// processBlockRange publishes the logs between from and to, fetching at most
+// rangeSize blocks per query and persisting the checkpoints after each range.
+// If a reorg replaced blocks that were already processed, the checkpoints are
+// moved back and the range is processed again from the fork, as the logs of
+// the replacing blocks aren't delivered again.
+func (ec *EventClient) processBlockRange(ctx context.Context, from, to, rangeSize uint64) error {
+	// Reorgs found by live logs are followed by the subscription
+	ec.reorgFork = nil
+
+ranges:
+	for from <= to {
+		end := min(from+rangeSize-1, to)
+
+		query := ec.filterQuery()
+		query.FromBlock = new(big.Int).SetUint64(from)
+		query.ToBlock = new(big.Int).SetUint64(end)
+
+		logs, err := ec.ethClient.FilterLogs(ctx, query)
+		if err != nil {
+			return fmt.Errorf("failed to filter logs for blocks %d-%d: %w", from, end, err)
+		}
+
+		for i := range logs {
+			// Already processed for this pool
+			if logs[i].BlockNumber <= ec.checkpoints[logs[i].Address] {
+				continue
+			}
+
+			if err := ec.processLog(ctx, &logs[i]); err != nil {
+				return err
+			}
+
+			if logs[i].BlockNumber+backfillOverlapWindow > to {
+				ec.backfilledBlocks[logs[i].BlockNumber] = logs[i].BlockHash
+			}
+
+			if ec.reorgFork != nil {
+				fork := *ec.reorgFork
+				ec.reorgFork = nil
+
+				if err := ec.rewindCheckpoint(ctx, fork); err != nil {
+					return err
+				}
+
+				// Logs already published from the fork on are published again
+				// with the same IDs
+				from = min(fork, logs[i].BlockNumber)
+				continue ranges
+			}
+		}
+
+		if err := ec.saveCheckpoint(ctx, end); err != nil {
+			return err
+		}
+
+		if ec.confirmations != nil {
+			if err := ec.releaseConfirmed(ctx); err != nil {
+				return err
+			}
+		}
+
+		log.Debug().Uint64("from_block", from).Uint64("to_block", end).Int("logs", len(logs)).Msg("processed block range")
+
+		from = end + 1
+	}
+
+	return nil
+}
+
+// resumeBlock loads the checkpoint of every pool and returns the first block
+// the backfill should process.
+func (ec *EventClient) resumeBlock(ctx context.Context, head uint64) (uint64, error) {
+	from := head + 1
+
+	for _, pool := range ec.pools {
+		checkpoint, found, err := ec.db.GetCheckpoint(ctx, pool.Hex())
+		if err != nil {
+			return 0, fmt.Errorf("failed to get checkpoint for pool %s: %w", pool.Hex(), err)
+		}
+
+		switch {
+		case found:
+			ec.checkpoints[pool] = checkpoint
+		case ec.startBlock > 0:
+			ec.checkpoints[pool] = ec.startBlock - 1
+		default:
+			// Nothing to backfill, start listening from the current head
+			if err := ec.savePoolCheckpoint(ctx, pool, head); err != nil {
+				return 0, err
+			}
+		}
+
+		from = min(from, ec.checkpoints[pool]+1)
+	}
+
+	return from, nil
+}
+
+// isBackfilled reports whether a live log belongs to a block the backfill already processed.
+func (ec *EventClient) isBackfilled(eventLog *types.Log) bool {
+	if eventLog.BlockNumber > ec.backfilledHead {
+		return false
+	}
+
+	hash, seen := ec.backfilledBlocks[eventLog.BlockNumber]
+
+	// A different hash means the block was reorganised after the backfill
+	return seen && hash == eventLog.BlockHash
+}
+
+// advanceCheckpoint persists the previous block as fully processed once a log
+// from a later block arrives (logs are delivered in block order).
+func (ec *EventClient) advanceCheckpoint(ctx context.Context, blockNumber uint64) error {
+	if blockNumber <= ec.lastBlock {
+		return nil
+	}
+
+	if ec.lastBlock > 0 {
+		if err := ec.saveCheckpoint(ctx, ec.lastBlock); err != nil {
+			return err
+		}
+	}
+	ec.lastBlock = blockNumber
+
+	return nil
+}
+
+// saveCheckpoint persists blockNumber as fully processed for every pool. When
+// publishing is confirmation gated a block only counts as processed once its
+// buffered logs have been released.
+func (ec *EventClient) saveCheckpoint(ctx context.Context, blockNumber uint64) error {
+	if ec.confirmations != nil {
+		ec.confirmations.completedBlock = max(ec.confirmations.completedBlock, blockNumber)
+		blockNumber = min(blockNumber, ec.confirmations.releasedHead)
+	}
+
+	for _, pool := range ec.pools {
+		if err := ec.savePoolCheckpoint(ctx, pool, blockNumber); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rewindCheckpoint moves the checkpoint of every pool back to the block before
+// fork, so the blocks a reorg replaced are processed again.
+func (ec *EventClient) rewindCheckpoint(ctx context.Context, fork uint64) error {
+	checkpoint := fork - 1
+
+	log.Info().Uint64("fork_block", fork).Msg("rewinding checkpoints to reprocess reorganised blocks")
+
+	for _, pool := range ec.pools {
+		if ec.checkpoints[pool] <= checkpoint {
+			continue
+		}
+
+		if err := ec.db.SetCheckpoint(ctx, pool.Hex(), checkpoint); err != nil {
+			return fmt.Errorf("failed to rewind checkpoint for pool %s: %w", pool.Hex(), err)
+		}
+		ec.checkpoints[pool] = checkpoint
+	}
+
+	ec.lastBlock = min(ec.lastBlock, checkpoint)
+
+	for number := range ec.backfilledBlocks {
+		if number >= fork {
+			delete(ec.backfilledBlocks, number)
+		}
+	}
+
+	// Logs of the replacing blocks are buffered again before the checkpoint
+	// can move past them
+	if ec.confirmations != nil {
+		ec.confirmations.releasedHead = min(ec.confirmations.releasedHead, checkpoint)
+		ec.confirmations.completedBlock = min(ec.confirmations.completedBlock, checkpoint)
+	}
+
+	return nil
+}
+
+func (ec *EventClient) savePoolCheckpoint(ctx context.Context, pool common.Address, blockNumber uint64) error {
+	if blockNumber <= ec.checkpoints[pool] {
+		return nil
+	}
+
+	if err := ec.db.SetCheckpoint(ctx, pool.Hex(), blockNumber); err != nil {
+		return fmt.Errorf("failed to save checkpoint for pool %s: %w", pool.Hex(), err)
+	}
+	ec.checkpoints[pool] = blockNumber
+
+	return nil
+}
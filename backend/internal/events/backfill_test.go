@@ -0,0 +1,242 @@
+package events
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/murraystewart96/token-swap/internal/config"
+	"github.com/murraystewart96/token-swap/internal/contracts"
+	"github.com/murraystewart96/token-swap/internal/models"
+	storageMock "github.com/murraystewart96/token-swap/internal/storage/mock"
+	"github.com/murraystewart96/token-swap/pkg/eth"
+	ethMock "github.com/murraystewart96/token-swap/pkg/eth/mock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+var testPoolAddr = common.HexToAddress("0x9fE46736679d2D9a65F0992F2272dE9f3c7fa6e0")
+
+func newBackfillClient(ethClient *ethMock.EthClient, db *storageMock.DB, producer *MockProducer, pool *MockPoolContract) *EventClient {
+	return &EventClient{
+		ethClient:        ethClient,
+		pools:            []common.Address{testPoolAddr},
+		poolContract:     pool,
+		timestamps:       eth.NewTimestampResolver(ethClient, 16),
+		producer:         producer,
+		db:               db,
+		batchSize:        10,
+		checkpoints:      make(map[common.Address]uint64),
+		backfilledBlocks: make(map[uint64]common.Hash),
+	}
+}
+
+// Matches a filter query covering the given block range
+func blockRange(from, to int64) any {
+	return mock.MatchedBy(func(q ethereum.FilterQuery) bool {
+		return q.FromBlock.Cmp(big.NewInt(from)) == 0 && q.ToBlock.Cmp(big.NewInt(to)) == 0
+	})
+}
+
+func createSyncLog(blockNumber uint64, txHash common.Hash) types.Log {
+	return types.Log{
+		Address:        testPoolAddr,
+		Topics:         []common.Hash{SyncEventSignature},
+		BlockNumber:    blockNumber,
+		BlockHash:      common.BigToHash(big.NewInt(int64(blockNumber))),
+		TxHash:         txHash,
+		BlockTimestamp: 1700000000 + blockNumber,
+	}
+}
+
+func TestBackfill_ResumesFromCheckpointInBatches(t *testing.T) {
+	mockClient := &ethMock.EthClient{}
+	mockDB := &storageMock.DB{}
+	mockProducer := &MockProducer{}
+	mockContract := &MockPoolContract{}
+
+	ec := newBackfillClient(mockClient, mockDB, mockProducer, mockContract)
+
+	syncLog := createSyncLog(105, common.HexToHash("0xabc"))
+
+	mockClient.On("BlockNumber", mock.Anything).Return(uint64(115), nil)
+	mockDB.On("GetCheckpoint", mock.Anything, testPoolAddr.Hex()).Return(uint64(100), true, nil)
+
+	// Two batches of (at most) 10 blocks: 101-110 and 111-115
+	mockClient.On("FilterLogs", mock.Anything, blockRange(101, 110)).Return([]types.Log{syncLog}, nil)
+	mockClient.On("FilterLogs", mock.Anything, blockRange(111, 115)).Return([]types.Log{}, nil)
+	mockDB.On("SetCheckpoint", mock.Anything, testPoolAddr.Hex(), uint64(110)).Return(nil).Once()
+	mockDB.On("SetCheckpoint", mock.Anything, testPoolAddr.Hex(), uint64(115)).Return(nil).Once()
+
+	mockDB.On("GetCanonicalBlock", mock.Anything, uint64(105)).Return(&models.Block{Hash: syncLog.BlockHash.Hex()}, nil)
+	mockContract.On("ParseSync", syncLog).Return(&contracts.PoolSync{
+		MeTokenAmount:  big.NewInt(100),
+		YouTokenAmount: big.NewInt(200),
+		Raw:            syncLog,
+	}, nil)
+	mockProducer.On("Produce", config.ReserveHistoryTopic, []byte(syncLog.Address.Hex()), mock.Anything).Return(nil)
+
+	err := ec.backfill(t.Context())
+
+	require.NoError(t, err)
+	assert.Len(t, mockProducer.GetMessages(), 1)
+	assert.Equal(t, uint64(115), ec.checkpoints[testPoolAddr])
+	assert.Equal(t, uint64(115), ec.backfilledHead)
+
+	mockClient.AssertExpectations(t)
+	mockDB.AssertExpectations(t)
+	mockProducer.AssertExpectations(t)
+}
+
+func TestBackfill_UsesStartBlockWithoutCheckpoint(t *testing.T) {
+	mockClient := &ethMock.EthClient{}
+	mockDB := &storageMock.DB{}
+
+	ec := newBackfillClient(mockClient, mockDB, &MockProducer{}, &MockPoolContract{})
+	ec.startBlock = 50
+
+	mockClient.On("BlockNumber", mock.Anything).Return(uint64(55), nil)
+	mockDB.On("GetCheckpoint", mock.Anything, testPoolAddr.Hex()).Return(uint64(0), false, nil)
+	mockClient.On("FilterLogs", mock.Anything, blockRange(50, 55)).Return([]types.Log{}, nil)
+	mockDB.On("SetCheckpoint", mock.Anything, testPoolAddr.Hex(), uint64(55)).Return(nil)
+
+	err := ec.backfill(t.Context())
+
+	require.NoError(t, err)
+	mockClient.AssertExpectations(t)
+	mockDB.AssertExpectations(t)
+}
+
+func TestBackfill_StartsAtHeadWithoutCheckpointOrStartBlock(t *testing.T) {
+	mockClient := &ethMock.EthClient{}
+	mockDB := &storageMock.DB{}
+
+	ec := newBackfillClient(mockClient, mockDB, &MockProducer{}, &MockPoolContract{})
+
+	mockClient.On("BlockNumber", mock.Anything).Return(uint64(200), nil)
+	mockDB.On("GetCheckpoint", mock.Anything, testPoolAddr.Hex()).Return(uint64(0), false, nil)
+	mockDB.On("SetCheckpoint", mock.Anything, testPoolAddr.Hex(), uint64(200)).Return(nil)
+
+	err := ec.backfill(t.Context())
+
+	require.NoError(t, err)
+	assert.Equal(t, uint64(200), ec.lastBlock)
+	mockClient.AssertNotCalled(t, "FilterLogs", mock.Anything, mock.Anything)
+	mockDB.AssertExpectations(t)
+}
+
+func TestBackfill_PublishFailureDoesNotAdvanceCheckpoint(t *testing.T) {
+	mockClient := &ethMock.EthClient{}
+	mockDB := &storageMock.DB{}
+	mockProducer := &MockProducer{}
+	mockContract := &MockPoolContract{}
+
+	ec := newBackfillClient(mockClient, mockDB, mockProducer, mockContract)
+
+	syncLog := createSyncLog(103, common.HexToHash("0xdef"))
+
+	mockClient.On("BlockNumber", mock.Anything).Return(uint64(105), nil)
+	mockDB.On("GetCheckpoint", mock.Anything, testPoolAddr.Hex()).Return(uint64(100), true, nil)
+	mockClient.On("FilterLogs", mock.Anything, blockRange(101, 105)).Return([]types.Log{syncLog}, nil)
+	mockDB.On("GetCanonicalBlock", mock.Anything, uint64(103)).Return(&models.Block{Hash: syncLog.BlockHash.Hex()}, nil)
+	mockContract.On("ParseSync", syncLog).Return(&contracts.PoolSync{
+		MeTokenAmount:  big.NewInt(100),
+		YouTokenAmount: big.NewInt(200),
+		Raw:            syncLog,
+	}, nil)
+	mockProducer.On("Produce", config.ReserveHistoryTopic, mock.Anything, mock.Anything).Return(assert.AnError)
+
+	err := ec.backfill(t.Context())
+
+	assert.Error(t, err)
+	mockDB.AssertNotCalled(t, "SetCheckpoint", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestBackfill_NewPoolDoesNotRepublishOtherPools(t *testing.T) {
+	mockClient := &ethMock.EthClient{}
+	mockDB := &storageMock.DB{}
+	mockProducer := &MockProducer{}
+	mockContract := &MockPoolContract{}
+
+	newPoolAddr := common.HexToAddress("0x5FC8d32690cc91D4c39d9d3abcBD16989F875707")
+
+	ec := newBackfillClient(mockClient, mockDB, mockProducer, mockContract)
+	ec.pools = append(ec.pools, newPoolAddr)
+	ec.startBlock = 101
+
+	// Existing pool is up to date to block 110, the new pool has no checkpoint yet
+	mockClient.On("BlockNumber", mock.Anything).Return(uint64(115), nil)
+	mockDB.On("GetCheckpoint", mock.Anything, testPoolAddr.Hex()).Return(uint64(110), true, nil)
+	mockDB.On("GetCheckpoint", mock.Anything, newPoolAddr.Hex()).Return(uint64(0), false, nil)
+
+	oldPoolLog := createSyncLog(105, common.HexToHash("0xabc"))
+	newPoolLog := createSyncLog(106, common.HexToHash("0xdef"))
+	newPoolLog.Address = newPoolAddr
+
+	mockClient.On("FilterLogs", mock.Anything, blockRange(101, 110)).Return([]types.Log{oldPoolLog, newPoolLog}, nil)
+	mockClient.On("FilterLogs", mock.Anything, blockRange(111, 115)).Return([]types.Log{}, nil)
+	mockDB.On("SetCheckpoint", mock.Anything, newPoolAddr.Hex(), uint64(110)).Return(nil).Once()
+	mockDB.On("SetCheckpoint", mock.Anything, newPoolAddr.Hex(), uint64(115)).Return(nil).Once()
+	mockDB.On("SetCheckpoint", mock.Anything, testPoolAddr.Hex(), uint64(115)).Return(nil).Once()
+
+	mockDB.On("GetCanonicalBlock", mock.Anything, uint64(106)).Return(&models.Block{Hash: newPoolLog.BlockHash.Hex()}, nil)
+	mockContract.On("ParseSync", newPoolLog).Return(&contracts.PoolSync{
+		MeTokenAmount:  big.NewInt(100),
+		YouTokenAmount: big.NewInt(200),
+		Raw:            newPoolLog,
+	}, nil)
+	mockProducer.On("Produce", config.ReserveHistoryTopic, []byte(newPoolLog.Address.Hex()), mock.Anything).Return(nil)
+
+	err := ec.backfill(t.Context())
+
+	require.NoError(t, err)
+
+	// Only the new pool's event is published
+	assert.Len(t, mockProducer.GetMessages(), 1)
+	mockContract.AssertNotCalled(t, "ParseSync", oldPoolLog)
+	mockClient.AssertExpectations(t)
+	mockDB.AssertExpectations(t)
+	mockProducer.AssertExpectations(t)
+}
+
+func TestIsBackfilled(t *testing.T) {
+	backfilledHash := common.HexToHash("0x01")
+
+	ec := &EventClient{
+		backfilledHead: 100,
+		backfilledBlocks: map[uint64]common.Hash{
+			99: backfilledHash,
+		},
+	}
+
+	assert.True(t, ec.isBackfilled(&types.Log{BlockNumber: 99, BlockHash: backfilledHash}))
+	assert.False(t, ec.isBackfilled(&types.Log{BlockNumber: 99, BlockHash: common.HexToHash("0x02")}), "reorganised block should be processed")
+	assert.False(t, ec.isBackfilled(&types.Log{BlockNumber: 101, BlockHash: backfilledHash}), "blocks after the backfill head should be processed")
+}
+
+func TestAdvanceCheckpoint_PersistsPreviousBlock(t *testing.T) {
+	mockDB := &storageMock.DB{}
+
+	ec := &EventClient{
+		pools:       []common.Address{testPoolAddr},
+		db:          mockDB,
+		checkpoints: map[common.Address]uint64{testPoolAddr: 100},
+		lastBlock:   100,
+	}
+
+	mockDB.On("SetCheckpoint", mock.Anything, testPoolAddr.Hex(), uint64(101)).Return(nil).Once()
+
+	// First log of block 101 - block 100 is already persisted
+	require.NoError(t, ec.advanceCheckpoint(t.Context(), 101))
+	// Another log from block 101 - nothing to persist
+	require.NoError(t, ec.advanceCheckpoint(t.Context(), 101))
+	// First log of block 103 - block 101 is now complete
+	require.NoError(t, ec.advanceCheckpoint(t.Context(), 103))
+
+	assert.Equal(t, uint64(101), ec.checkpoints[testPoolAddr])
+	assert.Equal(t, uint64(103), ec.lastBlock)
+	mockDB.AssertExpectations(t)
+}
@@ -0,0 +1,74 @@
+package events
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/murraystewart96/token-swap/internal/models"
+	"github.com/murraystewart96/token-swap/pkg/kafka"
+)
+
+// Events published by the listener, with their current schema versions
+var publishedEvents = []struct {
+	eventType     string
+	schemaVersion int
+	event         any
+}{
+	{models.EventTypeTrade, models.TradeEventVersion, models.TradeEvent{}},
+	{models.EventTypeReserve, models.ReserveEventVersion, models.ReserveEvent{}},
+	{models.EventTypeReorg, models.ReorgEventVersion, models.ReorgEvent{}},
+}
+
+// registerSchemas registers the schema of every published event in the
+// registry at path and returns their IDs by event type. Fails if a schema has
+// changed in a way that isn't backward compatible.
+func registerSchemas(path string) (map[string]int, error) {
+	registry, err := kafka.OpenSchemaRegistry(path)
+	if err != nil {
+		return nil, err
+	}
+
+	schemaIDs := make(map[string]int, len(publishedEvents))
+	for _, published := range publishedEvents {
+		schema, err := kafka.SchemaOf(published.event)
+		if err != nil {
+			return nil, fmt.Errorf("failed to derive %s schema: %w", published.eventType, err)
+		}
+
+		id, err := registry.Register(models.SchemaSubject(published.eventType, published.schemaVersion), schema)
+		if err != nil {
+			return nil, fmt.Errorf("failed to register %s schema: %w", published.eventType, err)
+		}
+		schemaIDs[published.eventType] = id
+	}
+
+	return schemaIDs, nil
+}
+
+// encode encodes event into the envelope and the envelope into a message value
+// with the configured codec. The returned headers name the codec and the
+// event's registered schema.
+func (ec *EventClient) encode(envelope *models.Envelope, event any) ([]byte, []kafka.Header, error) {
+	codec := ec.codec
+	if codec == nil {
+		codec = kafka.JSONCodec{}
+	}
+
+	data, err := codec.Marshal(event)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to marshal %s event: %w", envelope.Type, err)
+	}
+	envelope.Data = data
+
+	value, err := codec.Marshal(envelope)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to marshal %s envelope: %w", envelope.Type, err)
+	}
+
+	headers := []kafka.Header{{Key: kafka.HeaderContentType, Value: []byte(codec.ContentType())}}
+	if id, ok := ec.schemaIDs[envelope.Type]; ok {
+		headers = append(headers, kafka.Header{Key: kafka.HeaderSchemaID, Value: []byte(strconv.Itoa(id))})
+	}
+
+	return value, headers, nil
+}
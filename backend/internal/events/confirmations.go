@@ -0,0 +1,134 @@
+package events
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"math/big"
+	"slices"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/rs/zerolog/log"
+)
+
+const defaultConfirmationPollInterval = 12 * time.Second
+
+// confirmationBuffer holds logs back from the history topics until they are
+// confirmed, either by being depth blocks deep or by the node's finalized tag.
+type confirmationBuffer struct {
+	depth        uint64
+	finalized    bool
+	pollInterval time.Duration
+
+	pending        []types.Log // ordered by block number and log index
+	releasedHead   uint64      // every pending log at or below this block has been released
+	completedBlock uint64      // last block whose logs have all been received
+}
+
+func newConfirmationBuffer(depth uint64, finalized bool, pollInterval time.Duration) *confirmationBuffer {
+	if pollInterval <= 0 {
+		pollInterval = defaultConfirmationPollInterval
+	}
+
+	return &confirmationBuffer{
+		depth:        depth,
+		finalized:    finalized,
+		pollInterval: pollInterval,
+	}
+}
+
+// add buffers a log, ignoring logs that are already pending.
+func (cb *confirmationBuffer) add(eventLog types.Log) {
+	i, found := slices.BinarySearchFunc(cb.pending, eventLog, compareLogs)
+	if found && cb.pending[i].BlockHash == eventLog.BlockHash {
+		return
+	}
+
+	cb.pending = slices.Insert(cb.pending, i, eventLog)
+}
+
+func compareLogs(a, b types.Log) int {
+	if c := cmp.Compare(a.BlockNumber, b.BlockNumber); c != 0 {
+		return c
+	}
+	return cmp.Compare(a.Index, b.Index)
+}
+
+// releaseConfirmed publishes buffered logs that have been confirmed to the
+// history topics. Logs whose block was reorganised out while they were
+// buffered are dropped. The checkpoint is advanced as far as the released head.
+func (ec *EventClient) releaseConfirmed(ctx context.Context) error {
+	cb := ec.confirmations
+
+	head, err := ec.confirmedHead(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Canonical hash of each block with pending logs
+	canonical := make(map[uint64]common.Hash)
+
+	released := 0
+	defer func() {
+		cb.pending = cb.pending[released:]
+	}()
+
+	for _, eventLog := range cb.pending {
+		if eventLog.BlockNumber > head {
+			break
+		}
+
+		hash, ok := canonical[eventLog.BlockNumber]
+		if !ok {
+			header, err := ec.ethClient.HeaderByNumber(ctx, new(big.Int).SetUint64(eventLog.BlockNumber))
+			if err != nil {
+				return fmt.Errorf("failed to get canonical header for block %d: %w", eventLog.BlockNumber, err)
+			}
+			hash = header.Hash()
+			canonical[eventLog.BlockNumber] = hash
+		}
+
+		if hash != eventLog.BlockHash {
+			log.Info().Str("block_hash", eventLog.BlockHash.Hex()).Uint64("block_number", eventLog.BlockNumber).
+				Msg("dropping buffered event from reorganised block")
+		} else if err := ec.publishLog(ctx, &eventLog, true); err != nil {
+			return err
+		}
+
+		released++
+	}
+
+	if released > 0 {
+		log.Info().Int("events", released).Uint64("confirmed_head", head).Msg("released confirmed events")
+	}
+
+	cb.releasedHead = max(cb.releasedHead, head)
+
+	return ec.saveCheckpoint(ctx, cb.completedBlock)
+}
+
+// confirmedHead returns the highest block considered confirmed.
+func (ec *EventClient) confirmedHead(ctx context.Context) (uint64, error) {
+	cb := ec.confirmations
+
+	if cb.finalized {
+		header, err := ec.ethClient.HeaderByNumber(ctx, big.NewInt(int64(rpc.FinalizedBlockNumber)))
+		if err != nil {
+			return 0, fmt.Errorf("failed to get finalized block: %w", err)
+		}
+		return header.Number.Uint64(), nil
+	}
+
+	head, err := ec.ethClient.BlockNumber(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get current block number: %w", err)
+	}
+	if head < cb.depth {
+		return 0, nil
+	}
+
+	return head - cb.depth, nil
+}
@@ -0,0 +1,202 @@
+package events
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/murraystewart96/token-swap/internal/config"
+	"github.com/murraystewart96/token-swap/internal/contracts"
+	"github.com/murraystewart96/token-swap/internal/models"
+	storageMock "github.com/murraystewart96/token-swap/internal/storage/mock"
+	ethMock "github.com/murraystewart96/token-swap/pkg/eth/mock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func newGatedClient(ethClient *ethMock.EthClient, db *storageMock.DB, producer *MockProducer, pool *MockPoolContract, depth uint64) *EventClient {
+	ec := newBackfillClient(ethClient, db, producer, pool)
+	ec.confirmations = newConfirmationBuffer(depth, false, 0)
+	return ec
+}
+
+// Creates a sync log from the given header's block
+func createHeaderSyncLog(header *types.Header, index uint) types.Log {
+	syncLog := createSyncLog(header.Number.Uint64(), common.BigToHash(big.NewInt(int64(index))))
+	syncLog.BlockHash = header.Hash()
+	syncLog.Index = index
+	return syncLog
+}
+
+func expectParseSync(mockContract *MockPoolContract, syncLog types.Log) {
+	mockContract.On("ParseSync", syncLog).Return(&contracts.PoolSync{
+		MeTokenAmount:  big.NewInt(100),
+		YouTokenAmount: big.NewInt(200),
+		Raw:            syncLog,
+	}, nil)
+}
+
+func TestProcessLog_ConfirmationGatedPublishesUnconfirmedAndBuffers(t *testing.T) {
+	mockClient := &ethMock.EthClient{}
+	mockDB := &storageMock.DB{}
+	mockProducer := &MockProducer{}
+	mockContract := &MockPoolContract{}
+
+	ec := newGatedClient(mockClient, mockDB, mockProducer, mockContract, 12)
+
+	syncLog := createSyncLog(100, common.HexToHash("0xabc"))
+
+	mockDB.On("GetCanonicalBlock", mock.Anything, uint64(100)).Return(&models.Block{Hash: syncLog.BlockHash.Hex()}, nil)
+	expectParseSync(mockContract, syncLog)
+	mockProducer.On("Produce", config.ReserveHistoryUnconfirmedTopic, mock.Anything, mock.Anything).Return(nil)
+
+	err := ec.processLog(t.Context(), &syncLog)
+
+	require.NoError(t, err)
+	assert.Len(t, ec.confirmations.pending, 1)
+	mockProducer.AssertNotCalled(t, "Produce", config.ReserveHistoryTopic, mock.Anything, mock.Anything)
+	mockProducer.AssertExpectations(t)
+}
+
+func TestReleaseConfirmed_PublishesConfirmedAndDropsReorganised(t *testing.T) {
+	mockClient := &ethMock.EthClient{}
+	mockDB := &storageMock.DB{}
+	mockProducer := &MockProducer{}
+	mockContract := &MockPoolContract{}
+
+	ec := newGatedClient(mockClient, mockDB, mockProducer, mockContract, 12)
+	ec.checkpoints[testPoolAddr] = 99
+	ec.confirmations.completedBlock = 105
+
+	header100 := createTestHeader(100, common.Hash{}, 0)
+	header101 := createTestHeader(101, header100.Hash(), 0)
+	reorgedHeader101 := createTestHeader(101, header100.Hash(), 1)
+	header110 := createTestHeader(110, common.Hash{}, 0)
+
+	confirmedLog := createHeaderSyncLog(header100, 0)
+	reorgedLog := createHeaderSyncLog(reorgedHeader101, 0)
+	unconfirmedLog := createHeaderSyncLog(header110, 0)
+
+	ec.confirmations.add(unconfirmedLog)
+	ec.confirmations.add(reorgedLog)
+	ec.confirmations.add(confirmedLog)
+
+	// Head is 113 so blocks up to 101 are 12 deep
+	mockClient.On("BlockNumber", mock.Anything).Return(uint64(113), nil)
+	mockClient.On("HeaderByNumber", mock.Anything, big.NewInt(100)).Return(header100, nil)
+	mockClient.On("HeaderByNumber", mock.Anything, big.NewInt(101)).Return(header101, nil)
+
+	expectParseSync(mockContract, confirmedLog)
+	mockProducer.On("Produce", config.ReserveHistoryTopic, []byte(confirmedLog.Address.Hex()), mock.Anything).Return(nil).Once()
+
+	// Checkpoint only advances as far as the released head
+	mockDB.On("SetCheckpoint", mock.Anything, testPoolAddr.Hex(), uint64(101)).Return(nil).Once()
+
+	err := ec.releaseConfirmed(t.Context())
+
+	require.NoError(t, err)
+	assert.Equal(t, []types.Log{unconfirmedLog}, ec.confirmations.pending)
+	assert.Equal(t, uint64(101), ec.confirmations.releasedHead)
+	mockContract.AssertNotCalled(t, "ParseSync", reorgedLog)
+	mockClient.AssertExpectations(t)
+	mockDB.AssertExpectations(t)
+	mockProducer.AssertExpectations(t)
+}
+
+func TestReleaseConfirmed_PublishFailureKeepsLogBuffered(t *testing.T) {
+	mockClient := &ethMock.EthClient{}
+	mockProducer := &MockProducer{}
+	mockContract := &MockPoolContract{}
+
+	ec := newGatedClient(mockClient, &storageMock.DB{}, mockProducer, mockContract, 12)
+
+	header100 := createTestHeader(100, common.Hash{}, 0)
+	syncLog := createHeaderSyncLog(header100, 0)
+	ec.confirmations.add(syncLog)
+
+	mockClient.On("BlockNumber", mock.Anything).Return(uint64(120), nil)
+	mockClient.On("HeaderByNumber", mock.Anything, big.NewInt(100)).Return(header100, nil)
+	expectParseSync(mockContract, syncLog)
+	mockProducer.On("Produce", config.ReserveHistoryTopic, mock.Anything, mock.Anything).Return(assert.AnError)
+
+	err := ec.releaseConfirmed(t.Context())
+
+	assert.Error(t, err)
+	assert.Len(t, ec.confirmations.pending, 1)
+	assert.Zero(t, ec.confirmations.releasedHead)
+}
+
+func TestConfirmedHead(t *testing.T) {
+	t.Run("depth below head", func(t *testing.T) {
+		mockClient := &ethMock.EthClient{}
+		ec := &EventClient{ethClient: mockClient, confirmations: newConfirmationBuffer(12, false, 0)}
+
+		mockClient.On("BlockNumber", mock.Anything).Return(uint64(100), nil)
+
+		head, err := ec.confirmedHead(t.Context())
+
+		require.NoError(t, err)
+		assert.Equal(t, uint64(88), head)
+	})
+
+	t.Run("chain shorter than depth", func(t *testing.T) {
+		mockClient := &ethMock.EthClient{}
+		ec := &EventClient{ethClient: mockClient, confirmations: newConfirmationBuffer(12, false, 0)}
+
+		mockClient.On("BlockNumber", mock.Anything).Return(uint64(5), nil)
+
+		head, err := ec.confirmedHead(t.Context())
+
+		require.NoError(t, err)
+		assert.Zero(t, head)
+	})
+
+	t.Run("finalized tag", func(t *testing.T) {
+		mockClient := &ethMock.EthClient{}
+		ec := &EventClient{ethClient: mockClient, confirmations: newConfirmationBuffer(0, true, 0)}
+
+		finalized := createTestHeader(64, common.Hash{}, 0)
+		mockClient.On("HeaderByNumber", mock.Anything, big.NewInt(int64(rpc.FinalizedBlockNumber))).Return(finalized, nil)
+
+		head, err := ec.confirmedHead(t.Context())
+
+		require.NoError(t, err)
+		assert.Equal(t, uint64(64), head)
+		mockClient.AssertNotCalled(t, "BlockNumber", mock.Anything)
+	})
+}
+
+func TestSaveCheckpoint_ConfirmationGatedWaitsForRelease(t *testing.T) {
+	mockDB := &storageMock.DB{}
+
+	ec := newGatedClient(&ethMock.EthClient{}, mockDB, &MockProducer{}, &MockPoolContract{}, 12)
+	ec.checkpoints[testPoolAddr] = 90
+	ec.confirmations.releasedHead = 95
+
+	mockDB.On("SetCheckpoint", mock.Anything, testPoolAddr.Hex(), uint64(95)).Return(nil).Once()
+
+	// Block 100 is complete but its logs are still buffered
+	require.NoError(t, ec.saveCheckpoint(t.Context(), 100))
+
+	assert.Equal(t, uint64(95), ec.checkpoints[testPoolAddr])
+	assert.Equal(t, uint64(100), ec.confirmations.completedBlock)
+	mockDB.AssertExpectations(t)
+}
+
+func TestConfirmationBuffer_AddKeepsOrderAndIgnoresDuplicates(t *testing.T) {
+	cb := newConfirmationBuffer(12, false, 0)
+
+	first := types.Log{BlockNumber: 100, Index: 0, BlockHash: common.HexToHash("0x01")}
+	second := types.Log{BlockNumber: 100, Index: 1, BlockHash: common.HexToHash("0x01")}
+	third := types.Log{BlockNumber: 101, Index: 0, BlockHash: common.HexToHash("0x02")}
+
+	cb.add(third)
+	cb.add(first)
+	cb.add(second)
+	cb.add(first)
+
+	assert.Equal(t, []types.Log{first, second, third}, cb.pending)
+}
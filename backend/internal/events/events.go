@@ -1,20 +1,23 @@
 package events
 
 import (
+	"cmp"
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"math/big"
+	"strconv"
+	"time"
 
 	"github.com/ethereum/go-ethereum"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/murraystewart96/token-swap/internal/config"
 	"github.com/murraystewart96/token-swap/internal/contracts"
-	"github.com/murraystewart96/token-swap/pkg/kafka"
 	"github.com/murraystewart96/token-swap/internal/models"
 	"github.com/murraystewart96/token-swap/internal/storage"
 	"github.com/murraystewart96/token-swap/pkg/eth"
+	"github.com/murraystewart96/token-swap/pkg/kafka"
 	"github.com/murraystewart96/token-swap/pkg/tracing"
 	"github.com/rs/zerolog/log"
 )
@@ -24,16 +27,55 @@ var (
 	SyncEventSignature = common.HexToHash("0xcf2aa50876cdfbb541206f89af0ee78d44a2abf8d328e37fa4917f982149848a")
 )
 
-const MAX_RECENT_BLOCKS = 100
+const (
+	defaultBackfillBatchSize = 1000
+
+	// Number of block timestamps kept by the timestamp resolver
+	timestampCacheSize = 1024
+)
 
 type EventClient struct {
-	ethClient    eth.IClient
-	contractAddr common.Address
+	ethClient eth.IClient
+	pools     []common.Address
+	producer  kafka.IProducer
+	db        storage.DB
+
+	// Parses events from every pool (all pools share the pool ABI)
 	poolContract contracts.PoolContract
-	producer     kafka.IProducer
-	db           storage.DB
 
-	recentBlocks map[uint64]common.Hash
+	// Resolves block timestamps, which many nodes omit from logs
+	timestamps *eth.TimestampResolver
+
+	// Backfill and checkpoint state
+	startBlock       uint64
+	batchSize        uint64
+	checkpoints      map[common.Address]uint64 // last block persisted as fully processed, per pool
+	lastBlock        uint64                    // block currently being processed
+	backfilledHead   uint64                    // head the last backfill ran up to
+	backfilledBlocks map[uint64]common.Hash    // blocks near backfilledHead already processed
+	reorgFork        *uint64                   // first block replaced by a reorg, until a block range handles it
+
+	// Reconnect backoff bounds
+	minBackoff time.Duration
+	maxBackoff time.Duration
+
+	// Polling used when the transport cannot subscribe (HTTP)
+	pollInterval   time.Duration
+	pollBlockRange uint64
+
+	// Buffers logs until they are confirmed, nil when publishing immediately
+	confirmations *confirmationBuffer
+
+	// Event field trades and reserves are keyed by (config.MessageKey*)
+	messageKey string
+
+	// Recorded in the envelope of every published event
+	chainID uint64
+
+	// Encodes published events, and the registered schema ID of each event type
+	// (empty without a schema registry)
+	codec     kafka.Codec
+	schemaIDs map[string]int
 }
 
 func NewClient(cfg *config.Listener, producer kafka.IProducer, db storage.DB) (*EventClient, error) {
@@ -42,71 +84,213 @@ func NewClient(cfg *config.Listener, producer kafka.IProducer, db storage.DB) (*
 		return nil, fmt.Errorf("failed to create eth client: %w", err)
 	}
 
-	contractAddr := common.HexToAddress(cfg.ContractAddr)
-	poolContract, err := contracts.NewPool(contractAddr, ethClient.GetUnderlyingClient())
+	pools, err := cfg.PoolAddresses()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load pool addresses: %w", err)
+	}
+
+	chainID, err := ethClient.ChainID(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("failed to get chain id: %w", err)
+	}
+
+	codec, err := kafka.CodecByName(cmp.Or(cfg.Codec, kafka.CodecJSON))
+	if err != nil {
+		return nil, err
+	}
+
+	var schemaIDs map[string]int
+	if cfg.SchemaRegistry != "" {
+		if schemaIDs, err = registerSchemas(cfg.SchemaRegistry); err != nil {
+			return nil, err
+		}
+	}
+
+	poolContract, err := contracts.NewPool(pools[0], ethClient.GetUnderlyingClient())
 	if err != nil {
 		return nil, fmt.Errorf("failed to create pool contract interface: %w", err)
 	}
 
+	batchSize := cfg.BackfillBatchSize
+	if batchSize == 0 {
+		batchSize = defaultBackfillBatchSize
+	}
+
+	minBackoff, maxBackoff := cfg.ReconnectMinBackoff, cfg.ReconnectMaxBackoff
+	if minBackoff <= 0 {
+		minBackoff = defaultReconnectMinBackoff
+	}
+	if maxBackoff < minBackoff {
+		maxBackoff = max(minBackoff, defaultReconnectMaxBackoff)
+	}
+
+	pollInterval, pollBlockRange := cfg.PollInterval, cfg.PollBlockRange
+	if pollInterval <= 0 {
+		pollInterval = defaultPollInterval
+	}
+	if pollBlockRange == 0 {
+		pollBlockRange = defaultPollBlockRange
+	}
+
+	var confirmations *confirmationBuffer
+	if cfg.ConfirmationDepth > 0 || cfg.WaitForFinalized {
+		confirmations = newConfirmationBuffer(cfg.ConfirmationDepth, cfg.WaitForFinalized, cfg.ConfirmationPollInterval)
+	}
+
 	return &EventClient{
-		ethClient:    ethClient,
-		contractAddr: contractAddr,
-		poolContract: poolContract,
-		producer:     producer,
-		db:           db,
-		recentBlocks: make(map[uint64]common.Hash),
+		ethClient:        ethClient,
+		pools:            pools,
+		poolContract:     poolContract,
+		timestamps:       eth.NewTimestampResolver(ethClient, timestampCacheSize),
+		producer:         producer,
+		db:               db,
+		startBlock:       cfg.StartBlock,
+		batchSize:        batchSize,
+		checkpoints:      make(map[common.Address]uint64),
+		backfilledBlocks: make(map[uint64]common.Hash),
+		minBackoff:       minBackoff,
+		maxBackoff:       maxBackoff,
+		pollInterval:     pollInterval,
+		pollBlockRange:   pollBlockRange,
+		confirmations:    confirmations,
+		messageKey:       cfg.MessageKey,
+		chainID:          chainID.Uint64(),
+		codec:            codec,
+		schemaIDs:        schemaIDs,
 	}, nil
 }
 
+// Listen backfills any events missed since the last checkpoint and then
+// processes live events from the subscription, or by polling when the
+// transport cannot subscribe.
 func (ec *EventClient) Listen(ctx context.Context) error {
-	// One subscription for all events from this contract
-	query := ethereum.FilterQuery{
-		Addresses: []common.Address{ec.contractAddr},
+	if !ec.ethClient.SupportsSubscriptions() {
+		return ec.poll(ctx)
 	}
 
+	// One subscription for all events from the indexed pools.
+	// Subscribe before backfilling so that logs emitted while the backfill
+	// runs are buffered by the subscription instead of lost.
 	logs := make(chan types.Log)
-	sub, err := ec.ethClient.SubscribeFilterLogs(ctx, query, logs)
+	sub, err := ec.ethClient.SubscribeFilterLogs(ctx, ec.filterQuery(), logs)
 	if err != nil {
 		return fmt.Errorf("failed to subscribe to contract events: %w", err)
 	}
+	defer sub.Unsubscribe()
+
+	if err := ec.backfill(ctx); err != nil {
+		return fmt.Errorf("failed to backfill events: %w", err)
+	}
+
+	// Periodically release buffered logs that have been confirmed
+	var confirmationTick <-chan time.Time
+	if ec.confirmations != nil {
+		ticker := time.NewTicker(ec.confirmations.pollInterval)
+		defer ticker.Stop()
+		confirmationTick = ticker.C
+	}
 
-	log.Info().Msgf("listening for events on %s", ec.contractAddr.String())
+	log.Info().Msgf("listening for events on %d pool(s): %v", len(ec.pools), ec.pools)
 	for {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
 		case err := <-sub.Err():
 			return err
+		case <-confirmationTick:
+			if err := ec.releaseConfirmed(ctx); err != nil {
+				return err
+			}
 		case eventLog := <-logs:
-			// Check for chain reorg
-			reorg, err := ec.CheckForChainReorg(ctx, &eventLog)
-			if reorg {
-				log.Info().Msg("Chain was reorganised")
-				if err != nil {
-					log.Error().Err(err).Msgf("failed to rollback events")
-					continue
-				}
+			// Skip logs the backfill already published
+			if ec.isBackfilled(&eventLog) {
+				continue
+			}
+
+			if err := ec.advanceCheckpoint(ctx, eventLog.BlockNumber); err != nil {
+				return err
 			}
 
-			// Handle events
-			switch eventLog.Topics[0] {
-			case SwapEventSignature:
-				err := ec.handleSwapEvent(ctx, &eventLog)
-				if err != nil {
-					log.Error().Err(err).Msg("swap event handler failed")
-				}
-
-			case SyncEventSignature:
-				err := ec.handleSyncEvent(ctx, &eventLog)
-				if err != nil {
-					log.Error().Err(err).Msg("sync event handler failed")
-				}
+			if err := ec.processLog(ctx, &eventLog); err != nil {
+				return err
 			}
 		}
 	}
 }
 
-func (ec *EventClient) handleSwapEvent(ctx context.Context, eventLog *types.Log) error {
+// processLog runs reorg detection for a log and publishes it to the relevant topic.
+func (ec *EventClient) processLog(ctx context.Context, eventLog *types.Log) error {
+	// Check for chain reorg
+	reorg, err := ec.CheckForChainReorg(ctx, eventLog)
+	if reorg {
+		log.Info().Msg("Chain was reorganised")
+	}
+	if errors.Is(err, ErrNonCanonicalEvent) {
+		log.Info().Str("block_hash", eventLog.BlockHash.Hex()).Uint64("block_number", eventLog.BlockNumber).
+			Msg("skipping event from non-canonical block")
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to check for chain reorg: %w", err)
+	}
+
+	if len(eventLog.Topics) == 0 {
+		return nil
+	}
+
+	// Events are never published without a block timestamp, the log is
+	// fetched again after the listener restarts
+	timestamp, err := ec.timestamps.Resolve(ctx, eventLog)
+	if err != nil {
+		return fmt.Errorf("failed to resolve timestamp for event in tx %s: %w", eventLog.TxHash.Hex(), err)
+	}
+	eventLog.BlockTimestamp = timestamp
+
+	if ec.confirmations == nil {
+		return ec.publishLog(ctx, eventLog, true)
+	}
+
+	// Confirmation gated - publish to the unconfirmed topics now and hold
+	// the log back from the history topics until it is confirmed
+	if err := ec.publishLog(ctx, eventLog, false); err != nil {
+		return err
+	}
+	ec.confirmations.add(*eventLog)
+
+	return nil
+}
+
+// publishLog publishes a log to the history topics, or to their unconfirmed
+// counterparts when confirmed is false.
+func (ec *EventClient) publishLog(ctx context.Context, eventLog *types.Log, confirmed bool) error {
+	tradeTopic, reserveTopic := config.TradeHistoryTopic, config.ReserveHistoryTopic
+	if !confirmed {
+		tradeTopic, reserveTopic = config.TradeHistoryUnconfirmedTopic, config.ReserveHistoryUnconfirmedTopic
+	}
+
+	// Handle events
+	switch eventLog.Topics[0] {
+	case SwapEventSignature:
+		if err := ec.handleSwapEvent(ctx, eventLog, tradeTopic); err != nil {
+			return fmt.Errorf("swap event handler failed: %w", err)
+		}
+
+	case SyncEventSignature:
+		if err := ec.handleSyncEvent(ctx, eventLog, reserveTopic); err != nil {
+			return fmt.Errorf("sync event handler failed: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (ec *EventClient) filterQuery() ethereum.FilterQuery {
+	return ethereum.FilterQuery{
+		Addresses: ec.pools,
+	}
+}
+
+func (ec *EventClient) handleSwapEvent(ctx context.Context, eventLog *types.Log, topic string) error {
 	// Start a span for swap event processing
 	ctx, span := tracing.StartSpan(ctx, "events.handleSwapEvent")
 	defer span.End()
@@ -124,7 +308,9 @@ func (ec *EventClient) handleSwapEvent(ctx context.Context, eventLog *types.Log)
 		tradeEvent := models.TradeEvent{
 			TxHash:           swapEvent.Raw.TxHash.Hex(),
 			TransactionIndex: swapEvent.Raw.TxIndex,
+			LogIndex:         swapEvent.Raw.Index,
 			BlockNumber:      swapEvent.Raw.BlockNumber,
+			BlockHash:        swapEvent.Raw.BlockHash.Hex(),
 			Timestamp:        int64(swapEvent.Raw.BlockTimestamp),
 			Sender:           swapEvent.Sender.Hex(),
 			Recipient:        swapEvent.To.Hex(),
@@ -135,24 +321,30 @@ func (ec *EventClient) handleSwapEvent(ctx context.Context, eventLog *types.Log)
 			PoolAddress:      swapEvent.Raw.Address.Hex(),
 		}
 
-		// Convert to JSON and publish
-		tradeEventJSON, err := json.Marshal(tradeEvent)
+		if err := ec.enrichTrade(ctx, &tradeEvent, &swapEvent.Raw); err != nil {
+			return fmt.Errorf("failed to enrich trade event: %w", err)
+		}
+
+		// Wrap in an envelope and publish
+		value, headers, err := ec.envelope(models.EventTypeTrade, models.TradeEventVersion, &swapEvent.Raw, tradeEvent)
 		if err != nil {
 			return fmt.Errorf("failed to marshal trade event: %w", err)
 		}
 
-		log.Info().Str("topic", config.TradeHistoryTopic).Msg("publishing swap event")
+		log.Info().Str("topic", topic).Msg("publishing swap event")
 
-		err = ec.producer.Produce(ctx, config.TradeHistoryTopic, []byte(tradeEvent.TxHash), tradeEventJSON)
+		delivery, err := ec.producer.Produce(ctx, topic, ec.eventKey(tradeEvent.PoolAddress, tradeEvent.TxHash), value, headers...)
 		if err != nil {
 			return fmt.Errorf("failed to produce trade event: %w", err)
 		}
+
+		log.Debug().Int32("partition", delivery.Partition).Int64("offset", delivery.Offset).Msg("trade event delivered")
 	}
 
 	return nil
 }
 
-func (ec *EventClient) handleSyncEvent(ctx context.Context, eventLog *types.Log) error {
+func (ec *EventClient) handleSyncEvent(ctx context.Context, eventLog *types.Log, topic string) error {
 	// Start a span for sync event processing
 	ctx, span := tracing.StartSpan(ctx, "events.handleSyncEvent")
 	defer span.End()
@@ -168,29 +360,67 @@ func (ec *EventClient) handleSyncEvent(ctx context.Context, eventLog *types.Log)
 		reserveEvent := models.ReserveEvent{
 			TxHash:      syncEvent.Raw.TxHash.Hex(),
 			BlockNumber: syncEvent.Raw.BlockNumber,
+			BlockHash:   syncEvent.Raw.BlockHash.Hex(),
+			LogIndex:    syncEvent.Raw.Index,
 			Timestamp:   int64(syncEvent.Raw.BlockTimestamp),
 			METReserve:  syncEvent.MeTokenAmount.String(),
 			YOUReserve:  syncEvent.YouTokenAmount.String(),
 			PoolAddress: syncEvent.Raw.Address.Hex(),
 		}
 
-		// Convert to JSON and publish
-		reserveEventJSON, err := json.Marshal(reserveEvent)
+		// Wrap in an envelope and publish
+		value, headers, err := ec.envelope(models.EventTypeReserve, models.ReserveEventVersion, &syncEvent.Raw, reserveEvent)
 		if err != nil {
 			return fmt.Errorf("failed to marshal reserve event: %w", err)
 		}
 
-		log.Info().Str("topic", config.TradeHistoryTopic).Msg("publishing sync event")
+		log.Info().Str("topic", topic).Msg("publishing sync event")
 
-		err = ec.producer.Produce(ctx, config.ReserveHistoryTopic, []byte(reserveEvent.TxHash), reserveEventJSON)
+		delivery, err := ec.producer.Produce(ctx, topic, ec.eventKey(reserveEvent.PoolAddress, reserveEvent.TxHash), value, headers...)
 		if err != nil {
 			return fmt.Errorf("failed to produce reserve event: %w", err)
 		}
+
+		log.Debug().Int32("partition", delivery.Partition).Int64("offset", delivery.Offset).Msg("reserve event delivered")
 	}
 
 	return nil
 }
 
+// envelope wraps an event decoded from eventLog in a versioned envelope and
+// encodes it. The event ID is derived from the log's position so it is the same
+// if the event is published again (e.g. after a restart).
+func (ec *EventClient) envelope(eventType string, schemaVersion int, eventLog *types.Log, event any) ([]byte, []kafka.Header, error) {
+	envelope := models.NewEnvelope(eventType, schemaVersion)
+	envelope.ID = fmt.Sprintf("%s:%d", eventLog.BlockHash.Hex(), eventLog.Index)
+	envelope.Source = eventLog.Address.Hex()
+	envelope.ChainID = ec.chainID
+	envelope.BlockHash = eventLog.BlockHash.Hex()
+
+	value, headers, err := ec.encode(envelope, event)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Lets consumers check each key's events arrive in chain order
+	headers = append(headers,
+		kafka.Header{Key: kafka.HeaderBlockNumber, Value: []byte(strconv.FormatUint(eventLog.BlockNumber, 10))},
+		kafka.Header{Key: kafka.HeaderLogIndex, Value: []byte(strconv.FormatUint(uint64(eventLog.Index), 10))},
+	)
+
+	return value, headers, nil
+}
+
+// eventKey returns the Kafka key of a trade or reserve event. Keying by pool
+// address puts all of a pool's events on one partition, so they are consumed in
+// the order they were emitted.
+func (ec *EventClient) eventKey(poolAddr, txHash string) []byte {
+	if ec.messageKey == config.MessageKeyTxHash {
+		return []byte(txHash)
+	}
+	return []byte(poolAddr)
+}
+
 func determineTradeDirection(swapEvent *contracts.PoolSwap) (tokenIn, tokenOut, amountIn, amountOut string) {
 	if swapEvent.MeTokenIn.Cmp(big.NewInt(0)) > 0 {
 		// MET → YOU trade
@@ -2,10 +2,12 @@ package events
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"math/big"
+	"path/filepath"
+	"strconv"
 	"testing"
+	"time"
 
 	"github.com/ethereum/go-ethereum/accounts/abi/bind"
 	"github.com/ethereum/go-ethereum/common"
@@ -13,6 +15,10 @@ import (
 	"github.com/murraystewart96/token-swap/internal/config"
 	"github.com/murraystewart96/token-swap/internal/contracts"
 	"github.com/murraystewart96/token-swap/internal/models"
+	storageMock "github.com/murraystewart96/token-swap/internal/storage/mock"
+	"github.com/murraystewart96/token-swap/pkg/eth"
+	ethMock "github.com/murraystewart96/token-swap/pkg/eth/mock"
+	"github.com/murraystewart96/token-swap/pkg/kafka"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
@@ -100,21 +106,41 @@ type MockProducer struct {
 }
 
 type ProducedMessage struct {
-	topic string
-	key   []byte
-	value []byte
+	topic   string
+	key     []byte
+	value   []byte
+	headers []kafka.Header
 }
 
-func (m *MockProducer) Produce(ctx context.Context, topic string, key, value []byte) error {
+func (m *MockProducer) Produce(ctx context.Context, topic string, key, value []byte, headers ...kafka.Header) (*kafka.Delivery, error) {
 	args := m.Called(topic, key, value)
-	if args.Error(0) == nil {
-		m.messages = append(m.messages, ProducedMessage{
-			topic: topic,
-			key:   key,
-			value: value,
-		})
+	if err := args.Error(0); err != nil {
+		return nil, err
+	}
+
+	m.messages = append(m.messages, ProducedMessage{
+		topic:   topic,
+		key:     key,
+		value:   value,
+		headers: headers,
+	})
+
+	return &kafka.Delivery{Topic: topic, Offset: int64(len(m.messages) - 1), Key: key}, nil
+}
+
+func (m *MockProducer) ProduceAsync(ctx context.Context, topic string, key, value []byte, onDelivery kafka.DeliveryCallback, headers ...kafka.Header) error {
+	delivery, err := m.Produce(ctx, topic, key, value, headers...)
+	if err != nil {
+		return err
 	}
-	return args.Error(0)
+
+	onDelivery(delivery, nil)
+
+	return nil
+}
+
+func (m *MockProducer) Flush(timeout time.Duration) int {
+	return 0
 }
 
 func (m *MockProducer) GetMessages() []ProducedMessage {
@@ -160,6 +186,7 @@ func TestHandleSwapEvent(t *testing.T) {
 		name           string
 		swapEvent      *contracts.PoolSwap
 		parseError     error
+		receiptError   error
 		producerError  error
 		expectError    bool
 		expectedTopic  string
@@ -177,6 +204,7 @@ func TestHandleSwapEvent(t *testing.T) {
 				Raw: types.Log{
 					TxHash:         common.HexToHash("0x1234567890abcdef1234567890abcdef1234567890abcdef1234567890abc123"),
 					TxIndex:        5,
+					Index:          7,
 					BlockNumber:    12345,
 					BlockTimestamp: 1234567890,
 					Address:        common.HexToAddress("0xpool1234567890abcdef1234567890abcdef12345678"),
@@ -189,6 +217,7 @@ func TestHandleSwapEvent(t *testing.T) {
 			expectedFields: map[string]interface{}{
 				"tx_hash":           "0x1234567890abcdef1234567890abcdef1234567890abcdef1234567890abc123",
 				"transaction_index": uint(5),
+				"log_index":         uint(7),
 				"block_number":      uint64(12345),
 				"timestamp":         int64(1234567890),
 				"sender":            "0x1234567890AbcdEF1234567890abCdef12345678",
@@ -199,6 +228,10 @@ func TestHandleSwapEvent(t *testing.T) {
 				"amount_out":        "1500000",
 				"pool_address":      "0xPool1234567890abCdef1234567890abCdef12345678",
 				"event_type":        "swap",
+				"tx_from":           "0x00000000000000000000000000000000000000AA",
+				"tx_nonce":          uint64(9),
+				"gas_used":          uint64(120000),
+				"tx_fee":            "360000000000000",
 			},
 		},
 		{
@@ -233,6 +266,20 @@ func TestHandleSwapEvent(t *testing.T) {
 				"pool_address": "0xPool2234567890abCdef1234567890abCdef12345678",
 			},
 		},
+		{
+			name: "receipt error",
+			swapEvent: &contracts.PoolSwap{
+				MeTokenIn:   big.NewInt(1000),
+				YouTokenOut: big.NewInt(1500),
+				YouTokenIn:  big.NewInt(0),
+				MeTokenOut:  big.NewInt(0),
+				Raw: types.Log{
+					TxHash: common.HexToHash("0x90abcdef1234567890abcdef1234567890abcdef1234567890abcdef12345678"),
+				},
+			},
+			receiptError: errors.New("receipt not found"),
+			expectError:  true,
+		},
 		{
 			name:          "parse swap error",
 			swapEvent:     nil,
@@ -264,6 +311,7 @@ func TestHandleSwapEvent(t *testing.T) {
 			// Setup mocks
 			mockProducer := &MockProducer{}
 			mockContract := &MockPoolContract{}
+			mockClient := &ethMock.EthClient{}
 
 			eventLog := &types.Log{
 				Topics: []common.Hash{SwapEventSignature},
@@ -274,17 +322,24 @@ func TestHandleSwapEvent(t *testing.T) {
 				mockContract.On("ParseSwap", *eventLog).Return((*contracts.PoolSwap)(nil), tt.parseError)
 			} else if tt.swapEvent != nil {
 				mockContract.On("ParseSwap", *eventLog).Return(tt.swapEvent, nil)
-				mockProducer.On("Produce", config.TradeHistoryTopic, []byte(tt.swapEvent.Raw.TxHash.Hex()), mock.Anything).Return(tt.producerError)
+
+				if tt.receiptError != nil {
+					mockClient.On("TransactionReceipt", mock.Anything, tt.swapEvent.Raw.TxHash).Return(nil, tt.receiptError)
+				} else {
+					expectTransactionLookups(mockClient, tt.swapEvent.Raw)
+					mockProducer.On("Produce", config.TradeHistoryTopic, []byte(tt.swapEvent.Raw.Address.Hex()), mock.Anything).Return(tt.producerError)
+				}
 			}
 
 			// Create event client with mocks
 			ec := &EventClient{
+				ethClient:    mockClient,
 				producer:     mockProducer,
 				poolContract: mockContract,
 			}
 
 			// Execute
-			err := ec.handleSwapEvent(t.Context(), eventLog)
+			err := ec.handleSwapEvent(t.Context(), eventLog, config.TradeHistoryTopic)
 
 			// Verify
 			if tt.expectError {
@@ -301,8 +356,10 @@ func TestHandleSwapEvent(t *testing.T) {
 
 				// Verify JSON structure
 				var tradeEvent models.TradeEvent
-				err := json.Unmarshal(message.value, &tradeEvent)
-				require.NoError(t, err)
+				envelope := openEvent(t, message, models.EventTypeTrade, &tradeEvent)
+				assert.Equal(t, models.TradeEventVersion, envelope.SchemaVersion)
+				assert.Equal(t, tt.swapEvent.Raw.Address.Hex(), envelope.Source)
+				assert.Equal(t, tt.swapEvent.Raw.BlockHash.Hex(), envelope.BlockHash)
 
 				// Verify expected fields
 				for field, expected := range tt.expectedFields {
@@ -319,16 +376,39 @@ func TestHandleSwapEvent(t *testing.T) {
 						assert.Equal(t, expected, tradeEvent.AmountOut)
 					case "block_number":
 						assert.Equal(t, expected, tradeEvent.BlockNumber)
+					case "tx_from":
+						assert.Equal(t, expected, tradeEvent.TxFrom)
+					case "tx_nonce":
+						assert.Equal(t, expected, tradeEvent.TxNonce)
+					case "gas_used":
+						assert.Equal(t, expected, tradeEvent.GasUsed)
+					case "tx_fee":
+						assert.Equal(t, expected, tradeEvent.TxFee)
+					case "log_index":
+						assert.Equal(t, expected, tradeEvent.LogIndex)
 					}
 				}
 			}
 
 			mockContract.AssertExpectations(t)
 			mockProducer.AssertExpectations(t)
+			mockClient.AssertExpectations(t)
 		})
 	}
 }
 
+// Transaction lookups used to enrich trades with gas and fee details
+func expectTransactionLookups(mockClient *ethMock.EthClient, raw types.Log) {
+	tx := types.NewTx(&types.LegacyTx{Nonce: 9, GasPrice: big.NewInt(2_000_000_000)})
+
+	mockClient.On("TransactionReceipt", mock.Anything, raw.TxHash).Return(&types.Receipt{
+		GasUsed:           120000,
+		EffectiveGasPrice: big.NewInt(3_000_000_000),
+	}, nil)
+	mockClient.On("TransactionByHash", mock.Anything, raw.TxHash).Return(tx, false, nil)
+	mockClient.On("TransactionSender", mock.Anything, tx, raw.BlockHash, raw.TxIndex).Return(common.HexToAddress("0xaa"), nil)
+}
+
 func TestHandleSyncEvent(t *testing.T) {
 	tests := []struct {
 		name           string
@@ -347,6 +427,7 @@ func TestHandleSyncEvent(t *testing.T) {
 				Raw: types.Log{
 					TxHash:      common.HexToHash("0x1234567890abcdef1234567890abcdef1234567890abcdef1234567890abc123"),
 					BlockNumber: 12347,
+					Index:       2,
 					Address:     common.HexToAddress("0xpoolsync567890abcdef1234567890abcdef12345678"),
 				},
 			},
@@ -357,6 +438,7 @@ func TestHandleSyncEvent(t *testing.T) {
 			expectedFields: map[string]interface{}{
 				"tx_hash":      "0x1234567890abcdef1234567890abcdef1234567890abcdef1234567890abc123",
 				"block_number": uint64(12347),
+				"log_index":    uint(2),
 				"met_reserve":  "5000000",
 				"you_reserve":  "7500000",
 				"pool_address": "0xPoolsync567890abCdef1234567890abCdef12345678",
@@ -400,7 +482,7 @@ func TestHandleSyncEvent(t *testing.T) {
 				mockContract.On("ParseSync", *eventLog).Return((*contracts.PoolSync)(nil), tt.parseError)
 			} else if tt.syncEvent != nil {
 				mockContract.On("ParseSync", *eventLog).Return(tt.syncEvent, nil)
-				mockProducer.On("Produce", config.ReserveHistoryTopic, []byte(tt.syncEvent.Raw.TxHash.Hex()), mock.Anything).Return(tt.producerError)
+				mockProducer.On("Produce", config.ReserveHistoryTopic, []byte(tt.syncEvent.Raw.Address.Hex()), mock.Anything).Return(tt.producerError)
 			}
 
 			// Create event client with mocks
@@ -410,7 +492,7 @@ func TestHandleSyncEvent(t *testing.T) {
 			}
 
 			// Execute
-			err := ec.handleSyncEvent(t.Context(), eventLog)
+			err := ec.handleSyncEvent(t.Context(), eventLog, config.ReserveHistoryTopic)
 
 			// Verify
 			if tt.expectError {
@@ -427,8 +509,12 @@ func TestHandleSyncEvent(t *testing.T) {
 
 				// Verify JSON structure
 				var reserveEvent models.ReserveEvent
-				err := json.Unmarshal(message.value, &reserveEvent)
-				require.NoError(t, err)
+				envelope := openEvent(t, message, models.EventTypeReserve, &reserveEvent)
+				assert.Equal(t, models.ReserveEventVersion, envelope.SchemaVersion)
+
+				// The worker checks each key's events arrive in chain order from their headers
+				assert.Contains(t, message.headers, kafka.Header{Key: kafka.HeaderBlockNumber, Value: []byte(strconv.FormatUint(reserveEvent.BlockNumber, 10))})
+				assert.Contains(t, message.headers, kafka.Header{Key: kafka.HeaderLogIndex, Value: []byte(strconv.FormatUint(uint64(reserveEvent.LogIndex), 10))})
 
 				// Verify expected fields
 				for field, expected := range tt.expectedFields {
@@ -441,6 +527,8 @@ func TestHandleSyncEvent(t *testing.T) {
 						assert.Equal(t, expected, reserveEvent.YOUReserve)
 					case "block_number":
 						assert.Equal(t, expected, reserveEvent.BlockNumber)
+					case "log_index":
+						assert.Equal(t, expected, reserveEvent.LogIndex)
 					}
 				}
 			}
@@ -451,6 +539,99 @@ func TestHandleSyncEvent(t *testing.T) {
 	}
 }
 
+// openEvent decodes a published envelope of eventType and its data into event,
+// using the codec named by the message's content-type header
+func openEvent(t *testing.T, message ProducedMessage, eventType string, event any) *models.Envelope {
+	t.Helper()
+
+	var contentType string
+	for _, header := range message.headers {
+		if header.Key == kafka.HeaderContentType {
+			contentType = string(header.Value)
+		}
+	}
+
+	codec, err := kafka.CodecFor(contentType)
+	require.NoError(t, err)
+
+	envelope := &models.Envelope{}
+	require.NoError(t, codec.Unmarshal(message.value, envelope))
+	require.NoError(t, envelope.CheckType(eventType))
+	require.NoError(t, codec.Unmarshal(envelope.Data, event))
+
+	return envelope
+}
+
+func TestEventKey(t *testing.T) {
+	tests := []struct {
+		name       string
+		messageKey string
+		expected   string
+	}{
+		{name: "defaults to pool address", messageKey: "", expected: "0xpool"},
+		{name: "pool address", messageKey: config.MessageKeyPoolAddress, expected: "0xpool"},
+		{name: "tx hash", messageKey: config.MessageKeyTxHash, expected: "0xtx"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ec := &EventClient{messageKey: tt.messageKey}
+			assert.Equal(t, []byte(tt.expected), ec.eventKey("0xpool", "0xtx"))
+		})
+	}
+}
+
+func TestEncode(t *testing.T) {
+	tests := []struct {
+		name            string
+		codec           kafka.Codec
+		schemaIDs       map[string]int
+		expectedHeaders []kafka.Header
+	}{
+		{
+			name:            "defaults to json",
+			expectedHeaders: []kafka.Header{{Key: kafka.HeaderContentType, Value: []byte("application/json")}},
+		},
+		{
+			name:      "protobuf with schema id",
+			codec:     kafka.ProtobufCodec{},
+			schemaIDs: map[string]int{models.EventTypeReserve: 2},
+			expectedHeaders: []kafka.Header{
+				{Key: kafka.HeaderContentType, Value: []byte("application/x-protobuf")},
+				{Key: kafka.HeaderSchemaID, Value: []byte("2")},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ec := &EventClient{codec: tt.codec, schemaIDs: tt.schemaIDs}
+			reserveEvent := models.ReserveEvent{TxHash: "0xtx", BlockNumber: 7, METReserve: "1000", PoolAddress: "0xpool"}
+
+			value, headers, err := ec.encode(models.NewEnvelope(models.EventTypeReserve, models.ReserveEventVersion), reserveEvent)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectedHeaders, headers)
+
+			var decoded models.ReserveEvent
+			openEvent(t, ProducedMessage{value: value, headers: headers}, models.EventTypeReserve, &decoded)
+			assert.Equal(t, reserveEvent, decoded)
+		})
+	}
+}
+
+func TestRegisterSchemas(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "schemas.json")
+
+	first, err := registerSchemas(path)
+	require.NoError(t, err)
+	assert.Len(t, first, len(publishedEvents))
+
+	// Restarting with unchanged events reuses the registered schemas
+	second, err := registerSchemas(path)
+	require.NoError(t, err)
+	assert.Equal(t, first, second)
+}
+
 // Property-based tests
 func TestTradeDirectionProperties(t *testing.T) {
 	// Test property: exactly one of the input amounts should be > 0
@@ -483,3 +664,53 @@ func TestTradeDirectionProperties(t *testing.T) {
 		})
 	}
 }
+
+func TestProcessLog_ResolvesMissingTimestamp(t *testing.T) {
+	mockClient := &ethMock.EthClient{}
+	mockDB := &storageMock.DB{}
+	mockProducer := &MockProducer{}
+	mockContract := &MockPoolContract{}
+
+	ec := newBackfillClient(mockClient, mockDB, mockProducer, mockContract)
+
+	// Subscribed logs often have no block timestamp
+	syncLog := createSyncLog(100, common.HexToHash("0xabc"))
+	syncLog.BlockTimestamp = 0
+
+	resolved := syncLog
+	resolved.BlockTimestamp = 1700000100
+
+	mockDB.On("GetCanonicalBlock", mock.Anything, uint64(100)).Return(&models.Block{Hash: syncLog.BlockHash.Hex()}, nil)
+	mockClient.On("HeaderByHash", mock.Anything, syncLog.BlockHash).Return(&types.Header{Number: big.NewInt(100), Time: 1700000100}, nil).Once()
+	expectParseSync(mockContract, resolved)
+	mockProducer.On("Produce", config.ReserveHistoryTopic, mock.Anything, mock.Anything).Return(nil)
+
+	err := ec.processLog(t.Context(), &syncLog)
+
+	require.NoError(t, err)
+	require.Len(t, mockProducer.GetMessages(), 1)
+
+	var reserveEvent models.ReserveEvent
+	openEvent(t, mockProducer.GetMessages()[0], models.EventTypeReserve, &reserveEvent)
+	assert.Equal(t, int64(1700000100), reserveEvent.Timestamp)
+	mockClient.AssertExpectations(t)
+}
+
+func TestProcessLog_RejectsUnresolvedTimestamp(t *testing.T) {
+	mockClient := &ethMock.EthClient{}
+	mockDB := &storageMock.DB{}
+	mockProducer := &MockProducer{}
+
+	ec := newBackfillClient(mockClient, mockDB, mockProducer, &MockPoolContract{})
+
+	syncLog := createSyncLog(100, common.HexToHash("0xabc"))
+	syncLog.BlockTimestamp = 0
+
+	mockDB.On("GetCanonicalBlock", mock.Anything, uint64(100)).Return(&models.Block{Hash: syncLog.BlockHash.Hex()}, nil)
+	mockClient.On("HeaderByHash", mock.Anything, syncLog.BlockHash).Return(nil, assert.AnError)
+
+	err := ec.processLog(t.Context(), &syncLog)
+
+	assert.ErrorIs(t, err, eth.ErrUnresolvedTimestamp)
+	mockProducer.AssertNotCalled(t, "Produce", mock.Anything, mock.Anything, mock.Anything)
+}
@@ -0,0 +1,49 @@
+package events
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/murraystewart96/token-swap/internal/models"
+	"github.com/murraystewart96/token-swap/pkg/tracing"
+)
+
+// enrichTrade adds the gas and fee details of the transaction that emitted
+// the swap, so the all-in cost of a trade can be computed.
+func (ec *EventClient) enrichTrade(ctx context.Context, trade *models.TradeEvent, eventLog *types.Log) error {
+	ctx, span := tracing.StartSpan(ctx, "events.enrichTrade")
+	defer span.End()
+
+	receipt, err := ec.ethClient.TransactionReceipt(ctx, eventLog.TxHash)
+	if err != nil {
+		return fmt.Errorf("failed to get transaction receipt: %w", err)
+	}
+
+	tx, _, err := ec.ethClient.TransactionByHash(ctx, eventLog.TxHash)
+	if err != nil {
+		return fmt.Errorf("failed to get transaction: %w", err)
+	}
+
+	from, err := ec.ethClient.TransactionSender(ctx, tx, eventLog.BlockHash, eventLog.TxIndex)
+	if err != nil {
+		return fmt.Errorf("failed to get transaction sender: %w", err)
+	}
+
+	// Nodes that predate EIP-1559 receipts don't report the effective price
+	gasPrice := receipt.EffectiveGasPrice
+	if gasPrice == nil {
+		gasPrice = tx.GasPrice()
+	}
+
+	fee := new(big.Int).Mul(gasPrice, new(big.Int).SetUint64(receipt.GasUsed))
+
+	trade.TxFrom = from.Hex()
+	trade.TxNonce = tx.Nonce()
+	trade.GasUsed = receipt.GasUsed
+	trade.EffectiveGasPrice = gasPrice.String()
+	trade.TxFee = fee.String()
+
+	return nil
+}
@@ -0,0 +1,182 @@
+package events
+
+import (
+	"context"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/murraystewart96/token-swap/internal/config"
+	"github.com/murraystewart96/token-swap/internal/contracts"
+	"github.com/murraystewart96/token-swap/internal/models"
+	storageMock "github.com/murraystewart96/token-swap/internal/storage/mock"
+	"github.com/murraystewart96/token-swap/internal/worker"
+	ethMock "github.com/murraystewart96/token-swap/pkg/eth/mock"
+	"github.com/murraystewart96/token-swap/pkg/kafka"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// TestPipeline runs events from the listener through the in-memory broker to
+// the worker, with storage mocked
+func TestPipeline(t *testing.T) {
+	pool := common.HexToAddress("0x9fE46736679d2D9a65F0992F2272dE9f3c7fa6e0")
+	swapLog := types.Log{
+		Address:        pool,
+		TxHash:         common.HexToHash("0x01"),
+		BlockHash:      common.HexToHash("0xb1"),
+		BlockNumber:    100,
+		BlockTimestamp: 1700000000,
+		Index:          1,
+	}
+	syncLog := swapLog
+	syncLog.Index = 2
+
+	for _, codec := range []kafka.Codec{kafka.JSONCodec{}, kafka.ProtobufCodec{}} {
+		t.Run(codec.Name(), func(t *testing.T) {
+			ctx, cancel := context.WithCancel(t.Context())
+			defer cancel()
+
+			broker := kafka.NewMemoryBroker(3)
+
+			// Listener side
+			mockContract := &MockPoolContract{}
+			mockContract.On("ParseSwap", swapLog).Return(&contracts.PoolSwap{
+				Sender:      common.HexToAddress("0xaa"),
+				To:          common.HexToAddress("0xaa"),
+				MeTokenIn:   big.NewInt(1000),
+				YouTokenIn:  big.NewInt(0),
+				MeTokenOut:  big.NewInt(0),
+				YouTokenOut: big.NewInt(1500),
+				Raw:         swapLog,
+			}, nil)
+			mockContract.On("ParseSync", syncLog).Return(&contracts.PoolSync{
+				MeTokenAmount:  big.NewInt(2000),
+				YouTokenAmount: big.NewInt(3000),
+				Raw:            syncLog,
+			}, nil)
+
+			mockClient := &ethMock.EthClient{}
+			expectTransactionLookups(mockClient, swapLog)
+
+			producer := broker.NewProducer(&config.KafkaProducer{})
+			defer producer.Close()
+
+			ec := &EventClient{
+				ethClient:    mockClient,
+				producer:     producer,
+				poolContract: mockContract,
+				codec:        codec,
+			}
+			require.NoError(t, ec.handleSwapEvent(ctx, &swapLog, config.TradeHistoryTopic))
+			require.NoError(t, ec.handleSyncEvent(ctx, &syncLog, config.ReserveHistoryTopic))
+
+			// Worker side
+			stored := make(chan string, 2)
+			db := &storageMock.DB{}
+			db.On("CreateTrade", mock.Anything, mock.MatchedBy(func(trade *models.TradeEvent) bool {
+				return trade.TxHash == swapLog.TxHash.Hex() && trade.AmountIn == "1000" && trade.TxFee == "360000000000000"
+			})).Run(func(mock.Arguments) { stored <- "trade" }).Return(true, nil)
+			db.On("CreateReserve", mock.Anything, mock.MatchedBy(func(reserve *models.ReserveEvent) bool {
+				return reserve.LogIndex == 2 && reserve.METReserve == "2000" && reserve.YOUReserve == "3000"
+			})).Run(func(mock.Arguments) { stored <- "reserve" }).Return(true, nil)
+
+			poolCache := &storageMock.PoolCache{}
+			poolCache.On("SetReserves", mock.Anything, pool.Hex(), mock.Anything).Return(true, nil)
+			poolCache.On("SetPrice", mock.Anything, pool.Hex(), worker.MET_YOU_PAIR, mock.Anything).Return(true, nil)
+
+			consumer := broker.NewConsumer(&config.KafkaConsumer{GroupID: "worker", OffsetReset: "earliest", MaxAttempts: 1})
+			defer consumer.Close()
+
+			w, err := worker.New(consumer, []string{config.TradeHistoryTopic, config.ReserveHistoryTopic}, poolCache, db)
+			require.NoError(t, err)
+			go w.Start(ctx)
+
+			for range 2 {
+				select {
+				case <-stored:
+				case <-time.After(5 * time.Second):
+					t.Fatal("events weren't stored by the worker")
+				}
+			}
+
+			db.AssertExpectations(t)
+			poolCache.AssertExpectations(t)
+		})
+	}
+}
+
+// TestPipeline_StoresOffsetsWithEvents checks that a worker keeping its offsets
+// in the database writes each event together with its offset
+func TestPipeline_StoresOffsetsWithEvents(t *testing.T) {
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	swapLog := types.Log{
+		Address:        common.HexToAddress("0x9fE46736679d2D9a65F0992F2272dE9f3c7fa6e0"),
+		TxHash:         common.HexToHash("0x01"),
+		BlockHash:      common.HexToHash("0xb1"),
+		BlockNumber:    100,
+		BlockTimestamp: 1700000000,
+		Index:          1,
+	}
+
+	broker := kafka.NewMemoryBroker(1)
+
+	// Listener side
+	mockContract := &MockPoolContract{}
+	mockContract.On("ParseSwap", swapLog).Return(&contracts.PoolSwap{
+		Sender:      common.HexToAddress("0xaa"),
+		To:          common.HexToAddress("0xaa"),
+		MeTokenIn:   big.NewInt(1000),
+		YouTokenIn:  big.NewInt(0),
+		MeTokenOut:  big.NewInt(0),
+		YouTokenOut: big.NewInt(1500),
+		Raw:         swapLog,
+	}, nil)
+
+	mockClient := &ethMock.EthClient{}
+	expectTransactionLookups(mockClient, swapLog)
+
+	producer := broker.NewProducer(&config.KafkaProducer{})
+	defer producer.Close()
+
+	ec := &EventClient{
+		ethClient:    mockClient,
+		producer:     producer,
+		poolContract: mockContract,
+		codec:        kafka.JSONCodec{},
+	}
+	require.NoError(t, ec.handleSwapEvent(ctx, &swapLog, config.TradeHistoryTopic))
+
+	// Worker side, the first message of the partition is stored with the offset after it
+	stored := make(chan struct{})
+	db := &storageMock.DB{}
+	db.On("GetConsumerOffsets", mock.Anything, "worker", []string{config.TradeHistoryTopic}).Return([]*models.ConsumerOffset(nil), nil)
+	db.On("CreateTradesWithOffsets", mock.Anything,
+		mock.MatchedBy(func(trades []*models.TradeEvent) bool {
+			return len(trades) == 1 && trades[0].TxHash == swapLog.TxHash.Hex()
+		}),
+		[]*models.ConsumerOffset{{GroupID: "worker", Topic: config.TradeHistoryTopic, Partition: 0, Offset: 1}},
+	).Run(func(mock.Arguments) { close(stored) }).Return(1, nil)
+
+	consumer := broker.NewConsumer(&config.KafkaConsumer{GroupID: "worker", OffsetReset: "earliest", MaxAttempts: 1})
+	defer consumer.Close()
+	consumer.StoreOffsetsIn(db)
+
+	w, err := worker.New(consumer, []string{config.TradeHistoryTopic}, &storageMock.PoolCache{}, db)
+	require.NoError(t, err)
+	go w.Start(ctx)
+
+	select {
+	case <-stored:
+	case <-time.After(5 * time.Second):
+		t.Fatal("trade wasn't stored by the worker")
+	}
+
+	db.AssertExpectations(t)
+	db.AssertNotCalled(t, "CreateTrade", mock.Anything, mock.Anything)
+	db.AssertNotCalled(t, "SetConsumerOffsets", mock.Anything, mock.Anything)
+}
@@ -0,0 +1,65 @@
+package events
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	defaultPollInterval   = 4 * time.Second
+	defaultPollBlockRange = 100
+)
+
+// poll is used instead of a subscription for transports that cannot subscribe
+// (HTTP). After the backfill it fetches new logs with eth_getLogs every
+// pollInterval, in ranges of at most pollBlockRange blocks.
+func (ec *EventClient) poll(ctx context.Context) error {
+	if err := ec.backfill(ctx); err != nil {
+		return fmt.Errorf("failed to backfill events: %w", err)
+	}
+
+	ticker := time.NewTicker(ec.pollInterval)
+	defer ticker.Stop()
+
+	log.Info().Dur("interval", ec.pollInterval).Msgf("polling for events on %d pool(s): %v", len(ec.pools), ec.pools)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			if err := ec.pollLogs(ctx); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// pollLogs publishes the logs of every block produced since the last poll.
+func (ec *EventClient) pollLogs(ctx context.Context) error {
+	head, err := ec.ethClient.BlockNumber(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get current block number: %w", err)
+	}
+
+	from := ec.lastBlock + 1
+	if from > head {
+		// No new blocks, but buffered logs may have been confirmed since
+		if ec.confirmations != nil {
+			return ec.releaseConfirmed(ctx)
+		}
+		return nil
+	}
+
+	// Only live subscriptions overlap the backfill
+	clear(ec.backfilledBlocks)
+
+	if err := ec.processBlockRange(ctx, from, head, ec.pollBlockRange); err != nil {
+		return err
+	}
+	ec.lastBlock = head
+
+	return nil
+}
@@ -0,0 +1,165 @@
+package events
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/murraystewart96/token-swap/internal/config"
+	"github.com/murraystewart96/token-swap/internal/models"
+	storageMock "github.com/murraystewart96/token-swap/internal/storage/mock"
+	ethMock "github.com/murraystewart96/token-swap/pkg/eth/mock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func newPollingClient(ethClient *ethMock.EthClient, db *storageMock.DB, producer *MockProducer, pool *MockPoolContract) *EventClient {
+	ec := newBackfillClient(ethClient, db, producer, pool)
+	ec.pollInterval = time.Millisecond
+	ec.pollBlockRange = 5
+	return ec
+}
+
+func TestPollLogs_FetchesNewBlocksInRanges(t *testing.T) {
+	mockClient := &ethMock.EthClient{}
+	mockDB := &storageMock.DB{}
+	mockProducer := &MockProducer{}
+	mockContract := &MockPoolContract{}
+
+	ec := newPollingClient(mockClient, mockDB, mockProducer, mockContract)
+	ec.checkpoints[testPoolAddr] = 100
+	ec.lastBlock = 100
+
+	syncLog := createSyncLog(108, common.HexToHash("0x108"))
+
+	mockClient.On("BlockNumber", mock.Anything).Return(uint64(112), nil)
+	mockClient.On("FilterLogs", mock.Anything, blockRange(101, 105)).Return(nil, nil).Once()
+	mockClient.On("FilterLogs", mock.Anything, blockRange(106, 110)).Return([]types.Log{syncLog}, nil).Once()
+	mockClient.On("FilterLogs", mock.Anything, blockRange(111, 112)).Return(nil, nil).Once()
+
+	mockDB.On("GetCanonicalBlock", mock.Anything, uint64(108)).Return(&models.Block{Hash: syncLog.BlockHash.Hex()}, nil)
+	expectParseSync(mockContract, syncLog)
+	mockProducer.On("Produce", config.ReserveHistoryTopic, mock.Anything, mock.Anything).Return(nil).Once()
+
+	mockDB.On("SetCheckpoint", mock.Anything, testPoolAddr.Hex(), uint64(105)).Return(nil).Once()
+	mockDB.On("SetCheckpoint", mock.Anything, testPoolAddr.Hex(), uint64(110)).Return(nil).Once()
+	mockDB.On("SetCheckpoint", mock.Anything, testPoolAddr.Hex(), uint64(112)).Return(nil).Once()
+
+	err := ec.pollLogs(t.Context())
+
+	require.NoError(t, err)
+	assert.Equal(t, uint64(112), ec.lastBlock)
+	mockClient.AssertExpectations(t)
+	mockDB.AssertExpectations(t)
+	mockProducer.AssertExpectations(t)
+}
+
+func TestPollLogs_NoNewBlocks(t *testing.T) {
+	mockClient := &ethMock.EthClient{}
+
+	ec := newPollingClient(mockClient, &storageMock.DB{}, &MockProducer{}, &MockPoolContract{})
+	ec.lastBlock = 100
+
+	mockClient.On("BlockNumber", mock.Anything).Return(uint64(100), nil)
+
+	err := ec.pollLogs(t.Context())
+
+	require.NoError(t, err)
+	mockClient.AssertNotCalled(t, "FilterLogs", mock.Anything, mock.Anything)
+}
+
+func TestListen_PollsWhenSubscriptionsUnsupported(t *testing.T) {
+	mockClient := &ethMock.EthClient{}
+	mockDB := &storageMock.DB{}
+
+	ec := newPollingClient(mockClient, mockDB, &MockProducer{}, &MockPoolContract{})
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	mockClient.On("SupportsSubscriptions").Return(false)
+
+	// Backfill finds nothing to do, the first poll picks up block 101
+	mockClient.On("BlockNumber", mock.Anything).Return(uint64(100), nil).Once()
+	mockClient.On("BlockNumber", mock.Anything).Return(uint64(101), nil)
+	mockDB.On("GetCheckpoint", mock.Anything, testPoolAddr.Hex()).Return(uint64(100), true, nil)
+	mockClient.On("FilterLogs", mock.Anything, blockRange(101, 101)).Return(nil, nil)
+	mockDB.On("SetCheckpoint", mock.Anything, testPoolAddr.Hex(), uint64(101)).Return(nil).Run(func(mock.Arguments) {
+		cancel()
+	})
+
+	err := ec.Listen(ctx)
+
+	assert.ErrorIs(t, err, context.Canceled)
+	mockClient.AssertNotCalled(t, "SubscribeFilterLogs", mock.Anything, mock.Anything, mock.Anything)
+	mockDB.AssertExpectations(t)
+}
+
+func TestPollLogs_ReprocessesBlocksReplacedByReorg(t *testing.T) {
+	mockClient := &ethMock.EthClient{}
+	mockDB := &storageMock.DB{}
+	mockProducer := &MockProducer{}
+	mockContract := &MockPoolContract{}
+
+	// Block 101 was polled, then replaced before the next poll
+	ec := newPollingClient(mockClient, mockDB, mockProducer, mockContract)
+	ec.checkpoints[testPoolAddr] = 101
+	ec.lastBlock = 101
+
+	header100 := createTestHeader(100, common.Hash{}, 0)
+	oldHeader101 := createTestHeader(101, header100.Hash(), 0)
+	newHeader101 := createTestHeader(101, header100.Hash(), 1)
+	newHeader102 := createTestHeader(102, newHeader101.Hash(), 1)
+
+	newLog101 := createHeaderSyncLog(newHeader101, 0)
+	newLog102 := createHeaderSyncLog(newHeader102, 1)
+	expectParseSync(mockContract, newLog101)
+	expectParseSync(mockContract, newLog102)
+
+	mockClient.On("BlockNumber", mock.Anything).Return(uint64(102), nil)
+
+	// The log at 102 reveals the reorg, which orphans the polled block 101
+	mockClient.On("FilterLogs", mock.Anything, blockRange(102, 102)).Return([]types.Log{newLog102}, nil).Once()
+	mockDB.On("GetCanonicalBlock", mock.Anything, uint64(102)).Return(nil, nil).Twice()
+	mockDB.On("GetCanonicalBlock", mock.Anything, uint64(101)).Return(blockFromHeader(oldHeader101), nil).Once()
+	mockDB.On("GetCanonicalBlock", mock.Anything, uint64(100)).Return(blockFromHeader(header100), nil).Once()
+	mockClient.On("HeaderByHash", mock.Anything, newHeader102.Hash()).Return(newHeader102, nil)
+	mockClient.On("HeaderByHash", mock.Anything, newHeader101.Hash()).Return(newHeader101, nil)
+	mockDB.On("GetCanonicalBlocksFrom", mock.Anything, uint64(101)).Return([]*models.Block{blockFromHeader(oldHeader101)}, nil)
+	mockProducer.On("Produce", config.ChainReorgTopic, mock.Anything, mock.Anything).Return(nil).Once()
+	mockDB.On("OrphanBlocksFrom", mock.Anything, uint64(101)).Return(nil)
+	mockDB.On("SaveBlocks", mock.Anything, []*models.Block{blockFromHeader(newHeader102), blockFromHeader(newHeader101)}).Return(nil)
+
+	// The checkpoint moves back before the fork and the replacing blocks are fetched again
+	mockDB.On("SetCheckpoint", mock.Anything, testPoolAddr.Hex(), uint64(100)).Return(nil).Once()
+	mockClient.On("FilterLogs", mock.Anything, blockRange(101, 102)).Return([]types.Log{newLog101, newLog102}, nil).Once()
+	mockDB.On("GetCanonicalBlock", mock.Anything, uint64(101)).Return(blockFromHeader(newHeader101), nil)
+	mockDB.On("GetCanonicalBlock", mock.Anything, uint64(102)).Return(blockFromHeader(newHeader102), nil)
+	mockDB.On("SetCheckpoint", mock.Anything, testPoolAddr.Hex(), uint64(102)).Return(nil).Once()
+
+	mockProducer.On("Produce", config.ReserveHistoryTopic, mock.Anything, mock.Anything).Return(nil)
+
+	err := ec.pollLogs(t.Context())
+
+	require.NoError(t, err)
+	assert.Equal(t, uint64(102), ec.lastBlock)
+
+	// The new log at 101 is published
+	var published []uint64
+	for _, message := range mockProducer.GetMessages() {
+		if message.topic != config.ReserveHistoryTopic {
+			continue
+		}
+		var reserveEvent models.ReserveEvent
+		openEvent(t, message, models.EventTypeReserve, &reserveEvent)
+		published = append(published, reserveEvent.BlockNumber)
+	}
+	assert.Contains(t, published, uint64(101))
+
+	mockClient.AssertExpectations(t)
+	mockDB.AssertExpectations(t)
+	mockProducer.AssertExpectations(t)
+}
@@ -2,99 +2,225 @@ package events
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"math"
 	"math/big"
 
-	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/murraystewart96/token-swap/internal/config"
+	"github.com/murraystewart96/token-swap/internal/models"
+	"github.com/rs/zerolog/log"
 )
 
+// Deepest reorg the listener will follow before giving up
+const maxReorgDepth = 128
+
+// ErrNonCanonicalEvent is returned when an event belongs to a block that is no longer on the canonical chain.
+var ErrNonCanonicalEvent = errors.New("event is not on the canonical chain")
+
+// CheckForChainReorg makes sure the block containing the event is part of the
+// stored canonical chain. If it isn't, parent hashes are walked back to the
+// common ancestor with the stored chain, the stored blocks that are no longer
+// canonical are orphaned and a retraction for their events is published.
+//
+// Returns ErrNonCanonicalEvent if the event itself was emitted in an orphaned block.
 func (ec *EventClient) CheckForChainReorg(ctx context.Context, event *types.Log) (bool, error) {
-	// Check if we've seen this block number before
-	if existingHash, seen := ec.recentBlocks[event.BlockNumber]; seen {
-		if existingHash != event.BlockHash {
-			// Conflict detected - query the canonical chain
-			canonicalHash, err := ec.getCanonicalBlockHash(ctx, event.BlockNumber)
-			if err != nil {
-				return false, fmt.Errorf("failed to get canonical hash: %w", err)
+	stored, err := ec.db.GetCanonicalBlock(ctx, event.BlockNumber)
+	if err != nil {
+		return false, fmt.Errorf("failed to get stored block: %w", err)
+	}
+
+	// Already part of the stored canonical chain
+	if stored != nil && stored.Hash == event.BlockHash.Hex() && !event.Removed {
+		return false, nil
+	}
+
+	var header *types.Header
+	if stored == nil && !event.Removed {
+		// First event seen for this block
+		header, err = ec.ethClient.HeaderByHash(ctx, event.BlockHash)
+	} else {
+		// Conflicting hash or removed log - query the canonical chain
+		header, err = ec.ethClient.HeaderByNumber(ctx, new(big.Int).SetUint64(event.BlockNumber))
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to get canonical header: %w", err)
+	}
+	ec.timestamps.Add(header)
+
+	reorg, err := ec.updateCanonicalChain(ctx, header)
+	if err != nil {
+		return reorg, err
+	}
+
+	if event.Removed || header.Hash() != event.BlockHash {
+		return reorg, ErrNonCanonicalEvent
+	}
+
+	return reorg, nil
+}
+
+// updateCanonicalChain stores head as canonical, walking back through its
+// ancestors until one matches the stored chain. Only head and the blocks that
+// replaced stored blocks are stored. Stored blocks that conflict with the new
+// chain are retracted and orphaned; returns whether any were.
+func (ec *EventClient) updateCanonicalChain(ctx context.Context, head *types.Header) (bool, error) {
+	var (
+		newBlocks   []*models.Block
+		orphanFrom  uint64
+		hasConflict bool
+	)
+
+	header := head
+	stored, err := ec.db.GetCanonicalBlock(ctx, header.Number.Uint64())
+	if err != nil {
+		return false, fmt.Errorf("failed to get stored block: %w", err)
+	}
+
+	for {
+		number := header.Number.Uint64()
+		if head.Number.Uint64()-number > maxReorgDepth {
+			return false, fmt.Errorf("reorg deeper than %d blocks at block %d", maxReorgDepth, head.Number.Uint64())
+		}
+
+		if stored != nil {
+			if stored.Hash == header.Hash().Hex() {
+				break
 			}
+			// Stored block at this height was replaced
+			orphanFrom, hasConflict = number, true
+		}
+
+		newBlocks = append(newBlocks, blockFromHeader(header))
+		if number == 0 {
+			break
+		}
 
-			switch canonicalHash {
-			case event.BlockHash:
-				// New event is on canonical chain, old one was reorged
-				err := ec.rollbackFromBlock(event.BlockNumber)
-				if err != nil {
-					return true, err
-				}
-				ec.addBlock(event.BlockNumber, event.BlockHash)
-
-				return true, nil
-			case existingHash:
-				// Existing hash is canoniacal, ignore this event
-				return false, nil
-			default:
-				// Neither hash matches canonical - both were reorged
-				err := ec.rollbackFromBlock(event.BlockNumber)
-				if err != nil {
-					return true, err
-				}
-				ec.addBlock(event.BlockNumber, canonicalHash)
-
-				return true, nil
+		// Common ancestor found when the stored parent matches
+		stored, err = ec.db.GetCanonicalBlock(ctx, number-1)
+		if err != nil {
+			return false, fmt.Errorf("failed to get stored block: %w", err)
+		}
+		if stored != nil {
+			if stored.Hash == header.ParentHash.Hex() {
+				break
+			}
+			header, err = ec.ethClient.HeaderByHash(ctx, header.ParentHash)
+			if err != nil {
+				return false, fmt.Errorf("failed to get parent header: %w", err)
 			}
+			continue
+		}
+
+		// Only blocks with pool logs are stored, so a stored block further
+		// down may still have been replaced. It is compared with the canonical
+		// chain, and walked back from only if it was, unless nothing is stored
+		// within the deepest reorg followed.
+		stored, err = ec.db.GetLatestCanonicalBlockBelow(ctx, number)
+		if err != nil {
+			return false, fmt.Errorf("failed to get stored block: %w", err)
+		}
+		if stored == nil || head.Number.Uint64()-stored.Number > maxReorgDepth {
+			break
+		}
+
+		header, err = ec.ethClient.HeaderByNumber(ctx, new(big.Int).SetUint64(stored.Number))
+		if err != nil {
+			return false, fmt.Errorf("failed to get canonical header: %w", err)
+		}
+	}
+
+	// A stored child that doesn't build on the new head is orphaned too
+	if !hasConflict {
+		child, err := ec.db.GetCanonicalBlock(ctx, head.Number.Uint64()+1)
+		if err != nil {
+			return false, fmt.Errorf("failed to get stored block: %w", err)
+		}
+		if child != nil && child.ParentHash != head.Hash().Hex() {
+			orphanFrom, hasConflict = child.Number, true
 		}
 	}
 
-	// Mark block as seen with given hash
-	ec.addBlock(event.BlockNumber, event.BlockHash)
+	if hasConflict {
+		orphaned, err := ec.db.GetCanonicalBlocksFrom(ctx, orphanFrom)
+		if err != nil {
+			return true, fmt.Errorf("failed to get stored blocks: %w", err)
+		}
 
-	return false, nil
-}
+		// Published before the block store is updated so a failed publish is retried
+		if err := ec.publishReorg(ctx, head, orphaned); err != nil {
+			return true, err
+		}
 
-// rollbackFromBlock removes events from potentially false chain.
-// NOTE: Current implementation has limitation with out-of-order event delivery
-// during reorgs - may delete valid canonical events if higher block numbers
-// arrive first. Production system would need to track canonical status.
-func (ec *EventClient) rollbackFromBlock(blockNumber uint64) error {
-	// Delete all events >= this block number (they're on false chain)
-	err := ec.db.RollbackEvents(blockNumber)
-	if err != nil {
-		return err
+		if err := ec.db.OrphanBlocksFrom(ctx, orphanFrom); err != nil {
+			return true, fmt.Errorf("failed to orphan blocks: %w", err)
+		}
+
+		if ec.reorgFork == nil || orphanFrom < *ec.reorgFork {
+			ec.reorgFork = &orphanFrom
+		}
 	}
 
-	// Also clear invalid blocks from cache
-	for blockNum := range ec.recentBlocks {
-		if blockNum >= blockNumber {
-			delete(ec.recentBlocks, blockNum)
+	if len(newBlocks) > 0 {
+		if err := ec.db.SaveBlocks(ctx, newBlocks); err != nil {
+			return hasConflict, fmt.Errorf("failed to save canonical blocks: %w", err)
 		}
 	}
 
-	return nil
+	return hasConflict, nil
 }
 
-func (ec *EventClient) getCanonicalBlockHash(ctx context.Context, blockNum uint64) (common.Hash, error) {
-	block, err := ec.ethClient.BlockByNumber(ctx, big.NewInt(int64(blockNum)))
+// publishReorg emits a retraction for the events emitted in orphaned blocks.
+// The worker marks them orphaned and recomputes the cached pool state.
+func (ec *EventClient) publishReorg(ctx context.Context, head *types.Header, orphaned []*models.Block) error {
+	reorgEvent := models.ReorgEvent{
+		PoolAddresses:  make([]string, 0, len(ec.pools)),
+		ForkBlock:      orphaned[0].Number,
+		OrphanedBlocks: make([]string, 0, len(orphaned)),
+		NewHeadNumber:  head.Number.Uint64(),
+		NewHeadHash:    head.Hash().Hex(),
+	}
+	for _, pool := range ec.pools {
+		reorgEvent.PoolAddresses = append(reorgEvent.PoolAddresses, pool.Hex())
+	}
+	for _, block := range orphaned {
+		reorgEvent.OrphanedBlocks = append(reorgEvent.OrphanedBlocks, block.Hash)
+	}
+
+	envelope := models.NewEnvelope(models.EventTypeReorg, models.ReorgEventVersion)
+
+	// A reorg affects the whole chain, so its source is the chain (CAIP-2 id)
+	// rather than a pool
+	envelope.ID = fmt.Sprintf("reorg:%s:%d", reorgEvent.NewHeadHash, reorgEvent.ForkBlock)
+	envelope.Source = fmt.Sprintf("eip155:%d", ec.chainID)
+	envelope.ChainID = ec.chainID
+	envelope.BlockHash = reorgEvent.NewHeadHash
+
+	value, headers, err := ec.encode(envelope, reorgEvent)
 	if err != nil {
-		return common.Hash{}, err
+		return fmt.Errorf("failed to marshal reorg event: %w", err)
 	}
-	return block.Hash(), nil
+
+	log.Info().
+		Uint64("fork_block", reorgEvent.ForkBlock).
+		Strs("block_hashes", reorgEvent.OrphanedBlocks).
+		Str("topic", config.ChainReorgTopic).
+		Msg("publishing reorg retraction")
+
+	_, err = ec.producer.Produce(ctx, config.ChainReorgTopic, []byte(reorgEvent.NewHeadHash), value, headers...)
+	if err != nil {
+		return fmt.Errorf("failed to produce reorg event: %w", err)
+	}
+
+	return nil
 }
 
-// Adds block to recent blocks (keeps recent blocks lenght to MAX_RECENT_BLOCKS)
-func (ec *EventClient) addBlock(num uint64, hash common.Hash) {
-	ec.recentBlocks[num] = hash
-
-	// Remove oldest block
-	// In production we would use LRU cache instead of this logic
-	if len(ec.recentBlocks) > MAX_RECENT_BLOCKS {
-		// Find and remove the oldest block
-		var oldest uint64 = math.MaxUint64
-		for blockNum := range ec.recentBlocks {
-			if blockNum < oldest {
-				oldest = blockNum
-			}
-		}
-		delete(ec.recentBlocks, oldest)
+func blockFromHeader(header *types.Header) *models.Block {
+	return &models.Block{
+		Number:     header.Number.Uint64(),
+		Hash:       header.Hash().Hex(),
+		ParentHash: header.ParentHash.Hex(),
+		Timestamp:  int64(header.Time),
+		Status:     models.BlockStatusCanonical,
 	}
 }
@@ -1,16 +1,19 @@
 package events
 
 import (
-	"fmt"
 	"math/big"
 	"testing"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/murraystewart96/token-swap/internal/config"
+	"github.com/murraystewart96/token-swap/internal/models"
 	storageMock "github.com/murraystewart96/token-swap/internal/storage/mock"
+	"github.com/murraystewart96/token-swap/pkg/eth"
 	ethMock "github.com/murraystewart96/token-swap/pkg/eth/mock"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 )
 
 // Helper to create test event
@@ -22,30 +25,58 @@ func createTestEvent(blockNumber uint64, blockHash common.Hash) *types.Log {
 	}
 }
 
-// Helper to create test block - we'll create different blocks that naturally have different hashes
-func createTestBlock(blockNumber uint64, blockHash common.Hash) *types.Block {
-	// Create headers with different content to get different hashes
-	header := &types.Header{
+// Helper to create test headers - the fork byte gives blocks at the same height on different forks different hashes
+func createTestHeader(blockNumber uint64, parentHash common.Hash, fork byte) *types.Header {
+	return &types.Header{
 		Number:     big.NewInt(int64(blockNumber)),
-		ParentHash: blockHash,             // Use the desired hash as parent hash to make blocks different
-		GasLimit:   uint64(blockHash[31]), // Use last byte of hash as gas limit for uniqueness
+		ParentHash: parentHash,
+		Time:       1700000000 + blockNumber,
+		Extra:      []byte{fork},
+	}
+}
+
+func newReorgClient(mockClient *ethMock.EthClient, mockDB *storageMock.DB, mockProducer *MockProducer) *EventClient {
+	return &EventClient{
+		ethClient:  mockClient,
+		pools:      []common.Address{testPoolAddr},
+		timestamps: eth.NewTimestampResolver(mockClient, 16),
+		producer:   mockProducer,
+		db:         mockDB,
+	}
+}
+
+// Expects a reorg retraction to be published and returns a check for its contents
+func expectReorgPublished(mockProducer *MockProducer, err error) func(t *testing.T, forkBlock uint64, orphanedHashes ...string) {
+	mockProducer.On("Produce", config.ChainReorgTopic, mock.Anything, mock.Anything).Return(err)
+
+	return func(t *testing.T, forkBlock uint64, orphanedHashes ...string) {
+		messages := mockProducer.GetMessages()
+		require.Len(t, messages, 1)
+
+		var reorgEvent models.ReorgEvent
+		openEvent(t, messages[0], models.EventTypeReorg, &reorgEvent)
+		assert.Equal(t, []string{testPoolAddr.Hex()}, reorgEvent.PoolAddresses)
+		assert.Equal(t, forkBlock, reorgEvent.ForkBlock)
+		assert.Equal(t, orphanedHashes, reorgEvent.OrphanedBlocks)
 	}
-	return types.NewBlockWithHeader(header)
 }
 
 func TestCheckForChainReorg_NoConflict_FirstTimeSeeingBlock(t *testing.T) {
 	// Setup
 	mockClient := &ethMock.EthClient{}
 	mockDB := &storageMock.DB{}
+	mockProducer := &MockProducer{}
+	ec := newReorgClient(mockClient, mockDB, mockProducer)
 
-	ec := &EventClient{
-		ethClient:    mockClient,
-		db:           mockDB,
-		recentBlocks: make(map[uint64]common.Hash),
-	}
+	header99 := createTestHeader(99, common.Hash{}, 0)
+	header100 := createTestHeader(100, header99.Hash(), 0)
+	event := createTestEvent(100, header100.Hash())
 
-	blockHash := common.HexToHash("0xa1b2c3d4e5f6789012345678901234567890abcdef1234567890abcdef123456")
-	event := createTestEvent(100, blockHash)
+	mockDB.On("GetCanonicalBlock", mock.Anything, uint64(100)).Return(nil, nil)
+	mockDB.On("GetCanonicalBlock", mock.Anything, uint64(99)).Return(blockFromHeader(header99), nil)
+	mockDB.On("GetCanonicalBlock", mock.Anything, uint64(101)).Return(nil, nil)
+	mockClient.On("HeaderByHash", mock.Anything, header100.Hash()).Return(header100, nil)
+	mockDB.On("SaveBlocks", mock.Anything, []*models.Block{blockFromHeader(header100)}).Return(nil)
 
 	// Execute
 	reorg, err := ec.CheckForChainReorg(t.Context(), event)
@@ -53,28 +84,25 @@ func TestCheckForChainReorg_NoConflict_FirstTimeSeeingBlock(t *testing.T) {
 	// Assert
 	assert.NoError(t, err)
 	assert.False(t, reorg)
-	assert.Equal(t, blockHash, ec.recentBlocks[100])
 
-	// Verify no external calls were made
-	mockClient.AssertNotCalled(t, "BlockByNumber")
-	mockDB.AssertNotCalled(t, "RollbackEvents")
+	mockClient.AssertExpectations(t)
+	mockDB.AssertExpectations(t)
+	mockDB.AssertNotCalled(t, "OrphanBlocksFrom", mock.Anything, mock.Anything)
+	mockProducer.AssertNotCalled(t, "Produce", mock.Anything, mock.Anything, mock.Anything)
 }
 
 func TestCheckForChainReorg_NoConflict_SameHashAsStored(t *testing.T) {
 	// Setup
 	mockClient := &ethMock.EthClient{}
 	mockDB := &storageMock.DB{}
+	mockProducer := &MockProducer{}
+	ec := newReorgClient(mockClient, mockDB, mockProducer)
 
-	blockHash := common.HexToHash("0xa1b2c3d4e5f6789012345678901234567890abcdef1234567890abcdef123456")
-	ec := &EventClient{
-		ethClient: mockClient,
-		db:        mockDB,
-		recentBlocks: map[uint64]common.Hash{
-			100: blockHash, // Already seen this block with same hash
-		},
-	}
+	header100 := createTestHeader(100, common.Hash{}, 0)
+	event := createTestEvent(100, header100.Hash())
 
-	event := createTestEvent(100, blockHash)
+	// Already seen this block with same hash
+	mockDB.On("GetCanonicalBlock", mock.Anything, uint64(100)).Return(blockFromHeader(header100), nil)
 
 	// Execute
 	reorg, err := ec.CheckForChainReorg(t.Context(), event)
@@ -84,37 +112,39 @@ func TestCheckForChainReorg_NoConflict_SameHashAsStored(t *testing.T) {
 	assert.False(t, reorg)
 
 	// Verify no external calls were made
-	mockClient.AssertNotCalled(t, "BlockByNumber")
-	mockDB.AssertNotCalled(t, "RollbackEvents")
+	mockClient.AssertNotCalled(t, "HeaderByHash", mock.Anything, mock.Anything)
+	mockClient.AssertNotCalled(t, "HeaderByNumber", mock.Anything, mock.Anything)
+	mockDB.AssertNotCalled(t, "SaveBlocks", mock.Anything, mock.Anything)
 }
 
 func TestCheckForChainReorg_DetectsReorg_NewEventIsCanonical(t *testing.T) {
 	// Setup
 	mockClient := &ethMock.EthClient{}
 	mockDB := &storageMock.DB{}
+	mockProducer := &MockProducer{}
+	ec := newReorgClient(mockClient, mockDB, mockProducer)
 
-	oldHash := common.HexToHash("0x0000000000000000000000000000000000000000000000000000000000000123")
-	newHash := common.HexToHash("0x0000000000000000000000000000000000000000000000000000000000000456")
+	header99 := createTestHeader(99, common.Hash{}, 0)
+	oldHeader100 := createTestHeader(100, header99.Hash(), 0)
+	oldHeader101 := createTestHeader(101, oldHeader100.Hash(), 0)
+	newHeader100 := createTestHeader(100, header99.Hash(), 1)
 
-	ec := &EventClient{
-		ethClient: mockClient,
-		db:        mockDB,
-		recentBlocks: map[uint64]common.Hash{
-			100: oldHash, // We've seen block 100 with different hash
-		},
-	}
+	event := createTestEvent(100, newHeader100.Hash())
 
-	// Mock canonical chain first to get the canonical hash
-	canonicalBlock := createTestBlock(100, newHash)
-	canonicalHash := canonicalBlock.Hash() // Get the actual computed hash
+	// We've stored block 100 with a different hash
+	mockDB.On("GetCanonicalBlock", mock.Anything, uint64(100)).Return(blockFromHeader(oldHeader100), nil)
+	mockDB.On("GetCanonicalBlock", mock.Anything, uint64(99)).Return(blockFromHeader(header99), nil)
 
-	// Create event that matches the canonical hash (new event is canonical)
-	event := createTestEvent(100, canonicalHash)
+	// Canonical chain has the new block
+	mockClient.On("HeaderByNumber", mock.Anything, big.NewInt(100)).Return(newHeader100, nil)
 
-	mockClient.On("BlockByNumber", mock.Anything, big.NewInt(100)).Return(canonicalBlock, nil)
+	orphaned := []*models.Block{blockFromHeader(oldHeader100), blockFromHeader(oldHeader101)}
+	mockDB.On("GetCanonicalBlocksFrom", mock.Anything, uint64(100)).Return(orphaned, nil)
+	mockDB.On("OrphanBlocksFrom", mock.Anything, uint64(100)).Return(nil)
+	mockDB.On("SaveBlocks", mock.Anything, []*models.Block{blockFromHeader(newHeader100)}).Return(nil)
 
-	// Mock successful database rollback
-	mockDB.On("RollbackEvents", uint64(100)).Return(nil)
+	// Only the orphaned blocks' events are retracted
+	assertReorg := expectReorgPublished(mockProducer, nil)
 
 	// Execute
 	reorg, err := ec.CheckForChainReorg(t.Context(), event)
@@ -122,7 +152,7 @@ func TestCheckForChainReorg_DetectsReorg_NewEventIsCanonical(t *testing.T) {
 	// Assert
 	assert.NoError(t, err)
 	assert.True(t, reorg)
-	assert.Equal(t, canonicalHash, ec.recentBlocks[100]) // Should update to canonical hash
+	assertReorg(t, 100, oldHeader100.Hash().Hex(), oldHeader101.Hash().Hex())
 
 	// Verify external calls
 	mockClient.AssertExpectations(t)
@@ -133,65 +163,63 @@ func TestCheckForChainReorg_DetectsReorg_ExistingEventIsCanonical(t *testing.T)
 	// Setup
 	mockClient := &ethMock.EthClient{}
 	mockDB := &storageMock.DB{}
+	mockProducer := &MockProducer{}
+	ec := newReorgClient(mockClient, mockDB, mockProducer)
 
-	// Create canonical block first to get the actual canonical hash
-	canonicalBlock := createTestBlock(100, common.Hash{1}) // Some dummy hash for creating different blocks
-	canonicalHash := canonicalBlock.Hash()                 // Get the actual computed hash
+	canonicalHeader := createTestHeader(100, common.Hash{}, 0)
 	nonCanonicalHash := common.HexToHash("0xbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb")
 
-	ec := &EventClient{
-		ethClient: mockClient,
-		db:        mockDB,
-		recentBlocks: map[uint64]common.Hash{
-			100: canonicalHash, // We've seen canonical block with the actual hash
-		},
-	}
-
 	// New event has different hash (non-canonical)
 	event := createTestEvent(100, nonCanonicalHash)
 
+	mockDB.On("GetCanonicalBlock", mock.Anything, uint64(100)).Return(blockFromHeader(canonicalHeader), nil)
+	mockDB.On("GetCanonicalBlock", mock.Anything, uint64(101)).Return(nil, nil)
+
 	// Mock canonical chain returning the existing hash (existing is canonical)
-	mockClient.On("BlockByNumber", mock.Anything, big.NewInt(100)).Return(canonicalBlock, nil)
+	mockClient.On("HeaderByNumber", mock.Anything, big.NewInt(100)).Return(canonicalHeader, nil)
 
 	// Execute
 	reorg, err := ec.CheckForChainReorg(t.Context(), event)
 
 	// Assert
-	assert.NoError(t, err)
-	assert.False(t, reorg)                               // No reorg action taken
-	assert.Equal(t, canonicalHash, ec.recentBlocks[100]) // Should keep existing hash
+	assert.ErrorIs(t, err, ErrNonCanonicalEvent)
+	assert.False(t, reorg) // No reorg action taken
 
-	// Verify no database rollback occurred
+	// Verify no retraction was published
 	mockClient.AssertExpectations(t)
-	mockDB.AssertNotCalled(t, "RollbackEvents")
+	mockDB.AssertNotCalled(t, "OrphanBlocksFrom", mock.Anything, mock.Anything)
+	mockDB.AssertNotCalled(t, "SaveBlocks", mock.Anything, mock.Anything)
+	mockProducer.AssertNotCalled(t, "Produce", mock.Anything, mock.Anything, mock.Anything)
 }
 
-func TestCheckForChainReorg_DetectsReorg_BothEventsNonCanonical(t *testing.T) {
+func TestCheckForChainReorg_DetectsReorg_WalksBackToCommonAncestor(t *testing.T) {
 	// Setup
 	mockClient := &ethMock.EthClient{}
 	mockDB := &storageMock.DB{}
+	mockProducer := &MockProducer{}
+	ec := newReorgClient(mockClient, mockDB, mockProducer)
 
-	oldHash := common.HexToHash("0x0000000000000000000000000000000000000000000000000000000000000123")
-	newHash := common.HexToHash("0x0000000000000000000000000000000000000000000000000000000000000456")
-	canonicalHash := common.HexToHash("0xcccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccc")
-
-	ec := &EventClient{
-		ethClient: mockClient,
-		db:        mockDB,
-		recentBlocks: map[uint64]common.Hash{
-			100: oldHash,
-		},
-	}
+	header98 := createTestHeader(98, common.Hash{}, 0)
+	oldHeader99 := createTestHeader(99, header98.Hash(), 0)
+	oldHeader100 := createTestHeader(100, oldHeader99.Hash(), 0)
+	newHeader99 := createTestHeader(99, header98.Hash(), 1)
+	newHeader100 := createTestHeader(100, newHeader99.Hash(), 1)
 
-	event := createTestEvent(100, newHash)
+	event := createTestEvent(100, newHeader100.Hash())
 
-	// Mock canonical chain returning completely different hash
-	canonicalBlock := createTestBlock(100, canonicalHash)
-	actualCanonicalHash := canonicalBlock.Hash() // Get the actual computed hash
-	mockClient.On("BlockByNumber", mock.Anything, big.NewInt(100)).Return(canonicalBlock, nil)
+	mockDB.On("GetCanonicalBlock", mock.Anything, uint64(100)).Return(blockFromHeader(oldHeader100), nil)
+	mockDB.On("GetCanonicalBlock", mock.Anything, uint64(99)).Return(blockFromHeader(oldHeader99), nil)
+	mockDB.On("GetCanonicalBlock", mock.Anything, uint64(98)).Return(blockFromHeader(header98), nil)
 
-	// Mock successful database rollback
-	mockDB.On("RollbackEvents", uint64(100)).Return(nil)
+	mockClient.On("HeaderByNumber", mock.Anything, big.NewInt(100)).Return(newHeader100, nil)
+	mockClient.On("HeaderByHash", mock.Anything, newHeader99.Hash()).Return(newHeader99, nil)
+
+	// Block 98 is the common ancestor, everything above it is replaced
+	orphaned := []*models.Block{blockFromHeader(oldHeader99), blockFromHeader(oldHeader100)}
+	mockDB.On("GetCanonicalBlocksFrom", mock.Anything, uint64(99)).Return(orphaned, nil)
+	mockDB.On("OrphanBlocksFrom", mock.Anything, uint64(99)).Return(nil)
+	mockDB.On("SaveBlocks", mock.Anything, []*models.Block{blockFromHeader(newHeader100), blockFromHeader(newHeader99)}).Return(nil)
+	assertReorg := expectReorgPublished(mockProducer, nil)
 
 	// Execute
 	reorg, err := ec.CheckForChainReorg(t.Context(), event)
@@ -199,106 +227,252 @@ func TestCheckForChainReorg_DetectsReorg_BothEventsNonCanonical(t *testing.T) {
 	// Assert
 	assert.NoError(t, err)
 	assert.True(t, reorg)
-	assert.Equal(t, actualCanonicalHash, ec.recentBlocks[100]) // Should update to canonical hash
+	assertReorg(t, 99, oldHeader99.Hash().Hex(), oldHeader100.Hash().Hex())
 
 	mockClient.AssertExpectations(t)
 	mockDB.AssertExpectations(t)
 }
 
-func TestCheckForChainReorg_RollbackDatabaseError(t *testing.T) {
+func TestCheckForChainReorg_DetectsReorg_WalksPastUnstoredBlocks(t *testing.T) {
 	// Setup
 	mockClient := &ethMock.EthClient{}
 	mockDB := &storageMock.DB{}
+	mockProducer := &MockProducer{}
+	ec := newReorgClient(mockClient, mockDB, mockProducer)
+
+	header99 := createTestHeader(99, common.Hash{}, 0)
+	oldHeader100 := createTestHeader(100, header99.Hash(), 0)
+	newHeader100 := createTestHeader(100, header99.Hash(), 1)
+	newHeader101 := createTestHeader(101, newHeader100.Hash(), 1)
+	newHeader102 := createTestHeader(102, newHeader101.Hash(), 1)
+
+	event := createTestEvent(102, newHeader102.Hash())
+
+	// Block 101 had no pool logs, so the replaced block 100 isn't the stored parent
+	mockDB.On("GetCanonicalBlock", mock.Anything, uint64(102)).Return(nil, nil)
+	mockDB.On("GetCanonicalBlock", mock.Anything, uint64(101)).Return(nil, nil)
+	mockDB.On("GetCanonicalBlock", mock.Anything, uint64(99)).Return(blockFromHeader(header99), nil)
+	mockDB.On("GetLatestCanonicalBlockBelow", mock.Anything, uint64(102)).Return(blockFromHeader(oldHeader100), nil)
+
+	// The stored block is compared with the canonical chain, without fetching the blocks in between
+	mockClient.On("HeaderByHash", mock.Anything, newHeader102.Hash()).Return(newHeader102, nil)
+	mockClient.On("HeaderByNumber", mock.Anything, big.NewInt(100)).Return(newHeader100, nil)
+
+	// Only the head and the block that replaced a stored one are stored
+	orphaned := []*models.Block{blockFromHeader(oldHeader100)}
+	mockDB.On("GetCanonicalBlocksFrom", mock.Anything, uint64(100)).Return(orphaned, nil)
+	mockDB.On("OrphanBlocksFrom", mock.Anything, uint64(100)).Return(nil)
+	mockDB.On("SaveBlocks", mock.Anything, []*models.Block{
+		blockFromHeader(newHeader102), blockFromHeader(newHeader100),
+	}).Return(nil)
+	assertReorg := expectReorgPublished(mockProducer, nil)
 
-	oldHash := common.HexToHash("0x0000000000000000000000000000000000000000000000000000000000000123")
-	newHash := common.HexToHash("0x0000000000000000000000000000000000000000000000000000000000000456")
+	// Execute
+	reorg, err := ec.CheckForChainReorg(t.Context(), event)
 
-	ec := &EventClient{
-		ethClient: mockClient,
-		db:        mockDB,
-		recentBlocks: map[uint64]common.Hash{
-			100: oldHash,
-		},
-	}
+	// Assert
+	assert.NoError(t, err)
+	assert.True(t, reorg)
+	assertReorg(t, 100, oldHeader100.Hash().Hex())
 
-	event := createTestEvent(100, newHash)
+	mockClient.AssertExpectations(t)
+	mockDB.AssertExpectations(t)
+	mockClient.AssertNotCalled(t, "HeaderByHash", mock.Anything, newHeader101.Hash())
+}
 
-	// Mock canonical chain returning new hash
-	canonicalBlock := createTestBlock(100, newHash)
-	mockClient.On("BlockByNumber", mock.Anything, big.NewInt(100)).Return(canonicalBlock, nil)
+func TestCheckForChainReorg_NoConflict_StoredBlockBelowIsCanonical(t *testing.T) {
+	// Setup
+	mockClient := &ethMock.EthClient{}
+	mockDB := &storageMock.DB{}
+	mockProducer := &MockProducer{}
+	ec := newReorgClient(mockClient, mockDB, mockProducer)
+
+	header100 := createTestHeader(100, common.Hash{}, 0)
+	header110 := createTestHeader(110, common.HexToHash("0x109"), 0)
+	event := createTestEvent(110, header110.Hash())
+
+	// The nearest stored block is still canonical, so the gap isn't walked
+	mockDB.On("GetCanonicalBlock", mock.Anything, uint64(110)).Return(nil, nil)
+	mockDB.On("GetCanonicalBlock", mock.Anything, uint64(109)).Return(nil, nil)
+	mockDB.On("GetCanonicalBlock", mock.Anything, uint64(111)).Return(nil, nil)
+	mockDB.On("GetLatestCanonicalBlockBelow", mock.Anything, uint64(110)).Return(blockFromHeader(header100), nil).Once()
+	mockClient.On("HeaderByHash", mock.Anything, header110.Hash()).Return(header110, nil).Once()
+	mockClient.On("HeaderByNumber", mock.Anything, big.NewInt(100)).Return(header100, nil).Once()
+	mockDB.On("SaveBlocks", mock.Anything, []*models.Block{blockFromHeader(header110)}).Return(nil)
 
-	// Mock database rollback failure
-	mockDB.On("RollbackEvents", uint64(100)).Return(assert.AnError)
+	// Execute
+	reorg, err := ec.CheckForChainReorg(t.Context(), event)
+
+	// Assert
+	assert.NoError(t, err)
+	assert.False(t, reorg)
+
+	mockClient.AssertExpectations(t)
+	mockDB.AssertExpectations(t)
+	mockProducer.AssertNotCalled(t, "Produce", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestCheckForChainReorg_NoConflict_StoredBlockBeyondReorgDepth(t *testing.T) {
+	// Setup
+	mockClient := &ethMock.EthClient{}
+	mockDB := &storageMock.DB{}
+	mockProducer := &MockProducer{}
+	ec := newReorgClient(mockClient, mockDB, mockProducer)
+
+	header500 := createTestHeader(500, common.HexToHash("0x499"), 0)
+	event := createTestEvent(500, header500.Hash())
+
+	// The nearest stored block is too deep to be reorged, so the gap isn't walked
+	mockDB.On("GetCanonicalBlock", mock.Anything, uint64(500)).Return(nil, nil)
+	mockDB.On("GetCanonicalBlock", mock.Anything, uint64(499)).Return(nil, nil)
+	mockDB.On("GetCanonicalBlock", mock.Anything, uint64(501)).Return(nil, nil)
+	mockDB.On("GetLatestCanonicalBlockBelow", mock.Anything, uint64(500)).Return(&models.Block{Number: 100, Hash: "0x100"}, nil)
+	mockClient.On("HeaderByHash", mock.Anything, header500.Hash()).Return(header500, nil)
+	mockDB.On("SaveBlocks", mock.Anything, []*models.Block{blockFromHeader(header500)}).Return(nil)
 
 	// Execute
 	reorg, err := ec.CheckForChainReorg(t.Context(), event)
 
 	// Assert
-	assert.Error(t, err)
+	assert.NoError(t, err)
+	assert.False(t, reorg)
+
+	mockClient.AssertExpectations(t)
+	mockDB.AssertExpectations(t)
+	mockProducer.AssertNotCalled(t, "Produce", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestCheckForChainReorg_RemovedLogTriggersReorg(t *testing.T) {
+	// Setup
+	mockClient := &ethMock.EthClient{}
+	mockDB := &storageMock.DB{}
+	mockProducer := &MockProducer{}
+	ec := newReorgClient(mockClient, mockDB, mockProducer)
+
+	header99 := createTestHeader(99, common.Hash{}, 0)
+	oldHeader100 := createTestHeader(100, header99.Hash(), 0)
+	newHeader100 := createTestHeader(100, header99.Hash(), 1)
+
+	// Node tells us the log from the stored block was removed
+	event := createTestEvent(100, oldHeader100.Hash())
+	event.Removed = true
+
+	mockDB.On("GetCanonicalBlock", mock.Anything, uint64(100)).Return(blockFromHeader(oldHeader100), nil)
+	mockDB.On("GetCanonicalBlock", mock.Anything, uint64(99)).Return(blockFromHeader(header99), nil)
+	mockClient.On("HeaderByNumber", mock.Anything, big.NewInt(100)).Return(newHeader100, nil)
+	mockDB.On("GetCanonicalBlocksFrom", mock.Anything, uint64(100)).Return([]*models.Block{blockFromHeader(oldHeader100)}, nil)
+	mockDB.On("OrphanBlocksFrom", mock.Anything, uint64(100)).Return(nil)
+	mockDB.On("SaveBlocks", mock.Anything, []*models.Block{blockFromHeader(newHeader100)}).Return(nil)
+	assertReorg := expectReorgPublished(mockProducer, nil)
+
+	// Execute
+	reorg, err := ec.CheckForChainReorg(t.Context(), event)
+
+	// Assert - the removed log itself must not be published
+	assert.ErrorIs(t, err, ErrNonCanonicalEvent)
 	assert.True(t, reorg)
+	assertReorg(t, 100, oldHeader100.Hash().Hex())
 
 	mockClient.AssertExpectations(t)
 	mockDB.AssertExpectations(t)
 }
 
-func TestCheckForChainReorg_CanonicalChainQueryError(t *testing.T) {
+func TestCheckForChainReorg_OrphansStoredChildOfReplacedBlock(t *testing.T) {
 	// Setup
 	mockClient := &ethMock.EthClient{}
 	mockDB := &storageMock.DB{}
+	mockProducer := &MockProducer{}
+	ec := newReorgClient(mockClient, mockDB, mockProducer)
+
+	header99 := createTestHeader(99, common.Hash{}, 0)
+	oldHeader100 := createTestHeader(100, header99.Hash(), 0)
+	oldHeader101 := createTestHeader(101, oldHeader100.Hash(), 0)
+	newHeader100 := createTestHeader(100, header99.Hash(), 1)
+
+	// Block 100 was never stored but its (old) child was
+	event := createTestEvent(100, newHeader100.Hash())
+
+	mockDB.On("GetCanonicalBlock", mock.Anything, uint64(100)).Return(nil, nil)
+	mockDB.On("GetCanonicalBlock", mock.Anything, uint64(99)).Return(blockFromHeader(header99), nil)
+	mockDB.On("GetCanonicalBlock", mock.Anything, uint64(101)).Return(blockFromHeader(oldHeader101), nil)
+	mockClient.On("HeaderByHash", mock.Anything, newHeader100.Hash()).Return(newHeader100, nil)
+	mockDB.On("GetCanonicalBlocksFrom", mock.Anything, uint64(101)).Return([]*models.Block{blockFromHeader(oldHeader101)}, nil)
+	mockDB.On("OrphanBlocksFrom", mock.Anything, uint64(101)).Return(nil)
+	mockDB.On("SaveBlocks", mock.Anything, []*models.Block{blockFromHeader(newHeader100)}).Return(nil)
+	assertReorg := expectReorgPublished(mockProducer, nil)
 
-	oldHash := common.HexToHash("0x0000000000000000000000000000000000000000000000000000000000000123")
-	newHash := common.HexToHash("0x0000000000000000000000000000000000000000000000000000000000000456")
+	// Execute
+	reorg, err := ec.CheckForChainReorg(t.Context(), event)
 
-	ec := &EventClient{
-		ethClient: mockClient,
-		db:        mockDB,
-		recentBlocks: map[uint64]common.Hash{
-			100: oldHash,
-		},
-	}
+	// Assert
+	assert.NoError(t, err)
+	assert.True(t, reorg)
+	assertReorg(t, 101, oldHeader101.Hash().Hex())
 
-	event := createTestEvent(100, newHash)
+	mockClient.AssertExpectations(t)
+	mockDB.AssertExpectations(t)
+}
 
-	// Mock canonical chain query failure
-	mockClient.On("BlockByNumber", mock.Anything, big.NewInt(100)).Return(nil, assert.AnError)
+func TestCheckForChainReorg_PublishReorgError(t *testing.T) {
+	// Setup
+	mockClient := &ethMock.EthClient{}
+	mockDB := &storageMock.DB{}
+	mockProducer := &MockProducer{}
+	ec := newReorgClient(mockClient, mockDB, mockProducer)
+
+	header99 := createTestHeader(99, common.Hash{}, 0)
+	oldHeader100 := createTestHeader(100, header99.Hash(), 0)
+	newHeader100 := createTestHeader(100, header99.Hash(), 1)
+
+	event := createTestEvent(100, newHeader100.Hash())
+
+	mockDB.On("GetCanonicalBlock", mock.Anything, uint64(100)).Return(blockFromHeader(oldHeader100), nil)
+	mockDB.On("GetCanonicalBlock", mock.Anything, uint64(99)).Return(blockFromHeader(header99), nil)
+	mockClient.On("HeaderByNumber", mock.Anything, big.NewInt(100)).Return(newHeader100, nil)
+	mockDB.On("GetCanonicalBlocksFrom", mock.Anything, uint64(100)).Return([]*models.Block{blockFromHeader(oldHeader100)}, nil)
+
+	// Mock retraction publish failure
+	expectReorgPublished(mockProducer, assert.AnError)
 
 	// Execute
 	reorg, err := ec.CheckForChainReorg(t.Context(), event)
 
 	// Assert
 	assert.Error(t, err)
-	assert.False(t, reorg)
-	assert.Contains(t, err.Error(), "failed to get canonical hash")
+	assert.True(t, reorg)
 
+	// The block store is left untouched so the reorg is detected again on retry
 	mockClient.AssertExpectations(t)
-	mockDB.AssertNotCalled(t, "RollbackEvents")
+	mockDB.AssertExpectations(t)
+	mockDB.AssertNotCalled(t, "OrphanBlocksFrom", mock.Anything, mock.Anything)
+	mockDB.AssertNotCalled(t, "SaveBlocks", mock.Anything, mock.Anything)
 }
 
-// Test the memory management function
-func TestAddBlock_MemoryManagement(t *testing.T) {
-	ec := &EventClient{
-		recentBlocks: make(map[uint64]common.Hash),
-	}
+func TestCheckForChainReorg_CanonicalChainQueryError(t *testing.T) {
+	// Setup
+	mockClient := &ethMock.EthClient{}
+	mockDB := &storageMock.DB{}
+	mockProducer := &MockProducer{}
+	ec := newReorgClient(mockClient, mockDB, mockProducer)
 
-	// Fill up to MAX_RECENT_BLOCKS
-	for i := uint64(1); i <= MAX_RECENT_BLOCKS; i++ {
-		hash := common.HexToHash(fmt.Sprintf("0x%064d", i))
-		ec.addBlock(i, hash)
-	}
+	oldHash := common.HexToHash("0x0000000000000000000000000000000000000000000000000000000000000123")
+	newHash := common.HexToHash("0x0000000000000000000000000000000000000000000000000000000000000456")
+
+	event := createTestEvent(100, newHash)
 
-	assert.Equal(t, MAX_RECENT_BLOCKS, len(ec.recentBlocks))
+	mockDB.On("GetCanonicalBlock", mock.Anything, uint64(100)).Return(&models.Block{Number: 100, Hash: oldHash.Hex()}, nil)
 
-	// Add one more - should trigger cleanup
-	newHash := common.HexToHash("0x0000000000000000000000000000000000000000000000000000000000000999")
-	ec.addBlock(MAX_RECENT_BLOCKS+1, newHash)
+	// Mock canonical chain query failure
+	mockClient.On("HeaderByNumber", mock.Anything, big.NewInt(100)).Return(nil, assert.AnError)
 
-	// Should still be at max size
-	assert.Equal(t, MAX_RECENT_BLOCKS, len(ec.recentBlocks))
+	// Execute
+	reorg, err := ec.CheckForChainReorg(t.Context(), event)
 
-	// Should contain the newest block
-	assert.Equal(t, newHash, ec.recentBlocks[MAX_RECENT_BLOCKS+1])
+	// Assert
+	assert.Error(t, err)
+	assert.False(t, reorg)
+	assert.Contains(t, err.Error(), "failed to get canonical header")
 
-	// Should have removed the oldest block
-	_, exists := ec.recentBlocks[1]
-	assert.False(t, exists)
+	mockClient.AssertExpectations(t)
+	mockProducer.AssertNotCalled(t, "Produce", mock.Anything, mock.Anything, mock.Anything)
 }
@@ -0,0 +1,56 @@
+package events
+
+import (
+	"context"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	defaultReconnectMinBackoff = time.Second
+	defaultReconnectMaxBackoff = time.Minute
+)
+
+// Run keeps the listener alive until ctx is cancelled. Whenever Listen stops
+// (e.g. the WebSocket subscription drops) the eth client is reconnected with
+// exponential backoff and Listen is restarted. Each restart backfills from the
+// persisted checkpoint, which fills the block range missed during the outage.
+// Blocks below the checkpoint replaced by a reorg during the outage are
+// backfilled again from the fork.
+func (ec *EventClient) Run(ctx context.Context) error {
+	backoff := ec.minBackoff
+
+	for {
+		started := time.Now()
+		err := ec.Listen(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		// Only keep growing the backoff if the listener keeps failing quickly
+		if time.Since(started) > ec.maxBackoff {
+			backoff = ec.minBackoff
+		}
+
+		log.Error().Err(err).Dur("retry_in", backoff).Msg("event listener stopped, reconnecting")
+
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(backoff):
+			}
+
+			backoff = min(backoff*2, ec.maxBackoff)
+
+			if err := ec.ethClient.Reconnect(ctx); err != nil {
+				log.Error().Err(err).Dur("retry_in", backoff).Msg("failed to reconnect eth client")
+				continue
+			}
+
+			log.Info().Msg("eth client reconnected")
+			break
+		}
+	}
+}
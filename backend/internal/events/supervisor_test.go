@@ -0,0 +1,199 @@
+package events
+
+import (
+	"context"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/murraystewart96/token-swap/internal/config"
+	"github.com/murraystewart96/token-swap/internal/models"
+	storageMock "github.com/murraystewart96/token-swap/internal/storage/mock"
+	ethMock "github.com/murraystewart96/token-swap/pkg/eth/mock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSubscription is an ethereum.Subscription whose error channel is controlled by the test
+type fakeSubscription struct {
+	errCh chan error
+}
+
+func newFakeSubscription() *fakeSubscription {
+	return &fakeSubscription{errCh: make(chan error, 1)}
+}
+
+func (s *fakeSubscription) Unsubscribe()      {}
+func (s *fakeSubscription) Err() <-chan error { return s.errCh }
+
+var _ ethereum.Subscription = (*fakeSubscription)(nil)
+
+func TestRun_ReconnectsAndBackfillsAfterSubscriptionDrops(t *testing.T) {
+	mockClient := &ethMock.EthClient{}
+	mockDB := &storageMock.DB{}
+
+	ec := newBackfillClient(mockClient, mockDB, &MockProducer{}, &MockPoolContract{})
+	ec.minBackoff = time.Millisecond
+	ec.maxBackoff = 10 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	droppedSub := newFakeSubscription()
+	droppedSub.errCh <- assert.AnError
+	liveSub := newFakeSubscription()
+
+	mockClient.On("SupportsSubscriptions").Return(true)
+	mockClient.On("SubscribeFilterLogs", mock.Anything, mock.Anything, mock.Anything).Return(droppedSub, nil).Once()
+	mockClient.On("SubscribeFilterLogs", mock.Anything, mock.Anything, mock.Anything).Return(liveSub, nil).Once()
+
+	// First reconnect attempt fails, second succeeds
+	mockClient.On("Reconnect", mock.Anything).Return(assert.AnError).Once()
+	mockClient.On("Reconnect", mock.Anything).Return(nil).Once()
+
+	// Initial start at head 100, after the outage the chain has moved on to 105
+	mockClient.On("BlockNumber", mock.Anything).Return(uint64(100), nil).Once()
+	mockClient.On("BlockNumber", mock.Anything).Return(uint64(105), nil).Once()
+	mockDB.On("GetCheckpoint", mock.Anything, testPoolAddr.Hex()).Return(uint64(100), true, nil)
+
+	// The missed range is filled by the backfill, then the listener is stopped
+	mockClient.On("FilterLogs", mock.Anything, blockRange(101, 105)).Return(nil, nil)
+	mockDB.On("SetCheckpoint", mock.Anything, testPoolAddr.Hex(), uint64(105)).Return(nil).Run(func(mock.Arguments) {
+		cancel()
+	})
+
+	done := make(chan error)
+	go func() {
+		done <- ec.Run(ctx)
+	}()
+
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("listener did not stop")
+	}
+
+	mockClient.AssertExpectations(t)
+	mockDB.AssertExpectations(t)
+}
+
+func TestRun_BackfillsBlocksReplacedBelowCheckpointDuringOutage(t *testing.T) {
+	mockClient := &ethMock.EthClient{}
+	mockDB := &storageMock.DB{}
+	mockProducer := &MockProducer{}
+	mockContract := &MockPoolContract{}
+
+	ec := newBackfillClient(mockClient, mockDB, mockProducer, mockContract)
+	ec.minBackoff = time.Millisecond
+	ec.maxBackoff = 10 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	// Block 100 was processed before the outage and replaced during it
+	header99 := createTestHeader(99, common.Hash{}, 0)
+	oldHeader100 := createTestHeader(100, header99.Hash(), 0)
+	newHeader100 := createTestHeader(100, header99.Hash(), 1)
+	newHeader101 := createTestHeader(101, newHeader100.Hash(), 1)
+	newHeader102 := createTestHeader(102, newHeader101.Hash(), 1)
+
+	newLog100 := createHeaderSyncLog(newHeader100, 0)
+	newLog102 := createHeaderSyncLog(newHeader102, 1)
+	expectParseSync(mockContract, newLog100)
+	expectParseSync(mockContract, newLog102)
+
+	droppedSub := newFakeSubscription()
+	droppedSub.errCh <- assert.AnError
+
+	mockClient.On("SupportsSubscriptions").Return(true)
+	mockClient.On("SubscribeFilterLogs", mock.Anything, mock.Anything, mock.Anything).Return(droppedSub, nil).Once()
+	mockClient.On("SubscribeFilterLogs", mock.Anything, mock.Anything, mock.Anything).Return(newFakeSubscription(), nil).Once()
+	mockClient.On("Reconnect", mock.Anything).Return(nil).Once()
+
+	mockClient.On("BlockNumber", mock.Anything).Return(uint64(100), nil).Once()
+	mockClient.On("BlockNumber", mock.Anything).Return(uint64(102), nil).Once()
+	mockDB.On("GetCheckpoint", mock.Anything, testPoolAddr.Hex()).Return(uint64(100), true, nil)
+
+	// The gap-fill from the checkpoint finds the log at 102, whose ancestors replace block 100
+	mockClient.On("FilterLogs", mock.Anything, blockRange(101, 102)).Return([]types.Log{newLog102}, nil).Once()
+	mockDB.On("GetCanonicalBlock", mock.Anything, uint64(102)).Return(nil, nil).Twice()
+	mockDB.On("GetCanonicalBlock", mock.Anything, uint64(101)).Return(nil, nil).Once()
+	mockDB.On("GetLatestCanonicalBlockBelow", mock.Anything, uint64(102)).Return(blockFromHeader(oldHeader100), nil)
+	mockDB.On("GetCanonicalBlock", mock.Anything, uint64(99)).Return(blockFromHeader(header99), nil)
+	mockClient.On("HeaderByHash", mock.Anything, newHeader102.Hash()).Return(newHeader102, nil)
+	mockClient.On("HeaderByNumber", mock.Anything, big.NewInt(100)).Return(newHeader100, nil)
+	mockDB.On("GetCanonicalBlocksFrom", mock.Anything, uint64(100)).Return([]*models.Block{blockFromHeader(oldHeader100)}, nil)
+	mockProducer.On("Produce", config.ChainReorgTopic, mock.Anything, mock.Anything).Return(nil).Once()
+	mockDB.On("OrphanBlocksFrom", mock.Anything, uint64(100)).Return(nil)
+	mockDB.On("SaveBlocks", mock.Anything, mock.Anything).Return(nil)
+
+	// The checkpoint moves back before the fork and the gap-fill runs again from there
+	mockDB.On("SetCheckpoint", mock.Anything, testPoolAddr.Hex(), uint64(99)).Return(nil).Once()
+	mockClient.On("FilterLogs", mock.Anything, blockRange(100, 102)).Return([]types.Log{newLog100, newLog102}, nil).Once()
+	mockDB.On("GetCanonicalBlock", mock.Anything, uint64(100)).Return(blockFromHeader(newHeader100), nil)
+	mockDB.On("GetCanonicalBlock", mock.Anything, uint64(102)).Return(blockFromHeader(newHeader102), nil)
+	mockDB.On("SetCheckpoint", mock.Anything, testPoolAddr.Hex(), uint64(102)).Return(nil).Once().Run(func(mock.Arguments) {
+		cancel()
+	})
+
+	mockProducer.On("Produce", config.ReserveHistoryTopic, mock.Anything, mock.Anything).Return(nil)
+
+	done := make(chan error)
+	go func() {
+		done <- ec.Run(ctx)
+	}()
+
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("listener did not stop")
+	}
+
+	// The new log at 100 is published
+	var published []uint64
+	for _, message := range mockProducer.GetMessages() {
+		if message.topic != config.ReserveHistoryTopic {
+			continue
+		}
+		var reserveEvent models.ReserveEvent
+		openEvent(t, message, models.EventTypeReserve, &reserveEvent)
+		published = append(published, reserveEvent.BlockNumber)
+	}
+	assert.Contains(t, published, uint64(100))
+
+	mockClient.AssertExpectations(t)
+	mockDB.AssertExpectations(t)
+	mockProducer.AssertExpectations(t)
+}
+
+func TestRun_StopsOnContextCancellation(t *testing.T) {
+	mockClient := &ethMock.EthClient{}
+
+	ec := &EventClient{
+		ethClient:        mockClient,
+		pools:            []common.Address{testPoolAddr},
+		backfilledBlocks: make(map[uint64]common.Hash),
+		minBackoff:       time.Hour,
+		maxBackoff:       time.Hour,
+	}
+
+	ctx, cancel := context.WithCancel(t.Context())
+
+	mockClient.On("SupportsSubscriptions").Return(true)
+
+	// Subscription fails, the listener should wait on the backoff until cancelled
+	mockClient.On("SubscribeFilterLogs", mock.Anything, mock.Anything, mock.Anything).Return(nil, assert.AnError).Run(func(mock.Arguments) {
+		cancel()
+	})
+
+	err := ec.Run(ctx)
+
+	assert.NoError(t, err)
+	mockClient.AssertNotCalled(t, "Reconnect", mock.Anything)
+}
@@ -0,0 +1,76 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Event types published to Kafka
+const (
+	EventTypeTrade   = "io.tokenswap.trade"
+	EventTypeReserve = "io.tokenswap.reserve"
+	EventTypeReorg   = "io.tokenswap.reorg"
+)
+
+// Current schema version of each event type. Bump the version when a change to
+// the event struct isn't backwards compatible, and keep decoding older versions
+// in the worker until they are no longer on the topics.
+const (
+	TradeEventVersion   = 1
+	ReserveEventVersion = 1
+	ReorgEventVersion   = 1
+)
+
+// EnvelopeSpecVersion is the version of the envelope format itself
+const EnvelopeSpecVersion = "1.0"
+
+// ErrUnsupportedEvent is returned for envelopes with an unexpected type or an unknown schema version
+var ErrUnsupportedEvent = errors.New("unsupported event")
+
+// Envelope wraps every event published to Kafka with metadata describing it,
+// modelled on CloudEvents. Data holds the event itself, encoded with the same
+// codec as the envelope according to Type and SchemaVersion.
+type Envelope struct {
+	SpecVersion   string          `json:"specversion" protobuf:"1"`
+	ID            string          `json:"id" protobuf:"2"`     // Unique per event, stable across republishing
+	Type          string          `json:"type" protobuf:"3"`   // One of the EventType constants
+	Source        string          `json:"source" protobuf:"4"` // Address of the pool that emitted the event, or the chain for reorgs
+	SchemaVersion int             `json:"schema_version" protobuf:"5"`
+	ChainID       uint64          `json:"chain_id" protobuf:"6"`
+	BlockHash     string          `json:"block_hash" protobuf:"7"`
+	EmittedAt     time.Time       `json:"emitted_at" protobuf:"8"` // When the listener published the event
+	Data          json.RawMessage `json:"data" protobuf:"9"`       // JSON or Protobuf, see the content-type header
+}
+
+// NewEnvelope returns an envelope of the given type and schema version. The
+// caller fills in the event's metadata and encoded data.
+func NewEnvelope(eventType string, schemaVersion int) *Envelope {
+	return &Envelope{
+		SpecVersion:   EnvelopeSpecVersion,
+		Type:          eventType,
+		SchemaVersion: schemaVersion,
+		EmittedAt:     time.Now().UTC(),
+	}
+}
+
+// SchemaSubject names the schema of an event type's schema version in the
+// schema registry. Changes within a subject must be backward compatible,
+// breaking changes need a new schema version.
+func SchemaSubject(eventType string, schemaVersion int) string {
+	return fmt.Sprintf("%s.v%d", eventType, schemaVersion)
+}
+
+// CheckType returns an error if the envelope doesn't hold an event of eventType
+func (e *Envelope) CheckType(eventType string) error {
+	if e.Type != eventType {
+		return fmt.Errorf("%w: expected %s, got type %q", ErrUnsupportedEvent, eventType, e.Type)
+	}
+	return nil
+}
+
+// UnsupportedVersion returns the error for an envelope whose schema version can't be decoded
+func (e *Envelope) UnsupportedVersion() error {
+	return fmt.Errorf("%w: %s schema version %d", ErrUnsupportedEvent, e.Type, e.SchemaVersion)
+}
@@ -1,50 +1,130 @@
 package models
 
+import "math"
+
+// Event structs are published to Kafka. The protobuf tags are the field numbers
+// used by the Protobuf codec (see proto/tokenswap/events.proto) and must never be reused.
 type TradeEvent struct {
 	// Transaction identifiers
-	TxHash           string `json:"tx_hash"`
-	BlockNumber      uint64 `json:"block_number"`
-	Timestamp        int64  `json:"timestamp"`
-	TransactionIndex uint   `json:"transaction_index"`
+	TxHash           string `json:"tx_hash" protobuf:"1"`
+	BlockNumber      uint64 `json:"block_number" protobuf:"2"`
+	BlockHash        string `json:"block_hash" protobuf:"3"`
+	Timestamp        int64  `json:"timestamp" protobuf:"4"`
+	TransactionIndex uint   `json:"transaction_index" protobuf:"5"`
+	LogIndex         uint   `json:"log_index" protobuf:"6"` // Position of the Swap log in the block
 
 	// Trade participants
-	Sender    string `json:"sender"`    // Who initiated the trade
-	Recipient string `json:"recipient"` // Who received the output (usually same as sender)
+	Sender    string `json:"sender" protobuf:"7"`    // Who initiated the trade
+	Recipient string `json:"recipient" protobuf:"8"` // Who received the output (usually same as sender)
 
 	// Trade details
-	TokenIn   string `json:"token_in"`   // "MET" or "YOU"
-	TokenOut  string `json:"token_out"`  // "YOU" or "MET"
-	AmountIn  string `json:"amount_in"`  // Input amount
-	AmountOut string `json:"amount_out"` // Output amount
+	TokenIn   string `json:"token_in" protobuf:"9"`    // "MET" or "YOU"
+	TokenOut  string `json:"token_out" protobuf:"10"`  // "YOU" or "MET"
+	AmountIn  string `json:"amount_in" protobuf:"11"`  // Input amount
+	AmountOut string `json:"amount_out" protobuf:"12"` // Output amount
 
 	// Context
-	PoolAddress string `json:"pool_address"` // Which pool
+	PoolAddress string `json:"pool_address" protobuf:"13"` // Which pool
+
+	// Gas and fees paid by the transaction that contains the swap
+	TxFrom            string `json:"tx_from" protobuf:"14"`             // EOA that sent the transaction (Sender may be a router)
+	TxNonce           uint64 `json:"tx_nonce" protobuf:"15"`            // Nonce of TxFrom
+	GasUsed           uint64 `json:"gas_used" protobuf:"16"`            // Gas used by the whole transaction
+	EffectiveGasPrice string `json:"effective_gas_price" protobuf:"17"` // Wei per gas
+	TxFee             string `json:"tx_fee" protobuf:"18"`              // GasUsed * EffectiveGasPrice in wei
+
+	// Status of the stored trade, only set when read from or stored in the database
+	Status string `json:"status,omitempty"`
 }
 
 type ReserveEvent struct {
-	TxHash      string `json:"tx_hash"`
-	BlockNumber uint64 `json:"block_number"`
-	Timestamp   int64  `json:"timestamp"`
+	TxHash      string `json:"tx_hash" protobuf:"1"`
+	BlockNumber uint64 `json:"block_number" protobuf:"2"`
+	BlockHash   string `json:"block_hash" protobuf:"3"`
+	LogIndex    uint   `json:"log_index" protobuf:"4"` // Position of the Sync log in the block
+	Timestamp   int64  `json:"timestamp" protobuf:"5"`
 
-	METReserve  string `json:"met_reserve"`
-	YOUReserve  string `json:"you_reserve"`
-	PoolAddress string `json:"pool_address"`
+	METReserve  string `json:"met_reserve" protobuf:"6"`
+	YOUReserve  string `json:"you_reserve" protobuf:"7"`
+	PoolAddress string `json:"pool_address" protobuf:"8"`
+
+	// Status of the stored reserves, only set when read from or stored in the database
+	Status string `json:"status,omitempty"`
+}
+
+// Stored events are pending until their block is confirmed, and orphaned (but
+// retained) when their block is reorganised out of the canonical chain
+const (
+	EventStatusPending   = "pending"
+	EventStatusConfirmed = "confirmed"
+	EventStatusOrphaned  = "orphaned"
+)
+
+const (
+	BlockStatusCanonical = "canonical"
+	BlockStatusOrphaned  = "orphaned"
+)
+
+// Block is a block header tracked by the listener to detect chain reorgs
+type Block struct {
+	Number     uint64 `json:"number"`
+	Hash       string `json:"hash"`
+	ParentHash string `json:"parent_hash"`
+	Timestamp  int64  `json:"timestamp"`
+	Status     string `json:"status"` // "canonical" or "orphaned"
+}
+
+// ConsumerOffset is the next offset a consumer group reads from a partition,
+// stored alongside the events consumed up to it
+type ConsumerOffset struct {
+	GroupID   string `json:"group_id"`
+	Topic     string `json:"topic"`
+	Partition int32  `json:"partition"`
+	Offset    int64  `json:"offset"`
 }
 
+// ReorgEvent retracts the events emitted in blocks that are no longer on the canonical chain
+type ReorgEvent struct {
+	PoolAddresses  []string `json:"pool_addresses" protobuf:"1"`  // Pools indexed by the listener that detected the reorg
+	ForkBlock      uint64   `json:"fork_block" protobuf:"2"`      // First block number that was replaced
+	OrphanedBlocks []string `json:"orphaned_blocks" protobuf:"3"` // Hashes of the blocks that were orphaned
+	NewHeadNumber  uint64   `json:"new_head_number" protobuf:"4"`
+	NewHeadHash    string   `json:"new_head_hash" protobuf:"5"`
+}
+
+// Cached pool state records the position of the event it was derived from, so
+// older state never overwrites newer state
 type PoolReserves struct {
-	METAmount string `json:"met_amount"`
-	YOUAmount string `json:"you_amount"`
+	METAmount   string `json:"met_amount"`
+	YOUAmount   string `json:"you_amount"`
+	BlockNumber uint64 `json:"block_number"`
+	LogIndex    uint   `json:"log_index"`
+}
+
+type PoolPrice struct {
+	Price       string `json:"price"`
+	BlockNumber uint64 `json:"block_number"`
+	LogIndex    uint   `json:"log_index"`
 }
 
+// EndOfBlock is the log index used for state read from the chain at the end of
+// a block, which is newer than any event in that block
+const EndOfBlock = uint(math.MaxUint32)
+
 // *** API RESPONSE MODELS ***
 
 type ReservesResponse struct {
-	METAmount string `json:"met_amount"`
-	YOUAmount string `json:"you_amount"`
+	METAmount   string `json:"met_amount"`
+	YOUAmount   string `json:"you_amount"`
+	BlockNumber uint64 `json:"block_number"`
+	Status      string `json:"status,omitempty"` // Status of the reserves, set when filtered by status
 }
 
 type CurrentPriceResponse struct {
-	Price string `json:"current_price"`
+	PoolAddress string `json:"pool_address"`
+	Price       string `json:"current_price"`
+	BlockNumber uint64 `json:"block_number"`
+	Status      string `json:"status,omitempty"` // Status of the reserves priced, set when filtered by status
 }
 
 type TradesResponse struct {
@@ -55,6 +135,7 @@ type TradesResponse struct {
 
 type VolumeResponse struct {
 	Period      string `json:"period"`
+	PoolAddress string `json:"pool_address,omitempty"`
 	TotalVolume struct {
 		MET string `json:"met"`
 		YOU string `json:"you"`
@@ -63,9 +144,10 @@ type VolumeResponse struct {
 }
 
 type PriceHistoryResponse struct {
-	Period     string       `json:"period"`
-	Interval   string       `json:"interval"`
-	DataPoints []PricePoint `json:"data_points"`
+	Period      string       `json:"period"`
+	PoolAddress string       `json:"pool_address,omitempty"`
+	Interval    string       `json:"interval"`
+	DataPoints  []PricePoint `json:"data_points"`
 }
 
 type PricePoint struct {
@@ -74,8 +156,21 @@ type PricePoint struct {
 	Volume    string `json:"volume"` // Volume at this time point
 }
 
+type GasAnalyticsResponse struct {
+	Period          string `json:"period"`
+	PoolAddress     string `json:"pool_address,omitempty"`
+	TradeCount      int64  `json:"trade_count"`
+	TotalGasUsed    string `json:"total_gas_used"`
+	AverageGasUsed  string `json:"average_gas_used"`
+	AverageGasPrice string `json:"average_gas_price"` // Wei per gas
+	TotalFeesETH    string `json:"total_fees_eth"`
+	AverageFeeETH   string `json:"average_fee_eth"`
+	RoutedTrades    int64  `json:"routed_trades"` // Trades where the tx sender is not the swap sender (e.g. via a router)
+}
+
 type ActivityResponse struct {
 	Period         string  `json:"period"`
+	PoolAddress    string  `json:"pool_address,omitempty"`
 	TotalTrades    int64   `json:"total_trades"`
 	UniqueTraders  int64   `json:"unique_traders"`
 	AveragePerHour float64 `json:"average_per_hour"`
@@ -9,9 +9,11 @@ import (
 	"strings"
 	"time"
 
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/gin-gonic/gin"
 	"github.com/murraystewart96/token-swap/internal/models"
 	"github.com/murraystewart96/token-swap/internal/storage"
+	"github.com/murraystewart96/token-swap/internal/worker"
 	"github.com/rs/zerolog/log"
 )
 
@@ -51,6 +53,7 @@ func Serve(ctx context.Context, addr string, handler *Handler) {
 	router.GET("/api/analytics/volume", handler.GetVolumeAnalytics)
 	router.GET("/api/analytics/price-history", handler.GetPriceHistory)
 	router.GET("/api/analytics/activity", handler.GetActivityAnalytics)
+	router.GET("/api/analytics/gas", handler.GetGasAnalytics)
 
 	srv := &http.Server{
 		Addr:         addr,
@@ -90,7 +93,36 @@ func (h *Handler) GetReserves(ctx *gin.Context) {
 		return
 	}
 
-	reserves, err := h.cache.GetReserves(ctx, poolAddr)
+	poolAddr, err := parsePoolAddress(poolAddr)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	statuses, err := parseStatusFilter(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// The cache holds the latest state whatever its status, so filtered
+	// requests read the latest matching reserves from the database
+	if statuses != nil {
+		reserve, found := h.getLatestReserve(ctx, poolAddr, statuses)
+		if !found {
+			return
+		}
+
+		ctx.JSON(http.StatusOK, &models.ReservesResponse{
+			METAmount:   reserve.METReserve,
+			YOUAmount:   reserve.YOUReserve,
+			BlockNumber: reserve.BlockNumber,
+			Status:      reserve.Status,
+		})
+		return
+	}
+
+	reserves, err := h.cache.GetReserves(ctx.Request.Context(), poolAddr)
 	if err != nil {
 		log.Error().Err(err).Str("pool_address", poolAddr).Msg("failed getting reserves from cache")
 		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "failed to retrieve reserves"})
@@ -98,29 +130,78 @@ func (h *Handler) GetReserves(ctx *gin.Context) {
 	}
 
 	resp := &models.ReservesResponse{
-		METAmount: reserves.METAmount,
-		YOUAmount: reserves.YOUAmount,
+		METAmount:   reserves.METAmount,
+		YOUAmount:   reserves.YOUAmount,
+		BlockNumber: reserves.BlockNumber,
 	}
 
 	ctx.JSON(http.StatusOK, resp)
 }
 
 func (h *Handler) GetCurrentPrice(ctx *gin.Context) {
+	poolAddr, found := ctx.GetQuery("pool_address")
+	if !found {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "pool_address parameter required"})
+		return
+	}
+
+	poolAddr, err := parsePoolAddress(poolAddr)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
 	tradingPair, found := ctx.GetQuery("trading_pair")
 	if !found {
 		ctx.JSON(http.StatusBadRequest, gin.H{"error": "trading_pair parameter required"})
 		return
 	}
 
-	price, err := h.cache.GetPrice(ctx, tradingPair)
+	statuses, err := parseStatusFilter(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Filtered requests price the latest matching reserves from the database
+	if statuses != nil {
+		if tradingPair != worker.MET_YOU_PAIR {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "unsupported trading_pair"})
+			return
+		}
+
+		reserve, found := h.getLatestReserve(ctx, poolAddr, statuses)
+		if !found {
+			return
+		}
+
+		price, err := worker.CalculateMetToYouPrice(&models.PoolReserves{METAmount: reserve.METReserve, YOUAmount: reserve.YOUReserve})
+		if err != nil {
+			log.Error().Err(err).Str("pool_address", poolAddr).Msg("failed calculating price from reserves")
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "failed to retrieve trading pair"})
+			return
+		}
+
+		ctx.JSON(http.StatusOK, models.CurrentPriceResponse{
+			PoolAddress: poolAddr,
+			Price:       price,
+			BlockNumber: reserve.BlockNumber,
+			Status:      reserve.Status,
+		})
+		return
+	}
+
+	price, err := h.cache.GetPrice(ctx.Request.Context(), poolAddr, tradingPair)
 	if err != nil {
-		log.Error().Err(err).Str("trading_pair", tradingPair).Msg("failed getting current price from cache")
+		log.Error().Err(err).Str("pool_address", poolAddr).Str("trading_pair", tradingPair).Msg("failed getting current price from cache")
 		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "failed to retrieve trading pair"})
 		return
 	}
 
 	resp := models.CurrentPriceResponse{
-		Price: price,
+		PoolAddress: poolAddr,
+		Price:       price.Price,
+		BlockNumber: price.BlockNumber,
 	}
 
 	ctx.JSON(http.StatusOK, resp)
@@ -138,8 +219,14 @@ func (h *Handler) GetTrades(ctx *gin.Context) {
 	}
 
 	cursor, _ := ctx.GetQuery("cursor")
+	poolAddr, err := parseOptionalPoolAddress(ctx.Query("pool_address")) // Optional, all pools when omitted
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+
+		return
+	}
 
-	cursorBlock, cursorTx, err := parseCursor(cursor)
+	cursorBlock, cursorTx, cursorLog, err := parseCursor(cursor)
 	if err != nil {
 		log.Error().Err(err).Msgf("failed to parse cursor: %s", cursor)
 		ctx.JSON(http.StatusBadRequest, gin.H{"error": "failed to parse cursor param"})
@@ -147,7 +234,14 @@ func (h *Handler) GetTrades(ctx *gin.Context) {
 		return
 	}
 
-	trades, err := h.db.GetTradesByCursor(cursorBlock, cursorTx, limit)
+	statuses, err := parseStatusFilter(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+
+		return
+	}
+
+	trades, err := h.db.GetTradesByCursor(ctx.Request.Context(), poolAddr, statuses, cursorBlock, cursorTx, cursorLog, limit)
 	if err != nil {
 		log.Error().Err(err).Msg("failed getting trades")
 		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "failed to retrieve trading pair"})
@@ -159,7 +253,7 @@ func (h *Handler) GetTrades(ctx *gin.Context) {
 	var nextCursor *string
 	if len(trades) > 0 {
 		lastTrade := trades[len(trades)-1]
-		cursor := createCursor(lastTrade.BlockNumber, lastTrade.TransactionIndex)
+		cursor := createCursor(lastTrade.BlockNumber, lastTrade.TransactionIndex, lastTrade.LogIndex)
 		nextCursor = &cursor
 	}
 
@@ -175,12 +269,19 @@ func (h *Handler) GetTrades(ctx *gin.Context) {
 func (h *Handler) GetVolumeAnalytics(ctx *gin.Context) {
 	period := ctx.DefaultQuery("period", "24h")
 	token := ctx.DefaultQuery("token", "all") // "all", "MET", "YOU"
+	poolAddr := ctx.Query("pool_address")     // Optional, all pools when omitted
 
 	if token != "all" && token != "MET" && token != "YOU" {
 		ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid token parameter"})
 		return
 	}
 
+	poolAddr, err := parseOptionalPoolAddress(poolAddr)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
 	// Parse period into time range
 	start, end, err := parsePeriod(period)
 	if err != nil {
@@ -188,7 +289,13 @@ func (h *Handler) GetVolumeAnalytics(ctx *gin.Context) {
 		return
 	}
 
-	volumeData, err := h.db.GetVolumeAnalytics(start, end, token)
+	statuses, err := parseStatusFilter(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	volumeData, err := h.db.GetVolumeAnalytics(ctx.Request.Context(), poolAddr, statuses, start, end, token)
 	if err != nil {
 		log.Error().Err(err).Msg("failed getting volume analytics")
 		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "failed to retrieve volume data"})
@@ -202,6 +309,19 @@ func (h *Handler) GetPriceHistory(ctx *gin.Context) {
 	period := ctx.DefaultQuery("period", "24h")
 	interval := ctx.DefaultQuery("interval", "1h") // "1m", "5m", "1h", "1d"
 
+	// Prices from different pools can't be mixed
+	poolAddr, found := ctx.GetQuery("pool_address")
+	if !found {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "pool_address parameter required"})
+		return
+	}
+
+	poolAddr, err := parsePoolAddress(poolAddr)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
 	start, end, err := parsePeriod(period)
 	if err != nil {
 		ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid period"})
@@ -215,7 +335,13 @@ func (h *Handler) GetPriceHistory(ctx *gin.Context) {
 		return
 	}
 
-	priceData, err := h.db.GetPriceHistory(start, end, intervalDuration)
+	statuses, err := parseStatusFilter(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	priceData, err := h.db.GetPriceHistory(ctx.Request.Context(), poolAddr, statuses, start, end, intervalDuration)
 	if err != nil {
 		log.Error().Err(err).Msg("failed getting price history")
 		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "failed to retrieve price history"})
@@ -227,6 +353,11 @@ func (h *Handler) GetPriceHistory(ctx *gin.Context) {
 
 func (h *Handler) GetActivityAnalytics(ctx *gin.Context) {
 	period := ctx.DefaultQuery("period", "24h")
+	poolAddr, err := parseOptionalPoolAddress(ctx.Query("pool_address")) // Optional, all pools when omitted
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
 	start, end, err := parsePeriod(period)
 	if err != nil {
@@ -234,7 +365,13 @@ func (h *Handler) GetActivityAnalytics(ctx *gin.Context) {
 		return
 	}
 
-	activityData, err := h.db.GetActivityAnalytics(start, end)
+	statuses, err := parseStatusFilter(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	activityData, err := h.db.GetActivityAnalytics(ctx.Request.Context(), poolAddr, statuses, start, end)
 	if err != nil {
 		log.Error().Err(err).Msg("failed getting activity analytics")
 		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "failed to retrieve activity data"})
@@ -244,34 +381,142 @@ func (h *Handler) GetActivityAnalytics(ctx *gin.Context) {
 	ctx.JSON(http.StatusOK, activityData)
 }
 
+func (h *Handler) GetGasAnalytics(ctx *gin.Context) {
+	period := ctx.DefaultQuery("period", "24h")
+	poolAddr, err := parseOptionalPoolAddress(ctx.Query("pool_address")) // Optional, all pools when omitted
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	start, end, err := parsePeriod(period)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid period"})
+		return
+	}
+
+	statuses, err := parseStatusFilter(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	gasData, err := h.db.GetGasAnalytics(ctx.Request.Context(), poolAddr, statuses, start, end)
+	if err != nil {
+		log.Error().Err(err).Msg("failed getting gas analytics")
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "failed to retrieve gas data"})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gasData)
+}
+
+// getLatestReserve reads the latest reserves of a pool with one of the given
+// statuses, writing the error response if there are none
+func (h *Handler) getLatestReserve(ctx *gin.Context, poolAddr string, statuses []string) (*models.ReserveEvent, bool) {
+	reserve, err := h.db.GetLatestReserve(ctx.Request.Context(), poolAddr, statuses)
+	if err != nil {
+		log.Error().Err(err).Str("pool_address", poolAddr).Msg("failed getting latest reserves")
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "failed to retrieve reserves"})
+		return nil, false
+	}
+
+	if reserve == nil {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "no reserves with the requested status"})
+		return nil, false
+	}
+
+	return reserve, true
+}
+
 // *** HELPER ***
 
-// Cursor format: "block_number:transaction_index"
-func parseCursor(cursor string) (uint64, uint, error) {
+// parsePoolAddress validates a pool address and returns it checksummed, which
+// is how addresses are stored in the database and cache
+func parsePoolAddress(addr string) (string, error) {
+	if !common.IsHexAddress(addr) {
+		return "", fmt.Errorf("invalid pool_address parameter")
+	}
+
+	return common.HexToAddress(addr).Hex(), nil
+}
+
+// parseOptionalPoolAddress is parsePoolAddress for parameters that can be
+// omitted, returning an empty address when they are
+func parseOptionalPoolAddress(addr string) (string, error) {
+	if addr == "" {
+		return "", nil
+	}
+
+	return parsePoolAddress(addr)
+}
+
+// parseStatusFilter returns the event statuses a request is filtered to, given
+// either as a comma separated status parameter or as confirmed_only=true.
+// Returns nil for unfiltered requests, which read pending and confirmed events.
+func parseStatusFilter(ctx *gin.Context) ([]string, error) {
+	status := ctx.Query("status")
+
+	confirmedOnly, err := strconv.ParseBool(ctx.DefaultQuery("confirmed_only", "false"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid confirmed_only parameter")
+	}
+
+	if confirmedOnly {
+		if status != "" && status != models.EventStatusConfirmed {
+			return nil, fmt.Errorf("confirmed_only can't be combined with status %s", status)
+		}
+		return []string{models.EventStatusConfirmed}, nil
+	}
+
+	if status == "" {
+		return nil, nil
+	}
+
+	var statuses []string
+	for _, s := range strings.Split(status, ",") {
+		switch s {
+		case models.EventStatusPending, models.EventStatusConfirmed, models.EventStatusOrphaned:
+			statuses = append(statuses, s)
+		default:
+			return nil, fmt.Errorf("unsupported status: %s", s)
+		}
+	}
+
+	return statuses, nil
+}
+
+// Cursor format: "block_number:transaction_index:log_index"
+func parseCursor(cursor string) (uint64, uint, uint, error) {
 	if cursor == "" {
-		return 0, 0, nil // No cursor means start from beginning
+		return 0, 0, 0, nil // No cursor means start from beginning
 	}
 
 	parts := strings.Split(cursor, ":")
-	if len(parts) != 2 {
-		return 0, 0, fmt.Errorf("invalid cursor format")
+	if len(parts) != 3 {
+		return 0, 0, 0, fmt.Errorf("invalid cursor format")
 	}
 
 	blockNumber, err := strconv.ParseUint(parts[0], 10, 64)
 	if err != nil {
-		return 0, 0, fmt.Errorf("invalid block number in cursor")
+		return 0, 0, 0, fmt.Errorf("invalid block number in cursor")
 	}
 
 	txIndex, err := strconv.ParseUint(parts[1], 10, 32)
 	if err != nil {
-		return 0, 0, fmt.Errorf("invalid transaction index in cursor")
+		return 0, 0, 0, fmt.Errorf("invalid transaction index in cursor")
+	}
+
+	logIndex, err := strconv.ParseUint(parts[2], 10, 32)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("invalid log index in cursor")
 	}
 
-	return blockNumber, uint(txIndex), nil
+	return blockNumber, uint(txIndex), uint(logIndex), nil
 }
 
-func createCursor(blockNumber uint64, txIndex uint) string {
-	return fmt.Sprintf("%d:%d", blockNumber, txIndex)
+func createCursor(blockNumber uint64, txIndex, logIndex uint) string {
+	return fmt.Sprintf("%d:%d:%d", blockNumber, txIndex, logIndex)
 }
 
 func parsePeriod(period string) (time.Time, time.Time, error) {
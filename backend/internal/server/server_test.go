@@ -0,0 +1,167 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/murraystewart96/token-swap/internal/models"
+	storageMock "github.com/murraystewart96/token-swap/internal/storage/mock"
+	"github.com/murraystewart96/token-swap/internal/worker"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+const (
+	checksummedPool = "0x5FbDB2315678afecb367f032d93F642f64180aa3"
+	lowercasePool   = "0x5fbdb2315678afecb367f032d93f642f64180aa3"
+)
+
+func newTestRouter(handler *Handler) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+
+	router := gin.New()
+	router.GET("/api/pool/current-price", handler.GetCurrentPrice)
+	router.GET("/api/pool/reserves", handler.GetReserves)
+	router.GET("/api/trades", handler.GetTrades)
+	router.GET("/api/analytics/volume", handler.GetVolumeAnalytics)
+	router.GET("/api/analytics/price-history", handler.GetPriceHistory)
+
+	return router
+}
+
+func TestHandler_PoolAddress(t *testing.T) {
+	tests := []struct {
+		name           string
+		url            string
+		setupMocks     func(*storageMock.PoolCache, *storageMock.DB)
+		expectedStatus int
+	}{
+		{
+			name: "lowercase address reads checksummed reserves from cache",
+			url:  "/api/pool/reserves?pool_address=" + lowercasePool,
+			setupMocks: func(cache *storageMock.PoolCache, db *storageMock.DB) {
+				cache.On("GetReserves", mock.Anything, checksummedPool).Return(&models.PoolReserves{
+					METAmount: "100.0",
+					YOUAmount: "150.0",
+				}, nil)
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name: "lowercase address reads checksummed reserves from database",
+			url:  "/api/pool/reserves?status=confirmed&pool_address=" + lowercasePool,
+			setupMocks: func(cache *storageMock.PoolCache, db *storageMock.DB) {
+				db.On("GetLatestReserve", mock.Anything, checksummedPool, []string{models.EventStatusConfirmed}).Return(&models.ReserveEvent{
+					METReserve: "100.0",
+					YOUReserve: "150.0",
+				}, nil)
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name: "lowercase address reads checksummed price from cache",
+			url:  "/api/pool/current-price?trading_pair=" + worker.MET_YOU_PAIR + "&pool_address=" + lowercasePool,
+			setupMocks: func(cache *storageMock.PoolCache, db *storageMock.DB) {
+				cache.On("GetPrice", mock.Anything, checksummedPool, worker.MET_YOU_PAIR).Return(&models.PoolPrice{Price: "1.500000"}, nil)
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name: "lowercase address reads checksummed trades",
+			url:  "/api/trades?pool_address=" + lowercasePool,
+			setupMocks: func(cache *storageMock.PoolCache, db *storageMock.DB) {
+				db.On("GetTradesByCursor", mock.Anything, checksummedPool, []string(nil), uint64(0), uint(0), uint(0), 20).
+					Return([]*models.TradeEvent{}, nil)
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name: "trades of all pools when address omitted",
+			url:  "/api/trades",
+			setupMocks: func(cache *storageMock.PoolCache, db *storageMock.DB) {
+				db.On("GetTradesByCursor", mock.Anything, "", []string(nil), uint64(0), uint(0), uint(0), 20).
+					Return([]*models.TradeEvent{}, nil)
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name: "lowercase address reads checksummed volume",
+			url:  "/api/analytics/volume?pool_address=" + lowercasePool,
+			setupMocks: func(cache *storageMock.PoolCache, db *storageMock.DB) {
+				db.On("GetVolumeAnalytics", mock.Anything, checksummedPool, []string(nil), mock.Anything, mock.Anything, "all").
+					Return(&models.VolumeResponse{}, nil)
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "invalid address rejected",
+			url:            "/api/pool/reserves?pool_address=0xpool123",
+			setupMocks:     func(*storageMock.PoolCache, *storageMock.DB) {},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "invalid price history address rejected",
+			url:            "/api/analytics/price-history?pool_address=not-an-address",
+			setupMocks:     func(*storageMock.PoolCache, *storageMock.DB) {},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "invalid optional address rejected",
+			url:            "/api/trades?pool_address=0x1234",
+			setupMocks:     func(*storageMock.PoolCache, *storageMock.DB) {},
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCache := &storageMock.PoolCache{}
+			DB := &storageMock.DB{}
+			tt.setupMocks(mockCache, DB)
+
+			router := newTestRouter(NewHandler(DB, mockCache))
+
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.url, nil))
+
+			assert.Equal(t, tt.expectedStatus, rec.Code, rec.Body.String())
+
+			mockCache.AssertExpectations(t)
+			DB.AssertExpectations(t)
+		})
+	}
+}
+
+type requestKey struct{}
+
+func TestHandler_PassesRequestContextToCache(t *testing.T) {
+	// Matches only the context of the request, not the *gin.Context
+	fromRequest := mock.MatchedBy(func(ctx context.Context) bool {
+		_, isGin := ctx.(*gin.Context)
+		return !isGin && ctx.Value(requestKey{}) == "request"
+	})
+
+	mockCache := &storageMock.PoolCache{}
+	mockCache.On("GetReserves", fromRequest, checksummedPool).Return(&models.PoolReserves{}, nil)
+	mockCache.On("GetPrice", fromRequest, checksummedPool, worker.MET_YOU_PAIR).Return(&models.PoolPrice{}, nil)
+
+	router := newTestRouter(NewHandler(&storageMock.DB{}, mockCache))
+
+	for _, url := range []string{
+		"/api/pool/reserves?pool_address=" + checksummedPool,
+		"/api/pool/current-price?trading_pair=" + worker.MET_YOU_PAIR + "&pool_address=" + checksummedPool,
+	} {
+		req := httptest.NewRequest(http.MethodGet, url, nil)
+		req = req.WithContext(context.WithValue(req.Context(), requestKey{}, "request"))
+
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	}
+
+	mockCache.AssertExpectations(t)
+}
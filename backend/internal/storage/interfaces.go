@@ -8,33 +8,68 @@ import (
 )
 
 type PoolCache interface {
-	SetPrice(ctx context.Context, pair string, price string) error
-	GetPrice(ctx context.Context, pair string) (string, error)
-	SetReserves(ctx context.Context, poolAddr string, reserves *models.PoolReserves) error
+	// Setters only store state derived from a later block position than the
+	// cached state, returning false if the state was stale
+	SetPrice(ctx context.Context, poolAddr, pair string, price *models.PoolPrice) (bool, error)
+	GetPrice(ctx context.Context, poolAddr, pair string) (*models.PoolPrice, error)
+	SetReserves(ctx context.Context, poolAddr string, reserves *models.PoolReserves) (bool, error)
 	GetReserves(ctx context.Context, poolAddr string) (*models.PoolReserves, error)
+	// ResetPoolFrom removes cached state derived from blocks at or above blockNumber
+	ResetPoolFrom(ctx context.Context, poolAddr string, blockNumber uint64) error
 	Reset() error
 }
 
+// Reads that take statuses return events with one of them, or the pending and
+// confirmed events (those still on the canonical chain) when given none
 type DB interface {
 	// Trade operations
-	CreateTrade(trade *models.TradeEvent) error
-	GetTradesByTimeRange(start, end time.Time) ([]*models.TradeEvent, error)
-	GetTradesByCursor(cursorBlock uint64, cursorTx uint, limit int) ([]*models.TradeEvent, error)
-	UpdateConfirmedTrades(confirmationThreshold uint64) error
+	// Writes are idempotent - storing an event that is already stored is a no-op and returns false,
+	// unless it was orphaned and its block is canonical again, when it's pending again.
+	// The status each event is stored with is set on it.
+	CreateTrade(ctx context.Context, trade *models.TradeEvent) (bool, error)
+	// Batch writes are atomic and return the number of events that weren't already stored
+	CreateTrades(ctx context.Context, trades []*models.TradeEvent) (int, error)
+	// An empty pool address reads events from every pool
+	GetTradesByTimeRange(ctx context.Context, poolAddr string, statuses []string, start, end time.Time) ([]*models.TradeEvent, error)
+	GetTradesByCursor(ctx context.Context, poolAddr string, statuses []string, cursorBlock uint64, cursorTx, cursorLog uint, limit int) ([]*models.TradeEvent, error)
+	// Confirmations record each transition with head, the block that confirmed the event
+	UpdateConfirmedTrades(ctx context.Context, confirmationThreshold uint64, head *models.Block) error
 
 	// Reserve operations
-	CreateReserve(reserve *models.ReserveEvent) error
-	GetReservesByTimeRange(start, end time.Time) ([]*models.ReserveEvent, error)
-	UpdateConfirmedReserves(confirmationThreshold uint64) error
+	CreateReserve(ctx context.Context, reserve *models.ReserveEvent) (bool, error)
+	CreateReserves(ctx context.Context, reserves []*models.ReserveEvent) (int, error)
+	GetReservesByTimeRange(ctx context.Context, poolAddr string, statuses []string, start, end time.Time) ([]*models.ReserveEvent, error)
+	GetLatestReserve(ctx context.Context, poolAddr string, statuses []string) (*models.ReserveEvent, error)
+	UpdateConfirmedReserves(ctx context.Context, confirmationThreshold uint64, head *models.Block) error
 
-	// Analytics
-	GetVolumeAnalytics(start, end time.Time, token string) (*models.VolumeResponse, error)
-	GetPriceHistory(start, end time.Time, interval time.Duration) (*models.PriceHistoryResponse, error)
-	GetActivityAnalytics(start, end time.Time) (*models.ActivityResponse, error)
+	// Analytics - an empty pool address aggregates over every pool
+	GetVolumeAnalytics(ctx context.Context, poolAddr string, statuses []string, start, end time.Time, token string) (*models.VolumeResponse, error)
+	GetPriceHistory(ctx context.Context, poolAddr string, statuses []string, start, end time.Time, interval time.Duration) (*models.PriceHistoryResponse, error)
+	GetActivityAnalytics(ctx context.Context, poolAddr string, statuses []string, start, end time.Time) (*models.ActivityResponse, error)
+	GetGasAnalytics(ctx context.Context, poolAddr string, statuses []string, start, end time.Time) (*models.GasAnalyticsResponse, error)
 
-	RollbackEvents(blockNumber uint64) error
+	// Canonical chain tracking
+	GetCanonicalBlock(ctx context.Context, number uint64) (*models.Block, error)
+	GetLatestCanonicalBlockBelow(ctx context.Context, number uint64) (*models.Block, error)
+	SaveBlocks(ctx context.Context, blocks []*models.Block) error
+	GetCanonicalBlocksFrom(ctx context.Context, number uint64) ([]*models.Block, error)
+	OrphanBlocksFrom(ctx context.Context, number uint64) error
+	// Orphaned events are retained, and each transition is recorded with head, the new head of the reorg.
+	// The blocks are marked orphaned too, so events from them stored afterwards are stored orphaned.
+	OrphanEvents(ctx context.Context, blockHashes []string, forkBlock uint64, head *models.Block) error
+
+	// Listener checkpoints
+	GetCheckpoint(ctx context.Context, contractAddr string) (uint64, bool, error)
+	SetCheckpoint(ctx context.Context, contractAddr string, blockNumber uint64) error
+
+	// Consumer offsets, for workers that store them in the same transaction as
+	// the events they consumed. Stored offsets never move backwards.
+	CreateTradesWithOffsets(ctx context.Context, trades []*models.TradeEvent, offsets []*models.ConsumerOffset) (int, error)
+	CreateReservesWithOffsets(ctx context.Context, reserves []*models.ReserveEvent, offsets []*models.ConsumerOffset) (int, error)
+	GetConsumerOffsets(ctx context.Context, groupID string, topics []string) ([]*models.ConsumerOffset, error)
+	SetConsumerOffsets(ctx context.Context, offsets []*models.ConsumerOffset) error
 
 	// Infrastructure operations
-	Exec(query string) error
+	Exec(ctx context.Context, query string) error
 	Close()
 }
@@ -1,6 +1,7 @@
 package mock
 
 import (
+	"context"
 	"time"
 
 	"github.com/murraystewart96/token-swap/internal/models"
@@ -12,60 +13,150 @@ type DB struct {
 }
 
 // Trade operations
-func (m *DB) CreateTrade(trade *models.TradeEvent) error {
-	args := m.Called(trade)
-	return args.Error(0)
+func (m *DB) CreateTrade(ctx context.Context, trade *models.TradeEvent) (bool, error) {
+	args := m.Called(ctx, trade)
+	return args.Bool(0), args.Error(1)
+}
+
+func (m *DB) CreateTrades(ctx context.Context, trades []*models.TradeEvent) (int, error) {
+	args := m.Called(ctx, trades)
+	return args.Int(0), args.Error(1)
 }
 
-func (m *DB) GetTradesByTimeRange(start, end time.Time) ([]*models.TradeEvent, error) {
-	args := m.Called(start, end)
+func (m *DB) GetTradesByTimeRange(ctx context.Context, poolAddr string, statuses []string, start, end time.Time) ([]*models.TradeEvent, error) {
+	args := m.Called(ctx, poolAddr, statuses, start, end)
 	return args.Get(0).([]*models.TradeEvent), args.Error(1)
 }
 
-func (m *DB) GetTradesByCursor(cursorBlock uint64, cursorTx uint, limit int) ([]*models.TradeEvent, error) {
-	args := m.Called(cursorBlock, cursorTx, limit)
+func (m *DB) GetTradesByCursor(ctx context.Context, poolAddr string, statuses []string, cursorBlock uint64, cursorTx, cursorLog uint, limit int) ([]*models.TradeEvent, error) {
+	args := m.Called(ctx, poolAddr, statuses, cursorBlock, cursorTx, cursorLog, limit)
 	return args.Get(0).([]*models.TradeEvent), args.Error(1)
 }
 
-func (m *DB) UpdateConfirmedTrades(confirmationThreshold uint64) error {
-	args := m.Called(confirmationThreshold)
+func (m *DB) UpdateConfirmedTrades(ctx context.Context, confirmationThreshold uint64, head *models.Block) error {
+	args := m.Called(ctx, confirmationThreshold, head)
 	return args.Error(0)
 }
 
 // Reserve operations
-func (m *DB) CreateReserve(reserve *models.ReserveEvent) error {
-	args := m.Called(reserve)
-	return args.Error(0)
+func (m *DB) CreateReserve(ctx context.Context, reserve *models.ReserveEvent) (bool, error) {
+	args := m.Called(ctx, reserve)
+	return args.Bool(0), args.Error(1)
 }
 
-func (m *DB) GetReservesByTimeRange(start, end time.Time) ([]*models.ReserveEvent, error) {
-	args := m.Called(start, end)
+func (m *DB) CreateReserves(ctx context.Context, reserves []*models.ReserveEvent) (int, error) {
+	args := m.Called(ctx, reserves)
+	return args.Int(0), args.Error(1)
+}
+
+func (m *DB) GetReservesByTimeRange(ctx context.Context, poolAddr string, statuses []string, start, end time.Time) ([]*models.ReserveEvent, error) {
+	args := m.Called(ctx, poolAddr, statuses, start, end)
 	return args.Get(0).([]*models.ReserveEvent), args.Error(1)
 }
 
-func (m *DB) UpdateConfirmedReserves(confirmationThreshold uint64) error {
-	args := m.Called(confirmationThreshold)
+func (m *DB) GetLatestReserve(ctx context.Context, poolAddr string, statuses []string) (*models.ReserveEvent, error) {
+	args := m.Called(ctx, poolAddr, statuses)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*models.ReserveEvent), args.Error(1)
+}
+
+func (m *DB) UpdateConfirmedReserves(ctx context.Context, confirmationThreshold uint64, head *models.Block) error {
+	args := m.Called(ctx, confirmationThreshold, head)
 	return args.Error(0)
 }
 
 // Analytics
-func (m *DB) GetVolumeAnalytics(start, end time.Time, token string) (*models.VolumeResponse, error) {
-	args := m.Called(start, end, token)
+func (m *DB) GetVolumeAnalytics(ctx context.Context, poolAddr string, statuses []string, start, end time.Time, token string) (*models.VolumeResponse, error) {
+	args := m.Called(ctx, poolAddr, statuses, start, end, token)
 	return args.Get(0).(*models.VolumeResponse), args.Error(1)
 }
 
-func (m *DB) GetPriceHistory(start, end time.Time, interval time.Duration) (*models.PriceHistoryResponse, error) {
-	args := m.Called(start, end, interval)
+func (m *DB) GetPriceHistory(ctx context.Context, poolAddr string, statuses []string, start, end time.Time, interval time.Duration) (*models.PriceHistoryResponse, error) {
+	args := m.Called(ctx, poolAddr, statuses, start, end, interval)
 	return args.Get(0).(*models.PriceHistoryResponse), args.Error(1)
 }
 
-func (m *DB) GetActivityAnalytics(start, end time.Time) (*models.ActivityResponse, error) {
-	args := m.Called(start, end)
+func (m *DB) GetActivityAnalytics(ctx context.Context, poolAddr string, statuses []string, start, end time.Time) (*models.ActivityResponse, error) {
+	args := m.Called(ctx, poolAddr, statuses, start, end)
 	return args.Get(0).(*models.ActivityResponse), args.Error(1)
 }
 
-func (m *DB) RollbackEvents(blockNumber uint64) error {
-	args := m.Called(blockNumber)
+func (m *DB) GetGasAnalytics(ctx context.Context, poolAddr string, statuses []string, start, end time.Time) (*models.GasAnalyticsResponse, error) {
+	args := m.Called(ctx, poolAddr, statuses, start, end)
+	return args.Get(0).(*models.GasAnalyticsResponse), args.Error(1)
+}
+
+// Canonical chain tracking
+func (m *DB) GetCanonicalBlock(ctx context.Context, number uint64) (*models.Block, error) {
+	args := m.Called(ctx, number)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*models.Block), args.Error(1)
+}
+
+func (m *DB) GetLatestCanonicalBlockBelow(ctx context.Context, number uint64) (*models.Block, error) {
+	args := m.Called(ctx, number)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*models.Block), args.Error(1)
+}
+
+func (m *DB) SaveBlocks(ctx context.Context, blocks []*models.Block) error {
+	args := m.Called(ctx, blocks)
+	return args.Error(0)
+}
+
+func (m *DB) GetCanonicalBlocksFrom(ctx context.Context, number uint64) ([]*models.Block, error) {
+	args := m.Called(ctx, number)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]*models.Block), args.Error(1)
+}
+
+func (m *DB) OrphanBlocksFrom(ctx context.Context, number uint64) error {
+	args := m.Called(ctx, number)
+	return args.Error(0)
+}
+
+func (m *DB) OrphanEvents(ctx context.Context, blockHashes []string, forkBlock uint64, head *models.Block) error {
+	args := m.Called(ctx, blockHashes, forkBlock, head)
+	return args.Error(0)
+}
+
+// Listener checkpoints
+func (m *DB) GetCheckpoint(ctx context.Context, contractAddr string) (uint64, bool, error) {
+	args := m.Called(ctx, contractAddr)
+	return args.Get(0).(uint64), args.Bool(1), args.Error(2)
+}
+
+func (m *DB) SetCheckpoint(ctx context.Context, contractAddr string, blockNumber uint64) error {
+	args := m.Called(ctx, contractAddr, blockNumber)
+	return args.Error(0)
+}
+
+// Consumer offsets
+func (m *DB) CreateTradesWithOffsets(ctx context.Context, trades []*models.TradeEvent, offsets []*models.ConsumerOffset) (int, error) {
+	args := m.Called(ctx, trades, offsets)
+	return args.Int(0), args.Error(1)
+}
+
+func (m *DB) CreateReservesWithOffsets(ctx context.Context, reserves []*models.ReserveEvent, offsets []*models.ConsumerOffset) (int, error) {
+	args := m.Called(ctx, reserves, offsets)
+	return args.Int(0), args.Error(1)
+}
+
+func (m *DB) GetConsumerOffsets(ctx context.Context, groupID string, topics []string) ([]*models.ConsumerOffset, error) {
+	args := m.Called(ctx, groupID, topics)
+	return args.Get(0).([]*models.ConsumerOffset), args.Error(1)
+}
+
+func (m *DB) SetConsumerOffsets(ctx context.Context, offsets []*models.ConsumerOffset) error {
+	args := m.Called(ctx, offsets)
 	return args.Error(0)
 }
 
@@ -73,6 +164,6 @@ func (m *DB) Close() {
 	m.Called()
 }
 
-func (m *DB) Exec(query string) error {
+func (m *DB) Exec(ctx context.Context, query string) error {
 	return nil
 }
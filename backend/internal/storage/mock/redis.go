@@ -11,19 +11,22 @@ type PoolCache struct {
 	mock.Mock
 }
 
-func (m *PoolCache) SetPrice(ctx context.Context, pair string, price string) error {
-	args := m.Called(ctx, pair, price)
-	return args.Error(0)
+func (m *PoolCache) SetPrice(ctx context.Context, poolAddr, pair string, price *models.PoolPrice) (bool, error) {
+	args := m.Called(ctx, poolAddr, pair, price)
+	return args.Bool(0), args.Error(1)
 }
 
-func (m *PoolCache) GetPrice(ctx context.Context, pair string) (string, error) {
-	args := m.Called(ctx, pair)
-	return args.String(0), args.Error(1)
+func (m *PoolCache) GetPrice(ctx context.Context, poolAddr, pair string) (*models.PoolPrice, error) {
+	args := m.Called(ctx, poolAddr, pair)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*models.PoolPrice), args.Error(1)
 }
 
-func (m *PoolCache) SetReserves(ctx context.Context, poolAddr string, reserves *models.PoolReserves) error {
+func (m *PoolCache) SetReserves(ctx context.Context, poolAddr string, reserves *models.PoolReserves) (bool, error) {
 	args := m.Called(ctx, poolAddr, reserves)
-	return args.Error(0)
+	return args.Bool(0), args.Error(1)
 }
 
 func (m *PoolCache) GetReserves(ctx context.Context, poolAddr string) (*models.PoolReserves, error) {
@@ -31,6 +34,11 @@ func (m *PoolCache) GetReserves(ctx context.Context, poolAddr string) (*models.P
 	return args.Get(0).(*models.PoolReserves), args.Error(1)
 }
 
+func (m *PoolCache) ResetPoolFrom(ctx context.Context, poolAddr string, blockNumber uint64) error {
+	args := m.Called(ctx, poolAddr, blockNumber)
+	return args.Error(0)
+}
+
 func (m *PoolCache) Reset() error {
 	return nil
 }
@@ -11,9 +11,13 @@ import (
 
 const (
 	periodFormat = "2006-01-02 15:04"
+	weiPerETH    = "1000000000000000000"
 )
 
-func (db *DB) GetVolumeAnalytics(start, end time.Time, token string) (*models.VolumeResponse, error) {
+func (db *DB) GetVolumeAnalytics(ctx context.Context, poolAddr string, statuses []string, start, end time.Time, token string) (*models.VolumeResponse, error) {
+	ctx, cancel := db.withAnalyticsTimeout(ctx)
+	defer cancel()
+
 	var query string
 	var args []any
 
@@ -28,8 +32,8 @@ func (db *DB) GetVolumeAnalytics(start, end time.Time, token string) (*models.Vo
                          ELSE 0 END), 0) as you_volume,
             COUNT(*) as trade_count
         FROM trades 
-        WHERE to_timestamp(timestamp) BETWEEN $1 AND $2`
-		args = []any{start, end}
+        WHERE status = ANY($4) AND ($3 = '' OR pool_address = $3) AND to_timestamp(timestamp) BETWEEN $1 AND $2`
+		args = []any{start, end, poolAddr, statusesOrCanonical(statuses)}
 	} else {
 		query = `
         SELECT 
@@ -38,13 +42,17 @@ func (db *DB) GetVolumeAnalytics(start, end time.Time, token string) (*models.Vo
                          ELSE 0 END), 0) as volume,
             COUNT(*) as trade_count
         FROM trades 
-        WHERE (token_in = $1 OR token_out = $1) AND to_timestamp(timestamp) BETWEEN $2 AND $3`
-		args = []any{token, start, end}
+        WHERE status = ANY($5) AND ($4 = '' OR pool_address = $4)
+          AND (token_in = $1 OR token_out = $1) AND to_timestamp(timestamp) BETWEEN $2 AND $3`
+		args = []any{token, start, end, poolAddr, statusesOrCanonical(statuses)}
 	}
 
-	row := db.pool.QueryRow(context.Background(), query, args...)
+	row := db.pool.QueryRow(ctx, query, args...)
 
-	response := &models.VolumeResponse{Period: fmt.Sprintf("%v to %v", start.Format(periodFormat), end.Format(periodFormat))}
+	response := &models.VolumeResponse{
+		Period:      fmt.Sprintf("%v to %v", start.Format(periodFormat), end.Format(periodFormat)),
+		PoolAddress: poolAddr,
+	}
 
 	if token == "all" {
 		var metVolume, youVolume string
@@ -72,7 +80,10 @@ func (db *DB) GetVolumeAnalytics(start, end time.Time, token string) (*models.Vo
 	return response, nil
 }
 
-func (db *DB) GetPriceHistory(start, end time.Time, interval time.Duration) (*models.PriceHistoryResponse, error) {
+func (db *DB) GetPriceHistory(ctx context.Context, poolAddr string, statuses []string, start, end time.Time, interval time.Duration) (*models.PriceHistoryResponse, error) {
+	ctx, cancel := db.withAnalyticsTimeout(ctx)
+	defer cancel()
+
 	// Create time buckets and get the last trade in each bucket
 	intervalSeconds := int(interval.Seconds())
 
@@ -88,7 +99,7 @@ func (db *DB) GetPriceHistory(start, end time.Time, interval time.Duration) (*mo
                     ORDER BY timestamp DESC
                 ) as rn
             FROM trades
-            WHERE to_timestamp(timestamp) BETWEEN $1 AND $2
+            WHERE status = ANY($5) AND ($4 = '' OR pool_address = $4) AND to_timestamp(timestamp) BETWEEN $1 AND $2
         ),
         price_points AS (
             SELECT 
@@ -106,7 +117,7 @@ func (db *DB) GetPriceHistory(start, end time.Time, interval time.Duration) (*mo
         GROUP BY bucket_start, price
         ORDER BY bucket_start ASC`
 
-	rows, err := db.pool.Query(context.Background(), query, start, end, intervalSeconds)
+	rows, err := db.pool.Query(ctx, query, start, end, intervalSeconds, poolAddr, statusesOrCanonical(statuses))
 	if err != nil {
 		return nil, err
 	}
@@ -130,23 +141,70 @@ func (db *DB) GetPriceHistory(start, end time.Time, interval time.Duration) (*mo
 	}
 
 	return &models.PriceHistoryResponse{
-		Period:     fmt.Sprintf("%v to %v", start.Format(periodFormat), end.Format(periodFormat)),
-		Interval:   interval.String(),
-		DataPoints: dataPoints,
+		Period:      fmt.Sprintf("%v to %v", start.Format(periodFormat), end.Format(periodFormat)),
+		PoolAddress: poolAddr,
+		Interval:    interval.String(),
+		DataPoints:  dataPoints,
 	}, rows.Err()
 }
 
-func (db *DB) GetActivityAnalytics(start, end time.Time) (*models.ActivityResponse, error) {
+// GetGasAnalytics aggregates the gas and fees paid by trades. Fees are counted
+// once per transaction, so a transaction containing several swaps isn't double
+// counted. Trades stored before gas enrichment are excluded from the gas figures.
+func (db *DB) GetGasAnalytics(ctx context.Context, poolAddr string, statuses []string, start, end time.Time) (*models.GasAnalyticsResponse, error) {
+	ctx, cancel := db.withAnalyticsTimeout(ctx)
+	defer cancel()
+
+	query := `
+        WITH filtered AS (
+            SELECT tx_hash, block_hash, sender, tx_from, gas_used, effective_gas_price, tx_fee
+            FROM trades
+            WHERE status = ANY($4) AND ($3 = '' OR pool_address = $3) AND to_timestamp(timestamp) BETWEEN $1 AND $2
+        ),
+        txs AS (
+            SELECT DISTINCT ON (tx_hash, block_hash) gas_used, effective_gas_price, tx_fee
+            FROM filtered
+            WHERE gas_used > 0
+        )
+        SELECT 
+            (SELECT COUNT(*) FROM filtered) as trade_count,
+            (SELECT COUNT(*) FROM filtered WHERE tx_from <> '' AND tx_from <> sender) as routed_trades,
+            COALESCE(SUM(gas_used), 0)::text as total_gas_used,
+            COALESCE(ROUND(AVG(gas_used)), 0)::text as average_gas_used,
+            COALESCE(ROUND(SUM(effective_gas_price * gas_used) / NULLIF(SUM(gas_used), 0)), 0)::text as average_gas_price,
+            (COALESCE(SUM(tx_fee), 0) / ` + weiPerETH + `)::text as total_fees_eth,
+            (COALESCE(AVG(tx_fee), 0) / ` + weiPerETH + `)::text as average_fee_eth
+        FROM txs`
+
+	response := &models.GasAnalyticsResponse{
+		Period:      fmt.Sprintf("%v to %v", start.Format(periodFormat), end.Format(periodFormat)),
+		PoolAddress: poolAddr,
+	}
+
+	err := db.pool.QueryRow(ctx, query, start, end, poolAddr, statusesOrCanonical(statuses)).Scan(
+		&response.TradeCount, &response.RoutedTrades, &response.TotalGasUsed, &response.AverageGasUsed,
+		&response.AverageGasPrice, &response.TotalFeesETH, &response.AverageFeeETH)
+	if err != nil {
+		return nil, err
+	}
+
+	return response, nil
+}
+
+func (db *DB) GetActivityAnalytics(ctx context.Context, poolAddr string, statuses []string, start, end time.Time) (*models.ActivityResponse, error) {
+	ctx, cancel := db.withAnalyticsTimeout(ctx)
+	defer cancel()
+
 	// Get basic stats
 	basicQuery := `
         SELECT 
             COUNT(*) as total_trades,
             COUNT(DISTINCT sender) as unique_traders
         FROM trades 
-        WHERE to_timestamp(timestamp) BETWEEN $1 AND $2`
+        WHERE status = ANY($4) AND ($3 = '' OR pool_address = $3) AND to_timestamp(timestamp) BETWEEN $1 AND $2`
 
 	var totalTrades, uniqueTraders int64
-	err := db.pool.QueryRow(context.Background(), basicQuery, start, end).Scan(&totalTrades, &uniqueTraders)
+	err := db.pool.QueryRow(ctx, basicQuery, start, end, poolAddr, statusesOrCanonical(statuses)).Scan(&totalTrades, &uniqueTraders)
 	if err != nil {
 		return nil, err
 	}
@@ -157,14 +215,14 @@ func (db *DB) GetActivityAnalytics(start, end time.Time) (*models.ActivityRespon
             EXTRACT(HOUR FROM to_timestamp(timestamp)) as hour,
             COUNT(*) as trades_count
         FROM trades 
-        WHERE to_timestamp(timestamp) BETWEEN $1 AND $2
+        WHERE status = ANY($4) AND ($3 = '' OR pool_address = $3) AND to_timestamp(timestamp) BETWEEN $1 AND $2
         GROUP BY EXTRACT(HOUR FROM to_timestamp(timestamp))
         ORDER BY trades_count DESC
         LIMIT 1`
 
 	var peakHour int
 	var peakTrades int64
-	err = db.pool.QueryRow(context.Background(), hourlyQuery, start, end).Scan(&peakHour, &peakTrades)
+	err = db.pool.QueryRow(ctx, hourlyQuery, start, end, poolAddr, statusesOrCanonical(statuses)).Scan(&peakHour, &peakTrades)
 	if err != nil && err != pgx.ErrNoRows {
 		return nil, err
 	}
@@ -179,6 +237,7 @@ func (db *DB) GetActivityAnalytics(start, end time.Time) (*models.ActivityRespon
 
 	return &models.ActivityResponse{
 		Period:         fmt.Sprintf("%v to %v", start.Format(periodFormat), end.Format(periodFormat)),
+		PoolAddress:    poolAddr,
 		TotalTrades:    totalTrades,
 		UniqueTraders:  uniqueTraders,
 		AveragePerHour: averagePerHour,
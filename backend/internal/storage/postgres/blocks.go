@@ -0,0 +1,158 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/murraystewart96/token-swap/internal/models"
+)
+
+// GetCanonicalBlock returns the canonical block stored at the given height, or nil if none is stored.
+func (db *DB) GetCanonicalBlock(ctx context.Context, number uint64) (*models.Block, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+        SELECT number, hash, parent_hash, timestamp, status
+        FROM blocks
+        WHERE number = $1 AND status = $2`
+
+	block := &models.Block{}
+	err := db.pool.QueryRow(ctx, query, number, models.BlockStatusCanonical).
+		Scan(&block.Number, &block.Hash, &block.ParentHash, &block.Timestamp, &block.Status)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return block, nil
+}
+
+// GetLatestCanonicalBlockBelow returns the highest canonical block stored below the given height, or nil if none is stored.
+func (db *DB) GetLatestCanonicalBlockBelow(ctx context.Context, number uint64) (*models.Block, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+        SELECT number, hash, parent_hash, timestamp, status
+        FROM blocks
+        WHERE number < $1 AND status = $2
+        ORDER BY number DESC
+        LIMIT 1`
+
+	block := &models.Block{}
+	err := db.pool.QueryRow(ctx, query, number, models.BlockStatusCanonical).
+		Scan(&block.Number, &block.Hash, &block.ParentHash, &block.Timestamp, &block.Status)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return block, nil
+}
+
+// SaveBlocks stores the given blocks as canonical. A block that was previously
+// orphaned is marked canonical again, replacing the placeholder header stored
+// if the worker orphaned it first.
+func (db *DB) SaveBlocks(ctx context.Context, blocks []*models.Block) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := db.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	query := `
+        INSERT INTO blocks (number, hash, parent_hash, timestamp, status)
+        VALUES ($1, $2, $3, $4, $5)
+        ON CONFLICT (hash)
+        DO UPDATE SET number = EXCLUDED.number, parent_hash = EXCLUDED.parent_hash,
+                      timestamp = EXCLUDED.timestamp, status = EXCLUDED.status`
+
+	for _, block := range blocks {
+		_, err = tx.Exec(ctx, query,
+			block.Number, block.Hash, block.ParentHash, block.Timestamp, models.BlockStatusCanonical)
+		if err != nil {
+			return fmt.Errorf("failed to save block %d: %w", block.Number, err)
+		}
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// GetCanonicalBlocksFrom returns the canonical blocks stored at or above the given height, lowest first.
+func (db *DB) GetCanonicalBlocksFrom(ctx context.Context, number uint64) ([]*models.Block, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+        SELECT number, hash, parent_hash, timestamp, status
+        FROM blocks
+        WHERE status = $1 AND number >= $2
+        ORDER BY number ASC`
+
+	rows, err := db.pool.Query(ctx, query, models.BlockStatusCanonical, number)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var blocks []*models.Block
+	for rows.Next() {
+		block := &models.Block{}
+		err := rows.Scan(&block.Number, &block.Hash, &block.ParentHash, &block.Timestamp, &block.Status)
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, block)
+	}
+
+	return blocks, rows.Err()
+}
+
+// OrphanBlocksFrom marks every canonical block at or above the given height as orphaned.
+func (db *DB) OrphanBlocksFrom(ctx context.Context, number uint64) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+        UPDATE blocks
+        SET status = $1
+        WHERE status = $2
+          AND number >= $3`
+
+	_, err := db.pool.Exec(ctx, query,
+		models.BlockStatusOrphaned, models.BlockStatusCanonical, number)
+
+	return err
+}
+
+// orphanBlocks marks the given blocks orphaned. A block the listener hasn't
+// stored yet is stored with a placeholder header at the fork block, as
+// retractions only carry block hashes, and is replaced if it's saved as
+// canonical again.
+func orphanBlocks(ctx context.Context, tx pgx.Tx, blockHashes []string, forkBlock uint64) error {
+	query := `
+        INSERT INTO blocks (number, hash, parent_hash, timestamp, status)
+        SELECT $2, hash, '', 0, $3
+        FROM UNNEST($1::VARCHAR[]) AS hash
+        ON CONFLICT (hash)
+        DO UPDATE SET status = EXCLUDED.status`
+
+	_, err := tx.Exec(ctx, query, blockHashes, forkBlock, models.BlockStatusOrphaned)
+
+	return err
+}
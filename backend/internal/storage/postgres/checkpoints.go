@@ -0,0 +1,46 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// GetCheckpoint returns the last fully processed block for a contract.
+// found is false when the listener has never persisted a checkpoint for it.
+func (db *DB) GetCheckpoint(ctx context.Context, contractAddr string) (uint64, bool, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+        SELECT block_number
+        FROM listener_checkpoints
+        WHERE contract_address = $1`
+
+	var blockNumber uint64
+	err := db.pool.QueryRow(ctx, query, contractAddr).Scan(&blockNumber)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, false, nil
+		}
+		return 0, false, err
+	}
+
+	return blockNumber, true, nil
+}
+
+func (db *DB) SetCheckpoint(ctx context.Context, contractAddr string, blockNumber uint64) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+        INSERT INTO listener_checkpoints (contract_address, block_number, updated_at)
+        VALUES ($1, $2, NOW())
+        ON CONFLICT (contract_address)
+        DO UPDATE SET block_number = EXCLUDED.block_number, updated_at = NOW()`
+
+	_, err := db.pool.Exec(ctx, query, contractAddr, blockNumber)
+
+	return err
+}
@@ -0,0 +1,10 @@
+-- +goose Up
+CREATE TABLE listener_checkpoints (
+    contract_address VARCHAR(42) PRIMARY KEY,
+    block_number BIGINT NOT NULL,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+-- +goose Down
+DROP TABLE IF EXISTS listener_checkpoints;
+
@@ -0,0 +1,28 @@
+-- +goose Up
+CREATE TABLE blocks (
+    hash VARCHAR(66) PRIMARY KEY,
+    number BIGINT NOT NULL,
+    parent_hash VARCHAR(66) NOT NULL,
+    timestamp BIGINT NOT NULL,
+    status VARCHAR(16) NOT NULL DEFAULT 'canonical',
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+-- Only one canonical block per height
+CREATE UNIQUE INDEX blocks_canonical_number_idx ON blocks (number) WHERE status = 'canonical';
+
+ALTER TABLE trades ADD COLUMN block_hash VARCHAR(66) NOT NULL DEFAULT '';
+ALTER TABLE reserves ADD COLUMN block_hash VARCHAR(66) NOT NULL DEFAULT '';
+
+CREATE INDEX trades_block_hash_idx ON trades (block_hash);
+CREATE INDEX reserves_block_hash_idx ON reserves (block_hash);
+
+-- +goose Down
+DROP INDEX IF EXISTS reserves_block_hash_idx;
+DROP INDEX IF EXISTS trades_block_hash_idx;
+
+ALTER TABLE reserves DROP COLUMN IF EXISTS block_hash;
+ALTER TABLE trades DROP COLUMN IF EXISTS block_hash;
+
+DROP TABLE IF EXISTS blocks;
+
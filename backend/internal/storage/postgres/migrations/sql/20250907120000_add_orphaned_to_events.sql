@@ -0,0 +1,19 @@
+-- +goose Up
+-- Events from reorganised blocks are retained but marked orphaned by the worker
+ALTER TABLE trades ADD COLUMN orphaned BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE reserves ADD COLUMN orphaned BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- The same transaction can be included in both an orphaned and a canonical block
+ALTER TABLE trades DROP CONSTRAINT IF EXISTS trades_tx_hash_key;
+ALTER TABLE trades ADD CONSTRAINT trades_tx_hash_block_hash_key UNIQUE (tx_hash, block_hash);
+
+CREATE INDEX reserves_pool_latest_idx ON reserves (pool_address, block_number DESC) WHERE NOT orphaned;
+
+-- +goose Down
+DROP INDEX IF EXISTS reserves_pool_latest_idx;
+
+ALTER TABLE trades DROP CONSTRAINT IF EXISTS trades_tx_hash_block_hash_key;
+ALTER TABLE trades ADD CONSTRAINT trades_tx_hash_key UNIQUE (tx_hash);
+
+ALTER TABLE reserves DROP COLUMN IF EXISTS orphaned;
+ALTER TABLE trades DROP COLUMN IF EXISTS orphaned;
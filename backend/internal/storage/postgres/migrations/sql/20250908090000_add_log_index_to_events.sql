@@ -0,0 +1,41 @@
+-- +goose Up
+-- A transaction can emit several Swap/Sync events (e.g. a router doing multiple swaps),
+-- so events are identified by their log index within the transaction's block
+ALTER TABLE trades ADD COLUMN log_index INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE reserves ADD COLUMN log_index INTEGER NOT NULL DEFAULT 0;
+
+ALTER TABLE trades DROP CONSTRAINT IF EXISTS trades_tx_hash_block_hash_key;
+ALTER TABLE trades ADD CONSTRAINT trades_tx_hash_log_index_block_hash_key UNIQUE (tx_hash, log_index, block_hash);
+
+-- Existing reserves have no log index. Drop redelivered copies, then number any
+-- remaining snapshots from the same transaction in insertion order.
+DELETE FROM reserves r
+USING reserves d
+WHERE r.tx_hash = d.tx_hash
+  AND r.block_hash = d.block_hash
+  AND r.met_reserve = d.met_reserve
+  AND r.you_reserve = d.you_reserve
+  AND r.id > d.id;
+
+UPDATE reserves r
+SET log_index = n.rn - 1
+FROM (
+    SELECT id, ROW_NUMBER() OVER (PARTITION BY tx_hash, block_hash ORDER BY id) AS rn
+    FROM reserves
+) n
+WHERE r.id = n.id AND n.rn > 1;
+
+ALTER TABLE reserves ADD CONSTRAINT reserves_tx_hash_log_index_block_hash_key UNIQUE (tx_hash, log_index, block_hash);
+
+CREATE INDEX trades_cursor_idx ON trades (block_number DESC, transaction_index DESC, log_index DESC) WHERE NOT orphaned;
+
+-- +goose Down
+DROP INDEX IF EXISTS trades_cursor_idx;
+
+ALTER TABLE reserves DROP CONSTRAINT IF EXISTS reserves_tx_hash_log_index_block_hash_key;
+
+ALTER TABLE trades DROP CONSTRAINT IF EXISTS trades_tx_hash_log_index_block_hash_key;
+ALTER TABLE trades ADD CONSTRAINT trades_tx_hash_block_hash_key UNIQUE (tx_hash, block_hash);
+
+ALTER TABLE reserves DROP COLUMN IF EXISTS log_index;
+ALTER TABLE trades DROP COLUMN IF EXISTS log_index;
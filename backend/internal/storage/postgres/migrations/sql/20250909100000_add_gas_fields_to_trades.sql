@@ -0,0 +1,14 @@
+-- +goose Up
+-- Gas and fees of the transaction that contains the swap. Fees are in wei.
+ALTER TABLE trades ADD COLUMN tx_from VARCHAR(42) NOT NULL DEFAULT '';
+ALTER TABLE trades ADD COLUMN tx_nonce BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE trades ADD COLUMN gas_used BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE trades ADD COLUMN effective_gas_price NUMERIC(78, 0) NOT NULL DEFAULT 0;
+ALTER TABLE trades ADD COLUMN tx_fee NUMERIC(78, 0) NOT NULL DEFAULT 0;
+
+-- +goose Down
+ALTER TABLE trades DROP COLUMN IF EXISTS tx_fee;
+ALTER TABLE trades DROP COLUMN IF EXISTS effective_gas_price;
+ALTER TABLE trades DROP COLUMN IF EXISTS gas_used;
+ALTER TABLE trades DROP COLUMN IF EXISTS tx_nonce;
+ALTER TABLE trades DROP COLUMN IF EXISTS tx_from;
@@ -0,0 +1,13 @@
+-- +goose Up
+-- Offsets of workers that store them in the same transaction as the events they consumed
+CREATE TABLE consumer_offsets (
+    group_id VARCHAR(255) NOT NULL,
+    topic VARCHAR(255) NOT NULL,
+    partition INTEGER NOT NULL,
+    next_offset BIGINT NOT NULL,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    PRIMARY KEY (group_id, topic, partition)
+);
+
+-- +goose Down
+DROP TABLE IF EXISTS consumer_offsets;
@@ -0,0 +1,58 @@
+-- +goose Up
+-- Events are pending until their block is confirmed, and orphaned (but retained)
+-- when their block is reorganised out. This replaces the confirmed and orphaned flags.
+ALTER TABLE trades ADD COLUMN status VARCHAR(16) NOT NULL DEFAULT 'pending'
+    CHECK (status IN ('pending', 'confirmed', 'orphaned'));
+ALTER TABLE reserves ADD COLUMN status VARCHAR(16) NOT NULL DEFAULT 'pending'
+    CHECK (status IN ('pending', 'confirmed', 'orphaned'));
+
+UPDATE trades SET status = CASE WHEN orphaned THEN 'orphaned' WHEN confirmed THEN 'confirmed' ELSE 'pending' END;
+UPDATE reserves SET status = CASE WHEN orphaned THEN 'orphaned' WHEN confirmed THEN 'confirmed' ELSE 'pending' END;
+
+DROP INDEX IF EXISTS trades_cursor_idx;
+DROP INDEX IF EXISTS reserves_pool_latest_idx;
+
+ALTER TABLE trades DROP COLUMN confirmed, DROP COLUMN orphaned;
+ALTER TABLE reserves DROP COLUMN confirmed, DROP COLUMN orphaned;
+
+-- Reads can include orphaned events, so these are no longer partial
+CREATE INDEX trades_cursor_idx ON trades (block_number DESC, transaction_index DESC, log_index DESC);
+CREATE INDEX reserves_pool_latest_idx ON reserves (pool_address, block_number DESC);
+
+CREATE INDEX trades_pending_idx ON trades (block_number) WHERE status = 'pending';
+CREATE INDEX reserves_pending_idx ON reserves (block_number) WHERE status = 'pending';
+
+-- Every status change of a stored event, with the block that caused it: the
+-- head that confirmed the event, or the new head of the reorg that orphaned it
+CREATE TABLE event_status_transitions (
+    id BIGSERIAL PRIMARY KEY,
+    event_table VARCHAR(16) NOT NULL,
+    event_id BIGINT NOT NULL,
+    from_status VARCHAR(16) NOT NULL,
+    to_status VARCHAR(16) NOT NULL,
+    block_number BIGINT NOT NULL,
+    block_hash VARCHAR(66) NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX event_status_transitions_event_idx ON event_status_transitions (event_table, event_id);
+
+-- +goose Down
+DROP TABLE IF EXISTS event_status_transitions;
+
+DROP INDEX IF EXISTS reserves_pending_idx;
+DROP INDEX IF EXISTS trades_pending_idx;
+DROP INDEX IF EXISTS reserves_pool_latest_idx;
+DROP INDEX IF EXISTS trades_cursor_idx;
+
+ALTER TABLE trades ADD COLUMN confirmed BOOLEAN DEFAULT FALSE, ADD COLUMN orphaned BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE reserves ADD COLUMN confirmed BOOLEAN DEFAULT FALSE, ADD COLUMN orphaned BOOLEAN NOT NULL DEFAULT FALSE;
+
+UPDATE trades SET confirmed = status = 'confirmed', orphaned = status = 'orphaned';
+UPDATE reserves SET confirmed = status = 'confirmed', orphaned = status = 'orphaned';
+
+CREATE INDEX trades_cursor_idx ON trades (block_number DESC, transaction_index DESC, log_index DESC) WHERE NOT orphaned;
+CREATE INDEX reserves_pool_latest_idx ON reserves (pool_address, block_number DESC) WHERE NOT orphaned;
+
+ALTER TABLE reserves DROP COLUMN IF EXISTS status;
+ALTER TABLE trades DROP COLUMN IF EXISTS status;
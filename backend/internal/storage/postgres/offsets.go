@@ -0,0 +1,74 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/murraystewart96/token-swap/internal/models"
+)
+
+// Offsets only move forward, so a consumer still finishing messages of a
+// partition that was reassigned can't move the new owner back
+const upsertConsumerOffsetQuery = `
+        INSERT INTO consumer_offsets (group_id, topic, partition, next_offset, updated_at)
+        VALUES ($1, $2, $3, $4, NOW())
+        ON CONFLICT (group_id, topic, partition)
+        DO UPDATE SET next_offset = EXCLUDED.next_offset, updated_at = NOW()
+        WHERE consumer_offsets.next_offset < EXCLUDED.next_offset`
+
+func offsetArgs(offset *models.ConsumerOffset) []any {
+	return []any{offset.GroupID, offset.Topic, offset.Partition, offset.Offset}
+}
+
+// GetConsumerOffsets returns the stored offsets of a consumer group's partitions of topics
+func (db *DB) GetConsumerOffsets(ctx context.Context, groupID string, topics []string) ([]*models.ConsumerOffset, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+        SELECT group_id, topic, partition, next_offset
+        FROM consumer_offsets
+        WHERE group_id = $1 AND topic = ANY($2)
+        ORDER BY topic, partition`
+
+	rows, err := db.pool.Query(ctx, query, groupID, topics)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var offsets []*models.ConsumerOffset
+	for rows.Next() {
+		offset := &models.ConsumerOffset{}
+		if err := rows.Scan(&offset.GroupID, &offset.Topic, &offset.Partition, &offset.Offset); err != nil {
+			return nil, err
+		}
+		offsets = append(offsets, offset)
+	}
+
+	return offsets, rows.Err()
+}
+
+// SetConsumerOffsets stores offsets on their own, for messages that didn't write anything
+func (db *DB) SetConsumerOffsets(ctx context.Context, offsets []*models.ConsumerOffset) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := db.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	for _, offset := range offsets {
+		if _, err := tx.Exec(ctx, upsertConsumerOffsetQuery, offsetArgs(offset)...); err != nil {
+			return fmt.Errorf("failed to store consumer offset: %w", err)
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
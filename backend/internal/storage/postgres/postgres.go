@@ -3,13 +3,26 @@ package postgres
 import (
 	"context"
 	"fmt"
+	"time"
 
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/murraystewart96/token-swap/internal/config"
+	"github.com/murraystewart96/token-swap/internal/models"
+	"github.com/murraystewart96/token-swap/pkg/tracing"
+)
+
+const (
+	defaultQueryTimeout          = 5 * time.Second
+	defaultAnalyticsQueryTimeout = 30 * time.Second
 )
 
 type DB struct {
 	pool *pgxpool.Pool
+
+	// How long queries, and the slower analytics queries, may run
+	queryTimeout          time.Duration
+	analyticsQueryTimeout time.Duration
 }
 
 func NewDB(cfg *config.DB) (*DB, error) {
@@ -25,6 +38,9 @@ func NewDB(cfg *config.DB) (*DB, error) {
 	poolConfig.MaxConns = 10
 	poolConfig.MinConns = 2
 
+	// Queries get spans under the span of the context they run with
+	poolConfig.ConnConfig.Tracer = tracing.PgxTracer{}
+
 	pool, err := pgxpool.NewWithConfig(context.Background(), poolConfig)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create connection pool: %w", err)
@@ -37,11 +53,32 @@ func NewDB(cfg *config.DB) (*DB, error) {
 		return nil, fmt.Errorf("failed to ping database: %w", err)
 	}
 
+	queryTimeout, analyticsQueryTimeout := cfg.QueryTimeout, cfg.AnalyticsQueryTimeout
+	if queryTimeout <= 0 {
+		queryTimeout = defaultQueryTimeout
+	}
+	if analyticsQueryTimeout <= 0 {
+		analyticsQueryTimeout = defaultAnalyticsQueryTimeout
+	}
+
 	return &DB{
-		pool: pool,
+		pool:                  pool,
+		queryTimeout:          queryTimeout,
+		analyticsQueryTimeout: analyticsQueryTimeout,
 	}, nil
 }
 
+// withTimeout bounds a call by the query timeout. Queries are cancelled when
+// ctx is, e.g. when the client of an API request disconnects.
+func (db *DB) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, db.queryTimeout)
+}
+
+// withAnalyticsTimeout bounds an analytics query by the analytics query timeout
+func (db *DB) withAnalyticsTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, db.analyticsQueryTimeout)
+}
+
 func (db *DB) Close() {
 	db.pool.Close()
 }
@@ -50,30 +87,44 @@ func (db *DB) GetConn() *pgxpool.Pool {
 	return db.pool
 }
 
-func (db *DB) Exec(query string) error {
-	_, err := db.pool.Exec(context.Background(), query)
+func (db *DB) Exec(ctx context.Context, query string) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	_, err := db.pool.Exec(ctx, query)
 	return err
 }
 
-func (db *DB) RollbackEvents(blockNumber uint64) error {
-	ctx := context.Background()
-	
+// OrphanEvents marks trades and reserves that were emitted in the given (orphaned) blocks.
+// Orphaned rows are retained, and only read when asked for by status. Each
+// transition is recorded with head, the new head of the reorg.
+//
+// The blocks themselves are marked orphaned in the same transaction. The
+// listener publishes the retraction before it orphans them, so events from
+// them stored in between would otherwise be stored pending.
+func (db *DB) OrphanEvents(ctx context.Context, blockHashes []string, forkBlock uint64, head *models.Block) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
 	tx, err := db.pool.Begin(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to begin transaction: %w", err)
 	}
 	defer tx.Rollback(ctx)
 
-	tradesQuery := `DELETE FROM trades WHERE block_number >= $1`
-	_, err = tx.Exec(ctx, tradesQuery, blockNumber)
+	err = orphanBlocks(ctx, tx, blockHashes, forkBlock)
 	if err != nil {
-		return fmt.Errorf("failed to delete trades: %w", err)
+		return fmt.Errorf("failed to orphan blocks: %w", err)
 	}
 
-	reservesQuery := `DELETE FROM reserves WHERE block_number >= $1`
-	_, err = tx.Exec(ctx, reservesQuery, blockNumber)
+	err = orphanEvents(ctx, tx, tradesTable, blockHashes, head)
 	if err != nil {
-		return fmt.Errorf("failed to delete reserves: %w", err)
+		return fmt.Errorf("failed to orphan trades: %w", err)
+	}
+
+	err = orphanEvents(ctx, tx, reservesTable, blockHashes, head)
+	if err != nil {
+		return fmt.Errorf("failed to orphan reserves: %w", err)
 	}
 
 	err = tx.Commit(ctx)
@@ -83,3 +134,56 @@ func (db *DB) RollbackEvents(blockNumber uint64) error {
 
 	return nil
 }
+
+// sendInsertBatch runs a batch of idempotent inserts in one transaction, along
+// with storing the consumer offsets after them, and returns the number of rows
+// stored and the status of each. Each insert returns the number of rows it
+// stored and the status of the stored row.
+func (db *DB) sendInsertBatch(ctx context.Context, batch *pgx.Batch, offsets []*models.ConsumerOffset) (int, []string, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := db.pool.Begin(ctx)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	inserts := batch.Len()
+	for _, offset := range offsets {
+		batch.Queue(upsertConsumerOffsetQuery, offsetArgs(offset)...)
+	}
+
+	results := tx.SendBatch(ctx, batch)
+
+	inserted := 0
+	statuses := make([]string, inserts)
+	for i := 0; i < inserts; i++ {
+		var stored int
+		err := results.QueryRow().Scan(&stored, &statuses[i])
+		if err != nil {
+			results.Close()
+			return 0, nil, fmt.Errorf("failed to insert row %d of batch: %w", i, err)
+		}
+		inserted += stored
+	}
+
+	for range offsets {
+		_, err := results.Exec()
+		if err != nil {
+			results.Close()
+			return 0, nil, fmt.Errorf("failed to store consumer offset: %w", err)
+		}
+	}
+
+	if err := results.Close(); err != nil {
+		return 0, nil, fmt.Errorf("failed to close batch: %w", err)
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return inserted, statuses, nil
+}
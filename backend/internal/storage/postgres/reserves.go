@@ -2,35 +2,109 @@ package postgres
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"time"
 
+	"github.com/jackc/pgx/v5"
+
 	"github.com/murraystewart96/token-swap/internal/models"
 )
 
-func (db *DB) CreateReserve(reserve *models.ReserveEvent) error {
-	query := `
-        INSERT INTO reserves (tx_hash, block_number, timestamp, met_reserve, you_reserve, pool_address)
-        VALUES ($1, $2, $3, $4, $5, $6)`
+// insertReserveQuery stores a reserve snapshot and returns the number of rows
+// stored and the status of the stored snapshot. A snapshot orphaned by a reorg
+// is pending again once its block is canonical again.
+const insertReserveQuery = `
+        WITH stored AS (
+            INSERT INTO reserves (tx_hash, block_number, block_hash, log_index, timestamp, met_reserve, you_reserve, pool_address, status)
+            VALUES ($1, $2, $3, $4, $5, $6, $7, $8,
+                    CASE WHEN EXISTS (SELECT 1 FROM blocks WHERE hash = $3 AND status = 'orphaned')
+                         THEN 'orphaned' ELSE 'pending' END)
+            ON CONFLICT (tx_hash, log_index, block_hash) DO UPDATE SET status = 'pending'
+            WHERE reserves.status = 'orphaned'
+              AND NOT EXISTS (SELECT 1 FROM blocks WHERE hash = EXCLUDED.block_hash AND status = 'orphaned')
+            RETURNING id, block_number, block_hash, status, xmax = 0 AS inserted
+        ),
+        restored AS (
+            INSERT INTO event_status_transitions (event_table, event_id, from_status, to_status, block_number, block_hash)
+            SELECT 'reserves', id, 'orphaned', 'pending', block_number, block_hash
+            FROM stored
+            WHERE NOT inserted
+        )
+        SELECT (SELECT COUNT(*) FROM stored),
+               COALESCE((SELECT status FROM stored),
+                        (SELECT status FROM reserves WHERE tx_hash = $1 AND log_index = $4 AND block_hash = $3),
+                        '')`
+
+// CreateReserve stores a reserve snapshot, returning false if it was already stored (e.g. a redelivered event).
+// The status it's stored with is set on reserve.
+func (db *DB) CreateReserve(ctx context.Context, reserve *models.ReserveEvent) (bool, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	var stored int
+	err := db.pool.QueryRow(ctx, insertReserveQuery, reserveArgs(reserve)...).Scan(&stored, &reserve.Status)
+	if err != nil {
+		return false, err
+	}
+
+	return stored == 1, nil
+}
+
+// CreateReserves stores reserve snapshots in a single round trip and transaction,
+// returning how many were not already stored. The status each is stored with is
+// set on it.
+func (db *DB) CreateReserves(ctx context.Context, reserves []*models.ReserveEvent) (int, error) {
+	return db.CreateReservesWithOffsets(ctx, reserves, nil)
+}
 
-	_, err := db.pool.Exec(context.Background(), query,
+// CreateReservesWithOffsets stores reserves like CreateReserves and the consumer
+// offsets after them in the same transaction
+func (db *DB) CreateReservesWithOffsets(ctx context.Context, reserves []*models.ReserveEvent, offsets []*models.ConsumerOffset) (int, error) {
+	batch := &pgx.Batch{}
+	for _, reserve := range reserves {
+		batch.Queue(insertReserveQuery, reserveArgs(reserve)...)
+	}
+
+	inserted, statuses, err := db.sendInsertBatch(ctx, batch, offsets)
+	if err != nil {
+		return 0, err
+	}
+
+	for i, reserve := range reserves {
+		reserve.Status = statuses[i]
+	}
+
+	return inserted, nil
+}
+
+func reserveArgs(reserve *models.ReserveEvent) []any {
+	return []any{
 		reserve.TxHash,
 		reserve.BlockNumber,
+		reserve.BlockHash,
+		reserve.LogIndex,
 		reserve.Timestamp,
 		reserve.METReserve,
 		reserve.YOUReserve,
-		reserve.PoolAddress)
-
-	return err
+		reserve.PoolAddress,
+	}
 }
 
-func (db *DB) GetReservesByTimeRange(start, end time.Time) ([]*models.ReserveEvent, error) {
+// GetReservesByTimeRange returns the reserve snapshots with the given statuses between start and
+// end, oldest first. An empty pool address returns snapshots of every pool, and no statuses returns
+// pending and confirmed snapshots.
+func (db *DB) GetReservesByTimeRange(ctx context.Context, poolAddr string, statuses []string, start, end time.Time) ([]*models.ReserveEvent, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
 	query := `
-        SELECT tx_hash, block_number, timestamp, met_reserve, you_reserve, pool_address
+        SELECT tx_hash, block_number, block_hash, log_index, timestamp, met_reserve, you_reserve, pool_address, status
         FROM reserves
-        WHERE to_timestamp(timestamp) BETWEEN $1 AND $2
-        ORDER BY block_number ASC`
+        WHERE status = ANY($4) AND ($3 = '' OR pool_address = $3) AND to_timestamp(timestamp) BETWEEN $1 AND $2
+        ORDER BY block_number ASC, log_index ASC`
 
-	rows, err := db.pool.Query(context.Background(), query, start, end)
+	rows, err := db.pool.Query(ctx, query, start, end, poolAddr, statusesOrCanonical(statuses))
 	if err != nil {
 		return nil, err
 	}
@@ -39,9 +113,9 @@ func (db *DB) GetReservesByTimeRange(start, end time.Time) ([]*models.ReserveEve
 	var reserves []*models.ReserveEvent
 	for rows.Next() {
 		reserve := &models.ReserveEvent{}
-		err := rows.Scan(&reserve.TxHash, &reserve.BlockNumber, &reserve.Timestamp,
+		err := rows.Scan(&reserve.TxHash, &reserve.BlockNumber, &reserve.BlockHash, &reserve.LogIndex, &reserve.Timestamp,
 			&reserve.METReserve, &reserve.YOUReserve,
-			&reserve.PoolAddress)
+			&reserve.PoolAddress, &reserve.Status)
 		if err != nil {
 			return nil, err
 		}
@@ -51,17 +125,35 @@ func (db *DB) GetReservesByTimeRange(start, end time.Time) ([]*models.ReserveEve
 	return reserves, rows.Err()
 }
 
-func (db *DB) UpdateConfirmedReserves(confirmationThreshold uint64) error {
+// GetLatestReserve returns the most recent reserve snapshot for a pool with one of the given statuses,
+// or nil if there is none. No statuses returns the latest pending or confirmed snapshot.
+func (db *DB) GetLatestReserve(ctx context.Context, poolAddr string, statuses []string) (*models.ReserveEvent, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
 	query := `
-        UPDATE reserves 
-        SET confirmed = true 
-        WHERE confirmed = false 
-          AND block_number <= $1`
+        SELECT tx_hash, block_number, block_hash, log_index, timestamp, met_reserve, you_reserve, pool_address, status
+        FROM reserves
+        WHERE status = ANY($2) AND pool_address = $1
+        ORDER BY block_number DESC, log_index DESC
+        LIMIT 1`
 
-	_, err := db.pool.Exec(context.Background(), query, confirmationThreshold)
+	reserve := &models.ReserveEvent{}
+	err := db.pool.QueryRow(ctx, query, poolAddr, statusesOrCanonical(statuses)).Scan(
+		&reserve.TxHash, &reserve.BlockNumber, &reserve.BlockHash, &reserve.LogIndex, &reserve.Timestamp,
+		&reserve.METReserve, &reserve.YOUReserve, &reserve.PoolAddress, &reserve.Status)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("failed to get latest reserve: %w", err)
 	}
 
-	return nil
+	return reserve, nil
+}
+
+// UpdateConfirmedReserves confirms the pending reserves at or below the confirmation
+// threshold, recording the transitions with head, the block that confirmed them
+func (db *DB) UpdateConfirmedReserves(ctx context.Context, confirmationThreshold uint64, head *models.Block) error {
+	return db.confirmEvents(ctx, reservesTable, confirmationThreshold, head)
 }
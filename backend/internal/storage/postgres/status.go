@@ -0,0 +1,75 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/murraystewart96/token-swap/internal/models"
+)
+
+const (
+	tradesTable   = "trades"
+	reservesTable = "reserves"
+)
+
+// canonicalStatuses are the statuses of events still on the canonical chain,
+// which reads return when they aren't given any statuses
+var canonicalStatuses = []string{models.EventStatusPending, models.EventStatusConfirmed}
+
+func statusesOrCanonical(statuses []string) []string {
+	if len(statuses) == 0 {
+		return canonicalStatuses
+	}
+	return statuses
+}
+
+// confirmEvents marks the pending events of a table at or below the
+// confirmation threshold confirmed, recording each transition with the head
+// that confirmed it
+func (db *DB) confirmEvents(ctx context.Context, table string, confirmationThreshold uint64, head *models.Block) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	query := fmt.Sprintf(`
+        WITH confirmed AS (
+            UPDATE %[1]s
+            SET status = 'confirmed'
+            WHERE status = 'pending'
+              AND block_number <= $1
+            RETURNING id
+        )
+        INSERT INTO event_status_transitions (event_table, event_id, from_status, to_status, block_number, block_hash)
+        SELECT '%[1]s', id, 'pending', 'confirmed', $2, $3
+        FROM confirmed`, table)
+
+	_, err := db.pool.Exec(ctx, query, confirmationThreshold, head.Number, head.Hash)
+
+	return err
+}
+
+// orphanEvents marks the events of a table emitted in the given blocks
+// orphaned, recording each transition with the head of the reorg
+func orphanEvents(ctx context.Context, tx pgx.Tx, table string, blockHashes []string, head *models.Block) error {
+	query := fmt.Sprintf(`
+        WITH previous AS (
+            SELECT id, status
+            FROM %[1]s
+            WHERE block_hash = ANY($1) AND status <> 'orphaned'
+            FOR UPDATE
+        ),
+        orphaned AS (
+            UPDATE %[1]s e
+            SET status = 'orphaned'
+            FROM previous
+            WHERE e.id = previous.id
+            RETURNING e.id, previous.status
+        )
+        INSERT INTO event_status_transitions (event_table, event_id, from_status, to_status, block_number, block_hash)
+        SELECT '%[1]s', id, status, 'orphaned', $2, $3
+        FROM orphaned`, table)
+
+	_, err := tx.Exec(ctx, query, blockHashes, head.Number, head.Hash)
+
+	return err
+}
@@ -4,32 +4,103 @@ import (
 	"context"
 	"time"
 
+	"github.com/jackc/pgx/v5"
+
 	"github.com/murraystewart96/token-swap/internal/models"
 )
 
-func (db DB) CreateTrade(trade *models.TradeEvent) error {
-	query := `
-        INSERT INTO trades (tx_hash, block_number, transaction_index, timestamp, sender, recipient, 
-                           token_in, token_out, amount_in, amount_out, pool_address)
-        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`
+// insertTradeQuery stores a trade and returns the number of rows stored and the
+// status of the stored trade. A trade orphaned by a reorg is pending again once
+// its block is canonical again.
+const insertTradeQuery = `
+        WITH stored AS (
+            INSERT INTO trades (tx_hash, block_number, block_hash, transaction_index, log_index, timestamp, sender, recipient,
+                               token_in, token_out, amount_in, amount_out, pool_address,
+                               tx_from, tx_nonce, gas_used, effective_gas_price, tx_fee, status)
+            VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18,
+                    CASE WHEN EXISTS (SELECT 1 FROM blocks WHERE hash = $3 AND status = 'orphaned')
+                         THEN 'orphaned' ELSE 'pending' END)
+            ON CONFLICT (tx_hash, log_index, block_hash) DO UPDATE SET status = 'pending'
+            WHERE trades.status = 'orphaned'
+              AND NOT EXISTS (SELECT 1 FROM blocks WHERE hash = EXCLUDED.block_hash AND status = 'orphaned')
+            RETURNING id, block_number, block_hash, status, xmax = 0 AS inserted
+        ),
+        restored AS (
+            INSERT INTO event_status_transitions (event_table, event_id, from_status, to_status, block_number, block_hash)
+            SELECT 'trades', id, 'orphaned', 'pending', block_number, block_hash
+            FROM stored
+            WHERE NOT inserted
+        )
+        SELECT (SELECT COUNT(*) FROM stored),
+               COALESCE((SELECT status FROM stored),
+                        (SELECT status FROM trades WHERE tx_hash = $1 AND log_index = $5 AND block_hash = $3),
+                        '')`
+
+// CreateTrade stores a trade, returning false if it was already stored (e.g. a redelivered event)
+func (db DB) CreateTrade(ctx context.Context, trade *models.TradeEvent) (bool, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	var stored int
+	err := db.pool.QueryRow(ctx, insertTradeQuery, tradeArgs(trade)...).Scan(&stored, &trade.Status)
+	if err != nil {
+		return false, err
+	}
 
-	_, err := db.pool.Exec(context.Background(), query,
-		trade.TxHash, trade.BlockNumber, trade.TransactionIndex, trade.Timestamp,
-		trade.Sender, trade.Recipient, trade.TokenIn, trade.TokenOut,
-		trade.AmountIn, trade.AmountOut, trade.PoolAddress)
+	return stored == 1, nil
+}
 
-	return err
+// CreateTrades stores trades in a single round trip and transaction, returning
+// how many were not already stored
+func (db *DB) CreateTrades(ctx context.Context, trades []*models.TradeEvent) (int, error) {
+	return db.CreateTradesWithOffsets(ctx, trades, nil)
 }
 
-func (db *DB) GetTradesByTimeRange(start, end time.Time) ([]*models.TradeEvent, error) {
+// CreateTradesWithOffsets stores trades like CreateTrades and the consumer
+// offsets after them in the same transaction
+func (db *DB) CreateTradesWithOffsets(ctx context.Context, trades []*models.TradeEvent, offsets []*models.ConsumerOffset) (int, error) {
+	batch := &pgx.Batch{}
+	for _, trade := range trades {
+		batch.Queue(insertTradeQuery, tradeArgs(trade)...)
+	}
+
+	inserted, statuses, err := db.sendInsertBatch(ctx, batch, offsets)
+	if err != nil {
+		return 0, err
+	}
+
+	for i, trade := range trades {
+		trade.Status = statuses[i]
+	}
+
+	return inserted, nil
+}
+
+func tradeArgs(trade *models.TradeEvent) []any {
+	return []any{
+		trade.TxHash, trade.BlockNumber, trade.BlockHash, trade.TransactionIndex, trade.LogIndex, trade.Timestamp,
+		trade.Sender, trade.Recipient, trade.TokenIn, trade.TokenOut,
+		trade.AmountIn, trade.AmountOut, trade.PoolAddress,
+		trade.TxFrom, trade.TxNonce, trade.GasUsed, numericOrZero(trade.EffectiveGasPrice), numericOrZero(trade.TxFee),
+	}
+}
+
+// GetTradesByTimeRange returns the trades with the given statuses between start and end, oldest
+// first. An empty pool address returns trades from every pool, and no statuses returns pending
+// and confirmed trades.
+func (db *DB) GetTradesByTimeRange(ctx context.Context, poolAddr string, statuses []string, start, end time.Time) ([]*models.TradeEvent, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
 	query := `
-        SELECT tx_hash, block_number, transaction_index, timestamp, sender, recipient,
-               token_in, token_out, amount_in, amount_out, pool_address
+        SELECT tx_hash, block_number, block_hash, transaction_index, log_index, timestamp, sender, recipient,
+               token_in, token_out, amount_in, amount_out, pool_address,
+               tx_from, tx_nonce, gas_used, effective_gas_price, tx_fee, status
         FROM trades
-        WHERE to_timestamp(timestamp) BETWEEN $1 AND $2
-        ORDER BY block_number ASC`
+        WHERE status = ANY($4) AND ($3 = '' OR pool_address = $3) AND to_timestamp(timestamp) BETWEEN $1 AND $2
+        ORDER BY block_number ASC, log_index ASC`
 
-	rows, err := db.pool.Query(context.Background(), query, start, end)
+	rows, err := db.pool.Query(ctx, query, start, end, poolAddr, statusesOrCanonical(statuses))
 	if err != nil {
 		return nil, err
 	}
@@ -38,10 +109,11 @@ func (db *DB) GetTradesByTimeRange(start, end time.Time) ([]*models.TradeEvent,
 	var trades []*models.TradeEvent
 	for rows.Next() {
 		trade := &models.TradeEvent{}
-		err := rows.Scan(&trade.TxHash, &trade.BlockNumber, &trade.TransactionIndex, &trade.Timestamp,
+		err := rows.Scan(&trade.TxHash, &trade.BlockNumber, &trade.BlockHash, &trade.TransactionIndex, &trade.LogIndex, &trade.Timestamp,
 			&trade.Sender, &trade.Recipient, &trade.TokenIn,
 			&trade.TokenOut, &trade.AmountIn, &trade.AmountOut,
-			&trade.PoolAddress)
+			&trade.PoolAddress, &trade.TxFrom, &trade.TxNonce, &trade.GasUsed,
+			&trade.EffectiveGasPrice, &trade.TxFee, &trade.Status)
 		if err != nil {
 			return nil, err
 		}
@@ -51,33 +123,43 @@ func (db *DB) GetTradesByTimeRange(start, end time.Time) ([]*models.TradeEvent,
 	return trades, rows.Err()
 }
 
-func (db *DB) GetTradesByCursor(cursorBlock uint64, cursorTx uint, limit int) ([]*models.TradeEvent, error) {
+// GetTradesByCursor pages through trades with the given statuses newest first. An empty
+// pool address returns trades from every pool, and no statuses returns pending and confirmed trades.
+func (db *DB) GetTradesByCursor(ctx context.Context, poolAddr string, statuses []string, cursorBlock uint64, cursorTx, cursorLog uint, limit int) ([]*models.TradeEvent, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
 	var query string
 	var args []any
 
-	if cursorBlock == 0 && cursorTx == 0 {
+	if cursorBlock == 0 && cursorTx == 0 && cursorLog == 0 {
 		// First page - no cursor provided
 		query = `
-            SELECT tx_hash, block_number, transaction_index, timestamp, sender, recipient,
-                   token_in, token_out, amount_in, amount_out, pool_address
+            SELECT tx_hash, block_number, block_hash, transaction_index, log_index, timestamp, sender, recipient,
+                   token_in, token_out, amount_in, amount_out, pool_address,
+                   tx_from, tx_nonce, gas_used, effective_gas_price, tx_fee, status
             FROM trades
-            ORDER BY block_number DESC, transaction_index DESC
-            LIMIT $1`
-		args = []any{limit}
+            WHERE status = ANY($3)
+              AND ($1 = '' OR pool_address = $1)
+            ORDER BY block_number DESC, transaction_index DESC, log_index DESC
+            LIMIT $2`
+		args = []any{poolAddr, limit, statusesOrCanonical(statuses)}
 	} else {
 		// Subsequent pages - use cursor
 		query = `
-            SELECT tx_hash, block_number, transaction_index, timestamp, sender, recipient,
-                   token_in, token_out, amount_in, amount_out, pool_address
+            SELECT tx_hash, block_number, block_hash, transaction_index, log_index, timestamp, sender, recipient,
+                   token_in, token_out, amount_in, amount_out, pool_address,
+                   tx_from, tx_nonce, gas_used, effective_gas_price, tx_fee, status
             FROM trades
-            WHERE (block_number < $1) 
-               OR (block_number = $1 AND transaction_index < $2)
-            ORDER BY block_number DESC, transaction_index DESC
-            LIMIT $3`
-		args = []any{cursorBlock, cursorTx, limit}
+            WHERE status = ANY($6)
+              AND ($1 = '' OR pool_address = $1)
+              AND (block_number, transaction_index, log_index) < ($2, $3, $4)
+            ORDER BY block_number DESC, transaction_index DESC, log_index DESC
+            LIMIT $5`
+		args = []any{poolAddr, cursorBlock, cursorTx, cursorLog, limit, statusesOrCanonical(statuses)}
 	}
 
-	rows, err := db.pool.Query(context.Background(), query, args...)
+	rows, err := db.pool.Query(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -86,9 +168,10 @@ func (db *DB) GetTradesByCursor(cursorBlock uint64, cursorTx uint, limit int) ([
 	var trades []*models.TradeEvent
 	for rows.Next() {
 		trade := &models.TradeEvent{}
-		err := rows.Scan(&trade.TxHash, &trade.BlockNumber, &trade.TransactionIndex,
+		err := rows.Scan(&trade.TxHash, &trade.BlockNumber, &trade.BlockHash, &trade.TransactionIndex, &trade.LogIndex,
 			&trade.Timestamp, &trade.Sender, &trade.Recipient, &trade.TokenIn,
-			&trade.TokenOut, &trade.AmountIn, &trade.AmountOut, &trade.PoolAddress)
+			&trade.TokenOut, &trade.AmountIn, &trade.AmountOut, &trade.PoolAddress,
+			&trade.TxFrom, &trade.TxNonce, &trade.GasUsed, &trade.EffectiveGasPrice, &trade.TxFee, &trade.Status)
 		if err != nil {
 			return nil, err
 		}
@@ -98,17 +181,16 @@ func (db *DB) GetTradesByCursor(cursorBlock uint64, cursorTx uint, limit int) ([
 	return trades, rows.Err()
 }
 
-func (db *DB) UpdateConfirmedTrades(confirmationThreshold uint64) error {
-	query := `
-        UPDATE reserves 
-        SET confirmed = true 
-        WHERE confirmed = false 
-          AND block_number <= $1`
-
-	_, err := db.pool.Exec(context.Background(), query, confirmationThreshold)
-	if err != nil {
-		return err
+// numericOrZero defaults amounts missing from older events to zero
+func numericOrZero(amount string) string {
+	if amount == "" {
+		return "0"
 	}
+	return amount
+}
 
-	return nil
+// UpdateConfirmedTrades confirms the pending trades at or below the confirmation
+// threshold, recording the transitions with head, the block that confirmed them
+func (db *DB) UpdateConfirmedTrades(ctx context.Context, confirmationThreshold uint64, head *models.Block) error {
+	return db.confirmEvents(ctx, tradesTable, confirmationThreshold, head)
 }
@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"strconv"
 	"time"
 
 	"github.com/murraystewart96/token-swap/internal/config"
@@ -12,13 +13,47 @@ import (
 )
 
 const (
-	priceKeyNameSpaceFmt = "price:%s"
+	priceKeyNameSpaceFmt = "price:%s:%s"
 	priceCacheTTL        = 5 * time.Minute
 
 	reservesKeyNameSpaceFmt = "reserves:%s"
 	reservesCacheTTL        = 5 * time.Minute
 )
 
+// setIfNewer stores a value in a hash along with the block position it was derived
+// from, unless the cached value comes from the same or a later position.
+// KEYS[1] = key, ARGV = value, block number, log index, TTL in milliseconds.
+// Returns 1 if the value was stored.
+var setIfNewer = redis.NewScript(`
+if redis.call('TYPE', KEYS[1]).ok == 'hash' then
+	local current = redis.call('HMGET', KEYS[1], 'block_number', 'log_index')
+	local block, log = tonumber(current[1]), tonumber(current[2])
+	local newBlock, newLog = tonumber(ARGV[2]), tonumber(ARGV[3])
+	if block and log and (block > newBlock or (block == newBlock and log >= newLog)) then
+		return 0
+	end
+else
+	redis.call('DEL', KEYS[1])
+end
+redis.call('HSET', KEYS[1], 'value', ARGV[1], 'block_number', ARGV[2], 'log_index', ARGV[3])
+redis.call('PEXPIRE', KEYS[1], ARGV[4])
+return 1
+`)
+
+// deleteIfFrom deletes a value cached by setIfNewer if it was derived from a
+// block at or above the given block number.
+// KEYS[1] = key, ARGV = block number. Returns 1 if the value was deleted.
+var deleteIfFrom = redis.NewScript(`
+if redis.call('TYPE', KEYS[1]).ok ~= 'hash' then
+	return redis.call('DEL', KEYS[1])
+end
+local block = tonumber(redis.call('HGET', KEYS[1], 'block_number'))
+if block and block < tonumber(ARGV[1]) then
+	return 0
+end
+return redis.call('DEL', KEYS[1])
+`)
+
 type Cache struct {
 	client *redis.Client
 }
@@ -35,51 +70,59 @@ func NewCache(cfg *config.Redis) *Cache {
 	}
 }
 
-func (c *Cache) SetPrice(ctx context.Context, pair, price string) error {
-	key := fmt.Sprintf(priceKeyNameSpaceFmt, pair)
+// SetPrice caches the price unless a price from a later event is already cached.
+// Returns false if the price was stale.
+func (c *Cache) SetPrice(ctx context.Context, poolAddr, pair string, price *models.PoolPrice) (bool, error) {
+	key := fmt.Sprintf(priceKeyNameSpaceFmt, poolAddr, pair)
 
-	err := c.client.Set(ctx, key, price, priceCacheTTL).Err()
+	stored, err := c.setIfNewer(ctx, key, price.Price, price.BlockNumber, price.LogIndex, priceCacheTTL)
 	if err != nil {
-		return fmt.Errorf("failed to set price: %w", err)
+		return false, fmt.Errorf("failed to set price: %w", err)
 	}
 
-	return nil
+	return stored, nil
 }
 
-func (c *Cache) GetPrice(ctx context.Context, pair string) (string, error) {
-	key := fmt.Sprintf(priceKeyNameSpaceFmt, pair)
+func (c *Cache) GetPrice(ctx context.Context, poolAddr, pair string) (*models.PoolPrice, error) {
+	key := fmt.Sprintf(priceKeyNameSpaceFmt, poolAddr, pair)
 
-	value, err := c.client.Get(ctx, key).Result()
+	value, blockNumber, logIndex, err := c.get(ctx, key)
 	if err != nil {
 		if err == redis.Nil {
-			return "", fmt.Errorf("price not found for pair %s: %w", pair, err)
+			return nil, fmt.Errorf("price not found for pair %s in pool %s: %w", pair, poolAddr, err)
 		}
-		return "", fmt.Errorf("failed to get price: %w", err)
+		return nil, fmt.Errorf("failed to get price: %w", err)
 	}
 
-	return value, nil
+	return &models.PoolPrice{
+		Price:       value,
+		BlockNumber: blockNumber,
+		LogIndex:    logIndex,
+	}, nil
 }
 
-func (c *Cache) SetReserves(ctx context.Context, poolAddr string, reserves *models.PoolReserves) error {
+// SetReserves caches the reserves unless reserves from a later event are already
+// cached. Returns false if the reserves were stale.
+func (c *Cache) SetReserves(ctx context.Context, poolAddr string, reserves *models.PoolReserves) (bool, error) {
 	key := fmt.Sprintf(reservesKeyNameSpaceFmt, poolAddr)
 
 	reservesJSON, err := json.Marshal(reserves)
 	if err != nil {
-		return fmt.Errorf("failed to marshal reserves: %w", err)
+		return false, fmt.Errorf("failed to marshal reserves: %w", err)
 	}
 
-	err = c.client.Set(ctx, key, reservesJSON, reservesCacheTTL).Err()
+	stored, err := c.setIfNewer(ctx, key, string(reservesJSON), reserves.BlockNumber, reserves.LogIndex, reservesCacheTTL)
 	if err != nil {
-		return fmt.Errorf("failed to set reserves: %w", err)
+		return false, fmt.Errorf("failed to set reserves: %w", err)
 	}
 
-	return nil
+	return stored, nil
 }
 
 func (c *Cache) GetReserves(ctx context.Context, poolAddr string) (*models.PoolReserves, error) {
 	key := fmt.Sprintf(reservesKeyNameSpaceFmt, poolAddr)
 
-	value, err := c.client.Get(ctx, key).Result()
+	value, _, _, err := c.get(ctx, key)
 	if err != nil {
 		if err == redis.Nil {
 			return nil, fmt.Errorf("reserves not found: %w", err)
@@ -96,6 +139,57 @@ func (c *Cache) GetReserves(ctx context.Context, poolAddr string) (*models.PoolR
 	return &reserves, nil
 }
 
+// ResetPoolFrom removes the cached state of a pool that was derived from a block
+// at or above blockNumber, so state from an earlier block can be cached (e.g.
+// after a reorg). State from earlier blocks is kept.
+func (c *Cache) ResetPoolFrom(ctx context.Context, poolAddr string, blockNumber uint64) error {
+	keys := []string{fmt.Sprintf(reservesKeyNameSpaceFmt, poolAddr)}
+
+	iter := c.client.Scan(ctx, 0, fmt.Sprintf(priceKeyNameSpaceFmt, poolAddr, "*"), 0).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	if err := iter.Err(); err != nil {
+		return fmt.Errorf("failed to find cached prices: %w", err)
+	}
+
+	for _, key := range keys {
+		if err := deleteIfFrom.Run(ctx, c.client, []string{key}, blockNumber).Err(); err != nil {
+			return fmt.Errorf("failed to reset pool cache: %w", err)
+		}
+	}
+
+	return nil
+}
+
 func (c *Cache) Reset() error {
 	return c.client.FlushDB(context.Background()).Err()
 }
+
+func (c *Cache) setIfNewer(ctx context.Context, key, value string, blockNumber uint64, logIndex uint, ttl time.Duration) (bool, error) {
+	stored, err := setIfNewer.Run(ctx, c.client, []string{key},
+		value, blockNumber, logIndex, ttl.Milliseconds()).Int()
+	if err != nil {
+		return false, err
+	}
+
+	return stored == 1, nil
+}
+
+// get returns a value cached by setIfNewer and the block position it was derived from
+func (c *Cache) get(ctx context.Context, key string) (string, uint64, uint, error) {
+	fields, err := c.client.HMGet(ctx, key, "value", "block_number", "log_index").Result()
+	if err != nil {
+		return "", 0, 0, err
+	}
+
+	value, ok := fields[0].(string)
+	if !ok {
+		return "", 0, 0, redis.Nil
+	}
+
+	blockNumber, _ := strconv.ParseUint(fmt.Sprint(fields[1]), 10, 64)
+	logIndex, _ := strconv.ParseUint(fmt.Sprint(fields[2]), 10, 64)
+
+	return value, blockNumber, uint(logIndex), nil
+}
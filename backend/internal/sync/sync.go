@@ -2,9 +2,12 @@ package sync
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"math/big"
 	"time"
 
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/ethclient"
 	"github.com/murraystewart96/token-swap/internal/config"
@@ -12,6 +15,7 @@ import (
 	"github.com/murraystewart96/token-swap/internal/models"
 	"github.com/murraystewart96/token-swap/internal/storage"
 	"github.com/murraystewart96/token-swap/internal/worker"
+	"github.com/murraystewart96/token-swap/pkg/eth"
 	"github.com/rs/zerolog/log"
 	"github.com/shopspring/decimal"
 )
@@ -21,32 +25,41 @@ const (
 	TokenTypeYOU uint8 = 1
 )
 
+// Events are confirmed once their block is this many blocks below the head
+const confirmationDepth = 12
+
 type Sync struct {
-	ethClient    *ethclient.Client
-	contractAddr common.Address
-	poolContract contracts.PoolContract
-	db           storage.DB
-	poolCache    storage.PoolCache
+	ethClient *ethclient.Client
+	pools     map[common.Address]contracts.PoolContract
+	db        storage.DB
+	poolCache storage.PoolCache
 }
 
 func NewSync(cfg *config.Sync, poolCache storage.PoolCache, db storage.DB) (*Sync, error) {
-	client, err := ethclient.Dial(fmt.Sprintf("ws://%s", cfg.Listener.RPCUrl))
+	client, err := ethclient.Dial(eth.Endpoint(cfg.Listener.RPCUrl))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create eth client: %w", err)
 	}
 
-	contractAddr := common.HexToAddress(cfg.Listener.ContractAddr)
-	poolContract, err := contracts.NewPool(contractAddr, client)
+	poolAddrs, err := cfg.Listener.PoolAddresses()
 	if err != nil {
-		return nil, fmt.Errorf("failed to create pool contract interface: %w", err)
+		return nil, fmt.Errorf("failed to load pool addresses: %w", err)
+	}
+
+	pools := make(map[common.Address]contracts.PoolContract, len(poolAddrs))
+	for _, poolAddr := range poolAddrs {
+		poolContract, err := contracts.NewPool(poolAddr, client)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create pool contract interface for %s: %w", poolAddr.Hex(), err)
+		}
+		pools[poolAddr] = poolContract
 	}
 
 	return &Sync{
-		ethClient:    client,
-		contractAddr: contractAddr,
-		poolContract: poolContract,
-		poolCache:    poolCache,
-		db:           db,
+		ethClient: client,
+		pools:     pools,
+		poolCache: poolCache,
+		db:        db,
 	}, nil
 }
 
@@ -74,9 +87,27 @@ func (s *Sync) Start(ctx context.Context) error {
 	}
 }
 
+// Sync refreshes the cached price and reserves of every pool from on-chain state
 func (s *Sync) Sync(ctx context.Context) error {
+	var errs []error
+	for poolAddr, poolContract := range s.pools {
+		if err := s.syncPool(ctx, poolAddr, poolContract); err != nil {
+			errs = append(errs, fmt.Errorf("pool %s: %w", poolAddr.Hex(), err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (s *Sync) syncPool(ctx context.Context, poolAddr common.Address, poolContract contracts.PoolContract) error {
+	// Read state at a fixed block so it can be ordered against cached event state
+	blockNumber, err := s.ethClient.BlockNumber(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get current block number: %w", err)
+	}
+
 	// Sync reserves first
-	reserves, err := s.poolContract.GetReserves(nil)
+	reserves, err := poolContract.GetReserves(&bind.CallOpts{Context: ctx, BlockNumber: new(big.Int).SetUint64(blockNumber)})
 	if err != nil {
 		return fmt.Errorf("failed to get current reserves: %w", err)
 	}
@@ -92,22 +123,30 @@ func (s *Sync) Sync(ctx context.Context) error {
 	// Cache Current price
 	currentPrice := youReserve.Div(metReserve) // YOU per MET
 
-	log.Info().Str("MET:YOU", currentPrice.StringFixed(6)).Msg("syncing cache with latest price")
+	log.Info().Str("pool", poolAddr.Hex()).Str("MET:YOU", currentPrice.StringFixed(6)).Msg("syncing cache with latest price")
 
-	err = s.poolCache.SetPrice(ctx, worker.MET_YOU_PAIR, currentPrice.StringFixed(6))
+	price := &models.PoolPrice{
+		Price:       currentPrice.StringFixed(6),
+		BlockNumber: blockNumber,
+		LogIndex:    models.EndOfBlock,
+	}
+
+	_, err = s.poolCache.SetPrice(ctx, poolAddr.Hex(), worker.MET_YOU_PAIR, price)
 	if err != nil {
 		return fmt.Errorf("failed to sync cache with trade price: %w", err)
 	}
 
 	// Cache reserves
 	poolReserves := &models.PoolReserves{
-		METAmount: reserves.MeTokenReserve.String(),
-		YOUAmount: reserves.YouTokenReserve.String(),
+		METAmount:   reserves.MeTokenReserve.String(),
+		YOUAmount:   reserves.YouTokenReserve.String(),
+		BlockNumber: blockNumber,
+		LogIndex:    models.EndOfBlock,
 	}
 
-	log.Info().Str("MET", reserves.MeTokenReserve.String()).Str("YOU", reserves.YouTokenReserve.String()).Msg("syncing cache with latest reserves")
+	log.Info().Str("pool", poolAddr.Hex()).Str("MET", reserves.MeTokenReserve.String()).Str("YOU", reserves.YouTokenReserve.String()).Msg("syncing cache with latest reserves")
 
-	err = s.poolCache.SetReserves(ctx, s.contractAddr.Hex(), poolReserves)
+	_, err = s.poolCache.SetReserves(ctx, poolAddr.Hex(), poolReserves)
 	if err != nil {
 		return fmt.Errorf("failed to update reserves cache: %w", err)
 	}
@@ -115,19 +154,26 @@ func (s *Sync) Sync(ctx context.Context) error {
 	return nil
 }
 
+// updateConfirmedEvents confirms the pending events confirmationDepth blocks
+// below the current head, recording the head as the block that confirmed them
 func (s *Sync) updateConfirmedEvents(ctx context.Context) error {
-	currentBlock, err := s.ethClient.BlockNumber(ctx)
+	header, err := s.ethClient.HeaderByNumber(ctx, nil)
 	if err != nil {
-		return fmt.Errorf("failed to get current block number: %w", err)
+		return fmt.Errorf("failed to get current block header: %w", err)
+	}
+
+	head := &models.Block{Number: header.Number.Uint64(), Hash: header.Hash().Hex()}
+	if head.Number < confirmationDepth {
+		return nil
 	}
 
-	confirmationThreshold := currentBlock - 12
+	confirmationThreshold := head.Number - confirmationDepth
 
-	if err := s.db.UpdateConfirmedTrades(confirmationThreshold); err != nil {
+	if err := s.db.UpdateConfirmedTrades(ctx, confirmationThreshold, head); err != nil {
 		return fmt.Errorf("failed to update confirmed trades: %w", err)
 	}
 
-	if err := s.db.UpdateConfirmedReserves(confirmationThreshold); err != nil {
+	if err := s.db.UpdateConfirmedReserves(ctx, confirmationThreshold, head); err != nil {
 		return fmt.Errorf("failed to update confirmed reserves: %w", err)
 	}
 
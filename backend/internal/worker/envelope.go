@@ -0,0 +1,127 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/murraystewart96/token-swap/internal/models"
+	"github.com/murraystewart96/token-swap/pkg/kafka"
+)
+
+// Events are decoded with the codec named by the message's content-type header
+// and according to their envelope's schema version. When the worker has a
+// schema registry, the schema ID in the message's schema.id header must be
+// registered for the envelope's type and schema version. Messages that can't
+// be decoded (unknown codec, malformed, unexpected type, unknown version or
+// schema) are non-retryable and go straight to the dead-letter topic.
+
+// messageHeader looks up the headers of the message being handled
+func messageHeader(ctx context.Context) func(key string) string {
+	return func(key string) string {
+		return kafka.MessageHeader(ctx, key)
+	}
+}
+
+// openEnvelope decodes the envelope of a message holding an event of eventType
+// and returns it with the codec its data is encoded with
+func openEnvelope(schemas *kafka.SchemaRegistry, header func(key string) string, value []byte, eventType string) (*models.Envelope, kafka.Codec, error) {
+	codec, err := kafka.CodecFor(header(kafka.HeaderContentType))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	envelope := &models.Envelope{}
+	if err := codec.Unmarshal(value, envelope); err != nil {
+		return nil, nil, fmt.Errorf("failed to unmarshal event envelope: %w", err)
+	}
+
+	if err := envelope.CheckType(eventType); err != nil {
+		return nil, nil, err
+	}
+
+	if err := checkSchema(schemas, header(kafka.HeaderSchemaID), envelope); err != nil {
+		return nil, nil, err
+	}
+
+	return envelope, codec, nil
+}
+
+// checkSchema returns an error if schemaID isn't registered for the type and
+// schema version of the envelope. Messages sent without a schema ID, or handled
+// without a registry, aren't checked.
+func checkSchema(schemas *kafka.SchemaRegistry, schemaID string, envelope *models.Envelope) error {
+	if schemas == nil || schemaID == "" {
+		return nil
+	}
+
+	id, err := strconv.Atoi(schemaID)
+	if err != nil {
+		return fmt.Errorf("invalid schema id %q", schemaID)
+	}
+
+	registered, err := schemas.Lookup(id)
+	if err != nil {
+		return err
+	}
+
+	if subject := models.SchemaSubject(envelope.Type, envelope.SchemaVersion); registered.Subject != subject {
+		return fmt.Errorf("schema %d is registered for %s, not %s", id, registered.Subject, subject)
+	}
+
+	return nil
+}
+
+func decodeTrade(schemas *kafka.SchemaRegistry, header func(key string) string, value []byte) (*models.TradeEvent, error) {
+	envelope, codec, err := openEnvelope(schemas, header, value, models.EventTypeTrade)
+	if err != nil {
+		return nil, kafka.NonRetryable(fmt.Errorf("failed to unmarshal trade history event: %w", err))
+	}
+
+	switch envelope.SchemaVersion {
+	case 1:
+		tradeEvent := &models.TradeEvent{}
+		if err := codec.Unmarshal(envelope.Data, tradeEvent); err != nil {
+			return nil, kafka.NonRetryable(fmt.Errorf("failed to unmarshal trade history event: %w", err))
+		}
+		return tradeEvent, nil
+	default:
+		return nil, kafka.NonRetryable(envelope.UnsupportedVersion())
+	}
+}
+
+func decodeReserve(schemas *kafka.SchemaRegistry, header func(key string) string, value []byte) (*models.ReserveEvent, error) {
+	envelope, codec, err := openEnvelope(schemas, header, value, models.EventTypeReserve)
+	if err != nil {
+		return nil, kafka.NonRetryable(fmt.Errorf("failed to unmarshal reserve event: %w", err))
+	}
+
+	switch envelope.SchemaVersion {
+	case 1:
+		reserveEvent := &models.ReserveEvent{}
+		if err := codec.Unmarshal(envelope.Data, reserveEvent); err != nil {
+			return nil, kafka.NonRetryable(fmt.Errorf("failed to unmarshal reserve event: %w", err))
+		}
+		return reserveEvent, nil
+	default:
+		return nil, kafka.NonRetryable(envelope.UnsupportedVersion())
+	}
+}
+
+func decodeReorg(schemas *kafka.SchemaRegistry, header func(key string) string, value []byte) (*models.ReorgEvent, error) {
+	envelope, codec, err := openEnvelope(schemas, header, value, models.EventTypeReorg)
+	if err != nil {
+		return nil, kafka.NonRetryable(fmt.Errorf("failed to unmarshal reorg event: %w", err))
+	}
+
+	switch envelope.SchemaVersion {
+	case 1:
+		reorgEvent := &models.ReorgEvent{}
+		if err := codec.Unmarshal(envelope.Data, reorgEvent); err != nil {
+			return nil, kafka.NonRetryable(fmt.Errorf("failed to unmarshal reorg event: %w", err))
+		}
+		return reorgEvent, nil
+	default:
+		return nil, kafka.NonRetryable(envelope.UnsupportedVersion())
+	}
+}
@@ -0,0 +1,182 @@
+package worker
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/murraystewart96/token-swap/internal/models"
+	"github.com/murraystewart96/token-swap/pkg/kafka"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// marshalEvent wraps an event in a JSON envelope the way the listener publishes it
+func marshalEvent(eventType string, schemaVersion int, event any) ([]byte, error) {
+	return encodeEvent(kafka.JSONCodec{}, eventType, schemaVersion, event)
+}
+
+// encodeEvent wraps an event in an envelope encoded with codec
+func encodeEvent(codec kafka.Codec, eventType string, schemaVersion int, event any) ([]byte, error) {
+	data, err := codec.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+
+	envelope := models.NewEnvelope(eventType, schemaVersion)
+	envelope.Data = data
+
+	return codec.Marshal(envelope)
+}
+
+// contentType returns the headers of a message sent with a content-type header
+func contentType(value string) func(key string) string {
+	return headers(map[string]string{kafka.HeaderContentType: value})
+}
+
+// headers returns the lookup of a message's headers
+func headers(values map[string]string) func(key string) string {
+	return func(key string) string {
+		return values[key]
+	}
+}
+
+func TestDecodeTrade(t *testing.T) {
+	trade := &models.TradeEvent{TxHash: "0x123", LogIndex: 2, AmountIn: "100.0"}
+
+	tests := []struct {
+		name          string
+		eventType     string
+		schemaVersion int
+		expectedError string
+	}{
+		{
+			name:          "current version",
+			eventType:     models.EventTypeTrade,
+			schemaVersion: models.TradeEventVersion,
+		},
+		{
+			name:          "unknown version",
+			eventType:     models.EventTypeTrade,
+			schemaVersion: 99,
+			expectedError: "io.tokenswap.trade schema version 99",
+		},
+		{
+			name:          "wrong event type",
+			eventType:     models.EventTypeReserve,
+			schemaVersion: models.ReserveEventVersion,
+			expectedError: `got type "io.tokenswap.reserve"`,
+		},
+	}
+
+	// Topics are migrated between codecs gradually, so both are decoded
+	for _, codec := range []kafka.Codec{kafka.JSONCodec{}, kafka.ProtobufCodec{}} {
+		for _, tt := range tests {
+			t.Run(codec.Name()+"/"+tt.name, func(t *testing.T) {
+				value, err := encodeEvent(codec, tt.eventType, tt.schemaVersion, trade)
+				require.NoError(t, err)
+
+				decoded, err := decodeTrade(nil, contentType(codec.ContentType()), value)
+
+				if tt.expectedError != "" {
+					require.Error(t, err)
+					assert.Contains(t, err.Error(), tt.expectedError)
+					assert.ErrorIs(t, err, models.ErrUnsupportedEvent)
+					// Undecodable events go straight to the dead-letter topic
+					assert.ErrorIs(t, err, kafka.ErrNonRetryable)
+					return
+				}
+
+				require.NoError(t, err)
+				assert.Equal(t, trade, decoded)
+			})
+		}
+	}
+}
+
+func TestDecodeReorg_UnknownContentType(t *testing.T) {
+	value, err := marshalEvent(models.EventTypeReorg, models.ReorgEventVersion, &models.ReorgEvent{ForkBlock: 10})
+	require.NoError(t, err)
+
+	_, err = decodeReorg(nil, contentType("application/avro"), value)
+
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `unsupported content type "application/avro"`)
+	assert.ErrorIs(t, err, kafka.ErrNonRetryable)
+}
+
+func TestDecodeReserve_RejectsBareEvent(t *testing.T) {
+	// Events published without an envelope have no type
+	value, err := json.Marshal(&models.ReserveEvent{TxHash: "0x123"})
+	require.NoError(t, err)
+
+	_, err = decodeReserve(nil, contentType(""), value)
+
+	assert.ErrorIs(t, err, models.ErrUnsupportedEvent)
+	assert.ErrorIs(t, err, kafka.ErrNonRetryable)
+}
+
+func TestDecodeReserve_ChecksSchemaID(t *testing.T) {
+	schemas, err := kafka.OpenSchemaRegistry(filepath.Join(t.TempDir(), "schemas.json"))
+	require.NoError(t, err)
+
+	schema, err := kafka.SchemaOf(models.ReserveEvent{})
+	require.NoError(t, err)
+	tradeID, err := schemas.Register(models.SchemaSubject(models.EventTypeTrade, models.TradeEventVersion), schema)
+	require.NoError(t, err)
+	reserveID, err := schemas.Register(models.SchemaSubject(models.EventTypeReserve, models.ReserveEventVersion), schema)
+	require.NoError(t, err)
+
+	reserve := &models.ReserveEvent{TxHash: "0x123", METReserve: "100.0"}
+	value, err := marshalEvent(models.EventTypeReserve, models.ReserveEventVersion, reserve)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name          string
+		schemaID      string
+		expectedError string
+	}{
+		{
+			name:     "registered for the event",
+			schemaID: strconv.Itoa(reserveID),
+		},
+		{
+			name: "sent without a schema id",
+		},
+		{
+			name:          "registered for another event",
+			schemaID:      strconv.Itoa(tradeID),
+			expectedError: "is registered for io.tokenswap.trade.v1, not io.tokenswap.reserve.v1",
+		},
+		{
+			name:          "not registered",
+			schemaID:      "99",
+			expectedError: "schema not found",
+		},
+		{
+			name:          "malformed",
+			schemaID:      "reserve",
+			expectedError: `invalid schema id "reserve"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decoded, err := decodeReserve(schemas, headers(map[string]string{
+				kafka.HeaderContentType: kafka.JSONCodec{}.ContentType(),
+				kafka.HeaderSchemaID:    tt.schemaID,
+			}), value)
+
+			if tt.expectedError != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.expectedError)
+				assert.ErrorIs(t, err, kafka.ErrNonRetryable)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, reserve, decoded)
+		})
+	}
+}
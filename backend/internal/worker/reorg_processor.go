@@ -0,0 +1,83 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/murraystewart96/token-swap/internal/models"
+	"github.com/murraystewart96/token-swap/pkg/tracing"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// handleReorgEvent applies a retraction published by the listener: events from
+// the orphaned blocks are marked orphaned and the cached state of every
+// affected pool derived from the orphaned blocks is recomputed from its latest
+// reserves still on the canonical chain. Reserves from the orphaned blocks
+// handled afterwards are stored orphaned and never cached.
+func (w *Worker) handleReorgEvent(ctx context.Context, key, value []byte) error {
+	// Start a span for reorg event processing
+	ctx, span := tracing.StartSpan(ctx, "worker.handleReorgEvent")
+	defer span.End()
+
+	reorgEvent, err := decodeReorg(w.schemas, messageHeader(ctx), value)
+	if err != nil {
+		return err
+	}
+
+	// Add reorg-specific attributes to the span
+	span.SetAttributes(
+		attribute.Int64(tracing.AttrBlockNumber, int64(reorgEvent.NewHeadNumber)),
+	)
+
+	log.Info().
+		Uint64("fork_block", reorgEvent.ForkBlock).
+		Strs("block_hashes", reorgEvent.OrphanedBlocks).
+		Msg("orphaning events from reorganised blocks")
+
+	// Orphaned events are kept, recording the new head that replaced their blocks
+	head := &models.Block{Number: reorgEvent.NewHeadNumber, Hash: reorgEvent.NewHeadHash}
+	err = w.db.OrphanEvents(ctx, reorgEvent.OrphanedBlocks, reorgEvent.ForkBlock, head)
+	if err != nil {
+		return fmt.Errorf("failed to orphan events in database: %w", err)
+	}
+
+	for _, poolAddr := range reorgEvent.PoolAddresses {
+		if err := w.recomputePoolState(ctx, poolAddr, reorgEvent.ForkBlock); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// recomputePoolState replaces cached pool state derived from blocks at or above
+// the fork with the latest reserves still on the canonical chain
+func (w *Worker) recomputePoolState(ctx context.Context, poolAddr string, forkBlock uint64) error {
+	// The cached state may come from an orphaned block later than the latest
+	// canonical reserves, so it has to be cleared before recomputing. It is
+	// cleared before reading the reserves, so state cached meanwhile by new
+	// canonical events is either kept or read back.
+	if err := w.poolCache.ResetPoolFrom(ctx, poolAddr, forkBlock); err != nil {
+		return fmt.Errorf("failed to reset cached pool state: %w", err)
+	}
+
+	latest, err := w.db.GetLatestReserve(ctx, poolAddr, nil)
+	if err != nil {
+		return fmt.Errorf("failed to get latest canonical reserves: %w", err)
+	}
+
+	if latest == nil {
+		log.Warn().Str("pool", poolAddr).Msg("no canonical reserves left to recompute cached price from")
+		return nil
+	}
+
+	reserves := &models.PoolReserves{
+		METAmount:   latest.METReserve,
+		YOUAmount:   latest.YOUReserve,
+		BlockNumber: latest.BlockNumber,
+		LogIndex:    latest.LogIndex,
+	}
+
+	return w.cachePoolState(ctx, poolAddr, reserves)
+}
@@ -0,0 +1,217 @@
+package worker
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/murraystewart96/token-swap/internal/models"
+	storageMock "github.com/murraystewart96/token-swap/internal/storage/mock"
+	"github.com/murraystewart96/token-swap/pkg/kafka"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleReorgEvent(t *testing.T) {
+	orphanedBlocks := []string{"0xorphaned100", "0xorphaned101"}
+
+	tests := []struct {
+		name          string
+		inputEvent    *models.ReorgEvent
+		setupMocks    func(*storageMock.PoolCache, *storageMock.DB)
+		expectError   bool
+		expectedError string
+	}{
+		{
+			name: "orphans events and recomputes cached price from canonical reserves",
+			inputEvent: &models.ReorgEvent{
+				PoolAddresses:  []string{"0xpool123"},
+				ForkBlock:      100,
+				OrphanedBlocks: orphanedBlocks,
+				NewHeadNumber:  101,
+				NewHeadHash:    "0xnew101",
+			},
+			setupMocks: func(cache *storageMock.PoolCache, db *storageMock.DB) {
+				db.On("OrphanEvents", mock.Anything, orphanedBlocks, uint64(100), &models.Block{Number: 101, Hash: "0xnew101"}).Return(nil)
+				db.On("GetLatestReserve", mock.Anything, "0xpool123", []string(nil)).Return(&models.ReserveEvent{
+					BlockNumber: 99,
+					METReserve:  "200.0",
+					YOUReserve:  "100.0",
+					PoolAddress: "0xpool123",
+				}, nil)
+				cache.On("ResetPoolFrom", mock.Anything, "0xpool123", uint64(100)).Return(nil)
+				cache.On("SetPrice", mock.Anything, "0xpool123", MET_YOU_PAIR, matchPrice("0.500000")).Return(true, nil)
+				cache.On("SetReserves", mock.Anything, "0xpool123", &models.PoolReserves{
+					METAmount:   "200.0",
+					YOUAmount:   "100.0",
+					BlockNumber: 99,
+				}).Return(true, nil)
+			},
+			expectError: false,
+		},
+		{
+			name: "no canonical reserves left clears the cache",
+			inputEvent: &models.ReorgEvent{
+				PoolAddresses:  []string{"0xpool123"},
+				ForkBlock:      100,
+				OrphanedBlocks: orphanedBlocks,
+			},
+			setupMocks: func(cache *storageMock.PoolCache, db *storageMock.DB) {
+				db.On("OrphanEvents", mock.Anything, orphanedBlocks, mock.Anything, mock.AnythingOfType("*models.Block")).Return(nil)
+				db.On("GetLatestReserve", mock.Anything, "0xpool123", []string(nil)).Return(nil, nil)
+				cache.On("ResetPoolFrom", mock.Anything, "0xpool123", uint64(100)).Return(nil)
+			},
+			expectError: false,
+		},
+		{
+			name: "database failure orphaning events",
+			inputEvent: &models.ReorgEvent{
+				PoolAddresses:  []string{"0xpool123"},
+				ForkBlock:      100,
+				OrphanedBlocks: orphanedBlocks,
+			},
+			setupMocks: func(cache *storageMock.PoolCache, db *storageMock.DB) {
+				db.On("OrphanEvents", mock.Anything, orphanedBlocks, mock.Anything, mock.AnythingOfType("*models.Block")).Return(errors.New("db connection failed"))
+			},
+			expectError:   true,
+			expectedError: "failed to orphan events in database",
+		},
+		{
+			name: "database failure reading canonical reserves",
+			inputEvent: &models.ReorgEvent{
+				PoolAddresses:  []string{"0xpool123"},
+				ForkBlock:      100,
+				OrphanedBlocks: orphanedBlocks,
+			},
+			setupMocks: func(cache *storageMock.PoolCache, db *storageMock.DB) {
+				db.On("OrphanEvents", mock.Anything, orphanedBlocks, mock.Anything, mock.AnythingOfType("*models.Block")).Return(nil)
+				cache.On("ResetPoolFrom", mock.Anything, "0xpool123", uint64(100)).Return(nil)
+				db.On("GetLatestReserve", mock.Anything, "0xpool123", []string(nil)).Return(nil, errors.New("db connection failed"))
+			},
+			expectError:   true,
+			expectedError: "failed to get latest canonical reserves",
+		},
+		{
+			name: "cache failure resetting pool state",
+			inputEvent: &models.ReorgEvent{
+				PoolAddresses:  []string{"0xpool123"},
+				ForkBlock:      100,
+				OrphanedBlocks: orphanedBlocks,
+			},
+			setupMocks: func(cache *storageMock.PoolCache, db *storageMock.DB) {
+				db.On("OrphanEvents", mock.Anything, orphanedBlocks, mock.Anything, mock.AnythingOfType("*models.Block")).Return(nil)
+				cache.On("ResetPoolFrom", mock.Anything, "0xpool123", uint64(100)).Return(errors.New("cache connection failed"))
+			},
+			expectError:   true,
+			expectedError: "failed to reset cached pool state",
+		},
+		{
+			name: "price cache failure",
+			inputEvent: &models.ReorgEvent{
+				PoolAddresses:  []string{"0xpool123"},
+				ForkBlock:      100,
+				OrphanedBlocks: orphanedBlocks,
+			},
+			setupMocks: func(cache *storageMock.PoolCache, db *storageMock.DB) {
+				db.On("OrphanEvents", mock.Anything, orphanedBlocks, mock.Anything, mock.AnythingOfType("*models.Block")).Return(nil)
+				db.On("GetLatestReserve", mock.Anything, "0xpool123", []string(nil)).Return(&models.ReserveEvent{
+					METReserve: "100.0",
+					YOUReserve: "150.0",
+				}, nil)
+				cache.On("ResetPoolFrom", mock.Anything, "0xpool123", uint64(100)).Return(nil)
+				cache.On("SetPrice", mock.Anything, "0xpool123", MET_YOU_PAIR, matchPrice("1.500000")).
+					Return(false, errors.New("cache connection failed"))
+			},
+			expectError:   true,
+			expectedError: "failed to update cache with trade price",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Setup mocks
+			mockCache := &storageMock.PoolCache{}
+			DB := &storageMock.DB{}
+			tt.setupMocks(mockCache, DB)
+
+			// Create worker with mocks
+			worker := &Worker{
+				poolCache: mockCache,
+				db:        DB,
+			}
+
+			// Marshal event to JSON (simulating Kafka message)
+			eventBytes, err := marshalEvent(models.EventTypeReorg, models.ReorgEventVersion, tt.inputEvent)
+			require.NoError(t, err)
+
+			// Execute
+			err = worker.handleReorgEvent(t.Context(), []byte("0xpool123"), eventBytes)
+
+			// Verify
+			if tt.expectError {
+				assert.Error(t, err)
+				if tt.expectedError != "" {
+					assert.Contains(t, err.Error(), tt.expectedError)
+				}
+			} else {
+				assert.NoError(t, err)
+			}
+
+			// Verify mock expectations
+			mockCache.AssertExpectations(t)
+			DB.AssertExpectations(t)
+		})
+	}
+}
+
+func TestHandleReorgEventInvalidJSON(t *testing.T) {
+	worker := &Worker{
+		poolCache: &storageMock.PoolCache{},
+		db:        &storageMock.DB{},
+	}
+
+	err := worker.handleReorgEvent(t.Context(), []byte("key"), []byte(`this is not json at all`))
+
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to unmarshal reorg event")
+}
+
+func TestHandleReorgEvent_ThenReservesFromOrphanedBlocks(t *testing.T) {
+	cache := newPositionCache()
+	db := &storageMock.DB{}
+	expectOrphaningDB(db)
+	db.On("GetLatestReserve", mock.Anything, "0xpool123", []string(nil)).Return(&models.ReserveEvent{
+		BlockNumber: 99, METReserve: "100.0", YOUReserve: "100.0", PoolAddress: "0xpool123",
+	}, nil)
+	worker := &Worker{poolCache: cache, db: db}
+
+	// State from block 100 was cached before it was reorganised out
+	_, err := cache.SetReserves(t.Context(), "0xpool123", &models.PoolReserves{METAmount: "100.0", YOUAmount: "150.0", BlockNumber: 100})
+	require.NoError(t, err)
+
+	reorg, err := marshalEvent(models.EventTypeReorg, models.ReorgEventVersion, &models.ReorgEvent{
+		PoolAddresses:  []string{"0xpool123"},
+		ForkBlock:      100,
+		OrphanedBlocks: []string{"0xold100", "0xold101"},
+		NewHeadNumber:  100,
+		NewHeadHash:    "0xnew100",
+	})
+	require.NoError(t, err)
+	require.NoError(t, worker.handleReorgEvent(t.Context(), []byte("0xnew100"), reorg))
+
+	// Reserves from an orphaned block the worker hadn't stored yet arrive with
+	// the reserves replacing them
+	var records []kafka.Record
+	for _, reserve := range []*models.ReserveEvent{
+		{TxHash: "0xold", BlockNumber: 101, BlockHash: "0xold101", METReserve: "100.0", YOUReserve: "400.0", PoolAddress: "0xpool123"},
+		{TxHash: "0xnew", BlockNumber: 100, BlockHash: "0xnew100", METReserve: "100.0", YOUReserve: "300.0", PoolAddress: "0xpool123"},
+	} {
+		value, err := marshalEvent(models.EventTypeReserve, models.ReserveEventVersion, reserve)
+		require.NoError(t, err)
+		records = append(records, kafka.Record{Key: []byte("0xpool123"), Value: value})
+	}
+	require.NoError(t, worker.handleReserveBatch(t.Context(), records))
+
+	assert.Equal(t, &models.PoolReserves{METAmount: "100.0", YOUAmount: "300.0", BlockNumber: 100}, cache.reserves["0xpool123"])
+	assert.Equal(t, "3.000000", cache.prices["0xpool123"+MET_YOU_PAIR].Price)
+}
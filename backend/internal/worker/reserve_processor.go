@@ -2,16 +2,17 @@ package worker
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 
 	"github.com/murraystewart96/token-swap/internal/models"
+	"github.com/murraystewart96/token-swap/pkg/kafka"
 	"github.com/murraystewart96/token-swap/pkg/tracing"
 	"github.com/rs/zerolog/log"
 	"github.com/shopspring/decimal"
 )
 
 const (
+	// Trading pair every pool's price is cached under (YOU per MET)
 	MET_YOU_PAIR = "MET_YOU"
 )
 
@@ -19,9 +20,9 @@ func (w *Worker) handleReserveEvent(ctx context.Context, key, value []byte) erro
 	// Start a span for reserve event processing
 	ctx, span := tracing.StartSpan(ctx, "worker.handleReserveEvent")
 	defer span.End()
-	var reserveEvent models.ReserveEvent
-	if err := json.Unmarshal(value, &reserveEvent); err != nil {
-		return fmt.Errorf("failed to unmarshal reserve event: %w", err)
+	reserveEvent, err := decodeReserve(w.schemas, messageHeader(ctx), value)
+	if err != nil {
+		return err
 	}
 
 	// Add reserve-specific attributes to the span
@@ -30,51 +31,88 @@ func (w *Worker) handleReserveEvent(ctx context.Context, key, value []byte) erro
 	)
 
 	reserves := &models.PoolReserves{
-		METAmount: reserveEvent.METReserve,
-		YOUAmount: reserveEvent.YOUReserve,
+		METAmount:   reserveEvent.METReserve,
+		YOUAmount:   reserveEvent.YOUReserve,
+		BlockNumber: reserveEvent.BlockNumber,
+		LogIndex:    reserveEvent.LogIndex,
+	}
+
+	// Reject reserves no price can be calculated from before storing them
+	if _, err := CalculateMetToYouPrice(reserves); err != nil {
+		return fmt.Errorf("failed to calculate trading price: %w", err)
+	}
+
+	log.Info().Msg("storing reserve in database")
+
+	created, err := w.createReserve(ctx, reserveEvent)
+	if err != nil {
+		return fmt.Errorf("failed to store reserve event in database: %w", err)
+	}
+
+	// Redelivered event, already stored
+	if !created {
+		log.Info().Str("tx_hash", reserveEvent.TxHash).Uint("log_index", reserveEvent.LogIndex).Msg("reserve already stored")
+	}
+
+	// The retraction of its block was handled first. Caching it would also
+	// block the canonical reserves at the same position from being cached.
+	if reserveEvent.Status == models.EventStatusOrphaned {
+		log.Info().Str("tx_hash", reserveEvent.TxHash).Str("block_hash", reserveEvent.BlockHash).Msg("not caching reserve from orphaned block")
+		return nil
 	}
 
-	// Cache current price calculated from latest reserves
-	currentPrice, err := calculateMetToYouPrice(reserves)
+	// Cache latest reserves and the price calculated from them once stored, so
+	// the cache is never ahead of the database. Redelivered events are cached
+	// too, in case caching failed the first time.
+	return w.cachePoolState(ctx, reserveEvent.PoolAddress, reserves)
+}
+
+// cachePoolState caches the pool reserves and the current price calculated from
+// them. State older than the cached state is ignored, so events processed out of
+// order can't roll the cache back.
+func (w *Worker) cachePoolState(ctx context.Context, poolAddress string, reserves *models.PoolReserves) error {
+	currentPrice, err := CalculateMetToYouPrice(reserves)
 	if err != nil {
 		return fmt.Errorf("failed to calculate trading price: %w", err)
 	}
 
 	log.Info().Str("MET:YOU", currentPrice).Msg("caching latest price")
 
+	price := &models.PoolPrice{
+		Price:       currentPrice,
+		BlockNumber: reserves.BlockNumber,
+		LogIndex:    reserves.LogIndex,
+	}
+
 	// Start span for price caching
 	ctx, priceSpan := tracing.StartSpan(ctx, "cache.SetPrice")
-	err = w.poolCache.SetPrice(ctx, MET_YOU_PAIR, currentPrice)
+	stored, err := w.poolCache.SetPrice(ctx, poolAddress, MET_YOU_PAIR, price)
 	priceSpan.End()
 	if err != nil {
 		return fmt.Errorf("failed to update cache with trade price: %w", err)
 	}
+	if !stored {
+		log.Info().Str("pool", poolAddress).Uint64("block_number", reserves.BlockNumber).Msg("newer price already cached")
+	}
 
-	log.Info().Str("MET", reserveEvent.METReserve).Str("YOU", reserves.YOUAmount).Msg("caching latest reserves")
+	log.Info().Str("MET", reserves.METAmount).Str("YOU", reserves.YOUAmount).Msg("caching latest reserves")
 
 	// Start span for reserves caching
 	ctx, reservesSpan := tracing.StartSpan(ctx, "cache.SetReserves")
-	err = w.poolCache.SetReserves(ctx, reserveEvent.PoolAddress, reserves)
+	stored, err = w.poolCache.SetReserves(ctx, poolAddress, reserves)
 	reservesSpan.End()
 	if err != nil {
 		return fmt.Errorf("failed to update reserves cache: %w", err)
 	}
-
-	log.Info().Msg("storing reserve in database")
-
-	// Start span for database operation
-	ctx, dbSpan := tracing.StartSpan(ctx, "db.CreateReserve")
-	defer dbSpan.End()
-	
-	err = w.db.CreateReserve(&reserveEvent)
-	if err != nil {
-		return fmt.Errorf("failed to store reserve event in database: %w", err)
+	if !stored {
+		log.Info().Str("pool", poolAddress).Uint64("block_number", reserves.BlockNumber).Msg("newer reserves already cached")
 	}
 
 	return nil
 }
 
-func calculateMetToYouPrice(reserves *models.PoolReserves) (string, error) {
+// CalculateMetToYouPrice returns the MET:YOU price (YOU per MET) of a pool's reserves
+func CalculateMetToYouPrice(reserves *models.PoolReserves) (string, error) {
 	var metAmount, youAmount decimal.Decimal
 	var err error
 
@@ -95,3 +133,90 @@ func calculateMetToYouPrice(reserves *models.PoolReserves) (string, error) {
 	price := youAmount.Div(metAmount)
 	return price.StringFixed(6), nil
 }
+
+// handleReserveBatch stores a batch of reserve snapshots in a single database
+// transaction, then caches the latest state of each pool in the batch that
+// wasn't stored orphaned
+func (w *Worker) handleReserveBatch(ctx context.Context, records []kafka.Record) error {
+	ctx, span := tracing.StartSpan(ctx, "worker.handleReserveBatch")
+	defer span.End()
+
+	reserveEvents := make([]*models.ReserveEvent, 0, len(records))
+	for _, record := range records {
+		reserveEvent, err := decodeReserve(w.schemas, record.Header, record.Value)
+		if err != nil {
+			return err
+		}
+		reserveEvents = append(reserveEvents, reserveEvent)
+	}
+
+	created, err := w.createReserves(ctx, reserveEvents)
+	if err != nil {
+		return fmt.Errorf("failed to store reserve events in database: %w", err)
+	}
+
+	log.Info().Int("reserves", len(reserveEvents)).Int("new", created).Msg("stored reserve batch")
+
+	// Earlier snapshots in the batch are superseded, only the latest one not
+	// stored orphaned is cached
+	latest := make(map[string]*models.ReserveEvent)
+	for _, reserveEvent := range reserveEvents {
+		if reserveEvent.Status == models.EventStatusOrphaned {
+			continue
+		}
+		if current, ok := latest[reserveEvent.PoolAddress]; !ok || isLaterReserve(reserveEvent, current) {
+			latest[reserveEvent.PoolAddress] = reserveEvent
+		}
+	}
+
+	for poolAddress, reserveEvent := range latest {
+		reserves := &models.PoolReserves{
+			METAmount:   reserveEvent.METReserve,
+			YOUAmount:   reserveEvent.YOUReserve,
+			BlockNumber: reserveEvent.BlockNumber,
+			LogIndex:    reserveEvent.LogIndex,
+		}
+
+		if err := w.cachePoolState(ctx, poolAddress, reserves); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// isLaterReserve reports whether a was emitted after b
+func isLaterReserve(a, b *models.ReserveEvent) bool {
+	if a.BlockNumber != b.BlockNumber {
+		return a.BlockNumber > b.BlockNumber
+	}
+	return a.LogIndex > b.LogIndex
+}
+
+// createReserve stores a reserve snapshot, in the same transaction as the
+// consumer's offset when the consumer keeps its offsets in the database
+func (w *Worker) createReserve(ctx context.Context, reserve *models.ReserveEvent) (bool, error) {
+	if kafka.OffsetsToStore(ctx) == nil {
+		return w.db.CreateReserve(ctx, reserve)
+	}
+
+	created, err := w.createReserves(ctx, []*models.ReserveEvent{reserve})
+	return created == 1, err
+}
+
+// createReserves stores reserve snapshots, in the same transaction as the
+// consumer's offsets when the consumer keeps its offsets in the database
+func (w *Worker) createReserves(ctx context.Context, reserves []*models.ReserveEvent) (int, error) {
+	offsets := kafka.OffsetsToStore(ctx)
+	if offsets == nil {
+		return w.db.CreateReserves(ctx, reserves)
+	}
+
+	created, err := w.db.CreateReservesWithOffsets(ctx, reserves, offsets)
+	if err != nil {
+		return 0, err
+	}
+	kafka.MarkOffsetsStored(ctx)
+
+	return created, nil
+}
@@ -1,12 +1,14 @@
 package worker
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
+	"strings"
 	"testing"
 
 	"github.com/murraystewart96/token-swap/internal/models"
 	storageMock "github.com/murraystewart96/token-swap/internal/storage/mock"
+	"github.com/murraystewart96/token-swap/pkg/kafka"
 	"github.com/shopspring/decimal"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
@@ -80,7 +82,7 @@ func TestCalculateMetToYouPriceFromReserves(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			result, err := calculateMetToYouPrice(tt.reserves)
+			result, err := CalculateMetToYouPrice(tt.reserves)
 
 			if tt.expectError {
 				assert.Error(t, err)
@@ -93,6 +95,11 @@ func TestCalculateMetToYouPriceFromReserves(t *testing.T) {
 	}
 }
 
+// matchPrice matches a cached price by value, ignoring its block position
+func matchPrice(price string) any {
+	return mock.MatchedBy(func(p *models.PoolPrice) bool { return p.Price == price })
+}
+
 func TestHandleReserveEvent(t *testing.T) {
 	tests := []struct {
 		name          string
@@ -111,13 +118,49 @@ func TestHandleReserveEvent(t *testing.T) {
 				PoolAddress: "0xpool123",
 			},
 			setupMocks: func(cache *storageMock.PoolCache, db *storageMock.DB) {
-				cache.On("SetPrice", mock.Anything, MET_YOU_PAIR, "1.500000").Return(nil)
+				cache.On("SetPrice", mock.Anything, "0xpool123", MET_YOU_PAIR, &models.PoolPrice{
+					Price:       "1.500000",
+					BlockNumber: 12345,
+				}).Return(true, nil)
 				expectedReserves := &models.PoolReserves{
-					METAmount: "100.0",
-					YOUAmount: "150.0",
+					METAmount:   "100.0",
+					YOUAmount:   "150.0",
+					BlockNumber: 12345,
 				}
-				cache.On("SetReserves", mock.Anything, "0xpool123", expectedReserves).Return(nil)
-				db.On("CreateReserve", mock.Anything).Return(nil)
+				cache.On("SetReserves", mock.Anything, "0xpool123", expectedReserves).Return(true, nil)
+				db.On("CreateReserve", mock.Anything, mock.Anything).Return(true, nil)
+			},
+			expectError: false,
+		},
+		{
+			name: "redelivered reserve already stored",
+			inputEvent: &models.ReserveEvent{
+				TxHash:      "0xabc123",
+				BlockNumber: 12345,
+				METReserve:  "100.0",
+				YOUReserve:  "150.0",
+				PoolAddress: "0xpool123",
+			},
+			setupMocks: func(cache *storageMock.PoolCache, db *storageMock.DB) {
+				cache.On("SetPrice", mock.Anything, "0xpool123", MET_YOU_PAIR, matchPrice("1.500000")).Return(true, nil)
+				cache.On("SetReserves", mock.Anything, "0xpool123", mock.Anything).Return(true, nil)
+				db.On("CreateReserve", mock.Anything, mock.Anything).Return(false, nil)
+			},
+			expectError: false,
+		},
+		{
+			name: "older than cached state",
+			inputEvent: &models.ReserveEvent{
+				TxHash:      "0xabc123",
+				BlockNumber: 12345,
+				METReserve:  "100.0",
+				YOUReserve:  "150.0",
+				PoolAddress: "0xpool123",
+			},
+			setupMocks: func(cache *storageMock.PoolCache, db *storageMock.DB) {
+				cache.On("SetPrice", mock.Anything, "0xpool123", MET_YOU_PAIR, matchPrice("1.500000")).Return(false, nil)
+				cache.On("SetReserves", mock.Anything, "0xpool123", mock.Anything).Return(false, nil)
+				db.On("CreateReserve", mock.Anything, mock.Anything).Return(true, nil)
 			},
 			expectError: false,
 		},
@@ -130,8 +173,9 @@ func TestHandleReserveEvent(t *testing.T) {
 				PoolAddress: "0xpool123",
 			},
 			setupMocks: func(cache *storageMock.PoolCache, db *storageMock.DB) {
-				cache.On("SetPrice", mock.Anything, MET_YOU_PAIR, "1.500000").
-					Return(errors.New("cache connection failed"))
+				db.On("CreateReserve", mock.Anything, mock.Anything).Return(true, nil)
+				cache.On("SetPrice", mock.Anything, "0xpool123", MET_YOU_PAIR, matchPrice("1.500000")).
+					Return(false, errors.New("cache connection failed"))
 			},
 			expectError:   true,
 			expectedError: "failed to update cache with trade price",
@@ -145,9 +189,10 @@ func TestHandleReserveEvent(t *testing.T) {
 				PoolAddress: "0xpool123",
 			},
 			setupMocks: func(cache *storageMock.PoolCache, db *storageMock.DB) {
-				cache.On("SetPrice", mock.Anything, MET_YOU_PAIR, "1.500000").Return(nil)
+				db.On("CreateReserve", mock.Anything, mock.Anything).Return(true, nil)
+				cache.On("SetPrice", mock.Anything, "0xpool123", MET_YOU_PAIR, matchPrice("1.500000")).Return(true, nil)
 				cache.On("SetReserves", mock.Anything, "0xpool123", mock.Anything).
-					Return(errors.New("cache connection failed"))
+					Return(false, errors.New("cache connection failed"))
 			},
 			expectError:   true,
 			expectedError: "failed to update reserves cache",
@@ -161,9 +206,8 @@ func TestHandleReserveEvent(t *testing.T) {
 				PoolAddress: "0xpool123",
 			},
 			setupMocks: func(cache *storageMock.PoolCache, db *storageMock.DB) {
-				cache.On("SetPrice", mock.Anything, MET_YOU_PAIR, "1.500000").Return(nil)
-				cache.On("SetReserves", mock.Anything, "0xpool123", mock.Anything).Return(nil)
-				db.On("CreateReserve", mock.Anything).Return(errors.New("postgres connection failed"))
+				// The cache is not updated, so it isn't left ahead of the database
+				db.On("CreateReserve", mock.Anything, mock.Anything).Return(false, errors.New("postgres connection failed"))
 			},
 			expectError:   true,
 			expectedError: "failed to store reserve event in database",
@@ -208,7 +252,7 @@ func TestHandleReserveEvent(t *testing.T) {
 			}
 
 			// Marshal event to JSON (simulating Kafka message)
-			eventBytes, err := json.Marshal(tt.inputEvent)
+			eventBytes, err := marshalEvent(models.EventTypeReserve, models.ReserveEventVersion, tt.inputEvent)
 			require.NoError(t, err)
 
 			// Execute
@@ -269,6 +313,196 @@ func TestHandleReserveEventInvalidJSON(t *testing.T) {
 	}
 }
 
+func TestHandleReserveBatch(t *testing.T) {
+	reserves := []*models.ReserveEvent{
+		{TxHash: "0x2", BlockNumber: 11, LogIndex: 0, METReserve: "100.0", YOUReserve: "300.0", PoolAddress: "0xpool1"},
+		{TxHash: "0x1", BlockNumber: 10, LogIndex: 4, METReserve: "100.0", YOUReserve: "150.0", PoolAddress: "0xpool1"},
+		{TxHash: "0x3", BlockNumber: 10, LogIndex: 2, METReserve: "100.0", YOUReserve: "200.0", PoolAddress: "0xpool2"},
+	}
+
+	records := make([]kafka.Record, len(reserves))
+	for i, reserve := range reserves {
+		value, err := marshalEvent(models.EventTypeReserve, models.ReserveEventVersion, reserve)
+		require.NoError(t, err)
+		records[i] = kafka.Record{Key: []byte("key"), Value: value}
+	}
+
+	t.Run("stores the batch and caches the latest state of each pool", func(t *testing.T) {
+		cache := &storageMock.PoolCache{}
+		db := &storageMock.DB{}
+
+		db.On("CreateReserves", mock.Anything, reserves).Return(3, nil).Once()
+		cache.On("SetPrice", mock.Anything, "0xpool1", MET_YOU_PAIR, matchPrice("3.000000")).Return(true, nil).Once()
+		cache.On("SetReserves", mock.Anything, "0xpool1", &models.PoolReserves{METAmount: "100.0", YOUAmount: "300.0", BlockNumber: 11}).Return(true, nil).Once()
+		cache.On("SetPrice", mock.Anything, "0xpool2", MET_YOU_PAIR, matchPrice("2.000000")).Return(true, nil).Once()
+		cache.On("SetReserves", mock.Anything, "0xpool2", &models.PoolReserves{METAmount: "100.0", YOUAmount: "200.0", BlockNumber: 10, LogIndex: 2}).Return(true, nil).Once()
+
+		worker := &Worker{poolCache: cache, db: db}
+		require.NoError(t, worker.handleReserveBatch(t.Context(), records))
+
+		db.AssertExpectations(t)
+		cache.AssertExpectations(t)
+	})
+
+	t.Run("reserves stored orphaned aren't cached", func(t *testing.T) {
+		cache := &storageMock.PoolCache{}
+		db := &storageMock.DB{}
+
+		// The latest reserves of pool 1 are from a block that was retracted first
+		db.On("CreateReserves", mock.Anything, mock.Anything).Return(3, nil).Once().Run(func(args mock.Arguments) {
+			for _, reserve := range args.Get(1).([]*models.ReserveEvent) {
+				reserve.Status = models.EventStatusPending
+				if reserve.TxHash == "0x2" {
+					reserve.Status = models.EventStatusOrphaned
+				}
+			}
+		})
+		cache.On("SetPrice", mock.Anything, "0xpool1", MET_YOU_PAIR, matchPrice("1.500000")).Return(true, nil).Once()
+		cache.On("SetReserves", mock.Anything, "0xpool1", &models.PoolReserves{METAmount: "100.0", YOUAmount: "150.0", BlockNumber: 10, LogIndex: 4}).Return(true, nil).Once()
+		cache.On("SetPrice", mock.Anything, "0xpool2", MET_YOU_PAIR, matchPrice("2.000000")).Return(true, nil).Once()
+		cache.On("SetReserves", mock.Anything, "0xpool2", &models.PoolReserves{METAmount: "100.0", YOUAmount: "200.0", BlockNumber: 10, LogIndex: 2}).Return(true, nil).Once()
+
+		worker := &Worker{poolCache: cache, db: db}
+		require.NoError(t, worker.handleReserveBatch(t.Context(), records))
+
+		db.AssertExpectations(t)
+		cache.AssertExpectations(t)
+	})
+
+	t.Run("database failure skips the cache", func(t *testing.T) {
+		cache := &storageMock.PoolCache{}
+		db := &storageMock.DB{}
+		db.On("CreateReserves", mock.Anything, mock.Anything).Return(0, errors.New("db connection failed"))
+
+		worker := &Worker{poolCache: cache, db: db}
+		err := worker.handleReserveBatch(t.Context(), records)
+
+		assert.ErrorContains(t, err, "failed to store reserve events in database")
+		cache.AssertNotCalled(t, "SetPrice", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	})
+}
+
+// positionCache is a PoolCache that, like the Redis cache, never replaces state
+// with state from the same or an earlier block position
+type positionCache struct {
+	prices   map[string]*models.PoolPrice
+	reserves map[string]*models.PoolReserves
+}
+
+func newPositionCache() *positionCache {
+	return &positionCache{
+		prices:   make(map[string]*models.PoolPrice),
+		reserves: make(map[string]*models.PoolReserves),
+	}
+}
+
+func isNewerPosition(block uint64, log uint, currentBlock uint64, currentLog uint) bool {
+	return block > currentBlock || (block == currentBlock && log > currentLog)
+}
+
+func (c *positionCache) SetPrice(_ context.Context, poolAddr, pair string, price *models.PoolPrice) (bool, error) {
+	current, ok := c.prices[poolAddr+pair]
+	if ok && !isNewerPosition(price.BlockNumber, price.LogIndex, current.BlockNumber, current.LogIndex) {
+		return false, nil
+	}
+	c.prices[poolAddr+pair] = price
+	return true, nil
+}
+
+func (c *positionCache) GetPrice(_ context.Context, poolAddr, pair string) (*models.PoolPrice, error) {
+	return c.prices[poolAddr+pair], nil
+}
+
+func (c *positionCache) SetReserves(_ context.Context, poolAddr string, reserves *models.PoolReserves) (bool, error) {
+	current, ok := c.reserves[poolAddr]
+	if ok && !isNewerPosition(reserves.BlockNumber, reserves.LogIndex, current.BlockNumber, current.LogIndex) {
+		return false, nil
+	}
+	c.reserves[poolAddr] = reserves
+	return true, nil
+}
+
+func (c *positionCache) GetReserves(_ context.Context, poolAddr string) (*models.PoolReserves, error) {
+	return c.reserves[poolAddr], nil
+}
+
+func (c *positionCache) ResetPoolFrom(_ context.Context, poolAddr string, blockNumber uint64) error {
+	for key, price := range c.prices {
+		if strings.HasPrefix(key, poolAddr) && price.BlockNumber >= blockNumber {
+			delete(c.prices, key)
+		}
+	}
+	if reserves, ok := c.reserves[poolAddr]; ok && reserves.BlockNumber >= blockNumber {
+		delete(c.reserves, poolAddr)
+	}
+	return nil
+}
+
+func (c *positionCache) Reset() error {
+	c.prices = make(map[string]*models.PoolPrice)
+	c.reserves = make(map[string]*models.PoolReserves)
+	return nil
+}
+
+// expectOrphaningDB stores events from blocks the worker orphaned as orphaned,
+// as the database does
+func expectOrphaningDB(db *storageMock.DB) {
+	orphaned := make(map[string]bool)
+	status := func(blockHash string) string {
+		if orphaned[blockHash] {
+			return models.EventStatusOrphaned
+		}
+		return models.EventStatusPending
+	}
+
+	db.On("OrphanEvents", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+		for _, hash := range args.Get(1).([]string) {
+			orphaned[hash] = true
+		}
+	})
+	db.On("CreateReserve", mock.Anything, mock.Anything).Return(true, nil).Run(func(args mock.Arguments) {
+		reserve := args.Get(1).(*models.ReserveEvent)
+		reserve.Status = status(reserve.BlockHash)
+	})
+	db.On("CreateReserves", mock.Anything, mock.Anything).Return(1, nil).Run(func(args mock.Arguments) {
+		for _, reserve := range args.Get(1).([]*models.ReserveEvent) {
+			reserve.Status = status(reserve.BlockHash)
+		}
+	})
+}
+
+func TestHandleReserveEvent_RetractedBeforeStored(t *testing.T) {
+	cache := newPositionCache()
+	db := &storageMock.DB{}
+	expectOrphaningDB(db)
+	db.On("GetLatestReserve", mock.Anything, "0xpool123", []string(nil)).Return(nil, nil)
+	worker := &Worker{poolCache: cache, db: db}
+
+	// The retraction of block 100 is handled before its reserves
+	reorg, err := marshalEvent(models.EventTypeReorg, models.ReorgEventVersion, &models.ReorgEvent{
+		PoolAddresses:  []string{"0xpool123"},
+		ForkBlock:      100,
+		OrphanedBlocks: []string{"0xold100"},
+		NewHeadNumber:  100,
+		NewHeadHash:    "0xnew100",
+	})
+	require.NoError(t, err)
+	require.NoError(t, worker.handleReorgEvent(t.Context(), []byte("0xnew100"), reorg))
+
+	for _, reserve := range []*models.ReserveEvent{
+		{TxHash: "0xabc", BlockNumber: 100, BlockHash: "0xold100", LogIndex: 1, METReserve: "100.0", YOUReserve: "150.0", PoolAddress: "0xpool123"},
+		{TxHash: "0xabc", BlockNumber: 100, BlockHash: "0xnew100", LogIndex: 1, METReserve: "100.0", YOUReserve: "300.0", PoolAddress: "0xpool123"},
+	} {
+		value, err := marshalEvent(models.EventTypeReserve, models.ReserveEventVersion, reserve)
+		require.NoError(t, err)
+		require.NoError(t, worker.handleReserveEvent(t.Context(), []byte("0xpool123"), value))
+	}
+
+	// The replacement at the same position is cached, not the orphaned reserves
+	assert.Equal(t, &models.PoolReserves{METAmount: "100.0", YOUAmount: "300.0", BlockNumber: 100, LogIndex: 1}, cache.reserves["0xpool123"])
+	assert.Equal(t, "3.000000", cache.prices["0xpool123"+MET_YOU_PAIR].Price)
+}
+
 func TestReserveEventDataMapping(t *testing.T) {
 	// Test that ReserveEvent fields are properly mapped to PoolReserves
 	inputEvent := &models.ReserveEvent{
@@ -282,20 +516,22 @@ func TestReserveEventDataMapping(t *testing.T) {
 	mockCache := &storageMock.PoolCache{}
 	DB := &storageMock.DB{}
 
+	mockCache.On("SetPrice", mock.Anything, "0xpooltest", MET_YOU_PAIR, mock.Anything).Return(true, nil)
+
 	// Capture what gets passed to SetReserves
 	var capturedReserves *models.PoolReserves
 	mockCache.On("SetReserves", mock.Anything, "0xpooltest", mock.Anything).
 		Run(func(args mock.Arguments) {
 			capturedReserves = args.Get(2).(*models.PoolReserves)
-		}).Return(nil)
-	DB.On("CreateReserve", mock.Anything).Return(nil)
+		}).Return(true, nil)
+	DB.On("CreateReserve", mock.Anything, mock.Anything).Return(true, nil)
 
 	worker := &Worker{
 		poolCache: mockCache,
 		db:        DB,
 	}
 
-	eventBytes, _ := json.Marshal(inputEvent)
+	eventBytes, _ := marshalEvent(models.EventTypeReserve, models.ReserveEventVersion, inputEvent)
 	err := worker.handleReserveEvent(t.Context(), []byte("key"), eventBytes)
 
 	require.NoError(t, err)
@@ -317,7 +553,7 @@ func BenchmarkCalculateMetToYouPriceFromReserves(b *testing.B) {
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		_, err := calculateMetToYouPrice(reserves)
+		_, err := CalculateMetToYouPrice(reserves)
 		if err != nil {
 			b.Fatal(err)
 		}
@@ -335,7 +571,7 @@ func TestPriceCalculationPropertiesFromReserves(b *testing.T) {
 		YOUAmount: youAmount.String(),
 	}
 
-	price, err := calculateMetToYouPrice(reserves)
+	price, err := CalculateMetToYouPrice(reserves)
 	require.NoError(b, err)
 
 	// Verify the actual calculation
@@ -348,7 +584,7 @@ func TestPriceCalculationPropertiesFromReserves(b *testing.T) {
 		YOUAmount: youAmount.Mul(decimal.NewFromInt(2)).String(),
 	}
 
-	price2, err2 := calculateMetToYouPrice(reserves2)
+	price2, err2 := CalculateMetToYouPrice(reserves2)
 	require.NoError(b, err2)
 
 	// Should give same price despite different amounts
@@ -361,9 +597,9 @@ func BenchmarkHandleReserveEvent(b *testing.B) {
 	DB := &storageMock.DB{}
 
 	// Setup mocks to always succeed
-	mockCache.On("SetPrice", mock.Anything, mock.Anything, mock.Anything).Return(nil)
-	mockCache.On("SetReserves", mock.Anything, mock.Anything, mock.Anything).Return(nil)
-	DB.On("CreateReserve", mock.Anything).Return(nil)
+	mockCache.On("SetPrice", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(true, nil)
+	mockCache.On("SetReserves", mock.Anything, mock.Anything, mock.Anything).Return(true, nil)
+	DB.On("CreateReserve", mock.Anything, mock.Anything).Return(true, nil)
 
 	worker := &Worker{
 		poolCache: mockCache,
@@ -378,7 +614,7 @@ func BenchmarkHandleReserveEvent(b *testing.B) {
 		PoolAddress: "0xpool",
 	}
 
-	eventBytes, _ := json.Marshal(testEvent)
+	eventBytes, _ := marshalEvent(models.EventTypeReserve, models.ReserveEventVersion, testEvent)
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
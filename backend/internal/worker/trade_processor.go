@@ -2,10 +2,10 @@ package worker
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 
 	"github.com/murraystewart96/token-swap/internal/models"
+	"github.com/murraystewart96/token-swap/pkg/kafka"
 	"github.com/murraystewart96/token-swap/pkg/tracing"
 	"github.com/rs/zerolog/log"
 )
@@ -15,9 +15,9 @@ func (w *Worker) handleTradeEvent(ctx context.Context, key, value []byte) error
 	ctx, span := tracing.StartSpan(ctx, "worker.handleTradeEvent")
 	defer span.End()
 
-	tradeEvent := &models.TradeEvent{}
-	if err := json.Unmarshal(value, tradeEvent); err != nil {
-		return fmt.Errorf("failed to unmarshal trade history event: %w", err)
+	tradeEvent, err := decodeTrade(w.schemas, messageHeader(ctx), value)
+	if err != nil {
+		return err
 	}
 
 	// Add trade-specific attributes to the span
@@ -27,14 +27,67 @@ func (w *Worker) handleTradeEvent(ctx context.Context, key, value []byte) error
 
 	log.Info().Msg("storing trade in database")
 
-	// Start a span for database operation
-	ctx, dbSpan := tracing.StartSpan(ctx, "db.CreateTrade")
-	defer dbSpan.End()
-
-	err := w.db.CreateTrade(tradeEvent)
+	created, err := w.createTrade(ctx, tradeEvent)
 	if err != nil {
 		return fmt.Errorf("failed to store trade event in database: %w", err)
 	}
 
+	// Redelivered event, already stored
+	if !created {
+		log.Info().Str("tx_hash", tradeEvent.TxHash).Uint("log_index", tradeEvent.LogIndex).Msg("trade already stored")
+	}
+
+	return nil
+}
+
+// handleTradeBatch stores a batch of trades in a single database transaction
+func (w *Worker) handleTradeBatch(ctx context.Context, records []kafka.Record) error {
+	ctx, span := tracing.StartSpan(ctx, "worker.handleTradeBatch")
+	defer span.End()
+
+	trades := make([]*models.TradeEvent, 0, len(records))
+	for _, record := range records {
+		tradeEvent, err := decodeTrade(w.schemas, record.Header, record.Value)
+		if err != nil {
+			return err
+		}
+		trades = append(trades, tradeEvent)
+	}
+
+	created, err := w.createTrades(ctx, trades)
+	if err != nil {
+		return fmt.Errorf("failed to store trade events in database: %w", err)
+	}
+
+	log.Info().Int("trades", len(trades)).Int("new", created).Msg("stored trade batch")
+
 	return nil
 }
+
+// createTrade stores a trade, in the same transaction as the consumer's offset
+// when the consumer keeps its offsets in the database
+func (w *Worker) createTrade(ctx context.Context, trade *models.TradeEvent) (bool, error) {
+	if kafka.OffsetsToStore(ctx) == nil {
+		return w.db.CreateTrade(ctx, trade)
+	}
+
+	created, err := w.createTrades(ctx, []*models.TradeEvent{trade})
+	return created == 1, err
+}
+
+// createTrades stores trades, in the same transaction as the consumer's offsets
+// when the consumer keeps its offsets in the database
+func (w *Worker) createTrades(ctx context.Context, trades []*models.TradeEvent) (int, error) {
+	offsets := kafka.OffsetsToStore(ctx)
+	if offsets == nil {
+		return w.db.CreateTrades(ctx, trades)
+	}
+
+	created, err := w.db.CreateTradesWithOffsets(ctx, trades, offsets)
+	if err != nil {
+		return 0, err
+	}
+	kafka.MarkOffsetsStored(ctx)
+
+	return created, nil
+}
@@ -1,12 +1,12 @@
 package worker
 
 import (
-	"encoding/json"
 	"errors"
 	"testing"
 
 	"github.com/murraystewart96/token-swap/internal/models"
 	storageMock "github.com/murraystewart96/token-swap/internal/storage/mock"
+	"github.com/murraystewart96/token-swap/pkg/kafka"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
@@ -30,7 +30,7 @@ func TestHandleTradeEvent(t *testing.T) {
 				AmountOut: "150.0",
 			},
 			setupMocks: func(cache *storageMock.PoolCache, db *storageMock.DB) {
-				db.On("CreateTrade", mock.Anything).Return(nil)
+				db.On("CreateTrade", mock.Anything, mock.Anything).Return(true, nil)
 			},
 			expectError: false,
 		},
@@ -43,7 +43,7 @@ func TestHandleTradeEvent(t *testing.T) {
 				AmountOut: "150.0",
 			},
 			setupMocks: func(cache *storageMock.PoolCache, db *storageMock.DB) {
-				db.On("CreateTrade", mock.Anything).Return(errors.New("db connection failed"))
+				db.On("CreateTrade", mock.Anything, mock.Anything).Return(false, errors.New("db connection failed"))
 			},
 			expectError:   true,
 			expectedError: "failed to store trade event in database",
@@ -64,7 +64,7 @@ func TestHandleTradeEvent(t *testing.T) {
 			}
 
 			// Marshal event to JSON (simulating Kafka message)
-			eventBytes, err := json.Marshal(tt.inputEvent)
+			eventBytes, err := marshalEvent(models.EventTypeTrade, models.TradeEventVersion, tt.inputEvent)
 			require.NoError(t, err)
 
 			// Execute
@@ -110,7 +110,7 @@ func BenchmarkHandleTradeEvent(b *testing.B) {
 	mockDB := &storageMock.DB{}
 
 	// Setup mocks to always succeed
-	mockDB.On("CreateTrade", mock.Anything).Return(nil)
+	mockDB.On("CreateTrade", mock.Anything, mock.Anything).Return(true, nil)
 
 	worker := &Worker{
 		poolCache: mockCache,
@@ -125,7 +125,7 @@ func BenchmarkHandleTradeEvent(b *testing.B) {
 		AmountOut: "1500.0",
 	}
 
-	eventBytes, _ := json.Marshal(testEvent)
+	eventBytes, _ := marshalEvent(models.EventTypeTrade, models.TradeEventVersion, testEvent)
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
@@ -135,3 +135,47 @@ func BenchmarkHandleTradeEvent(b *testing.B) {
 		}
 	}
 }
+
+func TestHandleTradeBatch(t *testing.T) {
+	trades := []*models.TradeEvent{
+		{TxHash: "0x1", LogIndex: 0, AmountIn: "100.0", AmountOut: "150.0"},
+		{TxHash: "0x1", LogIndex: 1, AmountIn: "10.0", AmountOut: "15.0"},
+	}
+
+	records := make([]kafka.Record, len(trades))
+	for i, trade := range trades {
+		value, err := marshalEvent(models.EventTypeTrade, models.TradeEventVersion, trade)
+		require.NoError(t, err)
+		records[i] = kafka.Record{Key: []byte("test-key"), Value: value}
+	}
+
+	t.Run("stores every trade in one write", func(t *testing.T) {
+		db := &storageMock.DB{}
+		db.On("CreateTrades", mock.Anything, trades).Return(1, nil).Once()
+
+		worker := &Worker{db: db}
+		require.NoError(t, worker.handleTradeBatch(t.Context(), records))
+
+		db.AssertExpectations(t)
+	})
+
+	t.Run("database failure", func(t *testing.T) {
+		db := &storageMock.DB{}
+		db.On("CreateTrades", mock.Anything, mock.Anything).Return(0, errors.New("db connection failed"))
+
+		worker := &Worker{db: db}
+		err := worker.handleTradeBatch(t.Context(), records)
+
+		assert.ErrorContains(t, err, "failed to store trade events in database")
+	})
+
+	t.Run("malformed message fails the batch without retrying", func(t *testing.T) {
+		db := &storageMock.DB{}
+
+		worker := &Worker{db: db}
+		err := worker.handleTradeBatch(t.Context(), append(records, kafka.Record{Value: []byte("{invalid")}))
+
+		assert.ErrorIs(t, err, kafka.ErrNonRetryable)
+		db.AssertNotCalled(t, "CreateTrades", mock.Anything, mock.Anything)
+	})
+}
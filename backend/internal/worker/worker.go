@@ -5,8 +5,8 @@ import (
 	"fmt"
 
 	"github.com/murraystewart96/token-swap/internal/config"
-	"github.com/murraystewart96/token-swap/pkg/kafka"
 	"github.com/murraystewart96/token-swap/internal/storage"
+	"github.com/murraystewart96/token-swap/pkg/kafka"
 	"github.com/rs/zerolog/log"
 )
 
@@ -15,6 +15,13 @@ type Worker struct {
 	db            storage.DB
 	poolCache     storage.PoolCache
 	eventHandlers kafka.EventHandlers
+
+	// Batch handlers for the same topics, used when batching is enabled
+	batchHandlers kafka.BatchEventHandlers
+	batching      bool
+
+	// Registry the schema IDs of messages are checked against, if any
+	schemas *kafka.SchemaRegistry
 }
 
 func New(consumer kafka.IConsumer, topics []string, poolCache storage.PoolCache, db storage.DB) (*Worker, error) {
@@ -27,19 +34,30 @@ func New(consumer kafka.IConsumer, topics []string, poolCache storage.PoolCache,
 	eventHandlers := kafka.EventHandlers{
 		config.TradeHistoryTopic:   worker.handleTradeEvent,
 		config.ReserveHistoryTopic: worker.handleReserveEvent,
+		config.ChainReorgTopic:     worker.handleReorgEvent,
+	}
+
+	// Reorgs are rare, they aren't worth batching
+	batchHandlers := kafka.BatchEventHandlers{
+		config.TradeHistoryTopic:   worker.handleTradeBatch,
+		config.ReserveHistoryTopic: worker.handleReserveBatch,
+		config.ChainReorgTopic:     kafka.PerMessage(worker.handleReorgEvent),
 	}
 
 	// Assign configured topic handlers
 	activeHandlers := make(kafka.EventHandlers)
+	activeBatchHandlers := make(kafka.BatchEventHandlers)
 	for _, topic := range topics {
 		handler, found := eventHandlers[topic]
 		if !found {
 			return nil, fmt.Errorf("no event handler for topic: %s", topic)
 		}
 		activeHandlers[topic] = handler
+		activeBatchHandlers[topic] = batchHandlers[topic]
 	}
 
 	worker.eventHandlers = activeHandlers
+	worker.batchHandlers = activeBatchHandlers
 
 	return worker, nil
 }
@@ -57,9 +75,14 @@ func (w *Worker) Start(ctx context.Context) error {
 func (w *Worker) processEvents(ctx context.Context) error {
 	log.Info().Msgf("processing events...")
 
-	err := w.consumer.StartConsuming(ctx, w.eventHandlers)
+	var err error
+	if w.batching {
+		err = w.consumer.StartConsumingBatches(ctx, w.batchHandlers)
+	} else {
+		err = w.consumer.StartConsuming(ctx, w.eventHandlers)
+	}
 	if err != nil {
-		return fmt.Errorf("failed to start consuming topic: %w", err)
+		return fmt.Errorf("failed to consume topics: %w", err)
 	}
 
 	return nil
@@ -68,3 +91,15 @@ func (w *Worker) processEvents(ctx context.Context) error {
 func (w *Worker) SetEventHandlers(handlers kafka.EventHandlers) {
 	w.eventHandlers = handlers
 }
+
+// EnableBatching makes the worker consume messages in batches and write each
+// batch to the database in one transaction
+func (w *Worker) EnableBatching() {
+	w.batching = true
+}
+
+// CheckSchemas makes the worker check the schema ID each message is sent with is
+// registered in schemas for the message's event type and schema version
+func (w *Worker) CheckSchemas(schemas *kafka.SchemaRegistry) {
+	w.schemas = schemas
+}
@@ -4,8 +4,11 @@ import (
 	"context"
 	"fmt"
 	"math/big"
+	"path/filepath"
+	"strings"
 
 	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/ethclient"
 )
@@ -13,36 +16,126 @@ import (
 // IClient defines the interface for Ethereum client operations
 type IClient interface {
 	BlockByNumber(ctx context.Context, number *big.Int) (*types.Block, error)
+	BlockNumber(ctx context.Context) (uint64, error)
+	ChainID(ctx context.Context) (*big.Int, error)
+	HeaderByHash(ctx context.Context, hash common.Hash) (*types.Header, error)
+	HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error)
+	TransactionByHash(ctx context.Context, hash common.Hash) (*types.Transaction, bool, error)
+	TransactionReceipt(ctx context.Context, txHash common.Hash) (*types.Receipt, error)
+	TransactionSender(ctx context.Context, tx *types.Transaction, block common.Hash, index uint) (common.Address, error)
+	FilterLogs(ctx context.Context, q ethereum.FilterQuery) ([]types.Log, error)
 	SubscribeFilterLogs(ctx context.Context, q ethereum.FilterQuery, ch chan<- types.Log) (ethereum.Subscription, error)
+	SupportsSubscriptions() bool
+	Reconnect(ctx context.Context) error
 }
 
 // Client wraps the go-ethereum ethclient to implement IClient interface
 type Client struct {
+	rpcURL string
 	client *ethclient.Client
 }
 
 // NewClient creates a new Ethereum client instance
 func NewClient(rpcURL string) (*Client, error) {
-	client, err := ethclient.Dial(fmt.Sprintf("ws://%s", rpcURL))
+	client, err := dial(context.Background(), rpcURL)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create eth client: %w", err)
+		return nil, err
 	}
 
 	return &Client{
+		rpcURL: rpcURL,
 		client: client,
 	}, nil
 }
 
+// Reconnect closes the current connection and dials the node again.
+// Subscriptions created on the old connection are terminated.
+func (c *Client) Reconnect(ctx context.Context) error {
+	client, err := dial(ctx, c.rpcURL)
+	if err != nil {
+		return err
+	}
+
+	c.client.Close()
+	c.client = client
+
+	return nil
+}
+
+// Endpoint returns the URL to dial for rpcURL. http(s)://, ws(s):// and IPC
+// paths are used as they are, a bare host:port defaults to WebSocket.
+func Endpoint(rpcURL string) string {
+	if strings.Contains(rpcURL, "://") || strings.HasSuffix(rpcURL, ".ipc") || filepath.IsAbs(rpcURL) {
+		return rpcURL
+	}
+
+	return fmt.Sprintf("ws://%s", rpcURL)
+}
+
+func dial(ctx context.Context, rpcURL string) (*ethclient.Client, error) {
+	client, err := ethclient.DialContext(ctx, Endpoint(rpcURL))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create eth client: %w", err)
+	}
+
+	return client, nil
+}
+
 // BlockByNumber returns the block with the given number
 func (c *Client) BlockByNumber(ctx context.Context, number *big.Int) (*types.Block, error) {
 	return c.client.BlockByNumber(ctx, number)
 }
 
+// BlockNumber returns the most recent block number
+func (c *Client) BlockNumber(ctx context.Context) (uint64, error) {
+	return c.client.BlockNumber(ctx)
+}
+
+// ChainID returns the chain ID of the network the node is on
+func (c *Client) ChainID(ctx context.Context) (*big.Int, error) {
+	return c.client.ChainID(ctx)
+}
+
+// HeaderByHash returns the block header with the given hash
+func (c *Client) HeaderByHash(ctx context.Context, hash common.Hash) (*types.Header, error) {
+	return c.client.HeaderByHash(ctx, hash)
+}
+
+// HeaderByNumber returns the canonical block header with the given number (nil for latest)
+func (c *Client) HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error) {
+	return c.client.HeaderByNumber(ctx, number)
+}
+
+// TransactionByHash returns the transaction with the given hash and whether it is still pending
+func (c *Client) TransactionByHash(ctx context.Context, hash common.Hash) (*types.Transaction, bool, error) {
+	return c.client.TransactionByHash(ctx, hash)
+}
+
+// TransactionReceipt returns the receipt of a mined transaction
+func (c *Client) TransactionReceipt(ctx context.Context, txHash common.Hash) (*types.Receipt, error) {
+	return c.client.TransactionReceipt(ctx, txHash)
+}
+
+// TransactionSender returns the sender address of a transaction included in the given block
+func (c *Client) TransactionSender(ctx context.Context, tx *types.Transaction, block common.Hash, index uint) (common.Address, error) {
+	return c.client.TransactionSender(ctx, tx, block, index)
+}
+
+// FilterLogs executes a filter query and returns the matching logs
+func (c *Client) FilterLogs(ctx context.Context, q ethereum.FilterQuery) ([]types.Log, error) {
+	return c.client.FilterLogs(ctx, q)
+}
+
 // SubscribeFilterLogs subscribes to log events matching the given filter query
 func (c *Client) SubscribeFilterLogs(ctx context.Context, q ethereum.FilterQuery, ch chan<- types.Log) (ethereum.Subscription, error) {
 	return c.client.SubscribeFilterLogs(ctx, q, ch)
 }
 
+// SupportsSubscriptions reports whether the transport can subscribe to logs (false for HTTP)
+func (c *Client) SupportsSubscriptions() bool {
+	return c.client.Client().SupportsSubscriptions()
+}
+
 // Close closes the underlying client connection
 func (c *Client) Close() {
 	c.client.Close()
@@ -51,4 +144,4 @@ func (c *Client) Close() {
 // GetUnderlyingClient returns the underlying ethclient.Client for contract creation
 func (c *Client) GetUnderlyingClient() *ethclient.Client {
 	return c.client
-}
\ No newline at end of file
+}
@@ -5,6 +5,7 @@ import (
 	"math/big"
 
 	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/stretchr/testify/mock"
 )
@@ -23,6 +24,72 @@ func (m *EthClient) BlockByNumber(ctx context.Context, number *big.Int) (*types.
 	return args.Get(0).(*types.Block), args.Error(1)
 }
 
+// BlockNumber mocks the BlockNumber method
+func (m *EthClient) BlockNumber(ctx context.Context) (uint64, error) {
+	args := m.Called(ctx)
+	return args.Get(0).(uint64), args.Error(1)
+}
+
+// ChainID mocks the ChainID method
+func (m *EthClient) ChainID(ctx context.Context) (*big.Int, error) {
+	args := m.Called(ctx)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*big.Int), args.Error(1)
+}
+
+// HeaderByHash mocks the HeaderByHash method
+func (m *EthClient) HeaderByHash(ctx context.Context, hash common.Hash) (*types.Header, error) {
+	args := m.Called(ctx, hash)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*types.Header), args.Error(1)
+}
+
+// HeaderByNumber mocks the HeaderByNumber method
+func (m *EthClient) HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error) {
+	args := m.Called(ctx, number)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*types.Header), args.Error(1)
+}
+
+// TransactionByHash mocks the TransactionByHash method
+func (m *EthClient) TransactionByHash(ctx context.Context, hash common.Hash) (*types.Transaction, bool, error) {
+	args := m.Called(ctx, hash)
+	if args.Get(0) == nil {
+		return nil, args.Bool(1), args.Error(2)
+	}
+	return args.Get(0).(*types.Transaction), args.Bool(1), args.Error(2)
+}
+
+// TransactionReceipt mocks the TransactionReceipt method
+func (m *EthClient) TransactionReceipt(ctx context.Context, txHash common.Hash) (*types.Receipt, error) {
+	args := m.Called(ctx, txHash)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*types.Receipt), args.Error(1)
+}
+
+// TransactionSender mocks the TransactionSender method
+func (m *EthClient) TransactionSender(ctx context.Context, tx *types.Transaction, block common.Hash, index uint) (common.Address, error) {
+	args := m.Called(ctx, tx, block, index)
+	return args.Get(0).(common.Address), args.Error(1)
+}
+
+// FilterLogs mocks the FilterLogs method
+func (m *EthClient) FilterLogs(ctx context.Context, q ethereum.FilterQuery) ([]types.Log, error) {
+	args := m.Called(ctx, q)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]types.Log), args.Error(1)
+}
+
 // SubscribeFilterLogs mocks the SubscribeFilterLogs method
 func (m *EthClient) SubscribeFilterLogs(ctx context.Context, q ethereum.FilterQuery, ch chan<- types.Log) (ethereum.Subscription, error) {
 	args := m.Called(ctx, q, ch)
@@ -30,4 +97,16 @@ func (m *EthClient) SubscribeFilterLogs(ctx context.Context, q ethereum.FilterQu
 		return nil, args.Error(1)
 	}
 	return args.Get(0).(ethereum.Subscription), args.Error(1)
-}
\ No newline at end of file
+}
+
+// Reconnect mocks the Reconnect method
+func (m *EthClient) Reconnect(ctx context.Context) error {
+	args := m.Called(ctx)
+	return args.Error(0)
+}
+
+// SupportsSubscriptions mocks the SupportsSubscriptions method
+func (m *EthClient) SupportsSubscriptions() bool {
+	args := m.Called()
+	return args.Bool(0)
+}
@@ -0,0 +1,67 @@
+package eth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/lru"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// ErrUnresolvedTimestamp is returned when a block's timestamp can't be determined
+var ErrUnresolvedTimestamp = errors.New("block timestamp could not be resolved")
+
+// HeaderReader fetches block headers by hash
+type HeaderReader interface {
+	HeaderByHash(ctx context.Context, hash common.Hash) (*types.Header, error)
+}
+
+// TimestampResolver resolves block timestamps for logs. Many nodes leave
+// BlockTimestamp empty on logs, so the block header is fetched instead and
+// cached by block hash.
+type TimestampResolver struct {
+	client HeaderReader
+	cache  *lru.Cache[common.Hash, uint64]
+}
+
+// NewTimestampResolver creates a resolver caching the timestamps of up to size blocks
+func NewTimestampResolver(client HeaderReader, size int) *TimestampResolver {
+	return &TimestampResolver{
+		client: client,
+		cache:  lru.NewCache[common.Hash, uint64](size),
+	}
+}
+
+// Resolve returns the timestamp of the log's block. The timestamp reported on
+// the log is used when present, otherwise the header is looked up.
+func (r *TimestampResolver) Resolve(ctx context.Context, eventLog *types.Log) (uint64, error) {
+	if eventLog.BlockTimestamp != 0 {
+		r.cache.Add(eventLog.BlockHash, eventLog.BlockTimestamp)
+		return eventLog.BlockTimestamp, nil
+	}
+
+	if timestamp, ok := r.cache.Get(eventLog.BlockHash); ok {
+		return timestamp, nil
+	}
+
+	header, err := r.client.HeaderByHash(ctx, eventLog.BlockHash)
+	if err != nil {
+		return 0, fmt.Errorf("%w: failed to get header for block %s: %w", ErrUnresolvedTimestamp, eventLog.BlockHash.Hex(), err)
+	}
+	if header == nil || header.Time == 0 {
+		return 0, fmt.Errorf("%w: block %s has no timestamp", ErrUnresolvedTimestamp, eventLog.BlockHash.Hex())
+	}
+
+	r.cache.Add(eventLog.BlockHash, header.Time)
+
+	return header.Time, nil
+}
+
+// Add caches the timestamp of a header fetched elsewhere
+func (r *TimestampResolver) Add(header *types.Header) {
+	if header.Time != 0 {
+		r.cache.Add(header.Hash(), header.Time)
+	}
+}
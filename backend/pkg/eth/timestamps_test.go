@@ -0,0 +1,101 @@
+package eth
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/murraystewart96/token-swap/pkg/eth/mock"
+	"github.com/stretchr/testify/assert"
+	testifyMock "github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimestampResolver_Resolve(t *testing.T) {
+	header := &types.Header{Number: big.NewInt(100), Time: 1700000000}
+
+	tests := []struct {
+		name          string
+		eventLog      *types.Log
+		setupMock     func(*mock.EthClient)
+		expected      uint64
+		expectedError error
+	}{
+		{
+			name:     "uses timestamp reported on the log",
+			eventLog: &types.Log{BlockHash: header.Hash(), BlockTimestamp: 1700000001},
+			expected: 1700000001,
+		},
+		{
+			name:     "falls back to the block header",
+			eventLog: &types.Log{BlockHash: header.Hash()},
+			setupMock: func(m *mock.EthClient) {
+				m.On("HeaderByHash", testifyMock.Anything, header.Hash()).Return(header, nil).Once()
+			},
+			expected: 1700000000,
+		},
+		{
+			name:     "header lookup fails",
+			eventLog: &types.Log{BlockHash: header.Hash()},
+			setupMock: func(m *mock.EthClient) {
+				m.On("HeaderByHash", testifyMock.Anything, header.Hash()).Return(nil, assert.AnError)
+			},
+			expectedError: ErrUnresolvedTimestamp,
+		},
+		{
+			name:     "header without timestamp",
+			eventLog: &types.Log{BlockHash: common.HexToHash("0x01")},
+			setupMock: func(m *mock.EthClient) {
+				m.On("HeaderByHash", testifyMock.Anything, common.HexToHash("0x01")).Return(&types.Header{Number: big.NewInt(1)}, nil)
+			},
+			expectedError: ErrUnresolvedTimestamp,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockClient := &mock.EthClient{}
+			if tt.setupMock != nil {
+				tt.setupMock(mockClient)
+			}
+
+			resolver := NewTimestampResolver(mockClient, 8)
+
+			timestamp, err := resolver.Resolve(t.Context(), tt.eventLog)
+
+			if tt.expectedError != nil {
+				assert.ErrorIs(t, err, tt.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, timestamp)
+			mockClient.AssertExpectations(t)
+		})
+	}
+}
+
+func TestTimestampResolver_CachesByBlockHash(t *testing.T) {
+	mockClient := &mock.EthClient{}
+	header := &types.Header{Number: big.NewInt(100), Time: 1700000000}
+
+	mockClient.On("HeaderByHash", testifyMock.Anything, header.Hash()).Return(header, nil).Once()
+
+	resolver := NewTimestampResolver(mockClient, 8)
+
+	for range 3 {
+		timestamp, err := resolver.Resolve(t.Context(), &types.Log{BlockHash: header.Hash()})
+		require.NoError(t, err)
+		assert.Equal(t, uint64(1700000000), timestamp)
+	}
+
+	// Headers fetched elsewhere prime the cache
+	other := &types.Header{Number: big.NewInt(101), Time: 1700000012}
+	resolver.Add(other)
+
+	timestamp, err := resolver.Resolve(t.Context(), &types.Log{BlockHash: other.Hash()})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1700000012), timestamp)
+
+	mockClient.AssertExpectations(t)
+}
@@ -0,0 +1,77 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/rs/zerolog/log"
+)
+
+const topicMetadataTimeout = 10 * time.Second
+
+// EnsureTopics creates the topics that don't exist yet with the given partition
+// count and replication factor. Existing topics are left as they are.
+func (p *Producer) EnsureTopics(ctx context.Context, topics []string, partitions, replicationFactor int) error {
+	client, ok := p.client.(*kafka.Producer)
+	if !ok {
+		memory, ok := p.client.(*memoryProducer)
+		if !ok {
+			return fmt.Errorf("failed to create topics: unsupported producer client %T", p.client)
+		}
+
+		// In-memory broker
+		memory.broker.createTopics(topics, partitions)
+		return nil
+	}
+
+	admin, err := kafka.NewAdminClientFromProducer(client)
+	if err != nil {
+		return fmt.Errorf("failed to create admin client: %w", err)
+	}
+	defer admin.Close()
+
+	specs := make([]kafka.TopicSpecification, 0, len(topics))
+	for _, topic := range topics {
+		specs = append(specs, kafka.TopicSpecification{
+			Topic:             topic,
+			NumPartitions:     partitions,
+			ReplicationFactor: replicationFactor,
+		})
+	}
+
+	results, err := admin.CreateTopics(ctx, specs)
+	if err != nil {
+		return fmt.Errorf("failed to create topics: %w", err)
+	}
+
+	for _, result := range results {
+		switch result.Error.Code() {
+		case kafka.ErrNoError:
+			log.Info().Str("topic", result.Topic).Int("partitions", partitions).Msg("created topic")
+		case kafka.ErrTopicAlreadyExists:
+			checkPartitionCount(client, result.Topic, partitions)
+		default:
+			return fmt.Errorf("failed to create topic %s: %w", result.Topic, result.Error)
+		}
+	}
+
+	return nil
+}
+
+// checkPartitionCount warns when an existing topic has a different number of
+// partitions than configured. Changing the partition count of a topic moves keys
+// to other partitions, so it isn't done automatically.
+func checkPartitionCount(client *kafka.Producer, topic string, partitions int) {
+	metadata, err := client.GetMetadata(&topic, false, int(topicMetadataTimeout.Milliseconds()))
+	if err != nil {
+		log.Warn().Err(err).Str("topic", topic).Msg("failed to get topic metadata")
+		return
+	}
+
+	if existing := len(metadata.Topics[topic].Partitions); existing != partitions {
+		log.Warn().Str("topic", topic).Int("partitions", existing).Int("configured_partitions", partitions).
+			Msg("topic already exists with a different partition count")
+	}
+}
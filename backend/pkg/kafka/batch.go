@@ -0,0 +1,210 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/murraystewart96/token-swap/pkg/tracing"
+	"github.com/rs/zerolog/log"
+)
+
+// Record is a message passed to a BatchEventHandler
+type Record struct {
+	Key     []byte
+	Value   []byte
+	Headers []Header
+}
+
+// Header returns a header of the record, or "" if it isn't set
+func (r Record) Header(key string) string {
+	return headerValue(r.Headers, key)
+}
+
+// BatchEventHandler handles a batch of messages from one topic in the order they
+// were consumed. The batch is only committed once the handler returns nil, so it
+// should store all of the records or none of them.
+type BatchEventHandler func(ctx context.Context, records []Record) error
+type BatchEventHandlers map[string]BatchEventHandler
+
+// PerMessage adapts an EventHandler for topics that aren't worth batching
+func PerMessage(handler EventHandler) BatchEventHandler {
+	return func(ctx context.Context, records []Record) error {
+		for _, record := range records {
+			if err := handler(withHeaders(ctx, record.Headers), record.Key, record.Value); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// pendingBatch is a batch of messages from one topic waiting to be handled
+type pendingBatch struct {
+	messages []*kafka.Message
+	started  time.Time
+}
+
+// StartConsumingBatches consumes topics like StartConsuming, but accumulates
+// messages per topic and hands them to the topic's handler once batchSize
+// messages have arrived or the oldest has waited batchLinger. Offsets are
+// committed after the handler succeeds. Once ctx is done the batches already
+// read are handled, within drainTimeout, before it returns.
+func (c *Consumer) StartConsumingBatches(ctx context.Context, topicHandlers BatchEventHandlers) error {
+	topics := make([]string, 0, len(topicHandlers))
+	for topic := range topicHandlers {
+		topics = append(topics, topic)
+	}
+
+	log.Info().Msgf("subscribing to topics: %v", topics)
+
+	err := c.client.SubscribeTopics(topics, c.onRebalance)
+	if err != nil {
+		return fmt.Errorf("failed to subscribe to topics (%v): %w", topics, err)
+	}
+
+	log.Info().Int("batch_size", c.batchSize).Dur("batch_linger", c.batchLinger).Msg("consuming in batches...")
+
+	handlerCtx, stopHandlers := c.handlerContext(ctx)
+
+	pollTimeout := min(300*time.Millisecond, c.batchLinger)
+	batches := make(map[string]*pendingBatch)
+
+	// Batches mix partitions, so every pending batch is handled and committed
+	// before partitions are revoked
+	c.revoke = func([]kafka.TopicPartition) {
+		c.processBatches(handlerCtx, topicHandlers, batches)
+	}
+	defer func() { c.revoke = nil }()
+
+	for ctx.Err() == nil {
+		message, err := c.client.ReadMessage(pollTimeout)
+		if err != nil {
+			// Don't log timeouts (normal polling behaviour)
+			if err.(kafka.Error).Code() != kafka.ErrTimedOut {
+				log.Error().Err(err).Msg("failed to read from topic")
+			}
+		} else if topic := *message.TopicPartition.Topic; topicHandlers[topic] == nil {
+			log.Warn().Msgf("no handler for topic: %s", topic)
+		} else {
+			c.ordering.observe(message)
+
+			batch, ok := batches[topic]
+			if !ok {
+				batch = &pendingBatch{started: time.Now()}
+				batches[topic] = batch
+			}
+			batch.messages = append(batch.messages, message)
+		}
+
+		for topic, batch := range batches {
+			if len(batch.messages) >= c.batchSize || time.Since(batch.started) >= c.batchLinger {
+				c.processBatch(handlerCtx, topic, topicHandlers[topic], batch.messages)
+				delete(batches, topic)
+			}
+		}
+	}
+
+	log.Info().Int("batches", len(batches)).Dur("drain_timeout", c.drainTimeout).Msg("stopping consumer, draining batches")
+
+	// Batches still pending after the drain timeout aren't committed, they are
+	// consumed again on restart
+	c.processBatches(handlerCtx, topicHandlers, batches)
+	drainErr := stopHandlers()
+
+	if err := c.Close(); err != nil {
+		log.Error().Err(err).Msg("failed to close consumer")
+	}
+
+	return drainErr
+}
+
+// processBatches hands every pending batch to its topic's handler
+func (c *Consumer) processBatches(ctx context.Context, topicHandlers BatchEventHandlers, batches map[string]*pendingBatch) {
+	for topic, batch := range batches {
+		c.processBatch(ctx, topic, topicHandlers[topic], batch.messages)
+		delete(batches, topic)
+	}
+}
+
+// processBatch runs the handler on the batch with retries and commits it once it
+// succeeds. If the batch keeps failing, its messages are handled one at a time
+// so only the ones that fail are dead-lettered.
+func (c *Consumer) processBatch(ctx context.Context, topic string, handler BatchEventHandler, messages []*kafka.Message) {
+	ctx, span := tracing.StartSpan(ctx, "kafka.consumeBatch")
+	defer span.End()
+
+	span.SetAttributes(tracing.KafkaBatchAttributes(topic, len(messages))...)
+
+	records := make([]Record, len(messages))
+	for i, message := range messages {
+		records[i] = Record{Key: message.Key, Value: message.Value, Headers: message.Headers}
+	}
+
+	batchHandler := func(ctx context.Context, _, _ []byte) error {
+		return handler(ctx, records)
+	}
+
+	batchCtx, toStore := c.withOffsetsToStore(ctx, messages)
+
+	attempts, err := handleWithRetry(batchCtx, batchHandler, nil, nil, c.maxAttempts, c.minBackoff, c.maxBackoff)
+	if err == nil {
+		c.storeOffsetsOrLog(ctx, toStore)
+		c.commitBatch(messages)
+		return
+	}
+
+	// Shutting down - process the batch again on restart
+	if stopping(ctx) {
+		return
+	}
+
+	log.Warn().Err(err).Int("attempts", attempts).Str("topic", topic).Int("messages", len(messages)).
+		Msg("batch handler failed, handling messages individually")
+
+	messageHandler := func(ctx context.Context, key, value []byte) error {
+		return handler(ctx, []Record{{Key: key, Value: value, Headers: messageHeaders(ctx)}})
+	}
+
+	// Once the consumer rewinds a partition, its later messages are consumed again
+	rewound := make(map[int32]bool)
+	for _, message := range messages {
+		partition := message.TopicPartition.Partition
+		if rewound[partition] {
+			continue
+		}
+
+		if !c.processMessage(ctx, messageHandler, message) {
+			if stopping(ctx) {
+				return
+			}
+			rewound[partition] = true
+		}
+	}
+}
+
+// commitBatch commits the offset after the last message of each partition in the batch
+func (c *Consumer) commitBatch(messages []*kafka.Message) {
+	if _, err := c.client.CommitOffsets(nextOffsets(messages)); err != nil {
+		log.Error().Err(err).Msg("failed to commit batch offsets")
+	}
+}
+
+// nextOffsets returns the position after the last message of each partition
+func nextOffsets(messages []*kafka.Message) []kafka.TopicPartition {
+	next := make(map[int32]kafka.TopicPartition)
+	for _, message := range messages {
+		// Messages of a partition are consumed in offset order
+		position := message.TopicPartition
+		position.Offset++
+		next[position.Partition] = position
+	}
+
+	offsets := make([]kafka.TopicPartition, 0, len(next))
+	for _, position := range next {
+		offsets = append(offsets, position)
+	}
+
+	return offsets
+}
@@ -0,0 +1,145 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/murraystewart96/token-swap/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConsumer_BatchFallsBackToDeadLetteringFailingMessage(t *testing.T) {
+	if testing.Short() {
+		t.Skip("uses an in-process Kafka cluster")
+	}
+
+	cluster, err := kafka.NewMockCluster(1)
+	require.NoError(t, err)
+	defer cluster.Close()
+
+	producer, err := NewProducer(&config.KafkaProducer{BootstrapServers: cluster.BootstrapServers(), Acks: "all"})
+	require.NoError(t, err)
+	defer producer.Close()
+
+	values := []string{"a", "b", "poison", "c", "d"}
+	for _, value := range values {
+		_, err = producer.Produce(t.Context(), "events", []byte("key"), []byte(value))
+		require.NoError(t, err)
+	}
+
+	consumer, err := NewConsumer(&config.KafkaConsumer{
+		BootstrapServers: cluster.BootstrapServers(),
+		GroupID:          "test-worker",
+		OffsetReset:      "earliest",
+		MaxAttempts:      1,
+		RetryMinBackoff:  time.Millisecond,
+		BatchSize:        len(values),
+		BatchLinger:      10 * time.Second,
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	var mu sync.Mutex
+	var batchSizes []int
+	var stored []string
+
+	go consumer.StartConsumingBatches(ctx, BatchEventHandlers{
+		"events": func(ctx context.Context, records []Record) error {
+			mu.Lock()
+			defer mu.Unlock()
+
+			batchSizes = append(batchSizes, len(records))
+			for _, record := range records {
+				if string(record.Value) == "poison" {
+					return errors.New("cannot process")
+				}
+			}
+			for _, record := range records {
+				stored = append(stored, string(record.Value))
+			}
+			return nil
+		},
+	})
+
+	dead := readOne(t, cluster.BootstrapServers(), config.DeadLetterTopic("events"))
+	cancel()
+
+	assert.Equal(t, []byte("poison"), dead.Value)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	// The full batch fails once, then each message is handled on its own
+	assert.Equal(t, []int{5, 1, 1, 1, 1, 1}, batchSizes)
+	assert.Equal(t, []string{"a", "b", "c", "d"}, stored)
+}
+
+func TestNextOffsets_PastLastMessageOfEachPartition(t *testing.T) {
+	topic := "events"
+	messages := []*kafka.Message{
+		{TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: 0, Offset: 4}},
+		{TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: 1, Offset: 9}},
+		{TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: 0, Offset: 5}},
+	}
+
+	offsets := nextOffsets(messages)
+	slices.SortFunc(offsets, func(a, b kafka.TopicPartition) int { return int(a.Partition - b.Partition) })
+
+	require.Len(t, offsets, 2)
+	assert.Equal(t, "events[0]@6", fmt.Sprintf("%s[%d]@%d", *offsets[0].Topic, offsets[0].Partition, offsets[0].Offset))
+	assert.Equal(t, "events[1]@10", fmt.Sprintf("%s[%d]@%d", *offsets[1].Topic, offsets[1].Partition, offsets[1].Offset))
+}
+
+func TestConsumer_HandlesPendingBatchesOnShutdown(t *testing.T) {
+	broker := NewMemoryBroker(1)
+	producer := broker.NewProducer(&config.KafkaProducer{})
+	defer producer.Close()
+
+	for _, value := range []string{"a", "b"} {
+		_, err := producer.Produce(t.Context(), "trades", nil, []byte(value))
+		require.NoError(t, err)
+	}
+
+	// The batch can't fill up or linger long enough to be handled before shutdown
+	consumer := broker.NewConsumer(&config.KafkaConsumer{GroupID: "worker", OffsetReset: "earliest", BatchSize: 10, BatchLinger: time.Hour})
+	defer consumer.Close()
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	var handled []string
+	stopped := make(chan error, 1)
+
+	go func() {
+		stopped <- consumer.StartConsumingBatches(ctx, BatchEventHandlers{
+			"trades": func(_ context.Context, records []Record) error {
+				for _, record := range records {
+					handled = append(handled, string(record.Value))
+				}
+				return nil
+			},
+		})
+	}()
+
+	// Let the consumer read both messages
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-stopped:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("consumer didn't stop")
+	}
+	assert.Equal(t, []string{"a", "b"}, handled)
+	assert.Equal(t, int64(2), committedOffset(broker, "worker", "trades", 0))
+}
@@ -0,0 +1,69 @@
+package kafka
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Codec names (config values)
+const (
+	CodecJSON     = "json"
+	CodecProtobuf = "protobuf"
+)
+
+// Headers describing how a message value is encoded
+const (
+	HeaderContentType = "content-type"
+	HeaderSchemaID    = "schema.id"
+)
+
+// Codec encodes message values. The producer records the codec's content type
+// in the HeaderContentType header so consumers can decode messages written
+// with any codec.
+type Codec interface {
+	Name() string
+	ContentType() string
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+// JSONCodec encodes values with encoding/json
+type JSONCodec struct{}
+
+func (JSONCodec) Name() string        { return CodecJSON }
+func (JSONCodec) ContentType() string { return "application/json" }
+
+func (JSONCodec) Marshal(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec) Unmarshal(data []byte, v any) error {
+	return json.Unmarshal(data, v)
+}
+
+var codecs = []Codec{JSONCodec{}, ProtobufCodec{}}
+
+// CodecByName returns the codec with the given name (CodecJSON or CodecProtobuf)
+func CodecByName(name string) (Codec, error) {
+	for _, codec := range codecs {
+		if codec.Name() == name {
+			return codec, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown codec %q", name)
+}
+
+// CodecFor returns the codec of a message's content type. Messages without a
+// content type were written before codecs were configurable and are JSON.
+func CodecFor(contentType string) (Codec, error) {
+	if contentType == "" {
+		return JSONCodec{}, nil
+	}
+
+	for _, codec := range codecs {
+		if codec.ContentType() == contentType {
+			return codec, nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported content type %q", contentType)
+}
@@ -0,0 +1,141 @@
+package kafka
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+type testMessage struct {
+	Name     string    `json:"name" protobuf:"1"`
+	Count    uint64    `json:"count" protobuf:"2"`
+	Delta    int64     `json:"delta" protobuf:"3"`
+	Index    uint      `json:"index" protobuf:"4"`
+	Enabled  bool      `json:"enabled" protobuf:"5"`
+	Tags     []string  `json:"tags" protobuf:"6"`
+	Payload  []byte    `json:"payload" protobuf:"7"`
+	At       time.Time `json:"at" protobuf:"8"`
+	Internal string    `json:"internal"` // Not encoded by the Protobuf codec
+}
+
+// testMessageV2 is testMessage after a backward compatible change: field 3
+// removed and field 9 added
+type testMessageV2 struct {
+	Name  string `json:"name" protobuf:"1"`
+	Count uint64 `json:"count" protobuf:"2"`
+	Owner string `json:"owner" protobuf:"9"`
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		message testMessage
+	}{
+		{
+			name: "all fields set",
+			message: testMessage{
+				Name:    "pool",
+				Count:   1 << 60,
+				Delta:   -42,
+				Index:   7,
+				Enabled: true,
+				Tags:    []string{"a", "", "c"},
+				Payload: []byte{0x00, 0xff},
+				At:      time.Date(2024, 5, 1, 12, 30, 0, 123456789, time.UTC),
+			},
+		},
+		{
+			name:    "zero values",
+			message: testMessage{},
+		},
+	}
+
+	for _, codec := range []Codec{JSONCodec{}, ProtobufCodec{}} {
+		for _, tt := range tests {
+			t.Run(codec.Name()+"/"+tt.name, func(t *testing.T) {
+				data, err := codec.Marshal(&tt.message)
+				require.NoError(t, err)
+
+				var decoded testMessage
+				require.NoError(t, codec.Unmarshal(data, &decoded))
+				assert.Equal(t, tt.message, decoded)
+			})
+		}
+	}
+}
+
+func TestProtobufCodec_SkipsUntaggedFields(t *testing.T) {
+	data, err := ProtobufCodec{}.Marshal(testMessage{Name: "pool", Internal: "secret"})
+	require.NoError(t, err)
+
+	var decoded testMessage
+	require.NoError(t, ProtobufCodec{}.Unmarshal(data, &decoded))
+	assert.Equal(t, testMessage{Name: "pool"}, decoded)
+}
+
+func TestProtobufCodec_ReadsOtherSchemaVersions(t *testing.T) {
+	data, err := ProtobufCodec{}.Marshal(testMessage{Name: "pool", Count: 3, Delta: -1, Tags: []string{"x"}})
+	require.NoError(t, err)
+
+	// Fields the reader doesn't know about are skipped
+	var newer testMessageV2
+	require.NoError(t, ProtobufCodec{}.Unmarshal(data, &newer))
+	assert.Equal(t, testMessageV2{Name: "pool", Count: 3}, newer)
+
+	data, err = ProtobufCodec{}.Marshal(testMessageV2{Name: "pool", Owner: "0xabc"})
+	require.NoError(t, err)
+
+	var older testMessage
+	require.NoError(t, ProtobufCodec{}.Unmarshal(data, &older))
+	assert.Equal(t, testMessage{Name: "pool"}, older)
+}
+
+func TestProtobufCodec_WireFormat(t *testing.T) {
+	data, err := ProtobufCodec{}.Marshal(testMessage{Name: "a", Count: 1})
+	require.NoError(t, err)
+
+	// Field 1 length-delimited "a", field 2 varint 1, as protoc would encode them
+	expected := protowire.AppendTag(nil, 1, protowire.BytesType)
+	expected = protowire.AppendString(expected, "a")
+	expected = protowire.AppendTag(expected, 2, protowire.VarintType)
+	expected = protowire.AppendVarint(expected, 1)
+	assert.Equal(t, expected, data)
+}
+
+func TestProtobufCodec_RejectsTruncatedData(t *testing.T) {
+	data, err := ProtobufCodec{}.Marshal(testMessage{Name: "pool"})
+	require.NoError(t, err)
+
+	var decoded testMessage
+	assert.Error(t, ProtobufCodec{}.Unmarshal(data[:len(data)-1], &decoded))
+}
+
+func TestCodecFor(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		expected    Codec
+		expectError bool
+	}{
+		{name: "no content type is json", contentType: "", expected: JSONCodec{}},
+		{name: "json", contentType: "application/json", expected: JSONCodec{}},
+		{name: "protobuf", contentType: "application/x-protobuf", expected: ProtobufCodec{}},
+		{name: "unknown", contentType: "application/avro", expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			codec, err := CodecFor(tt.contentType)
+			if tt.expectError {
+				assert.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, codec)
+		})
+	}
+}
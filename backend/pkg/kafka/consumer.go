@@ -2,7 +2,11 @@ package kafka
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/confluentinc/confluent-kafka-go/kafka"
@@ -12,33 +16,264 @@ import (
 	"go.opentelemetry.io/otel/propagation"
 )
 
+const (
+	defaultMaxAttempts     = 5
+	defaultRetryMinBackoff = 500 * time.Millisecond
+	defaultRetryMaxBackoff = 30 * time.Second
+	defaultBatchSize       = 500
+	defaultBatchLinger     = 200 * time.Millisecond
+	defaultConcurrency     = 1
+	defaultDrainTimeout    = 30 * time.Second
+
+	// How long a read waits for a message
+	pollTimeout = 100 * time.Millisecond
+
+	// How long a replay waits to be assigned partitions of the dead-letter topic
+	replayJoinTimeout = 30 * time.Second
+)
+
+// Headers added to messages published to a dead-letter topic
+const (
+	HeaderDLQError             = "dlq.error"
+	HeaderDLQOriginalTopic     = "dlq.original_topic"
+	HeaderDLQOriginalPartition = "dlq.original_partition"
+	HeaderDLQOriginalOffset    = "dlq.original_offset"
+	HeaderDLQAttempts          = "dlq.attempts"
+	HeaderDLQFailedAt          = "dlq.failed_at"
+)
+
+// ErrNonRetryable marks handler errors that retrying can't fix (e.g. a
+// malformed message), so the message goes straight to the dead-letter topic
+var ErrNonRetryable = errors.New("non-retryable")
+
+// errDrainTimeout cancels the messages still being handled once the drain
+// timeout has passed after the consumer was stopped
+var errDrainTimeout = errors.New("drain timeout expired")
+
+// NonRetryable wraps err with ErrNonRetryable
+func NonRetryable(err error) error {
+	return fmt.Errorf("%w: %w", ErrNonRetryable, err)
+}
+
 type IConsumer interface {
 	StartConsuming(ctx context.Context, handlers EventHandlers) error
+	StartConsumingBatches(ctx context.Context, handlers BatchEventHandlers) error
+	Close() error
+}
+
+// consumerClient is the part of the Kafka consumer API the Consumer uses. It is
+// implemented by *kafka.Consumer and by MemoryBroker's consumers.
+type consumerClient interface {
+	SubscribeTopics(topics []string, rebalanceCb kafka.RebalanceCb) error
+	ReadMessage(timeout time.Duration) (*kafka.Message, error)
+	CommitMessage(message *kafka.Message) ([]kafka.TopicPartition, error)
+	CommitOffsets(offsets []kafka.TopicPartition) ([]kafka.TopicPartition, error)
+	Seek(partition kafka.TopicPartition, ignoredTimeoutMs int) error
+	Assignment() ([]kafka.TopicPartition, error)
+	Assign(partitions []kafka.TopicPartition) error
+	Unassign() error
 	Close() error
 }
 
 type Consumer struct {
-	client *kafka.Consumer
+	client  consumerClient
+	groupID string
+
+	// Publishes messages that keep failing to their dead-letter topic
+	deadLetters *Producer
+
+	// Closes the client and the dead-letter producer once they are done
+	closeOnce sync.Once
+	closeErr  error
+
+	handlerSettings
+
+	// Warns when messages with the same key arrive on different partitions
+	ordering *orderingCheck
+
+	// Where offsets are stored besides Kafka, if anywhere (see StoreOffsetsIn)
+	offsetStore OffsetStore
+
+	// Finishes the messages of revoked partitions, set while consuming
+	revoke func(partitions []kafka.TopicPartition)
 }
 
+// EventHandler handles a message. The message's headers are available through
+// MessageHeader.
 type EventHandler func(ctx context.Context, key, value []byte) error
 type EventHandlers map[string]EventHandler
 
+type headersKey struct{}
+
+// withHeaders makes the headers of the message being handled available to its handler
+func withHeaders(ctx context.Context, headers []kafka.Header) context.Context {
+	return context.WithValue(ctx, headersKey{}, headers)
+}
+
+func messageHeaders(ctx context.Context) []kafka.Header {
+	headers, _ := ctx.Value(headersKey{}).([]kafka.Header)
+	return headers
+}
+
+// MessageHeader returns a header of the message being handled, or "" if it isn't set
+func MessageHeader(ctx context.Context, key string) string {
+	return headerValue(messageHeaders(ctx), key)
+}
+
+func headerValue(headers []kafka.Header, key string) string {
+	for _, header := range headers {
+		if header.Key == key {
+			return string(header.Value)
+		}
+	}
+	return ""
+}
+
 func NewConsumer(cfg *config.KafkaConsumer) (*Consumer, error) {
 	client, err := kafka.NewConsumer(&kafka.ConfigMap{
-		"bootstrap.servers": cfg.BootstrapServers,
-		"group.id":          cfg.GroupID,
-		"auto.offset.reset": cfg.OffsetReset,
+		"bootstrap.servers":  cfg.BootstrapServers,
+		"group.id":           cfg.GroupID,
+		"auto.offset.reset":  cfg.OffsetReset,
+		"enable.auto.commit": false,
 	})
 	if err != nil {
 		return nil, fmt.Errorf("Failed to create consumer: %w", err)
 	}
 
+	deadLetters, err := NewProducer(&config.KafkaProducer{
+		BootstrapServers: cfg.BootstrapServers,
+		Acks:             "all",
+	})
+	if err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to create dead-letter producer: %w", err)
+	}
+
+	return newConsumer(client, deadLetters, cfg), nil
+}
+
+func newConsumer(client consumerClient, deadLetters *Producer, cfg *config.KafkaConsumer) *Consumer {
 	return &Consumer{
-		client: client,
-	}, nil
+		client:          client,
+		groupID:         cfg.GroupID,
+		deadLetters:     deadLetters,
+		handlerSettings: newHandlerSettings(cfg),
+		ordering:        newOrderingCheck(),
+	}
 }
 
+// handlerSettings control how consumers retry and batch messages
+type handlerSettings struct {
+	maxAttempts int
+	minBackoff  time.Duration
+	maxBackoff  time.Duration
+
+	// Bounds on the size and age of a batch when consuming in batches
+	batchSize   int
+	batchLinger time.Duration
+
+	// Goroutines handling messages when not consuming in batches
+	concurrency int
+
+	// How long messages being handled when the consumer stops, or when their
+	// partition is revoked, are given to finish
+	drainTimeout time.Duration
+}
+
+func newHandlerSettings(cfg *config.KafkaConsumer) handlerSettings {
+	maxAttempts := cfg.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = defaultMaxAttempts
+	}
+
+	minBackoff, maxBackoff := cfg.RetryMinBackoff, cfg.RetryMaxBackoff
+	if minBackoff <= 0 {
+		minBackoff = defaultRetryMinBackoff
+	}
+	if maxBackoff < minBackoff {
+		maxBackoff = max(minBackoff, defaultRetryMaxBackoff)
+	}
+
+	batchSize, batchLinger := cfg.BatchSize, cfg.BatchLinger
+	if batchSize <= 1 {
+		batchSize = defaultBatchSize
+	}
+	if batchLinger <= 0 {
+		batchLinger = defaultBatchLinger
+	}
+
+	concurrency := cfg.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultConcurrency
+	}
+
+	drainTimeout := cfg.DrainTimeout
+	if drainTimeout <= 0 {
+		drainTimeout = defaultDrainTimeout
+	}
+
+	return handlerSettings{
+		maxAttempts:  maxAttempts,
+		minBackoff:   minBackoff,
+		maxBackoff:   maxBackoff,
+		batchSize:    batchSize,
+		batchLinger:  batchLinger,
+		concurrency:  concurrency,
+		drainTimeout: drainTimeout,
+	}
+}
+
+type consumerCtxKey struct{}
+
+// handlerContext returns the context messages are handled with. It is only
+// cancelled drainTimeout after ctx, so the messages being handled when the
+// consumer stops can finish. stop releases it and returns an error if messages
+// were still being handled when the drain timeout expired.
+func (s handlerSettings) handlerContext(ctx context.Context) (handlerCtx context.Context, stop func() error) {
+	handlerCtx, cancel := context.WithCancelCause(context.WithValue(context.WithoutCancel(ctx), consumerCtxKey{}, ctx))
+	stopDrain := context.AfterFunc(ctx, func() {
+		time.AfterFunc(s.drainTimeout, func() { cancel(errDrainTimeout) })
+	})
+
+	return handlerCtx, func() error {
+		stopDrain()
+		cause := context.Cause(handlerCtx)
+		cancel(context.Canceled)
+
+		if errors.Is(cause, errDrainTimeout) {
+			return fmt.Errorf("messages were still being handled %s after the consumer stopped: %w", s.drainTimeout, cause)
+		}
+		return nil
+	}
+}
+
+// stopped returns a channel that is closed once the consumer handling the
+// message of ctx is stopped, which is before ctx is done while it drains
+func stopped(ctx context.Context) <-chan struct{} {
+	if consumerCtx, ok := ctx.Value(consumerCtxKey{}).(context.Context); ok {
+		return consumerCtx.Done()
+	}
+	return ctx.Done()
+}
+
+// stopping reports whether the consumer handling the message of ctx is stopped.
+// Messages that fail while it drains aren't retried or dead-lettered, they are
+// handled again on restart.
+func stopping(ctx context.Context) bool {
+	select {
+	case <-stopped(ctx):
+		return true
+	default:
+		return ctx.Err() != nil
+	}
+}
+
+// StartConsuming consumes topics until ctx is done. Messages are handled by up
+// to concurrency goroutines, each message key (or partition, for messages
+// without one) by the same goroutine in the order it was read, and a partition
+// is only committed up to its oldest unfinished message. Once ctx is done it
+// stops reading and gives the messages being handled up to drainTimeout to
+// finish before committing them, returning an error if they didn't.
 func (c *Consumer) StartConsuming(ctx context.Context, topicHandlers EventHandlers) error {
 	topics := make([]string, 0, len(topicHandlers))
 	for topic := range topicHandlers {
@@ -47,59 +282,286 @@ func (c *Consumer) StartConsuming(ctx context.Context, topicHandlers EventHandle
 
 	log.Info().Msgf("subscribing to topics: %v", topics)
 
-	err := c.client.SubscribeTopics(topics, nil)
+	err := c.client.SubscribeTopics(topics, c.onRebalance)
 	if err != nil {
 		return fmt.Errorf("failed to subscribe to topics (%v): %w", topics, err)
 	}
 
-	log.Info().Msgf("consuming...")
+	log.Info().Int("concurrency", c.concurrency).Msgf("consuming...")
+
+	handlerCtx, stopHandlers := c.handlerContext(ctx)
+	pool := c.startLanes(ctx, handlerCtx)
+
+	// Called from ReadMessage when partitions are revoked
+	c.revoke = func(partitions []kafka.TopicPartition) {
+		c.finishPartitions(ctx, pool, partitions)
+	}
+	defer func() { c.revoke = nil }()
+
+	for ctx.Err() == nil {
+		// Commit the messages that have finished, waiting for one while too many are in flight
+		for pool.inFlight > 0 && c.collect(ctx, pool, pool.inFlight >= pool.maxInFlight) {
+		}
+
+		message, err := c.client.ReadMessage(pollTimeout)
+		if err != nil {
+			// Don't log timeouts (normal polling behaviour)
+			if err.(kafka.Error).Code() != kafka.ErrTimedOut {
+				log.Error().Err(err).Msg("failed to read from topic")
+			}
+			continue
+		}
+
+		log.Info().Msg("consuming event...")
+		c.ordering.observe(message)
+
+		handler, ok := topicHandlers[*message.TopicPartition.Topic]
+		if !ok {
+			log.Warn().Msgf("no handler for topic: %s", *message.TopicPartition.Topic)
+			continue
+		}
+
+		c.dispatch(pool, message, handler)
+	}
+
+	log.Info().Int("in_flight", pool.inFlight).Dur("drain_timeout", c.drainTimeout).Msg("stopping consumer, draining messages")
+
+	c.stopLanes(ctx, pool)
+	drainErr := stopHandlers()
+
+	if err := c.Close(); err != nil {
+		log.Error().Err(err).Msg("failed to close consumer")
+	}
+
+	return drainErr
+}
+
+// handleMessage runs the handler with retries. A message that still fails is
+// published to the dead-letter topic. Returns false if the message was neither
+// handled nor dead-lettered.
+func (c *Consumer) handleMessage(ctx context.Context, handler EventHandler, message *kafka.Message) bool {
+	// Extract trace context from message headers
+	propagator := propagation.TraceContext{}
+	msgCtx := propagator.Extract(ctx, NewHeaderCarrier(&message.Headers))
+
+	// Start a span for message processing
+	msgCtx, span := tracing.StartSpan(msgCtx, "kafka.consume")
+	defer span.End()
+
+	span.SetAttributes(
+		tracing.KafkaAttributes(*message.TopicPartition.Topic, message.TopicPartition.Partition, int64(message.TopicPartition.Offset))...,
+	)
+
+	msgCtx = withHeaders(msgCtx, message.Headers)
+	msgCtx, toStore := c.withOffsetsToStore(msgCtx, []*kafka.Message{message})
+
+	attempts, err := handleWithRetry(msgCtx, handler, message.Key, message.Value, c.maxAttempts, c.minBackoff, c.maxBackoff)
+	if err == nil {
+		c.storeOffsetsOrLog(msgCtx, toStore)
+		return true
+	}
+
+	// Shutting down - process the message again on restart
+	if stopping(ctx) {
+		return false
+	}
+
+	log.Error().Err(err).Int("attempts", attempts).Str("topic", *message.TopicPartition.Topic).
+		Msg("message handler failed, sending to dead-letter topic")
+
+	if err := c.sendToDeadLetter(msgCtx, message, err, attempts); err != nil {
+		log.Error().Err(err).Msg("failed to send message to dead-letter topic")
+		return false
+	}
+
+	c.storeOffsetsOrLog(msgCtx, toStore)
+
+	return true
+}
+
+// processMessage handles a message and commits its offset, or rewinds to it if
+// it was neither handled nor dead-lettered. Returns false if the consumer didn't
+// move past the message.
+func (c *Consumer) processMessage(ctx context.Context, handler EventHandler, message *kafka.Message) bool {
+	if !c.handleMessage(ctx, handler, message) {
+		if !stopping(ctx) {
+			c.rewind(message.TopicPartition)
+		}
+		return false
+	}
+
+	// Commit offset only after successful processing. This is at-least-once: a
+	// crash before the commit redelivers the message, so writes must be
+	// idempotent unless the offset is stored with them (see StoreOffsetsIn).
+	if _, err := c.client.CommitMessage(message); err != nil {
+		log.Error().Err(err).Msg("failed to commit message offset")
+	}
+
+	return true
+}
+
+// handleWithRetry calls handler until it succeeds, returns a non-retryable
+// error or maxAttempts is reached, or the consumer is stopped. Returns the
+// number of attempts made.
+func handleWithRetry(ctx context.Context, handler EventHandler, key, value []byte, maxAttempts int, minBackoff, maxBackoff time.Duration) (int, error) {
+	backoff := minBackoff
+
+	for attempt := 1; ; attempt++ {
+		err := handler(ctx, key, value)
+		if err == nil || errors.Is(err, ErrNonRetryable) || attempt >= maxAttempts || stopping(ctx) {
+			return attempt, err
+		}
+
+		log.Warn().Err(err).Int("attempt", attempt).Dur("retry_in", backoff).Msg("message handler failed, retrying")
 
-	for {
 		select {
 		case <-ctx.Done():
-			c.client.Close()
+			return attempt, err
+		case <-stopped(ctx):
+			return attempt, err
+		case <-time.After(backoff):
+		}
 
-			return nil
-		default:
-			message, err := c.client.ReadMessage(300 * time.Millisecond)
-			if err != nil {
-				// Don't log timeouts (normal polling behaviour)
-				if err.(kafka.Error).Code() != kafka.ErrTimedOut {
-					log.Error().Err(err).Msg("failed to read from topic")
-				}
-				continue
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+// sendToDeadLetter publishes the message to "<topic>.dlq" with its original
+// headers plus headers describing the failure.
+func (c *Consumer) sendToDeadLetter(ctx context.Context, message *kafka.Message, handlerErr error, attempts int) error {
+	topic := *message.TopicPartition.Topic
+	dlqTopic := config.DeadLetterTopic(topic)
+
+	headers := deadLetterHeaders(message.Headers, topic, strconv.Itoa(int(message.TopicPartition.Partition)),
+		message.TopicPartition.Offset.String(), handlerErr, attempts)
+
+	_, err := c.deadLetters.produceMessage(ctx, &kafka.Message{
+		TopicPartition: kafka.TopicPartition{
+			Topic:     &dlqTopic,
+			Partition: kafka.PartitionAny,
+		},
+		Key:     message.Key,
+		Value:   message.Value,
+		Headers: headers,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to publish to %s: %w", dlqTopic, err)
+	}
+
+	return nil
+}
+
+// deadLetterHeaders returns the headers of a message plus headers describing
+// why and where it failed
+func deadLetterHeaders(headers []kafka.Header, topic, partition, offset string, handlerErr error, attempts int) []kafka.Header {
+	return append(append([]kafka.Header{}, headers...),
+		kafka.Header{Key: HeaderDLQError, Value: []byte(handlerErr.Error())},
+		kafka.Header{Key: HeaderDLQOriginalTopic, Value: []byte(topic)},
+		kafka.Header{Key: HeaderDLQOriginalPartition, Value: []byte(partition)},
+		kafka.Header{Key: HeaderDLQOriginalOffset, Value: []byte(offset)},
+		kafka.Header{Key: HeaderDLQAttempts, Value: []byte(strconv.Itoa(attempts))},
+		kafka.Header{Key: HeaderDLQFailedAt, Value: []byte(time.Now().UTC().Format(time.RFC3339))},
+	)
+}
+
+// rewind seeks back to position so the messages from there are consumed again
+func (c *Consumer) rewind(position kafka.TopicPartition) {
+	if err := c.client.Seek(position, 0); err != nil {
+		log.Error().Err(err).Msg("failed to rewind to message")
+	}
+}
+
+// ReplayDeadLetters re-publishes the messages in the dead-letter topic of topic
+// to the topic they failed on, committing each one once it is re-published.
+// It returns once no message has arrived for idleTimeout.
+func (c *Consumer) ReplayDeadLetters(ctx context.Context, topic string, idleTimeout time.Duration) (int, error) {
+	dlqTopic := config.DeadLetterTopic(strings.TrimSuffix(topic, config.DeadLetterSuffix))
+
+	if err := c.client.SubscribeTopics([]string{dlqTopic}, nil); err != nil {
+		return 0, fmt.Errorf("failed to subscribe to %s: %w", dlqTopic, err)
+	}
+
+	replayed := 0
+	started := time.Now()
+	lastMessage := started
+
+	for time.Since(lastMessage) < idleTimeout {
+		if ctx.Err() != nil {
+			return replayed, ctx.Err()
+		}
+
+		message, err := c.client.ReadMessage(300 * time.Millisecond)
+		if err != nil {
+			if err.(kafka.Error).Code() != kafka.ErrTimedOut {
+				log.Error().Err(err).Msg("failed to read from topic")
 			}
 
-			log.Info().Msg("consuming event...")
-
-			if handler, ok := topicHandlers[*message.TopicPartition.Topic]; ok {
-				// Extract trace context from message headers
-				propagator := propagation.TraceContext{}
-				msgCtx := propagator.Extract(ctx, NewHeaderCarrier(&message.Headers))
-
-				// Start a span for message processing
-				msgCtx, span := tracing.StartSpan(msgCtx, "kafka.consume")
-				span.SetAttributes(
-					tracing.KafkaAttributes(*message.TopicPartition.Topic, message.TopicPartition.Partition, int64(message.TopicPartition.Offset))...,
-				)
-
-				if err := handler(msgCtx, message.Key, message.Value); err != nil {
-					log.Error().Err(err).Msg("message handler failed")
-				} else {
-					// Commit offset only after successful processing (exactly-once semantics)
-					if _, err := c.client.CommitMessage(message); err != nil {
-						log.Error().Err(err).Msg("failed to commit message offset")
-					}
-				}
-
-				span.End()
-			} else {
-				log.Warn().Msgf("no handler for topic: %s", *message.TopicPartition.Topic)
+			// Joining the group can take a while, only count idle time once partitions
+			// are assigned (or the topic turns out to have none)
+			if assignment, err := c.client.Assignment(); err == nil && len(assignment) == 0 && time.Since(started) < replayJoinTimeout {
+				lastMessage = time.Now()
 			}
+			continue
+		}
+		lastMessage = time.Now()
+
+		originalTopic, headers := stripDeadLetterHeaders(message.Headers)
+		if originalTopic == "" {
+			originalTopic = strings.TrimSuffix(dlqTopic, config.DeadLetterSuffix)
+		}
+
+		_, err = c.deadLetters.produceMessage(ctx, &kafka.Message{
+			TopicPartition: kafka.TopicPartition{
+				Topic:     &originalTopic,
+				Partition: kafka.PartitionAny,
+			},
+			Key:     message.Key,
+			Value:   message.Value,
+			Headers: headers,
+		})
+		if err != nil {
+			return replayed, fmt.Errorf("failed to replay message to %s: %w", originalTopic, err)
 		}
+
+		if _, err := c.client.CommitMessage(message); err != nil {
+			return replayed, fmt.Errorf("failed to commit replayed message: %w", err)
+		}
+
+		replayed++
+		log.Info().Str("topic", originalTopic).Int64("dlq_offset", int64(message.TopicPartition.Offset)).Msg("replayed dead-letter message")
 	}
+
+	return replayed, nil
 }
 
+// stripDeadLetterHeaders returns the original topic recorded on a dead-letter
+// message and its headers without the dead-letter metadata
+func stripDeadLetterHeaders(headers []kafka.Header) (string, []kafka.Header) {
+	var originalTopic string
+	var stripped []kafka.Header
+
+	for _, header := range headers {
+		switch {
+		case header.Key == HeaderDLQOriginalTopic:
+			originalTopic = string(header.Value)
+		case strings.HasPrefix(header.Key, "dlq."):
+		default:
+			stripped = append(stripped, header)
+		}
+	}
+
+	return originalTopic, stripped
+}
+
+// Close closes the consumer and its dead-letter producer. The consumer is
+// closed once it stops consuming, so later calls do nothing.
 func (c *Consumer) Close() error {
-	return c.client.Close()
+	c.closeOnce.Do(func() {
+		if err := c.deadLetters.Close(); err != nil {
+			log.Error().Err(err).Msg("failed to close dead-letter producer")
+		}
+		c.closeErr = c.client.Close()
+	})
+
+	return c.closeErr
 }
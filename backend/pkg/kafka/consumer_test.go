@@ -0,0 +1,254 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/murraystewart96/token-swap/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleWithRetry(t *testing.T) {
+	errHandler := errors.New("handler failed")
+
+	tests := []struct {
+		name             string
+		failures         int
+		err              error
+		expectedAttempts int
+		expectError      bool
+	}{
+		{
+			name:             "succeeds first time",
+			expectedAttempts: 1,
+		},
+		{
+			name:             "succeeds after retries",
+			failures:         2,
+			err:              errHandler,
+			expectedAttempts: 3,
+		},
+		{
+			name:             "gives up after max attempts",
+			failures:         10,
+			err:              errHandler,
+			expectedAttempts: 4,
+			expectError:      true,
+		},
+		{
+			name:             "non-retryable error is not retried",
+			failures:         10,
+			err:              NonRetryable(errHandler),
+			expectedAttempts: 1,
+			expectError:      true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			handler := func(ctx context.Context, key, value []byte) error {
+				calls++
+				if calls <= tt.failures {
+					return tt.err
+				}
+				return nil
+			}
+
+			attempts, err := handleWithRetry(t.Context(), handler, nil, nil, 4, time.Millisecond, 2*time.Millisecond)
+
+			if tt.expectError {
+				assert.ErrorIs(t, err, errHandler)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.expectedAttempts, attempts)
+			assert.Equal(t, tt.expectedAttempts, calls)
+		})
+	}
+}
+
+func TestHandleWithRetry_StopsRetryingOnceConsumerStops(t *testing.T) {
+	errHandler := errors.New("handler failed")
+
+	ctx, cancel := context.WithCancel(t.Context())
+	handlerCtx, stop := handlerSettings{drainTimeout: time.Minute}.handlerContext(ctx)
+	defer stop()
+
+	calls := 0
+	handler := func(ctx context.Context, key, value []byte) error {
+		calls++
+		cancel()
+		return errHandler
+	}
+
+	// The handler can still use its context while draining, but isn't retried
+	attempts, err := handleWithRetry(handlerCtx, handler, nil, nil, 4, time.Minute, time.Minute)
+
+	assert.ErrorIs(t, err, errHandler)
+	assert.Equal(t, 1, attempts)
+	assert.Equal(t, 1, calls)
+	assert.NoError(t, handlerCtx.Err())
+}
+
+func TestStripDeadLetterHeaders(t *testing.T) {
+	headers := []kafka.Header{
+		{Key: "traceparent", Value: []byte("00-abc-def-01")},
+		{Key: HeaderDLQOriginalTopic, Value: []byte("trade-history")},
+		{Key: HeaderDLQError, Value: []byte("boom")},
+		{Key: HeaderDLQAttempts, Value: []byte("5")},
+	}
+
+	topic, stripped := stripDeadLetterHeaders(headers)
+
+	assert.Equal(t, "trade-history", topic)
+	assert.Equal(t, []kafka.Header{{Key: "traceparent", Value: []byte("00-abc-def-01")}}, stripped)
+}
+
+// Reads the next message from topic on the mock cluster
+func readOne(t *testing.T, bootstrapServers, topic string) *kafka.Message {
+	t.Helper()
+
+	reader, err := kafka.NewConsumer(&kafka.ConfigMap{
+		"bootstrap.servers": bootstrapServers,
+		"group.id":          "test-reader-" + topic,
+		"auto.offset.reset": "earliest",
+	})
+	require.NoError(t, err)
+	defer reader.Close()
+
+	require.NoError(t, reader.SubscribeTopics([]string{topic}, nil))
+
+	message, err := reader.ReadMessage(20 * time.Second)
+	require.NoError(t, err)
+
+	return message
+}
+
+func TestConsumer_DeadLettersAndReplaysFailingMessage(t *testing.T) {
+	if testing.Short() {
+		t.Skip("uses an in-process Kafka cluster")
+	}
+
+	cluster, err := kafka.NewMockCluster(1)
+	require.NoError(t, err)
+	defer cluster.Close()
+
+	cfg := &config.KafkaConsumer{
+		BootstrapServers: cluster.BootstrapServers(),
+		GroupID:          "test-worker",
+		OffsetReset:      "earliest",
+		MaxAttempts:      2,
+		RetryMinBackoff:  time.Millisecond,
+	}
+
+	producer, err := NewProducer(&config.KafkaProducer{BootstrapServers: cluster.BootstrapServers(), Acks: "all"})
+	require.NoError(t, err)
+	defer producer.Close()
+
+	_, err = producer.Produce(t.Context(), "events", []byte("key"), []byte("poison"))
+	require.NoError(t, err)
+
+	consumer, err := NewConsumer(cfg)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	attempts := make(chan struct{}, 10)
+	go consumer.StartConsuming(ctx, EventHandlers{
+		"events": func(ctx context.Context, key, value []byte) error {
+			attempts <- struct{}{}
+			return errors.New("cannot process")
+		},
+	})
+
+	dead := readOne(t, cluster.BootstrapServers(), config.DeadLetterTopic("events"))
+	cancel()
+
+	assert.Equal(t, []byte("poison"), dead.Value)
+	assert.Len(t, attempts, 2)
+
+	headers := make(map[string]string)
+	for _, header := range dead.Headers {
+		headers[header.Key] = string(header.Value)
+	}
+	assert.Equal(t, "cannot process", headers[HeaderDLQError])
+	assert.Equal(t, "events", headers[HeaderDLQOriginalTopic])
+	assert.Equal(t, "2", headers[HeaderDLQAttempts])
+
+	// Replay it back onto the original topic
+	replayCfg := *cfg
+	replayCfg.GroupID = "test-replay"
+
+	replayer, err := NewConsumer(&replayCfg)
+	require.NoError(t, err)
+	defer replayer.Close()
+
+	replayed, err := replayer.ReplayDeadLetters(t.Context(), "events", 3*time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, 1, replayed)
+
+	reader, err := kafka.NewConsumer(&kafka.ConfigMap{
+		"bootstrap.servers": cluster.BootstrapServers(),
+		"group.id":          "test-verify",
+		"auto.offset.reset": "earliest",
+	})
+	require.NoError(t, err)
+	defer reader.Close()
+	require.NoError(t, reader.SubscribeTopics([]string{"events"}, nil))
+
+	var values []string
+	for len(values) < 2 {
+		message, err := reader.ReadMessage(20 * time.Second)
+		require.NoError(t, err)
+		values = append(values, string(message.Value))
+
+		for _, header := range message.Headers {
+			assert.NotContains(t, header.Key, "dlq.")
+		}
+	}
+	assert.Equal(t, []string{"poison", "poison"}, values)
+}
+
+func TestConsumer_ClosesDeadLetterProducerWhenStopped(t *testing.T) {
+	tests := []struct {
+		name    string
+		consume func(ctx context.Context, consumer *Consumer) error
+	}{
+		{
+			name: "one message at a time",
+			consume: func(ctx context.Context, consumer *Consumer) error {
+				return consumer.StartConsuming(ctx, EventHandlers{"events": func(context.Context, []byte, []byte) error { return nil }})
+			},
+		},
+		{
+			name: "batches",
+			consume: func(ctx context.Context, consumer *Consumer) error {
+				return consumer.StartConsumingBatches(ctx, BatchEventHandlers{"events": func(context.Context, []Record) error { return nil }})
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			consumer := NewMemoryBroker(1).NewConsumer(&config.KafkaConsumer{GroupID: "worker"})
+
+			ctx, cancel := context.WithCancel(t.Context())
+			cancel()
+
+			require.NoError(t, tt.consume(ctx, consumer))
+
+			// The dead-letter producer can't be used once the consumer has stopped
+			_, err := consumer.deadLetters.Produce(t.Context(), "events.dlq", nil, []byte("value"))
+			assert.Error(t, err)
+
+			// Closing again does nothing
+			assert.NoError(t, consumer.Close())
+		})
+	}
+}
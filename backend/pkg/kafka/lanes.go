@@ -0,0 +1,188 @@
+package kafka
+
+import (
+	"context"
+	"hash/fnv"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/rs/zerolog/log"
+)
+
+// Messages a lane can be given before the consumer waits for one to finish
+const maxInFlightPerLane = 100
+
+// laneJob is a message waiting to be handled by a lane
+type laneJob struct {
+	message *kafka.Message
+	handler EventHandler
+	offsets *partitionOffsets
+}
+
+// laneResult reports whether a lane handled (or dead-lettered) a message
+type laneResult struct {
+	job     *laneJob
+	handled bool
+}
+
+// lanePool is the lanes of a consumer and the messages given to them that
+// haven't been committed yet
+type lanePool struct {
+	lanes   []chan *laneJob
+	results chan laneResult
+	running sync.WaitGroup
+
+	offsets     *offsetTracker
+	inFlight    int
+	maxInFlight int
+}
+
+// startLanes starts concurrency lanes handling messages with handlerCtx. Messages
+// given to them that haven't started once ctx is done are skipped.
+func (c *Consumer) startLanes(ctx, handlerCtx context.Context) *lanePool {
+	maxInFlight := c.concurrency * maxInFlightPerLane
+
+	pool := &lanePool{
+		lanes:       make([]chan *laneJob, c.concurrency),
+		results:     make(chan laneResult, maxInFlight),
+		offsets:     newOffsetTracker(),
+		maxInFlight: maxInFlight,
+	}
+
+	for i := range pool.lanes {
+		pool.lanes[i] = make(chan *laneJob, maxInFlight)
+
+		pool.running.Add(1)
+		go func() {
+			defer pool.running.Done()
+			c.runLane(ctx, handlerCtx, pool.lanes[i], pool.results)
+		}()
+	}
+
+	return pool
+}
+
+// laneOf returns the lane that handles message. Messages with the same key
+// always go to the same lane, so they are handled in order. With an offset
+// store every message of a partition goes to the same lane.
+func (c *Consumer) laneOf(message *kafka.Message, lanes int) int {
+	hash := fnv.New32a()
+	hash.Write([]byte(*message.TopicPartition.Topic))
+	if len(message.Key) > 0 && c.offsetStore == nil {
+		hash.Write(message.Key)
+	} else {
+		hash.Write([]byte(strconv.Itoa(int(message.TopicPartition.Partition))))
+	}
+
+	return int(hash.Sum32() % uint32(lanes))
+}
+
+// dispatch gives message to its lane
+func (c *Consumer) dispatch(pool *lanePool, message *kafka.Message, handler EventHandler) {
+	pool.lanes[c.laneOf(message, len(pool.lanes))] <- &laneJob{
+		message: message,
+		handler: handler,
+		offsets: pool.offsets.start(message),
+	}
+	pool.inFlight++
+}
+
+// runLane handles the messages given to a lane one at a time until it is closed
+func (c *Consumer) runLane(ctx, handlerCtx context.Context, jobs <-chan *laneJob, results chan<- laneResult) {
+	for job := range jobs {
+		// The partition was rewound to an earlier message (this one is read again)
+		// or revoked, or the consumer is shutting down
+		if job.offsets.rewound.Load() || ctx.Err() != nil {
+			results <- laneResult{job: job}
+			continue
+		}
+
+		results <- laneResult{job: job, handled: c.handleMessage(handlerCtx, job.handler, job.message)}
+	}
+}
+
+// collect finishes a message a lane is done with, waiting for one if wait is
+// set. Returns false if no message had finished.
+func (c *Consumer) collect(ctx context.Context, pool *lanePool, wait bool) bool {
+	var result laneResult
+	if wait {
+		result = <-pool.results
+	} else {
+		select {
+		case result = <-pool.results:
+		default:
+			return false
+		}
+	}
+
+	pool.inFlight--
+	c.finish(ctx, pool.offsets, result)
+
+	return true
+}
+
+// finish commits the partition of a finished message up to its oldest
+// unfinished message. If the message wasn't handled the partition is rewound
+// so it is consumed again.
+func (c *Consumer) finish(ctx context.Context, offsets *offsetTracker, result laneResult) {
+	message := result.job.message
+
+	if result.handled {
+		if position, ok := offsets.finish(message, result.job.offsets); ok {
+			if _, err := c.client.CommitOffsets([]kafka.TopicPartition{position}); err != nil {
+				log.Error().Err(err).Msg("failed to commit message offset")
+			}
+		}
+		return
+	}
+
+	// Shutting down - unfinished messages are consumed again on restart
+	if ctx.Err() != nil {
+		return
+	}
+
+	if position, ok := offsets.rewind(message, result.job.offsets); ok {
+		c.rewind(position)
+	}
+}
+
+// finishPartitions waits up to drainTimeout for the messages of revoked
+// partitions to finish and commits them, so their next owner doesn't handle
+// them again. Their messages that haven't started are skipped.
+func (c *Consumer) finishPartitions(ctx context.Context, pool *lanePool, partitions []kafka.TopicPartition) {
+	defer pool.offsets.forget(partitions)
+
+	deadline := time.NewTimer(c.drainTimeout)
+	defer deadline.Stop()
+
+	for pool.offsets.pendingIn(partitions) {
+		select {
+		case result := <-pool.results:
+			pool.inFlight--
+			c.finish(ctx, pool.offsets, result)
+
+		case <-deadline.C:
+			log.Warn().Dur("drain_timeout", c.drainTimeout).
+				Msg("revoked partitions still have messages being handled, their next owner handles them again")
+			return
+		}
+	}
+}
+
+// stopLanes stops giving messages to the lanes and waits for them to finish
+// the messages they started, then commits them. Messages that hadn't started
+// are consumed again on restart.
+func (c *Consumer) stopLanes(ctx context.Context, pool *lanePool) {
+	for _, lane := range pool.lanes {
+		close(lane)
+	}
+	pool.running.Wait()
+	close(pool.results)
+
+	for result := range pool.results {
+		c.finish(ctx, pool.offsets, result)
+	}
+	pool.inFlight = 0
+}
@@ -0,0 +1,353 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/murraystewart96/token-swap/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// committedOffset returns the offset the group committed for a partition
+func committedOffset(broker *MemoryBroker, group, topic string, partition int32) int64 {
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+
+	if g, ok := broker.groups[group]; ok {
+		return int64(g.committed[topicPartition{topic: topic, partition: partition}])
+	}
+	return 0
+}
+
+func offsetMessageWithKey(key string) *kafka.Message {
+	message := offsetMessage(0, 0)
+	message.Key = []byte(key)
+	return message
+}
+
+func TestConsumer_SlowKeyDoesNotBlockOtherKeys(t *testing.T) {
+	const lanes = 4
+
+	broker := NewMemoryBroker(1)
+	producer := broker.NewProducer(&config.KafkaProducer{})
+	defer producer.Close()
+
+	consumer := broker.NewConsumer(&config.KafkaConsumer{GroupID: "worker", OffsetReset: "earliest", Concurrency: lanes})
+	defer consumer.Close()
+
+	// Keys handled by different lanes
+	slowKey, fastKey := "pool-0", ""
+	for i := 1; fastKey == ""; i++ {
+		key := fmt.Sprintf("pool-%d", i)
+		if consumer.laneOf(offsetMessageWithKey(slowKey), lanes) != consumer.laneOf(offsetMessageWithKey(key), lanes) {
+			fastKey = key
+		}
+	}
+
+	for _, key := range []string{slowKey, fastKey} {
+		_, err := producer.Produce(t.Context(), "trades", []byte(key), []byte(key))
+		require.NoError(t, err)
+	}
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	release := make(chan struct{})
+	handled := make(chan string, 2)
+
+	go consumer.StartConsuming(ctx, EventHandlers{
+		"trades": func(_ context.Context, key, _ []byte) error {
+			if string(key) == slowKey {
+				<-release
+			}
+			handled <- string(key)
+			return nil
+		},
+	})
+
+	select {
+	case key := <-handled:
+		assert.Equal(t, fastKey, key)
+	case <-time.After(5 * time.Second):
+		t.Fatal("message was held up by a slow message with another key")
+	}
+
+	// The slow message comes first in the partition, so nothing is committed yet
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int64(0), committedOffset(broker, "worker", "trades", 0))
+
+	close(release)
+	<-handled
+
+	require.Eventually(t, func() bool {
+		return committedOffset(broker, "worker", "trades", 0) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestConsumer_KeepsKeyOrderWhenConcurrent(t *testing.T) {
+	broker := NewMemoryBroker(2)
+	producer := broker.NewProducer(&config.KafkaProducer{})
+	defer producer.Close()
+
+	const keys, perKey = 5, 20
+	for i := range perKey {
+		for key := range keys {
+			_, err := producer.Produce(t.Context(), "trades", []byte(fmt.Sprintf("pool-%d", key)), []byte(fmt.Sprintf("pool-%d/%02d", key, i)))
+			require.NoError(t, err)
+		}
+	}
+
+	consumer := broker.NewConsumer(&config.KafkaConsumer{GroupID: "worker", OffsetReset: "earliest", Concurrency: 3})
+	defer consumer.Close()
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	var mu sync.Mutex
+	handled := make(map[string][]string)
+	done := make(chan struct{})
+	count := 0
+
+	go consumer.StartConsuming(ctx, EventHandlers{
+		"trades": func(_ context.Context, key, value []byte) error {
+			time.Sleep(time.Duration(rand.IntN(500)) * time.Microsecond)
+
+			mu.Lock()
+			defer mu.Unlock()
+			handled[string(key)] = append(handled[string(key)], string(value))
+			if count++; count == keys*perKey {
+				close(done)
+			}
+			return nil
+		},
+	})
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("messages weren't all handled")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for key, values := range handled {
+		assert.Len(t, values, perKey)
+		assert.IsIncreasing(t, values, "messages of %s were handled out of order", key)
+		for _, value := range values {
+			assert.True(t, strings.HasPrefix(value, key+"/"))
+		}
+	}
+}
+
+func TestConsumer_FinishesInFlightMessagesOnShutdown(t *testing.T) {
+	broker := NewMemoryBroker(1)
+	producer := broker.NewProducer(&config.KafkaProducer{})
+	defer producer.Close()
+
+	_, err := producer.Produce(t.Context(), "trades", nil, []byte("a"))
+	require.NoError(t, err)
+
+	consumer := broker.NewConsumer(&config.KafkaConsumer{GroupID: "worker", OffsetReset: "earliest", MaxAttempts: 1})
+	defer consumer.Close()
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handlerErr := make(chan error, 1)
+	stopped := make(chan error, 1)
+
+	go func() {
+		stopped <- consumer.StartConsuming(ctx, EventHandlers{
+			"trades": func(ctx context.Context, _, _ []byte) error {
+				close(started)
+				<-release
+				handlerErr <- ctx.Err()
+				return nil
+			},
+		})
+	}()
+
+	<-started
+	cancel()
+
+	// The consumer waits for the handler, which can still use its context
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	assert.NoError(t, <-handlerErr)
+
+	select {
+	case err := <-stopped:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("consumer didn't stop")
+	}
+	assert.Equal(t, int64(1), committedOffset(broker, "worker", "trades", 0))
+}
+
+func TestConsumer_DoesntRetryOrDeadLetterMessagesFailingWhileDraining(t *testing.T) {
+	broker := NewMemoryBroker(1)
+	producer := broker.NewProducer(&config.KafkaProducer{})
+	defer producer.Close()
+
+	_, err := producer.Produce(t.Context(), "trades", nil, []byte("a"))
+	require.NoError(t, err)
+
+	consumer := broker.NewConsumer(&config.KafkaConsumer{GroupID: "worker", OffsetReset: "earliest", MaxAttempts: 5, RetryMinBackoff: time.Second})
+	defer consumer.Close()
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	stopped := make(chan error, 1)
+	var attempts atomic.Int32
+
+	go func() {
+		stopped <- consumer.StartConsuming(ctx, EventHandlers{
+			"trades": func(ctx context.Context, _, _ []byte) error {
+				if attempts.Add(1) == 1 {
+					close(started)
+				}
+				<-release
+				return errors.New("database unavailable")
+			},
+		})
+	}()
+
+	<-started
+	cancel()
+	close(release)
+
+	select {
+	case err := <-stopped:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("consumer didn't stop")
+	}
+
+	// The message is consumed again on restart instead of being dead-lettered
+	assert.Equal(t, int32(1), attempts.Load())
+	assert.Equal(t, int64(0), committedOffset(broker, "worker", "trades", 0))
+
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	assert.Empty(t, broker.topics[config.DeadLetterTopic("trades")])
+}
+
+func TestConsumer_FailsWhenDrainTimesOut(t *testing.T) {
+	broker := NewMemoryBroker(1)
+	producer := broker.NewProducer(&config.KafkaProducer{})
+	defer producer.Close()
+
+	_, err := producer.Produce(t.Context(), "trades", nil, []byte("a"))
+	require.NoError(t, err)
+
+	consumer := broker.NewConsumer(&config.KafkaConsumer{GroupID: "worker", OffsetReset: "earliest", MaxAttempts: 1, DrainTimeout: 50 * time.Millisecond})
+	defer consumer.Close()
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	started := make(chan struct{})
+	stopped := make(chan error, 1)
+
+	go func() {
+		stopped <- consumer.StartConsuming(ctx, EventHandlers{
+			"trades": func(ctx context.Context, _, _ []byte) error {
+				close(started)
+				<-ctx.Done()
+				return ctx.Err()
+			},
+		})
+	}()
+
+	<-started
+	cancel()
+
+	select {
+	case err := <-stopped:
+		assert.ErrorIs(t, err, errDrainTimeout)
+	case <-time.After(5 * time.Second):
+		t.Fatal("consumer didn't stop")
+	}
+
+	// The message wasn't handled, it is consumed again on restart
+	assert.Equal(t, int64(0), committedOffset(broker, "worker", "trades", 0))
+}
+
+func TestConsumer_FinishesRevokedPartitionsBeforeHandingThemOver(t *testing.T) {
+	broker := NewMemoryBroker(2)
+	producer := broker.NewProducer(&config.KafkaProducer{})
+	defer producer.Close()
+
+	// A message on each partition
+	values := make(map[int32]string)
+	for i := 0; len(values) < 2; i++ {
+		key := fmt.Sprintf("pool-%d", i)
+		delivery, err := producer.Produce(t.Context(), "trades", []byte(key), []byte(key))
+		require.NoError(t, err)
+		if _, ok := values[delivery.Partition]; !ok {
+			values[delivery.Partition] = key
+		}
+	}
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	var mu sync.Mutex
+	handled := make(map[string]int)
+	started := make(chan struct{}, 10)
+	release := make(chan struct{})
+
+	handlers := EventHandlers{
+		"trades": func(_ context.Context, _, value []byte) error {
+			started <- struct{}{}
+			<-release
+
+			mu.Lock()
+			defer mu.Unlock()
+			handled[string(value)]++
+			return nil
+		},
+	}
+
+	// The first consumer gets both partitions and starts handling their messages
+	first := broker.NewConsumer(&config.KafkaConsumer{GroupID: "worker", OffsetReset: "earliest", Concurrency: 2})
+	defer first.Close()
+	go first.StartConsuming(ctx, handlers)
+	<-started
+
+	// A second consumer joins and takes over a partition once the first has finished with it
+	second := broker.NewConsumer(&config.KafkaConsumer{GroupID: "worker", OffsetReset: "earliest", Concurrency: 2})
+	defer second.Close()
+	go second.StartConsuming(ctx, handlers)
+
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	// Give the second consumer time to read anything handed over uncommitted
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(handled) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, value := range values {
+		assert.Equal(t, 1, handled[value], "%s was handled more than once", value)
+	}
+}
@@ -0,0 +1,592 @@
+package kafka
+
+import (
+	"cmp"
+	"errors"
+	"hash/fnv"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/murraystewart96/token-swap/internal/config"
+	"github.com/rs/zerolog/log"
+)
+
+// Partitions of topics the broker creates on first use
+const defaultMemoryPartitions = 1
+
+var errMemoryClientClosed = errors.New("client is closed")
+
+// MemoryBroker is an in-process stand-in for a Kafka cluster, so the listener
+// and worker can run in one process without one, and tests can run the whole
+// pipeline. Like Kafka, topics are split into partitions (messages are assigned
+// one by key), consumers in a group share a topic's partitions and resume from
+// their group's committed offsets, and headers are kept. Messages are only kept
+// in memory and never expire.
+type MemoryBroker struct {
+	partitions int
+
+	mu     sync.Mutex
+	topics map[string][][]*kafka.Message // messages of each partition by offset
+	groups map[string]*memoryGroup
+
+	// Closed and replaced whenever messages are produced or a group rebalances,
+	// waking up consumers waiting for messages
+	changed chan struct{}
+
+	// Partition of the next unkeyed message
+	nextPartition int
+}
+
+// NewMemoryBroker returns an empty broker. Topics are created on first use with
+// the given number of partitions unless created with EnsureTopics.
+func NewMemoryBroker(partitions int) *MemoryBroker {
+	if partitions <= 0 {
+		partitions = defaultMemoryPartitions
+	}
+
+	return &MemoryBroker{
+		partitions: partitions,
+		topics:     make(map[string][][]*kafka.Message),
+		groups:     make(map[string]*memoryGroup),
+		changed:    make(chan struct{}),
+	}
+}
+
+// NewProducer returns a producer publishing to the broker
+func (b *MemoryBroker) NewProducer(cfg *config.KafkaProducer) *Producer {
+	return newProducer(&memoryProducer{broker: b, events: make(chan kafka.Event, 1000)}, cfg)
+}
+
+// NewConsumer returns a consumer joining cfg.GroupID on the broker. Its
+// dead-letter topics are on the broker too.
+func (b *MemoryBroker) NewConsumer(cfg *config.KafkaConsumer) *Consumer {
+	client := &memoryConsumer{
+		broker:      b,
+		group:       cfg.GroupID,
+		offsetReset: cfg.OffsetReset,
+		positions:   make(map[topicPartition]kafka.Offset),
+	}
+
+	return newConsumer(client, b.NewProducer(&config.KafkaProducer{}), cfg)
+}
+
+// topicPartition identifies a partition
+type topicPartition struct {
+	topic     string
+	partition int32
+}
+
+func (tp topicPartition) kafka(offset kafka.Offset) kafka.TopicPartition {
+	topic := tp.topic
+	return kafka.TopicPartition{Topic: &topic, Partition: tp.partition, Offset: offset}
+}
+
+// memoryGroup is a consumer group: its members and committed offsets
+type memoryGroup struct {
+	members   []*memoryConsumer
+	committed map[topicPartition]kafka.Offset
+}
+
+// notify wakes up waiting consumers. Must be called with b.mu held.
+func (b *MemoryBroker) notify() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// topic returns the partitions of topic, creating it if needed. Must be called
+// with b.mu held.
+func (b *MemoryBroker) topic(name string) [][]*kafka.Message {
+	partitions, ok := b.topics[name]
+	if !ok {
+		partitions = make([][]*kafka.Message, b.partitions)
+		b.topics[name] = partitions
+	}
+	return partitions
+}
+
+// createTopics creates the topics that don't exist yet with the given number of partitions
+func (b *MemoryBroker) createTopics(topics []string, partitions int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, topic := range topics {
+		if existing, ok := b.topics[topic]; ok {
+			if len(existing) != partitions {
+				log.Warn().Str("topic", topic).Int("partitions", len(existing)).Int("configured_partitions", partitions).
+					Msg("topic already exists with a different partition count")
+			}
+			continue
+		}
+		b.topics[topic] = make([][]*kafka.Message, max(partitions, 1))
+	}
+
+	// Groups subscribed to a new topic get its partitions
+	for _, group := range b.groups {
+		b.rebalance(group)
+	}
+	b.notify()
+}
+
+// produce appends message to its partition and returns it as stored
+func (b *MemoryBroker) produce(message *kafka.Message) (*kafka.Message, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if message.TopicPartition.Topic == nil {
+		return nil, kafka.NewError(kafka.ErrUnknownTopic, "message has no topic", false)
+	}
+	topic := *message.TopicPartition.Topic
+	partitions := b.topic(topic)
+
+	partition := message.TopicPartition.Partition
+	switch {
+	case partition == kafka.PartitionAny && len(message.Key) > 0:
+		hash := fnv.New32a()
+		hash.Write(message.Key)
+		partition = int32(hash.Sum32() % uint32(len(partitions)))
+	case partition == kafka.PartitionAny:
+		partition = int32(b.nextPartition % len(partitions))
+		b.nextPartition++
+	case partition < 0 || int(partition) >= len(partitions):
+		return nil, kafka.NewError(kafka.ErrUnknownPartition, "unknown partition", false)
+	}
+
+	stored := *message
+	stored.TopicPartition = kafka.TopicPartition{
+		Topic:     &topic,
+		Partition: partition,
+		Offset:    kafka.Offset(len(partitions[partition])),
+	}
+	stored.Headers = slices.Clone(message.Headers)
+	stored.Timestamp = time.Now()
+	stored.Opaque = nil
+
+	partitions[partition] = append(partitions[partition], &stored)
+	b.notify()
+
+	return &stored, nil
+}
+
+// rebalance assigns the partitions of each topic subscribed to by the group's
+// members, spreading them over the members subscribed to the topic. Members
+// keep their position in partitions they already had and resume the others
+// from the group's committed offsets, so messages that weren't committed are
+// consumed again. Must be called with b.mu held.
+func (b *MemoryBroker) rebalance(group *memoryGroup) {
+	previous := make(map[*memoryConsumer]map[topicPartition]kafka.Offset, len(group.members))
+	for _, member := range group.members {
+		previous[member] = member.positions
+		member.positions = make(map[topicPartition]kafka.Offset)
+	}
+	defer func() {
+		for _, member := range group.members {
+			if !maps.EqualFunc(previous[member], member.positions, func(kafka.Offset, kafka.Offset) bool { return true }) {
+				member.reassigned = true
+			}
+
+			// Members handling rebalances finish the partitions they lost first
+			if member.rebalanceCb == nil {
+				continue
+			}
+			for tp := range member.revoking {
+				if _, reassigned := member.positions[tp]; reassigned {
+					delete(member.revoking, tp)
+				}
+			}
+			for tp := range previous[member] {
+				if _, kept := member.positions[tp]; !kept {
+					if member.revoking == nil {
+						member.revoking = make(map[topicPartition]bool)
+					}
+					member.revoking[tp] = true
+				}
+			}
+		}
+	}()
+
+	topics := make(map[string][]*memoryConsumer)
+	for _, member := range group.members {
+		for _, topic := range member.topics {
+			topics[topic] = append(topics[topic], member)
+		}
+	}
+
+	for topic, members := range topics {
+		partitions := b.topic(topic)
+		for partition := range partitions {
+			tp := topicPartition{topic: topic, partition: int32(partition)}
+			member := members[partition%len(members)]
+
+			if position, ok := previous[member][tp]; ok {
+				member.positions[tp] = position
+				continue
+			}
+
+			offset, ok := group.committed[tp]
+			if !ok {
+				offset = 0
+				if member.offsetReset == "latest" {
+					offset = kafka.Offset(len(partitions[partition]))
+				}
+			}
+			member.positions[tp] = offset
+		}
+	}
+}
+
+// revoking reports whether a member of group is still finishing a partition it
+// lost in a rebalance. Must be called with b.mu held.
+func (b *MemoryBroker) revoking(group string, tp topicPartition) bool {
+	if g, ok := b.groups[group]; ok {
+		for _, member := range g.members {
+			if member.revoking[tp] {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// memoryProducer implements producerClient on a MemoryBroker
+type memoryProducer struct {
+	broker *MemoryBroker
+	events chan kafka.Event
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func (p *memoryProducer) Produce(message *kafka.Message, deliveryChan chan kafka.Event) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return kafka.NewError(kafka.ErrState, errMemoryClientClosed.Error(), false)
+	}
+
+	stored, err := p.broker.produce(message)
+	if err != nil {
+		return err
+	}
+
+	// Delivery reports carry the message as produced, with its position
+	report := *stored
+	report.Opaque = message.Opaque
+
+	if deliveryChan != nil {
+		deliveryChan <- &report
+	} else {
+		p.events <- &report
+	}
+
+	return nil
+}
+
+func (p *memoryProducer) Events() chan kafka.Event {
+	return p.events
+}
+
+// Flush returns straight away, messages are delivered as they are produced
+func (p *memoryProducer) Flush(int) int {
+	return 0
+}
+
+func (p *memoryProducer) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.closed {
+		p.closed = true
+		close(p.events)
+	}
+}
+
+// memoryConsumer implements consumerClient on a MemoryBroker. Its fields are
+// guarded by the broker's lock.
+type memoryConsumer struct {
+	broker      *MemoryBroker
+	group       string
+	offsetReset string
+
+	topics    []string
+	positions map[topicPartition]kafka.Offset // next offset to read of each assigned partition
+	closed    bool
+
+	// Called from ReadMessage with the new assignment after a rebalance
+	rebalanceCb kafka.RebalanceCb
+	reassigned  bool
+
+	// Partitions lost in a rebalance that the consumer can still commit until
+	// its rebalance callback has handled their revocation. Their new owner
+	// doesn't read them until then.
+	revoking map[topicPartition]bool
+
+	// Partition read from last, so partitions are read in turn
+	last int
+}
+
+func (c *memoryConsumer) SubscribeTopics(topics []string, rebalanceCb kafka.RebalanceCb) error {
+	b := c.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if c.closed {
+		return kafka.NewError(kafka.ErrState, errMemoryClientClosed.Error(), false)
+	}
+
+	group, ok := b.groups[c.group]
+	if !ok {
+		group = &memoryGroup{committed: make(map[topicPartition]kafka.Offset)}
+		b.groups[c.group] = group
+	}
+	if !slices.Contains(group.members, c) {
+		group.members = append(group.members, c)
+	}
+
+	c.topics = slices.Clone(topics)
+	c.rebalanceCb = rebalanceCb
+	b.rebalance(group)
+	b.notify()
+
+	return nil
+}
+
+func (c *memoryConsumer) ReadMessage(timeout time.Duration) (*kafka.Message, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	b := c.broker
+	for {
+		b.mu.Lock()
+		if c.closed {
+			b.mu.Unlock()
+			return nil, kafka.NewError(kafka.ErrState, errMemoryClientClosed.Error(), false)
+		}
+
+		// Like librdkafka, rebalance events are served while polling
+		if c.reassigned && c.rebalanceCb != nil {
+			c.reassigned = false
+			revoked := c.revokedPartitions()
+			assignment := kafka.AssignedPartitions{Partitions: c.assignment()}
+			b.mu.Unlock()
+
+			if len(revoked) > 0 {
+				if err := c.rebalanceCb(nil, kafka.RevokedPartitions{Partitions: revoked}); err != nil {
+					log.Error().Err(err).Msg("rebalance callback failed")
+				}
+
+				b.mu.Lock()
+				c.release(revoked)
+				b.mu.Unlock()
+			}
+
+			if err := c.rebalanceCb(nil, assignment); err != nil {
+				log.Error().Err(err).Msg("rebalance callback failed")
+			}
+			continue
+		}
+
+		if message := c.next(); message != nil {
+			b.mu.Unlock()
+			return message, nil
+		}
+		changed := b.changed
+		b.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-timer.C:
+			return nil, kafka.NewError(kafka.ErrTimedOut, "timed out waiting for a message", false)
+		}
+	}
+}
+
+// next returns the next unread message of the assigned partitions, taking
+// partitions in turn. Must be called with the broker's lock held.
+func (c *memoryConsumer) next() *kafka.Message {
+	assigned := c.assigned()
+	for i := range assigned {
+		tp := assigned[(c.last+1+i)%len(assigned)]
+
+		// The previous owner is still finishing the partition's messages
+		if c.broker.revoking(c.group, tp) {
+			continue
+		}
+
+		messages := c.broker.topics[tp.topic][tp.partition]
+		position := c.positions[tp]
+		if int(position) >= len(messages) {
+			continue
+		}
+
+		c.positions[tp] = position + 1
+		c.last = (c.last + 1 + i) % len(assigned)
+
+		message := *messages[position]
+		message.Headers = slices.Clone(message.Headers)
+		return &message
+	}
+
+	return nil
+}
+
+// assigned returns the assigned partitions in a stable order
+func (c *memoryConsumer) assigned() []topicPartition {
+	assigned := make([]topicPartition, 0, len(c.positions))
+	for tp := range c.positions {
+		assigned = append(assigned, tp)
+	}
+
+	slices.SortFunc(assigned, func(a, b topicPartition) int {
+		return cmp.Or(strings.Compare(a.topic, b.topic), cmp.Compare(a.partition, b.partition))
+	})
+
+	return assigned
+}
+
+func (c *memoryConsumer) CommitMessage(message *kafka.Message) ([]kafka.TopicPartition, error) {
+	position := message.TopicPartition
+	position.Offset++
+
+	return c.CommitOffsets([]kafka.TopicPartition{position})
+}
+
+func (c *memoryConsumer) CommitOffsets(offsets []kafka.TopicPartition) ([]kafka.TopicPartition, error) {
+	b := c.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	group, ok := b.groups[c.group]
+	if !ok || c.closed {
+		return nil, kafka.NewError(kafka.ErrState, "consumer is not in a group", false)
+	}
+
+	for _, offset := range offsets {
+		tp := topicPartition{topic: *offset.Topic, partition: offset.Partition}
+
+		// Commits for partitions lost in a rebalance would overwrite the new owner's
+		if _, assigned := c.positions[tp]; !assigned && !c.revoking[tp] {
+			return nil, kafka.NewError(kafka.ErrUnknownMemberID, "partition isn't assigned to this consumer", false)
+		}
+		group.committed[tp] = offset.Offset
+	}
+
+	return offsets, nil
+}
+
+func (c *memoryConsumer) Seek(partition kafka.TopicPartition, _ int) error {
+	b := c.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	tp := topicPartition{topic: *partition.Topic, partition: partition.Partition}
+	if _, assigned := c.positions[tp]; !assigned {
+		return kafka.NewError(kafka.ErrState, "partition isn't assigned to this consumer", false)
+	}
+	c.positions[tp] = partition.Offset
+
+	return nil
+}
+
+func (c *memoryConsumer) Assignment() ([]kafka.TopicPartition, error) {
+	c.broker.mu.Lock()
+	defer c.broker.mu.Unlock()
+
+	return c.assignment(), nil
+}
+
+// assignment returns the assigned partitions. Must be called with the broker's lock held.
+func (c *memoryConsumer) assignment() []kafka.TopicPartition {
+	assigned := c.assigned()
+	partitions := make([]kafka.TopicPartition, len(assigned))
+	for i, tp := range assigned {
+		partitions[i] = tp.kafka(kafka.OffsetInvalid)
+	}
+
+	return partitions
+}
+
+// revokedPartitions returns the partitions the consumer is still finishing
+// after losing them in a rebalance. Must be called with the broker's lock held.
+func (c *memoryConsumer) revokedPartitions() []kafka.TopicPartition {
+	partitions := make([]kafka.TopicPartition, 0, len(c.revoking))
+	for tp := range c.revoking {
+		partitions = append(partitions, tp.kafka(kafka.OffsetInvalid))
+	}
+
+	return partitions
+}
+
+// release hands revoked partitions over to their new owner, which starts from
+// the offsets committed while they were revoked. Must be called with the
+// broker's lock held.
+func (c *memoryConsumer) release(partitions []kafka.TopicPartition) {
+	b := c.broker
+	group := b.groups[c.group]
+
+	for _, partition := range partitions {
+		tp := topicPartition{topic: *partition.Topic, partition: partition.Partition}
+		delete(c.revoking, tp)
+
+		committed, ok := group.committed[tp]
+		if !ok {
+			continue
+		}
+		for _, member := range group.members {
+			if _, assigned := member.positions[tp]; assigned && member != c {
+				member.positions[tp] = committed
+			}
+		}
+	}
+
+	b.notify()
+}
+
+// Assign moves to the offsets given for assigned partitions. The group decides
+// which partitions are assigned, partitions without an offset keep their position.
+func (c *memoryConsumer) Assign(partitions []kafka.TopicPartition) error {
+	b := c.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, partition := range partitions {
+		tp := topicPartition{topic: *partition.Topic, partition: partition.Partition}
+		if _, assigned := c.positions[tp]; assigned && partition.Offset >= 0 {
+			c.positions[tp] = partition.Offset
+		}
+	}
+
+	return nil
+}
+
+// Unassign does nothing, partitions are revoked by the group's next rebalance
+func (c *memoryConsumer) Unassign() error {
+	return nil
+}
+
+// Close leaves the group, handing the consumer's partitions to the other members
+func (c *memoryConsumer) Close() error {
+	b := c.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+
+	if group, ok := b.groups[c.group]; ok {
+		group.members = slices.DeleteFunc(group.members, func(member *memoryConsumer) bool { return member == c })
+		c.release(c.revokedPartitions())
+		b.rebalance(group)
+	}
+	clear(c.positions)
+	b.notify()
+
+	return nil
+}
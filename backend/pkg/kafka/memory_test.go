@@ -0,0 +1,233 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/murraystewart96/token-swap/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// consumeMemory consumes topic from the broker until want messages have been
+// handled, returning their values in the order they were handled
+func consumeMemory(t *testing.T, broker *MemoryBroker, group, topic string, want int, handler EventHandler) []string {
+	t.Helper()
+
+	consumer := broker.NewConsumer(&config.KafkaConsumer{GroupID: group, OffsetReset: "earliest", MaxAttempts: 1})
+	defer consumer.Close()
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	var mu sync.Mutex
+	var values []string
+	done := make(chan struct{})
+
+	stopped := make(chan struct{})
+	defer func() {
+		// Offsets are committed as the consumer stops
+		cancel()
+		<-stopped
+	}()
+
+	go func() {
+		defer close(stopped)
+		consumer.StartConsuming(ctx, EventHandlers{
+			topic: func(ctx context.Context, key, value []byte) error {
+				if handler != nil {
+					if err := handler(ctx, key, value); err != nil {
+						return err
+					}
+				}
+
+				mu.Lock()
+				defer mu.Unlock()
+				if values = append(values, string(value)); len(values) == want {
+					close(done)
+				}
+				return nil
+			},
+		})
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("consumed %d of %d messages", len(values), want)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	return values
+}
+
+func TestMemoryBroker_KeepsKeyOrderWithinPartition(t *testing.T) {
+	broker := NewMemoryBroker(4)
+	producer := broker.NewProducer(&config.KafkaProducer{})
+	defer producer.Close()
+
+	partitions := make(map[string]int32)
+	for i := range 12 {
+		key := fmt.Sprintf("pool-%d", i%3)
+		delivery, err := producer.Produce(t.Context(), "events", []byte(key), []byte(fmt.Sprintf("%s/%d", key, i)))
+		require.NoError(t, err)
+
+		if partition, ok := partitions[key]; ok {
+			assert.Equal(t, partition, delivery.Partition, "key %s moved partition", key)
+		}
+		partitions[key] = delivery.Partition
+	}
+
+	values := consumeMemory(t, broker, "worker", "events", 12, nil)
+
+	// Messages of a key are consumed in the order they were produced
+	for i := range 3 {
+		var ofKey []string
+		for _, value := range values {
+			if value[:6] == fmt.Sprintf("pool-%d", i) {
+				ofKey = append(ofKey, value)
+			}
+		}
+		assert.Equal(t, []string{
+			fmt.Sprintf("pool-%d/%d", i, i),
+			fmt.Sprintf("pool-%d/%d", i, i+3),
+			fmt.Sprintf("pool-%d/%d", i, i+6),
+			fmt.Sprintf("pool-%d/%d", i, i+9),
+		}, ofKey)
+	}
+}
+
+func TestMemoryBroker_GroupMembersSharePartitions(t *testing.T) {
+	broker := NewMemoryBroker(4)
+
+	first := broker.NewConsumer(&config.KafkaConsumer{GroupID: "worker", OffsetReset: "earliest"})
+	defer first.Close()
+	second := broker.NewConsumer(&config.KafkaConsumer{GroupID: "worker", OffsetReset: "earliest"})
+	defer second.Close()
+	other := broker.NewConsumer(&config.KafkaConsumer{GroupID: "other", OffsetReset: "earliest"})
+	defer other.Close()
+
+	for _, consumer := range []*Consumer{first, second, other} {
+		require.NoError(t, consumer.client.SubscribeTopics([]string{"events"}, nil))
+	}
+
+	firstAssignment, err := first.client.Assignment()
+	require.NoError(t, err)
+	secondAssignment, err := second.client.Assignment()
+	require.NoError(t, err)
+	otherAssignment, err := other.client.Assignment()
+	require.NoError(t, err)
+
+	assert.Len(t, firstAssignment, 2)
+	assert.Len(t, secondAssignment, 2)
+	assert.NotEqual(t, firstAssignment[0].Partition, secondAssignment[0].Partition)
+	assert.Len(t, otherAssignment, 4)
+
+	// The remaining member takes over the partitions of one that leaves
+	require.NoError(t, second.Close())
+	firstAssignment, err = first.client.Assignment()
+	require.NoError(t, err)
+	assert.Len(t, firstAssignment, 4)
+}
+
+func TestMemoryBroker_ResumesFromCommittedOffsets(t *testing.T) {
+	broker := NewMemoryBroker(1)
+	producer := broker.NewProducer(&config.KafkaProducer{})
+	defer producer.Close()
+
+	for _, value := range []string{"a", "b"} {
+		_, err := producer.Produce(t.Context(), "events", nil, []byte(value))
+		require.NoError(t, err)
+	}
+	assert.Equal(t, []string{"a", "b"}, consumeMemory(t, broker, "worker", "events", 2, nil))
+
+	_, err := producer.Produce(t.Context(), "events", nil, []byte("c"))
+	require.NoError(t, err)
+
+	// A new member of the group starts after the committed messages, another group from the start
+	assert.Equal(t, []string{"c"}, consumeMemory(t, broker, "worker", "events", 1, nil))
+	assert.Equal(t, []string{"a", "b", "c"}, consumeMemory(t, broker, "other", "events", 3, nil))
+}
+
+func TestMemoryBroker_PassesHeadersToHandlers(t *testing.T) {
+	broker := NewMemoryBroker(1)
+	producer := broker.NewProducer(&config.KafkaProducer{})
+	defer producer.Close()
+
+	_, err := producer.Produce(t.Context(), "events", []byte("key"), []byte("value"),
+		Header{Key: HeaderContentType, Value: []byte("application/x-protobuf")})
+	require.NoError(t, err)
+
+	var contentType string
+	consumeMemory(t, broker, "worker", "events", 1, func(ctx context.Context, _, _ []byte) error {
+		contentType = MessageHeader(ctx, HeaderContentType)
+		return nil
+	})
+
+	assert.Equal(t, "application/x-protobuf", contentType)
+}
+
+func TestMemoryBroker_PassesAsyncHeadersToHandlers(t *testing.T) {
+	broker := NewMemoryBroker(1)
+	producer := broker.NewProducer(&config.KafkaProducer{})
+	defer producer.Close()
+
+	err := producer.ProduceAsync(t.Context(), "events", []byte("key"), []byte("value"), nil,
+		Header{Key: HeaderContentType, Value: []byte("application/x-protobuf")})
+	require.NoError(t, err)
+
+	var contentType string
+	consumeMemory(t, broker, "worker", "events", 1, func(ctx context.Context, _, _ []byte) error {
+		contentType = MessageHeader(ctx, HeaderContentType)
+		return nil
+	})
+
+	assert.Equal(t, "application/x-protobuf", contentType)
+}
+
+func TestMemoryBroker_DeadLettersFailingMessages(t *testing.T) {
+	broker := NewMemoryBroker(1)
+	producer := broker.NewProducer(&config.KafkaProducer{})
+	defer producer.Close()
+
+	for _, value := range []string{"poison", "ok"} {
+		_, err := producer.Produce(t.Context(), "events", nil, []byte(value))
+		require.NoError(t, err)
+	}
+
+	handled := consumeMemory(t, broker, "worker", "events", 1, func(_ context.Context, _, value []byte) error {
+		if string(value) == "poison" {
+			return NonRetryable(errors.New("cannot process"))
+		}
+		return nil
+	})
+	assert.Equal(t, []string{"ok"}, handled)
+
+	var failedTopic string
+	dead := consumeMemory(t, broker, "inspect", config.DeadLetterTopic("events"), 1, func(ctx context.Context, _, _ []byte) error {
+		failedTopic = MessageHeader(ctx, HeaderDLQOriginalTopic)
+		return nil
+	})
+	assert.Equal(t, []string{"poison"}, dead)
+	assert.Equal(t, "events", failedTopic)
+}
+
+func TestMemoryConsumer_ReadMessageTimesOut(t *testing.T) {
+	broker := NewMemoryBroker(1)
+	consumer := broker.NewConsumer(&config.KafkaConsumer{GroupID: "worker", OffsetReset: "earliest"})
+	defer consumer.Close()
+
+	require.NoError(t, consumer.client.SubscribeTopics([]string{"events"}, nil))
+
+	_, err := consumer.client.ReadMessage(10 * time.Millisecond)
+
+	var kafkaErr kafka.Error
+	require.ErrorAs(t, err, &kafkaErr)
+	assert.Equal(t, kafka.ErrTimedOut, kafkaErr.Code())
+}
@@ -0,0 +1,124 @@
+package kafka
+
+import (
+	"sync/atomic"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+)
+
+// offsetTracker tracks the messages of each partition that are being handled.
+// Messages are handled concurrently, so a message can finish before one read
+// earlier from its partition; a partition is only committed up to its oldest
+// unfinished message.
+type offsetTracker struct {
+	partitions map[topicPartition]*partitionOffsets
+}
+
+// partitionOffsets are the unfinished messages of a partition
+type partitionOffsets struct {
+	// Offsets not yet committed, in the order they were read, and the ones of
+	// those that have finished
+	pending  []kafka.Offset
+	finished map[kafka.Offset]bool
+
+	// Set when the partition is rewound to an earlier message. Messages read
+	// before that are skipped, they are read again.
+	rewound atomic.Bool
+}
+
+func newOffsetTracker() *offsetTracker {
+	return &offsetTracker{partitions: make(map[topicPartition]*partitionOffsets)}
+}
+
+// start records that message is being handled and returns its partition's offsets
+func (t *offsetTracker) start(message *kafka.Message) *partitionOffsets {
+	tp := topicPartition{topic: *message.TopicPartition.Topic, partition: message.TopicPartition.Partition}
+
+	offset := message.TopicPartition.Offset
+
+	offsets, ok := t.partitions[tp]
+	if ok && len(offsets.pending) > 0 && offset <= offsets.pending[len(offsets.pending)-1] {
+		// The partition is being read again from an earlier position (e.g. it was
+		// reassigned in a rebalance), messages read before are read again
+		offsets.rewound.Store(true)
+		ok = false
+	}
+	if !ok {
+		offsets = &partitionOffsets{finished: make(map[kafka.Offset]bool)}
+		t.partitions[tp] = offsets
+	}
+	offsets.pending = append(offsets.pending, offset)
+
+	return offsets
+}
+
+// finish records that message, started with offsets, has been handled. Returns
+// the position to commit if the partition's oldest unfinished message moved.
+func (t *offsetTracker) finish(message *kafka.Message, offsets *partitionOffsets) (kafka.TopicPartition, bool) {
+	if offsets.rewound.Load() {
+		return kafka.TopicPartition{}, false
+	}
+
+	offsets.finished[message.TopicPartition.Offset] = true
+
+	var committed kafka.Offset
+	for len(offsets.pending) > 0 && offsets.finished[offsets.pending[0]] {
+		committed = offsets.pending[0] + 1
+		delete(offsets.finished, offsets.pending[0])
+		offsets.pending = offsets.pending[1:]
+	}
+
+	if committed == 0 {
+		return kafka.TopicPartition{}, false
+	}
+
+	position := message.TopicPartition
+	position.Offset = committed
+
+	return position, true
+}
+
+// rewind forgets the partition of message, started with offsets, so its
+// unfinished messages are skipped, and returns the position of the oldest
+// unfinished one to read the partition from again. Returns false if the
+// partition was already rewound.
+func (t *offsetTracker) rewind(message *kafka.Message, offsets *partitionOffsets) (kafka.TopicPartition, bool) {
+	if !offsets.rewound.CompareAndSwap(false, true) {
+		return kafka.TopicPartition{}, false
+	}
+
+	tp := topicPartition{topic: *message.TopicPartition.Topic, partition: message.TopicPartition.Partition}
+	if t.partitions[tp] == offsets {
+		delete(t.partitions, tp)
+	}
+
+	// Messages read before the failed one may not have finished either
+	position := message.TopicPartition
+	position.Offset = offsets.pending[0]
+
+	return position, true
+}
+
+// pendingIn reports whether any message of partitions hasn't finished
+func (t *offsetTracker) pendingIn(partitions []kafka.TopicPartition) bool {
+	for _, partition := range partitions {
+		tp := topicPartition{topic: *partition.Topic, partition: partition.Partition}
+		if offsets, ok := t.partitions[tp]; ok && len(offsets.pending) > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// forget drops partitions that were revoked. Their unfinished messages are
+// skipped and aren't committed, the partitions' next owner reads them again.
+func (t *offsetTracker) forget(partitions []kafka.TopicPartition) {
+	for _, partition := range partitions {
+		tp := topicPartition{topic: *partition.Topic, partition: partition.Partition}
+		if offsets, ok := t.partitions[tp]; ok {
+			offsets.rewound.Store(true)
+			delete(t.partitions, tp)
+		}
+	}
+}
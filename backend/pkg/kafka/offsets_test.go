@@ -0,0 +1,108 @@
+package kafka
+
+import (
+	"testing"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func offsetMessage(partition int32, offset kafka.Offset) *kafka.Message {
+	topic := "trades"
+	return &kafka.Message{TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: partition, Offset: offset}}
+}
+
+func TestOffsetTracker_CommitsContiguousOffsets(t *testing.T) {
+	tracker := newOffsetTracker()
+
+	messages := []*kafka.Message{offsetMessage(0, 10), offsetMessage(0, 11), offsetMessage(0, 13), offsetMessage(1, 5)}
+	offsets := make([]*partitionOffsets, len(messages))
+	for i, message := range messages {
+		offsets[i] = tracker.start(message)
+	}
+
+	// Offset 10 hasn't finished, so nothing can be committed
+	_, ok := tracker.finish(messages[1], offsets[1])
+	assert.False(t, ok)
+
+	// Partitions are tracked separately
+	position, ok := tracker.finish(messages[3], offsets[3])
+	require.True(t, ok)
+	assert.Equal(t, int32(1), position.Partition)
+	assert.Equal(t, kafka.Offset(6), position.Offset)
+
+	// Commits past every finished message, skipping gaps in the offsets
+	position, ok = tracker.finish(messages[0], offsets[0])
+	require.True(t, ok)
+	assert.Equal(t, kafka.Offset(12), position.Offset)
+
+	position, ok = tracker.finish(messages[2], offsets[2])
+	require.True(t, ok)
+	assert.Equal(t, kafka.Offset(14), position.Offset)
+}
+
+func TestOffsetTracker_RewindsToOldestUnfinishedMessage(t *testing.T) {
+	tracker := newOffsetTracker()
+
+	first, second, third := offsetMessage(0, 1), offsetMessage(0, 2), offsetMessage(0, 3)
+	offsets := tracker.start(first)
+	tracker.start(second)
+	tracker.start(third)
+
+	_, ok := tracker.finish(second, offsets)
+	assert.False(t, ok)
+
+	// The third message failed while the first was still being handled
+	position, ok := tracker.rewind(third, offsets)
+	require.True(t, ok)
+	assert.Equal(t, kafka.Offset(1), position.Offset)
+	assert.True(t, offsets.rewound.Load())
+
+	// Results of messages read before the rewind are ignored
+	_, ok = tracker.rewind(first, offsets)
+	assert.False(t, ok)
+	_, ok = tracker.finish(first, offsets)
+	assert.False(t, ok)
+
+	// The partition is read again from the first message
+	reread := tracker.start(first)
+	assert.NotSame(t, offsets, reread)
+	position, ok = tracker.finish(first, reread)
+	require.True(t, ok)
+	assert.Equal(t, kafka.Offset(2), position.Offset)
+}
+
+func TestOffsetTracker_StartsOverWhenPartitionIsReadAgain(t *testing.T) {
+	tracker := newOffsetTracker()
+
+	offsets := tracker.start(offsetMessage(0, 7))
+	tracker.start(offsetMessage(0, 8))
+
+	// e.g. the partition was reassigned and is read from the last commit
+	reread := tracker.start(offsetMessage(0, 7))
+	assert.True(t, offsets.rewound.Load())
+
+	position, ok := tracker.finish(offsetMessage(0, 7), reread)
+	require.True(t, ok)
+	assert.Equal(t, kafka.Offset(8), position.Offset)
+}
+
+func TestOffsetTracker_ForgetsRevokedPartitions(t *testing.T) {
+	tracker := newOffsetTracker()
+
+	first := offsetMessage(0, 10)
+	offsets := tracker.start(first)
+	tracker.start(offsetMessage(1, 3))
+
+	partition := []kafka.TopicPartition{first.TopicPartition}
+	assert.True(t, tracker.pendingIn(partition))
+
+	tracker.forget(partition)
+	assert.False(t, tracker.pendingIn(partition))
+	assert.True(t, tracker.pendingIn([]kafka.TopicPartition{offsetMessage(1, 3).TopicPartition}))
+
+	// Messages of the revoked partition that finish afterwards aren't committed
+	_, ok := tracker.finish(first, offsets)
+	assert.False(t, ok)
+}
@@ -0,0 +1,120 @@
+package kafka
+
+import (
+	"context"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/murraystewart96/token-swap/internal/models"
+	"github.com/rs/zerolog/log"
+)
+
+// OffsetStore stores consumed offsets outside Kafka, in the database the
+// messages are written to, so a message's writes and its offset can be
+// committed in one transaction
+type OffsetStore interface {
+	GetConsumerOffsets(ctx context.Context, groupID string, topics []string) ([]*models.ConsumerOffset, error)
+	SetConsumerOffsets(ctx context.Context, offsets []*models.ConsumerOffset) error
+}
+
+type offsetsKey struct{}
+
+// offsetsToStore are the offsets after the messages being handled
+type offsetsToStore struct {
+	offsets []*models.ConsumerOffset
+	stored  bool
+}
+
+// OffsetsToStore returns the offsets to store for the messages being handled,
+// or nil if the consumer doesn't use an offset store. A handler that writes them
+// in the same transaction as the messages' data calls MarkOffsetsStored,
+// otherwise the consumer stores them once the handler succeeds.
+func OffsetsToStore(ctx context.Context) []*models.ConsumerOffset {
+	if toStore, ok := ctx.Value(offsetsKey{}).(*offsetsToStore); ok {
+		return toStore.offsets
+	}
+	return nil
+}
+
+// MarkOffsetsStored records that the handler stored the offsets returned by OffsetsToStore
+func MarkOffsetsStored(ctx context.Context) {
+	if toStore, ok := ctx.Value(offsetsKey{}).(*offsetsToStore); ok {
+		toStore.stored = true
+	}
+}
+
+// StoreOffsetsIn makes the consumer keep its offsets in store as well as
+// committing them to Kafka. Assigned partitions are read from the offsets in
+// store, and the messages of a partition are handled one at a time so its
+// stored offset only moves forward.
+func (c *Consumer) StoreOffsetsIn(store OffsetStore) {
+	c.offsetStore = store
+}
+
+// withOffsetsToStore makes the offsets after messages available to their
+// handler when the consumer uses an offset store
+func (c *Consumer) withOffsetsToStore(ctx context.Context, messages []*kafka.Message) (context.Context, *offsetsToStore) {
+	if c.offsetStore == nil {
+		return ctx, nil
+	}
+
+	positions := nextOffsets(messages)
+	toStore := &offsetsToStore{offsets: make([]*models.ConsumerOffset, len(positions))}
+	for i, position := range positions {
+		toStore.offsets[i] = &models.ConsumerOffset{
+			GroupID:   c.groupID,
+			Topic:     *position.Topic,
+			Partition: position.Partition,
+			Offset:    int64(position.Offset),
+		}
+	}
+
+	return context.WithValue(ctx, offsetsKey{}, toStore), toStore
+}
+
+// storeOffsetsOrLog stores the offsets the handler didn't store itself, e.g.
+// for a reorg or a message that was dead-lettered. Their writes, if any, are
+// idempotent, so if this fails they are just handled again after a restart.
+func (c *Consumer) storeOffsetsOrLog(ctx context.Context, toStore *offsetsToStore) {
+	if toStore == nil || toStore.stored {
+		return
+	}
+
+	if err := c.offsetStore.SetConsumerOffsets(ctx, toStore.offsets); err != nil {
+		log.Error().Err(err).Msg("failed to store consumer offsets")
+		return
+	}
+	toStore.stored = true
+}
+
+// storedPositions sets the offset of each partition that has one in the
+// offset store. Returns the partitions unchanged if the store can't be read.
+func (c *Consumer) storedPositions(ctx context.Context, partitions []kafka.TopicPartition) ([]kafka.TopicPartition, error) {
+	var topics []string
+	seen := make(map[string]bool)
+	for _, partition := range partitions {
+		if topic := *partition.Topic; !seen[topic] {
+			seen[topic] = true
+			topics = append(topics, topic)
+		}
+	}
+
+	stored, err := c.offsetStore.GetConsumerOffsets(ctx, c.groupID, topics)
+	if err != nil {
+		return partitions, err
+	}
+
+	offsets := make(map[topicPartition]kafka.Offset, len(stored))
+	for _, offset := range stored {
+		offsets[topicPartition{topic: offset.Topic, partition: offset.Partition}] = kafka.Offset(offset.Offset)
+	}
+
+	positions := make([]kafka.TopicPartition, len(partitions))
+	for i, partition := range partitions {
+		positions[i] = partition
+		if offset, ok := offsets[topicPartition{topic: *partition.Topic, partition: partition.Partition}]; ok {
+			positions[i].Offset = offset
+		}
+	}
+
+	return positions, nil
+}
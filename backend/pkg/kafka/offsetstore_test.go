@@ -0,0 +1,154 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/murraystewart96/token-swap/internal/config"
+	"github.com/murraystewart96/token-swap/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memoryOffsetStore is an OffsetStore that keeps offsets in memory
+type memoryOffsetStore struct {
+	mu      sync.Mutex
+	offsets map[topicPartition]int64
+	sets    int
+}
+
+func (s *memoryOffsetStore) GetConsumerOffsets(_ context.Context, groupID string, topics []string) ([]*models.ConsumerOffset, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var offsets []*models.ConsumerOffset
+	for tp, offset := range s.offsets {
+		offsets = append(offsets, &models.ConsumerOffset{GroupID: groupID, Topic: tp.topic, Partition: tp.partition, Offset: offset})
+	}
+	return offsets, nil
+}
+
+func (s *memoryOffsetStore) SetConsumerOffsets(_ context.Context, offsets []*models.ConsumerOffset) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sets++
+	for _, offset := range offsets {
+		s.offsets[topicPartition{topic: offset.Topic, partition: offset.Partition}] = offset.Offset
+	}
+	return nil
+}
+
+func (s *memoryOffsetStore) offset(topic string, partition int32) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.offsets[topicPartition{topic: topic, partition: partition}]
+}
+
+// consumeWithStore consumes topic with an offset store until want messages
+// have been handled, returning their values
+func consumeWithStore(t *testing.T, broker *MemoryBroker, store OffsetStore, topic string, want int, handler EventHandler) []string {
+	t.Helper()
+
+	consumer := broker.NewConsumer(&config.KafkaConsumer{GroupID: "worker", OffsetReset: "earliest", MaxAttempts: 1, Concurrency: 4})
+	defer consumer.Close()
+	consumer.StoreOffsetsIn(store)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	values := make(chan string, want)
+	go consumer.StartConsuming(ctx, EventHandlers{
+		topic: func(ctx context.Context, key, value []byte) error {
+			if err := handler(ctx, key, value); err != nil {
+				return err
+			}
+			values <- string(value)
+			return nil
+		},
+	})
+
+	var handled []string
+	for range want {
+		select {
+		case value := <-values:
+			handled = append(handled, value)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("consumed %d of %d messages", len(handled), want)
+		}
+	}
+	return handled
+}
+
+func TestConsumer_StartsFromStoredOffsets(t *testing.T) {
+	broker := NewMemoryBroker(1)
+	producer := broker.NewProducer(&config.KafkaProducer{})
+	defer producer.Close()
+
+	for i := range 5 {
+		_, err := producer.Produce(t.Context(), "events", nil, []byte(fmt.Sprint(i)))
+		require.NoError(t, err)
+	}
+
+	// Kafka has no committed offset, the store is ahead of it
+	store := &memoryOffsetStore{offsets: map[topicPartition]int64{{topic: "events", partition: 0}: 3}}
+
+	values := consumeWithStore(t, broker, store, "events", 2, func(context.Context, []byte, []byte) error { return nil })
+	assert.Equal(t, []string{"3", "4"}, values)
+
+	// The handler didn't store the offsets, so the consumer did
+	assert.Eventually(t, func() bool { return store.offset("events", 0) == 5 }, time.Second, 10*time.Millisecond)
+}
+
+func TestConsumer_HandlerStoresOffsets(t *testing.T) {
+	broker := NewMemoryBroker(2)
+	producer := broker.NewProducer(&config.KafkaProducer{})
+	defer producer.Close()
+
+	for i := range 4 {
+		_, err := producer.Produce(t.Context(), "events", []byte(fmt.Sprintf("pool-%d", i)), []byte(fmt.Sprint(i)))
+		require.NoError(t, err)
+	}
+
+	store := &memoryOffsetStore{offsets: make(map[topicPartition]int64)}
+
+	var mu sync.Mutex
+	var stored []*models.ConsumerOffset
+	consumeWithStore(t, broker, store, "events", 4, func(ctx context.Context, _, _ []byte) error {
+		offsets := OffsetsToStore(ctx)
+		if len(offsets) != 1 {
+			return fmt.Errorf("expected the offset of one message, got %d", len(offsets))
+		}
+
+		mu.Lock()
+		stored = append(stored, offsets[0])
+		mu.Unlock()
+
+		MarkOffsetsStored(ctx)
+		return nil
+	})
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	// Each offset is the position after its message, and the consumer doesn't store them again
+	for _, offset := range stored {
+		assert.Equal(t, "worker", offset.GroupID)
+		assert.Equal(t, "events", offset.Topic)
+		assert.Positive(t, offset.Offset)
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	assert.Zero(t, store.sets)
+}
+
+func TestOffsetsToStore_NilWithoutStore(t *testing.T) {
+	assert.Nil(t, OffsetsToStore(t.Context()))
+
+	// Harmless without a store
+	MarkOffsetsStored(t.Context())
+}
@@ -0,0 +1,119 @@
+package kafka
+
+import (
+	"strconv"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/rs/zerolog/log"
+)
+
+// Headers recording where on the chain a message's event was emitted, used to
+// check each key's messages are consumed in order
+const (
+	HeaderBlockNumber = "block.number"
+	HeaderLogIndex    = "log.index"
+)
+
+// Keys tracked before the ordering check starts over
+const maxOrderedKeys = 10000
+
+// orderingCheck tracks the partition, offset and chain position of the last
+// message consumed for each key. Kafka only orders messages within a
+// partition, so a key that moves between partitions (the producer changed how
+// it keys messages or the partition count changed) can be processed out of
+// order, and a key whose chain position goes backwards was produced out of
+// order.
+type orderingCheck struct {
+	keys map[string]keyPosition
+}
+
+type keyPosition struct {
+	partition   int32
+	offset      kafka.Offset
+	blockNumber uint64
+	logIndex    uint64
+	positioned  bool
+}
+
+func newOrderingCheck() *orderingCheck {
+	return &orderingCheck{keys: make(map[string]keyPosition)}
+}
+
+// observe records the message and warns if it breaks its key's ordering.
+// Returns false if it does. Messages read again after their partition is
+// rewound aren't reported, but events republished after a reorg are, as they
+// go back to the fork.
+func (o *orderingCheck) observe(message *kafka.Message) bool {
+	if len(message.Key) == 0 {
+		return true
+	}
+
+	topic := *message.TopicPartition.Topic
+	key := topic + "/" + string(message.Key)
+	current := keyPosition{
+		partition: message.TopicPartition.Partition,
+		offset:    message.TopicPartition.Offset,
+	}
+	current.blockNumber, current.logIndex, current.positioned = chainPosition(message)
+
+	previous, seen := o.keys[key]
+	if !seen && len(o.keys) >= maxOrderedKeys {
+		clear(o.keys)
+	}
+	o.keys[key] = current
+
+	if !seen {
+		return true
+	}
+
+	if previous.partition != current.partition {
+		log.Warn().Str("topic", topic).Bytes("key", message.Key).
+			Int32("previous_partition", previous.partition).Int32("partition", current.partition).
+			Msg("key moved to another partition, its messages may be processed out of order")
+		return false
+	}
+
+	// Read again after a rewind
+	if current.offset <= previous.offset {
+		return true
+	}
+
+	if previous.positioned && current.positioned && current.isBefore(previous) {
+		log.Warn().Str("topic", topic).Bytes("key", message.Key).Int32("partition", current.partition).
+			Uint64("previous_block_number", previous.blockNumber).Uint64("previous_log_index", previous.logIndex).
+			Uint64("block_number", current.blockNumber).Uint64("log_index", current.logIndex).
+			Msg("key's messages arrived out of order")
+		return false
+	}
+
+	return true
+}
+
+// isBefore reports whether p was emitted before other
+func (p keyPosition) isBefore(other keyPosition) bool {
+	if p.blockNumber != other.blockNumber {
+		return p.blockNumber < other.blockNumber
+	}
+	return p.logIndex < other.logIndex
+}
+
+// chainPosition returns the block number and log index in a message's headers.
+// Returns false if the message doesn't have them.
+func chainPosition(message *kafka.Message) (uint64, uint64, bool) {
+	var blockNumber, logIndex uint64
+	var foundBlock, foundLog bool
+
+	for _, header := range message.Headers {
+		var err error
+		switch header.Key {
+		case HeaderBlockNumber:
+			blockNumber, err = strconv.ParseUint(string(header.Value), 10, 64)
+			foundBlock = err == nil
+		case HeaderLogIndex:
+			logIndex, err = strconv.ParseUint(string(header.Value), 10, 64)
+			foundLog = err == nil
+		}
+	}
+
+	return blockNumber, logIndex, foundBlock && foundLog
+}
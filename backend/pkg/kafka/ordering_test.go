@@ -0,0 +1,98 @@
+package kafka
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOrderingCheck(t *testing.T) {
+	message := func(topic, key string, partition int32) *kafka.Message {
+		return &kafka.Message{
+			TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: partition},
+			Key:            []byte(key),
+		}
+	}
+	// positioned returns a message at an offset of partition 0 with the chain
+	// position of its event in its headers
+	positioned := func(key string, offset kafka.Offset, blockNumber uint64, logIndex uint) *kafka.Message {
+		topic := "trades"
+		return &kafka.Message{
+			TopicPartition: kafka.TopicPartition{Topic: &topic, Offset: offset},
+			Key:            []byte(key),
+			Headers: []kafka.Header{
+				{Key: HeaderBlockNumber, Value: []byte(strconv.FormatUint(blockNumber, 10))},
+				{Key: HeaderLogIndex, Value: []byte(strconv.FormatUint(uint64(logIndex), 10))},
+			},
+		}
+	}
+
+	tests := []struct {
+		name     string
+		messages []*kafka.Message
+		expected []bool
+	}{
+		{
+			name:     "same key on the same partition",
+			messages: []*kafka.Message{message("trades", "pool1", 0), message("trades", "pool1", 0)},
+			expected: []bool{true, true},
+		},
+		{
+			name:     "key moved to another partition",
+			messages: []*kafka.Message{message("trades", "pool1", 0), message("trades", "pool1", 3)},
+			expected: []bool{true, false},
+		},
+		{
+			name:     "keys are tracked per topic",
+			messages: []*kafka.Message{message("trades", "pool1", 0), message("reserves", "pool1", 2)},
+			expected: []bool{true, true},
+		},
+		{
+			name:     "key's events in chain order",
+			messages: []*kafka.Message{positioned("pool1", 0, 10, 2), positioned("pool1", 1, 10, 3), positioned("pool1", 2, 11, 0)},
+			expected: []bool{true, true, true},
+		},
+		{
+			name:     "key's event from an earlier block",
+			messages: []*kafka.Message{positioned("pool1", 0, 11, 0), positioned("pool1", 1, 10, 5)},
+			expected: []bool{true, false},
+		},
+		{
+			name:     "key's event from earlier in the same block",
+			messages: []*kafka.Message{positioned("pool1", 0, 10, 3), positioned("pool1", 1, 10, 2)},
+			expected: []bool{true, false},
+		},
+		{
+			name:     "positions are tracked per key",
+			messages: []*kafka.Message{positioned("pool1", 0, 11, 0), positioned("pool2", 1, 10, 0)},
+			expected: []bool{true, true},
+		},
+		{
+			name:     "messages read again after a rewind",
+			messages: []*kafka.Message{positioned("pool1", 0, 10, 0), positioned("pool1", 1, 11, 0), positioned("pool1", 0, 10, 0)},
+			expected: []bool{true, true, true},
+		},
+		{
+			name:     "messages without a position only checked for partition changes",
+			messages: []*kafka.Message{message("trades", "pool1", 0), positioned("pool1", 1, 10, 0)},
+			expected: []bool{true, true},
+		},
+		{
+			name:     "messages without a key aren't ordered",
+			messages: []*kafka.Message{message("trades", "", 0), message("trades", "", 1)},
+			expected: []bool{true, true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			check := newOrderingCheck()
+
+			for i, message := range tt.messages {
+				assert.Equal(t, tt.expected[i], check.observe(message))
+			}
+		})
+	}
+}
@@ -3,52 +3,201 @@ package kafka
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"github.com/confluentinc/confluent-kafka-go/kafka"
 	"github.com/murraystewart96/token-swap/internal/config"
 	"github.com/murraystewart96/token-swap/pkg/tracing"
+	"github.com/rs/zerolog/log"
 	"go.opentelemetry.io/otel/propagation"
 )
 
+const defaultFlushTimeout = 10 * time.Second
+
 type IProducer interface {
-	Produce(ctx context.Context, topic string, key, value []byte) error
+	// Produce publishes a message and waits until the broker acknowledges it
+	Produce(ctx context.Context, topic string, key, value []byte, headers ...Header) (*Delivery, error)
+	// ProduceAsync queues a message, onDelivery is called with its delivery report
+	ProduceAsync(ctx context.Context, topic string, key, value []byte, onDelivery DeliveryCallback, headers ...Header) error
+	// Flush waits up to timeout for queued messages and returns how many are still undelivered
+	Flush(timeout time.Duration) int
 	Close() error
 }
 
+// Header is a message header
+type Header = kafka.Header
+
+// Delivery is where an acknowledged message was written
+type Delivery struct {
+	Topic     string
+	Partition int32
+	Offset    int64
+	Key       []byte
+
+	// Entry ID when publishing to Redis Streams, which has no partitions or offsets
+	StreamID string
+}
+
+// DeliveryCallback receives the delivery report of an asynchronously produced message
+type DeliveryCallback func(delivery *Delivery, err error)
+
+// producerClient is the part of the Kafka producer API the Producer uses. It is
+// implemented by *kafka.Producer and by MemoryBroker's producers.
+type producerClient interface {
+	Produce(message *kafka.Message, deliveryChan chan kafka.Event) error
+	Events() chan kafka.Event
+	Flush(timeoutMs int) int
+	Close()
+}
+
 type Producer struct {
-	client *kafka.Producer
+	client       producerClient
+	flushTimeout time.Duration
 }
 
 func NewProducer(cfg *config.KafkaProducer) (*Producer, error) {
-	client, err := kafka.NewProducer(&kafka.ConfigMap{
+	configMap := &kafka.ConfigMap{
 		"bootstrap.servers": cfg.BootstrapServers,
 		"acks":              cfg.Acks,
-	})
+	}
+
+	// Batch messages for up to linger before sending (async mode)
+	if cfg.Linger > 0 {
+		_ = configMap.SetKey("linger.ms", int(cfg.Linger.Milliseconds()))
+	}
+
+	client, err := kafka.NewProducer(configMap)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to create producer: %w", err)
 	}
 
-	return &Producer{
-		client: client,
-	}, nil
+	return newProducer(client, cfg), nil
+}
+
+func newProducer(client producerClient, cfg *config.KafkaProducer) *Producer {
+	flushTimeout := cfg.FlushTimeout
+	if flushTimeout <= 0 {
+		flushTimeout = defaultFlushTimeout
+	}
+
+	p := &Producer{
+		client:       client,
+		flushTimeout: flushTimeout,
+	}
+
+	go p.handleEvents()
+
+	return p
 }
 
-func (p *Producer) Produce(ctx context.Context, topic string, key, value []byte) error {
+func (p *Producer) Produce(ctx context.Context, topic string, key, value []byte, headers ...Header) (*Delivery, error) {
 	// Start a span for Kafka produce operation
 	ctx, span := tracing.StartSpan(ctx, "kafka.produce")
 	defer span.End()
 
-	// Add span attributes
+	delivery, err := p.produceMessage(ctx, newMessage(ctx, topic, key, value, headers))
+	if err != nil {
+		return nil, err
+	}
+
+	// Partition and offset are only known once delivered
+	span.SetAttributes(
+		tracing.KafkaAttributes(delivery.Topic, delivery.Partition, delivery.Offset)...,
+	)
+
+	return delivery, nil
+}
+
+// produceMessage publishes a message and waits for its delivery report
+func (p *Producer) produceMessage(ctx context.Context, message *kafka.Message) (*Delivery, error) {
+	deliveryChan := make(chan kafka.Event, 1)
+
+	err := p.client.Produce(message, deliveryChan)
+	if err != nil {
+		return nil, fmt.Errorf("failed to produce event: %w", err)
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, fmt.Errorf("delivery of event not confirmed: %w", ctx.Err())
+	case e := <-deliveryChan:
+		message := e.(*kafka.Message)
+		if message.TopicPartition.Error != nil {
+			return nil, fmt.Errorf("failed to deliver event: %w", message.TopicPartition.Error)
+		}
+
+		return deliveryFromMessage(message), nil
+	}
+}
+
+func (p *Producer) ProduceAsync(ctx context.Context, topic string, key, value []byte, onDelivery DeliveryCallback, headers ...Header) error {
+	ctx, span := tracing.StartSpan(ctx, "kafka.produce_async")
+	defer span.End()
+
 	span.SetAttributes(
 		tracing.KafkaAttributes(topic, 0, -1)..., // partition and offset unknown at produce time
 	)
 
-	// Create headers for trace propagation
-	headers := []kafka.Header{}
+	message := newMessage(ctx, topic, key, value, headers)
+	message.Opaque = onDelivery
+
+	// Delivery reports for messages without a delivery channel go to Events()
+	if err := p.client.Produce(message, nil); err != nil {
+		return fmt.Errorf("failed to produce event: %w", err)
+	}
+
+	return nil
+}
+
+func (p *Producer) Flush(timeout time.Duration) int {
+	return p.client.Flush(int(timeout.Milliseconds()))
+}
+
+// Close waits up to the flush timeout for queued messages to be delivered
+// before closing the producer.
+func (p *Producer) Close() error {
+	remaining := p.Flush(p.flushTimeout)
+	p.client.Close()
+
+	if remaining > 0 {
+		return fmt.Errorf("%d messages were not delivered before the producer closed", remaining)
+	}
+
+	return nil
+}
+
+// handleEvents dispatches delivery reports of async messages to their callbacks
+func (p *Producer) handleEvents() {
+	for e := range p.client.Events() {
+		switch ev := e.(type) {
+		case *kafka.Message:
+			onDelivery, _ := ev.Opaque.(DeliveryCallback)
+			if onDelivery == nil {
+				if ev.TopicPartition.Error != nil {
+					log.Error().Err(ev.TopicPartition.Error).Msg("failed to deliver event")
+				}
+				continue
+			}
+
+			if ev.TopicPartition.Error != nil {
+				onDelivery(nil, ev.TopicPartition.Error)
+			} else {
+				onDelivery(deliveryFromMessage(ev), nil)
+			}
+
+		case kafka.Error:
+			log.Error().Err(ev).Msg("kafka producer error")
+		}
+	}
+}
+
+func newMessage(ctx context.Context, topic string, key, value []byte, headers []kafka.Header) *kafka.Message {
+	// Add headers for trace propagation
+	headers = append([]kafka.Header{}, headers...)
 	propagator := propagation.TraceContext{}
 	propagator.Inject(ctx, NewHeaderCarrier(&headers))
 
-	err := p.client.Produce(&kafka.Message{
+	return &kafka.Message{
 		TopicPartition: kafka.TopicPartition{
 			Topic:     &topic,
 			Partition: kafka.PartitionAny,
@@ -56,15 +205,14 @@ func (p *Producer) Produce(ctx context.Context, topic string, key, value []byte)
 		Key:     key,
 		Value:   value,
 		Headers: headers,
-	}, nil)
-	if err != nil {
-		return fmt.Errorf("failed to produce event: %w", err)
 	}
-
-	return nil
 }
 
-func (p *Producer) Close() error {
-	p.client.Close()
-	return nil
+func deliveryFromMessage(message *kafka.Message) *Delivery {
+	return &Delivery{
+		Topic:     *message.TopicPartition.Topic,
+		Partition: message.TopicPartition.Partition,
+		Offset:    int64(message.TopicPartition.Offset),
+		Key:       message.Key,
+	}
 }
@@ -0,0 +1,110 @@
+package kafka
+
+import (
+	"testing"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/murraystewart96/token-swap/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Creates a producer connected to an in-process mock Kafka cluster
+func newTestProducer(t *testing.T) *Producer {
+	t.Helper()
+
+	cluster, err := kafka.NewMockCluster(1)
+	require.NoError(t, err)
+	t.Cleanup(cluster.Close)
+
+	producer, err := NewProducer(&config.KafkaProducer{
+		BootstrapServers: cluster.BootstrapServers(),
+		Acks:             "all",
+		FlushTimeout:     5 * time.Second,
+	})
+	require.NoError(t, err)
+
+	return producer
+}
+
+func TestProducer_ProduceWaitsForDelivery(t *testing.T) {
+	producer := newTestProducer(t)
+	defer producer.Close()
+
+	first, err := producer.Produce(t.Context(), "test-topic", []byte("key"), []byte("first"))
+	require.NoError(t, err)
+
+	second, err := producer.Produce(t.Context(), "test-topic", []byte("key"), []byte("second"))
+	require.NoError(t, err)
+
+	assert.Equal(t, "test-topic", second.Topic)
+	assert.Equal(t, []byte("key"), second.Key)
+	assert.Equal(t, first.Partition, second.Partition, "same key should go to the same partition")
+	assert.Equal(t, first.Offset+1, second.Offset)
+}
+
+func TestProducer_ProduceAsyncReportsDelivery(t *testing.T) {
+	producer := newTestProducer(t)
+	defer producer.Close()
+
+	deliveries := make(chan *Delivery, 3)
+	for range 3 {
+		err := producer.ProduceAsync(t.Context(), "test-topic", []byte("key"), []byte("value"), func(delivery *Delivery, err error) {
+			assert.NoError(t, err)
+			deliveries <- delivery
+		})
+		require.NoError(t, err)
+	}
+
+	assert.Zero(t, producer.Flush(5*time.Second))
+
+	for range 3 {
+		select {
+		case delivery := <-deliveries:
+			assert.Equal(t, "test-topic", delivery.Topic)
+			assert.GreaterOrEqual(t, delivery.Offset, int64(0))
+		case <-time.After(5 * time.Second):
+			t.Fatal("delivery report not received")
+		}
+	}
+}
+
+func TestProducer_CloseFlushesQueuedMessages(t *testing.T) {
+	producer := newTestProducer(t)
+
+	delivered := make(chan struct{}, 1)
+	err := producer.ProduceAsync(t.Context(), "test-topic", nil, []byte("value"), func(_ *Delivery, err error) {
+		if err == nil {
+			delivered <- struct{}{}
+		}
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, producer.Close())
+
+	select {
+	case <-delivered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("queued message was not delivered on close")
+	}
+}
+
+// unsupportedClient is a producer client that is neither Kafka nor the in-memory broker
+type unsupportedClient struct {
+	events chan kafka.Event
+}
+
+func (c *unsupportedClient) Produce(*kafka.Message, chan kafka.Event) error { return nil }
+func (c *unsupportedClient) Events() chan kafka.Event                       { return c.events }
+func (c *unsupportedClient) Flush(int) int                                  { return 0 }
+func (c *unsupportedClient) Close()                                         { close(c.events) }
+
+func TestProducer_EnsureTopicsUnsupportedClient(t *testing.T) {
+	producer := newProducer(&unsupportedClient{events: make(chan kafka.Event)}, &config.KafkaProducer{})
+	defer producer.Close()
+
+	err := producer.EnsureTopics(t.Context(), []string{"test-topic"}, 3, 1)
+
+	assert.ErrorContains(t, err, "unsupported producer client")
+}
@@ -0,0 +1,348 @@
+package kafka
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// ProtobufCodec encodes structs in the Protobuf wire format without generated
+// code. Each encoded field carries its field number in a `protobuf:"N"` struct
+// tag, fields without one are skipped. The supported field types are string,
+// []byte, signed and unsigned integers, bool, []string and time.Time (as a
+// google.protobuf.Timestamp). Like proto3, zero values aren't written and
+// unknown fields are ignored when decoding.
+type ProtobufCodec struct{}
+
+func (ProtobufCodec) Name() string        { return CodecProtobuf }
+func (ProtobufCodec) ContentType() string { return "application/x-protobuf" }
+
+// Protobuf type of a struct field, as written in a .proto file
+type protoType string
+
+const (
+	protoString         protoType = "string"
+	protoBytes          protoType = "bytes"
+	protoRepeatedString protoType = "repeated string"
+	protoUint64         protoType = "uint64"
+	protoUint32         protoType = "uint32"
+	protoInt64          protoType = "int64"
+	protoInt32          protoType = "int32"
+	protoBool           protoType = "bool"
+	protoTimestamp      protoType = "google.protobuf.Timestamp"
+)
+
+func (t protoType) wireType() protowire.Type {
+	switch t {
+	case protoUint64, protoUint32, protoInt64, protoInt32, protoBool:
+		return protowire.VarintType
+	default:
+		return protowire.BytesType
+	}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// protoField is a struct field encoded by the Protobuf codec
+type protoField struct {
+	index  int
+	number protowire.Number
+	name   string // JSON name, so schemas read the same for both codecs
+	typ    protoType
+}
+
+type protoMessage struct {
+	fields   []protoField
+	byNumber map[protowire.Number]protoField
+}
+
+// Parsed struct tags, by struct type
+var protoMessages sync.Map
+
+func protoMessageOf(t reflect.Type) (*protoMessage, error) {
+	if cached, ok := protoMessages.Load(t); ok {
+		return cached.(*protoMessage), nil
+	}
+
+	if t.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("protobuf: %s is not a struct", t)
+	}
+
+	message := &protoMessage{byNumber: make(map[protowire.Number]protoField)}
+	for i := range t.NumField() {
+		structField := t.Field(i)
+
+		tag := structField.Tag.Get("protobuf")
+		if tag == "" || !structField.IsExported() {
+			continue
+		}
+
+		var number int
+		if _, err := fmt.Sscanf(tag, "%d", &number); err != nil || !protowire.Number(number).IsValid() {
+			return nil, fmt.Errorf("protobuf: invalid field number %q on %s.%s", tag, t, structField.Name)
+		}
+
+		typ, err := protoTypeOf(structField.Type)
+		if err != nil {
+			return nil, fmt.Errorf("protobuf: %s.%s: %w", t, structField.Name, err)
+		}
+
+		field := protoField{
+			index:  i,
+			number: protowire.Number(number),
+			name:   jsonName(structField),
+			typ:    typ,
+		}
+		if _, ok := message.byNumber[field.number]; ok {
+			return nil, fmt.Errorf("protobuf: field number %d is used twice on %s", number, t)
+		}
+
+		message.fields = append(message.fields, field)
+		message.byNumber[field.number] = field
+	}
+
+	protoMessages.Store(t, message)
+
+	return message, nil
+}
+
+func protoTypeOf(t reflect.Type) (protoType, error) {
+	if t == timeType {
+		return protoTimestamp, nil
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return protoString, nil
+	case reflect.Slice:
+		switch t.Elem().Kind() {
+		case reflect.Uint8:
+			return protoBytes, nil
+		case reflect.String:
+			return protoRepeatedString, nil
+		}
+	case reflect.Uint, reflect.Uint64:
+		return protoUint64, nil
+	case reflect.Uint32, reflect.Uint16, reflect.Uint8:
+		return protoUint32, nil
+	case reflect.Int, reflect.Int64:
+		return protoInt64, nil
+	case reflect.Int32, reflect.Int16, reflect.Int8:
+		return protoInt32, nil
+	case reflect.Bool:
+		return protoBool, nil
+	}
+
+	return "", fmt.Errorf("unsupported type %s", t)
+}
+
+func jsonName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	if name == "" || name == "-" {
+		return field.Name
+	}
+	return name
+}
+
+func (ProtobufCodec) Marshal(v any) ([]byte, error) {
+	value := reflect.Indirect(reflect.ValueOf(v))
+	if !value.IsValid() {
+		return nil, fmt.Errorf("protobuf: cannot marshal %T", v)
+	}
+
+	message, err := protoMessageOf(value.Type())
+	if err != nil {
+		return nil, err
+	}
+
+	var b []byte
+	for _, field := range message.fields {
+		b = appendProtoField(b, field, value.Field(field.index))
+	}
+
+	return b, nil
+}
+
+func appendProtoField(b []byte, field protoField, value reflect.Value) []byte {
+	switch field.typ {
+	case protoString:
+		if s := value.String(); s != "" {
+			b = protowire.AppendTag(b, field.number, protowire.BytesType)
+			b = protowire.AppendString(b, s)
+		}
+	case protoBytes:
+		if value.Len() > 0 {
+			b = protowire.AppendTag(b, field.number, protowire.BytesType)
+			b = protowire.AppendBytes(b, value.Bytes())
+		}
+	case protoRepeatedString:
+		for i := range value.Len() {
+			b = protowire.AppendTag(b, field.number, protowire.BytesType)
+			b = protowire.AppendString(b, value.Index(i).String())
+		}
+	case protoUint64, protoUint32:
+		if u := value.Uint(); u != 0 {
+			b = protowire.AppendTag(b, field.number, protowire.VarintType)
+			b = protowire.AppendVarint(b, u)
+		}
+	case protoInt64, protoInt32:
+		if i := value.Int(); i != 0 {
+			b = protowire.AppendTag(b, field.number, protowire.VarintType)
+			b = protowire.AppendVarint(b, uint64(i))
+		}
+	case protoBool:
+		if value.Bool() {
+			b = protowire.AppendTag(b, field.number, protowire.VarintType)
+			b = protowire.AppendVarint(b, 1)
+		}
+	case protoTimestamp:
+		if t := value.Interface().(time.Time); !t.IsZero() {
+			b = protowire.AppendTag(b, field.number, protowire.BytesType)
+			b = protowire.AppendBytes(b, appendTimestamp(nil, t))
+		}
+	}
+
+	return b
+}
+
+// appendTimestamp encodes t as a google.protobuf.Timestamp message
+func appendTimestamp(b []byte, t time.Time) []byte {
+	if seconds := t.Unix(); seconds != 0 {
+		b = protowire.AppendTag(b, 1, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(seconds))
+	}
+	if nanos := t.Nanosecond(); nanos != 0 {
+		b = protowire.AppendTag(b, 2, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(nanos))
+	}
+	return b
+}
+
+func (ProtobufCodec) Unmarshal(data []byte, v any) error {
+	ptr := reflect.ValueOf(v)
+	if ptr.Kind() != reflect.Pointer || ptr.IsNil() {
+		return fmt.Errorf("protobuf: cannot unmarshal into %T", v)
+	}
+	value := ptr.Elem()
+
+	message, err := protoMessageOf(value.Type())
+	if err != nil {
+		return err
+	}
+
+	value.SetZero()
+
+	for len(data) > 0 {
+		number, wireType, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return fmt.Errorf("protobuf: %w", protowire.ParseError(n))
+		}
+		data = data[n:]
+
+		// Skip fields this version of the struct doesn't know about
+		field, ok := message.byNumber[number]
+		if !ok || wireType != field.typ.wireType() {
+			n = protowire.ConsumeFieldValue(number, wireType, data)
+		} else {
+			n, err = consumeProtoField(data, field, value.Field(field.index))
+			if err != nil {
+				return fmt.Errorf("protobuf: field %s: %w", field.name, err)
+			}
+		}
+		if n < 0 {
+			return fmt.Errorf("protobuf: %w", protowire.ParseError(n))
+		}
+		data = data[n:]
+	}
+
+	return nil
+}
+
+// consumeProtoField decodes the value of field from data into value and returns
+// the number of bytes read, or a negative protowire error code
+func consumeProtoField(data []byte, field protoField, value reflect.Value) (int, error) {
+	if field.typ.wireType() == protowire.VarintType {
+		u, n := protowire.ConsumeVarint(data)
+		if n < 0 {
+			return n, nil
+		}
+
+		switch field.typ {
+		case protoUint64, protoUint32:
+			if value.OverflowUint(u) {
+				return 0, fmt.Errorf("value %d overflows %s", u, value.Type())
+			}
+			value.SetUint(u)
+		case protoInt64, protoInt32:
+			if value.OverflowInt(int64(u)) {
+				return 0, fmt.Errorf("value %d overflows %s", int64(u), value.Type())
+			}
+			value.SetInt(int64(u))
+		case protoBool:
+			value.SetBool(u != 0)
+		}
+		return n, nil
+	}
+
+	b, n := protowire.ConsumeBytes(data)
+	if n < 0 {
+		return n, nil
+	}
+
+	switch field.typ {
+	case protoString:
+		value.SetString(string(b))
+	case protoBytes:
+		value.SetBytes(append([]byte(nil), b...))
+	case protoRepeatedString:
+		value.Set(reflect.Append(value, reflect.ValueOf(string(b)).Convert(value.Type().Elem())))
+	case protoTimestamp:
+		t, err := consumeTimestamp(b)
+		if err != nil {
+			return 0, err
+		}
+		value.Set(reflect.ValueOf(t))
+	}
+
+	return n, nil
+}
+
+// consumeTimestamp decodes a google.protobuf.Timestamp message
+func consumeTimestamp(b []byte) (time.Time, error) {
+	var seconds, nanos int64
+
+	for len(b) > 0 {
+		number, wireType, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return time.Time{}, protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		if wireType != protowire.VarintType || (number != 1 && number != 2) {
+			n = protowire.ConsumeFieldValue(number, wireType, b)
+		} else {
+			var u uint64
+			u, n = protowire.ConsumeVarint(b)
+			if number == 1 {
+				seconds = int64(u)
+			} else {
+				nanos = int64(u)
+			}
+		}
+		if n < 0 {
+			return time.Time{}, protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+
+	if nanos < 0 || nanos >= int64(time.Second) {
+		return time.Time{}, errors.New("timestamp nanos out of range")
+	}
+
+	return time.Unix(seconds, nanos).UTC(), nil
+}
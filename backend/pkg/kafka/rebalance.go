@@ -0,0 +1,45 @@
+package kafka
+
+import (
+	"context"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/rs/zerolog/log"
+)
+
+// onRebalance is called from ReadMessage when the group's partitions are
+// reassigned. Before revoked partitions are given up, the messages of theirs
+// being handled are finished and committed, so their next owner doesn't handle
+// them again. Newly assigned partitions start from the offsets in the offset
+// store, if there is one, or else from the offsets committed to Kafka.
+func (c *Consumer) onRebalance(_ *kafka.Consumer, event kafka.Event) error {
+	switch e := event.(type) {
+	case kafka.AssignedPartitions:
+		log.Info().Int("partitions", len(e.Partitions)).Msg("partitions assigned")
+
+		if c.offsetStore == nil {
+			// The client assigns the partitions itself
+			return nil
+		}
+
+		// Rebalances aren't part of a message's trace
+		partitions, err := c.storedPositions(context.Background(), e.Partitions)
+		if err != nil {
+			// Partitions still start from the offsets committed to Kafka
+			log.Error().Err(err).Msg("failed to read stored consumer offsets")
+		}
+
+		return c.client.Assign(partitions)
+
+	case kafka.RevokedPartitions:
+		log.Info().Int("partitions", len(e.Partitions)).Msg("partitions revoked")
+
+		if c.revoke != nil {
+			c.revoke(e.Partitions)
+		}
+
+		return c.client.Unassign()
+	}
+
+	return nil
+}
@@ -0,0 +1,585 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/murraystewart96/token-swap/internal/config"
+	"github.com/murraystewart96/token-swap/pkg/tracing"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// Redis Streams transport. Each topic is a stream whose entries hold the
+// message's key, value and headers as fields. Consumers read through a consumer
+// group and acknowledge (XACK) an entry once it is handled or dead-lettered,
+// which is what committing its offset is on Kafka. Entries read by a consumer
+// that stopped before acknowledging them are handled again when it restarts
+// under the same name, or claimed by another consumer of the group once they
+// have been idle for ClaimMinIdle.
+//
+// Streams have no partitions, so with several consumers in a group the events
+// of a pool can be handled out of order.
+
+const (
+	streamFieldKey     = "key"
+	streamFieldValue   = "value"
+	streamHeaderPrefix = "header:"
+
+	defaultClaimMinIdle = time.Minute
+
+	// How long a read waits for new entries, and how many it returns
+	streamPollTimeout = 300 * time.Millisecond
+	streamReadCount   = 100
+)
+
+// RedisStreamProducer publishes messages to Redis Streams
+type RedisStreamProducer struct {
+	client *redis.Client
+	maxLen int64
+}
+
+func NewRedisStreamProducer(redisCfg *config.Redis, cfg *config.KafkaProducer) *RedisStreamProducer {
+	return &RedisStreamProducer{
+		client: newRedisClient(redisCfg),
+		maxLen: cfg.StreamMaxLen,
+	}
+}
+
+func newRedisClient(cfg *config.Redis) *redis.Client {
+	return redis.NewClient(&redis.Options{
+		Addr: cfg.Addr,
+	})
+}
+
+func (p *RedisStreamProducer) Produce(ctx context.Context, topic string, key, value []byte, headers ...Header) (*Delivery, error) {
+	ctx, span := tracing.StartSpan(ctx, "redis.produce")
+	defer span.End()
+
+	delivery, err := p.add(ctx, newMessage(ctx, topic, key, value, headers))
+	if err != nil {
+		return nil, err
+	}
+
+	span.SetAttributes(tracing.RedisStreamAttributes(delivery.Topic, delivery.StreamID)...)
+
+	return delivery, nil
+}
+
+// ProduceAsync adds the message before returning, since XADD is a single round
+// trip, so messages produced one after another keep their order
+func (p *RedisStreamProducer) ProduceAsync(ctx context.Context, topic string, key, value []byte, onDelivery DeliveryCallback, headers ...Header) error {
+	ctx, span := tracing.StartSpan(ctx, "redis.produce_async")
+	defer span.End()
+
+	delivery, err := p.add(ctx, newMessage(ctx, topic, key, value, headers))
+	if onDelivery != nil {
+		onDelivery(delivery, err)
+	} else if err != nil {
+		log.Error().Err(err).Msg("failed to deliver event")
+	}
+
+	return nil
+}
+
+// add appends message to the stream named after its topic
+func (p *RedisStreamProducer) add(ctx context.Context, message *kafka.Message) (*Delivery, error) {
+	topic := *message.TopicPartition.Topic
+
+	id, err := p.client.XAdd(ctx, &redis.XAddArgs{
+		Stream: topic,
+		MaxLen: p.maxLen,
+		Approx: true,
+		Values: streamValues(message.Key, message.Value, message.Headers),
+	}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to add event to stream %s: %w", topic, err)
+	}
+
+	return &Delivery{
+		Topic:    topic,
+		Offset:   int64(kafka.OffsetInvalid),
+		Key:      message.Key,
+		StreamID: id,
+	}, nil
+}
+
+// Flush returns straight away, messages are added before Produce and ProduceAsync return
+func (p *RedisStreamProducer) Flush(time.Duration) int {
+	return 0
+}
+
+func (p *RedisStreamProducer) Close() error {
+	return p.client.Close()
+}
+
+// streamValues returns the fields of a stream entry holding a message
+func streamValues(key, value []byte, headers []kafka.Header) []any {
+	values := []any{streamFieldKey, string(key), streamFieldValue, string(value)}
+	for _, header := range headers {
+		values = append(values, streamHeaderPrefix+header.Key, string(header.Value))
+	}
+
+	return values
+}
+
+// streamMessage is a message read from a stream
+type streamMessage struct {
+	stream  string
+	id      string
+	key     []byte
+	value   []byte
+	headers []kafka.Header
+}
+
+// parseStreamMessage reads a message from the fields of a stream entry. Returns
+// nil if the entry was deleted after it was read.
+func parseStreamMessage(stream string, entry redis.XMessage) *streamMessage {
+	if entry.Values == nil {
+		return nil
+	}
+
+	message := &streamMessage{stream: stream, id: entry.ID}
+	for field, value := range entry.Values {
+		value, _ := value.(string)
+
+		switch {
+		case field == streamFieldKey:
+			if value != "" {
+				message.key = []byte(value)
+			}
+		case field == streamFieldValue:
+			message.value = []byte(value)
+		case strings.HasPrefix(field, streamHeaderPrefix):
+			message.headers = append(message.headers, kafka.Header{
+				Key:   strings.TrimPrefix(field, streamHeaderPrefix),
+				Value: []byte(value),
+			})
+		}
+	}
+
+	// Fields come back as a map, keep headers in a stable order
+	sort.Slice(message.headers, func(i, j int) bool {
+		return message.headers[i].Key < message.headers[j].Key
+	})
+
+	return message
+}
+
+// RedisStreamConsumer consumes Redis Streams through a consumer group
+type RedisStreamConsumer struct {
+	client *redis.Client
+	group  string
+	name   string
+
+	// Where a new consumer group starts reading a stream, "0" for the first entry or "$" for new entries only
+	startID string
+
+	// Entries other consumers left unacknowledged for this long are claimed
+	claimMinIdle time.Duration
+
+	// Publishes messages that keep failing to their dead-letter stream
+	deadLetters *RedisStreamProducer
+
+	handlerSettings
+}
+
+func NewRedisStreamConsumer(redisCfg *config.Redis, cfg *config.KafkaConsumer) *RedisStreamConsumer {
+	client := newRedisClient(redisCfg)
+
+	name := cfg.ConsumerName
+	if name == "" {
+		name = defaultConsumerName()
+	}
+
+	startID := "$"
+	if cfg.OffsetReset == "earliest" {
+		startID = "0"
+	}
+
+	claimMinIdle := cfg.ClaimMinIdle
+	if claimMinIdle <= 0 {
+		claimMinIdle = defaultClaimMinIdle
+	}
+
+	return &RedisStreamConsumer{
+		client:          client,
+		group:           cfg.GroupID,
+		name:            name,
+		startID:         startID,
+		claimMinIdle:    claimMinIdle,
+		deadLetters:     &RedisStreamProducer{client: client},
+		handlerSettings: newHandlerSettings(cfg),
+	}
+}
+
+// defaultConsumerName identifies the consumer by its host, which stays the same
+// across restarts of a container
+func defaultConsumerName() string {
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		return hostname
+	}
+
+	return fmt.Sprintf("consumer-%d", os.Getpid())
+}
+
+func (c *RedisStreamConsumer) StartConsuming(ctx context.Context, topicHandlers EventHandlers) error {
+	topics := make([]string, 0, len(topicHandlers))
+	for topic := range topicHandlers {
+		topics = append(topics, topic)
+	}
+
+	if err := c.createGroups(ctx, topics); err != nil {
+		return err
+	}
+
+	log.Info().Str("group", c.group).Str("consumer", c.name).Msgf("consuming streams: %v", topics)
+
+	// The message being handled when ctx is done gets drainTimeout to finish
+	handlerCtx, stopHandlers := c.handlerContext(ctx)
+
+	err := c.consume(ctx, topics, streamReadCount, func(messages []*streamMessage) {
+		for _, message := range messages {
+			if ctx.Err() != nil {
+				return
+			}
+
+			c.processMessage(handlerCtx, topicHandlers[message.stream], message)
+		}
+	})
+
+	return errors.Join(err, stopHandlers())
+}
+
+// streamBatch is a batch of messages from one stream waiting to be handled
+type streamBatch struct {
+	messages []*streamMessage
+	started  time.Time
+}
+
+// StartConsumingBatches consumes streams like StartConsuming, but hands messages
+// to the stream's handler in batches bounded by batchSize and batchLinger.
+// Entries are acknowledged after the handler succeeds.
+func (c *RedisStreamConsumer) StartConsumingBatches(ctx context.Context, topicHandlers BatchEventHandlers) error {
+	topics := make([]string, 0, len(topicHandlers))
+	for topic := range topicHandlers {
+		topics = append(topics, topic)
+	}
+
+	if err := c.createGroups(ctx, topics); err != nil {
+		return err
+	}
+
+	log.Info().Str("group", c.group).Str("consumer", c.name).Int("batch_size", c.batchSize).Dur("batch_linger", c.batchLinger).
+		Msgf("consuming streams in batches: %v", topics)
+
+	// Pending batches aren't acknowledged, they are handled again on restart.
+	// The batch being handled when ctx is done gets drainTimeout to finish.
+	batches := make(map[string]*streamBatch)
+	handlerCtx, stopHandlers := c.handlerContext(ctx)
+
+	err := c.consume(ctx, topics, int64(c.batchSize), func(messages []*streamMessage) {
+		for _, message := range messages {
+			batch, ok := batches[message.stream]
+			if !ok {
+				batch = &streamBatch{started: time.Now()}
+				batches[message.stream] = batch
+			}
+			batch.messages = append(batch.messages, message)
+
+			if len(batch.messages) >= c.batchSize {
+				if ctx.Err() != nil {
+					return
+				}
+				c.processBatch(handlerCtx, message.stream, topicHandlers[message.stream], batch.messages)
+				delete(batches, message.stream)
+			}
+		}
+
+		for topic, batch := range batches {
+			if time.Since(batch.started) >= c.batchLinger && ctx.Err() == nil {
+				c.processBatch(handlerCtx, topic, topicHandlers[topic], batch.messages)
+				delete(batches, topic)
+			}
+		}
+	})
+
+	return errors.Join(err, stopHandlers())
+}
+
+// createGroups creates the consumer group on each stream, creating streams that
+// don't exist yet
+func (c *RedisStreamConsumer) createGroups(ctx context.Context, topics []string) error {
+	for _, topic := range topics {
+		err := c.client.XGroupCreateMkStream(ctx, topic, c.group, c.startID).Err()
+		if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+			return fmt.Errorf("failed to create consumer group %s on stream %s: %w", c.group, topic, err)
+		}
+	}
+
+	return nil
+}
+
+// consume passes the entries of topics to handle: first the ones this consumer
+// read before it last stopped but didn't acknowledge, then new ones, claiming
+// entries other consumers have left idle along the way. handle is also called
+// with no entries when a read times out. Returns once ctx is done.
+func (c *RedisStreamConsumer) consume(ctx context.Context, topics []string, count int64, handle func([]*streamMessage)) error {
+	defer c.client.Close()
+
+	pending, err := c.readPending(ctx, topics, count)
+	if err != nil {
+		return err
+	}
+	if len(pending) > 0 {
+		log.Info().Int("entries", len(pending)).Msg("handling entries left unacknowledged by the last run")
+	}
+	handle(pending)
+
+	var lastClaim time.Time
+
+	for ctx.Err() == nil {
+		if time.Since(lastClaim) >= c.claimMinIdle/2 {
+			handle(c.claim(ctx, topics, count))
+			lastClaim = time.Now()
+		}
+
+		messages, err := c.read(ctx, topics, ">", count, streamPollTimeout)
+		if err != nil && ctx.Err() == nil {
+			log.Error().Err(err).Msg("failed to read from streams")
+
+			select {
+			case <-ctx.Done():
+			case <-time.After(streamPollTimeout):
+			}
+		}
+
+		handle(messages)
+	}
+
+	return nil
+}
+
+// readPending returns the entries delivered to this consumer that it hasn't acknowledged
+func (c *RedisStreamConsumer) readPending(ctx context.Context, topics []string, count int64) ([]*streamMessage, error) {
+	var pending []*streamMessage
+
+	for _, topic := range topics {
+		// Reading from an ID returns this consumer's pending entries after it
+		for lastID := "0"; ; {
+			messages, err := c.read(ctx, []string{topic}, lastID, count, -1)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read pending entries of stream %s: %w", topic, err)
+			}
+			if len(messages) == 0 {
+				break
+			}
+
+			pending = append(pending, messages...)
+			lastID = messages[len(messages)-1].id
+		}
+	}
+
+	return pending, nil
+}
+
+// read reads entries of topics after id (">" for entries not yet delivered to
+// the group), waiting up to block for them (a negative block doesn't wait)
+func (c *RedisStreamConsumer) read(ctx context.Context, topics []string, id string, count int64, block time.Duration) ([]*streamMessage, error) {
+	streams := append([]string{}, topics...)
+	for range topics {
+		streams = append(streams, id)
+	}
+
+	results, err := c.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    c.group,
+		Consumer: c.name,
+		Streams:  streams,
+		Count:    count,
+		Block:    block,
+	}).Result()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var messages []*streamMessage
+	for _, result := range results {
+		for _, entry := range result.Messages {
+			if message := parseStreamMessage(result.Stream, entry); message != nil {
+				messages = append(messages, message)
+			}
+		}
+	}
+
+	return messages, nil
+}
+
+// claim takes over the entries of topics that have been pending for longer
+// than claimMinIdle, e.g. because the consumer that read them crashed
+func (c *RedisStreamConsumer) claim(ctx context.Context, topics []string, count int64) []*streamMessage {
+	var claimed []*streamMessage
+
+	for _, topic := range topics {
+		for start := "0-0"; ; {
+			entries, next, err := c.client.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+				Stream:   topic,
+				Group:    c.group,
+				Consumer: c.name,
+				MinIdle:  c.claimMinIdle,
+				Start:    start,
+				Count:    count,
+			}).Result()
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Error().Err(err).Str("stream", topic).Msg("failed to claim idle entries")
+				}
+				break
+			}
+
+			for _, entry := range entries {
+				if message := parseStreamMessage(topic, entry); message != nil {
+					claimed = append(claimed, message)
+				} else {
+					// Deleted since it was read, nothing left to handle
+					c.ack(ctx, topic, entry.ID)
+				}
+			}
+
+			if next == "0-0" {
+				break
+			}
+			start = next
+		}
+	}
+
+	if len(claimed) > 0 {
+		log.Warn().Int("entries", len(claimed)).Msg("claimed entries left idle by other consumers")
+	}
+
+	return claimed
+}
+
+// processMessage runs the handler with retries. A message that still fails is
+// published to the dead-letter stream. The entry is acknowledged once the message
+// is handled or dead-lettered, otherwise it stays pending and is handled again.
+func (c *RedisStreamConsumer) processMessage(ctx context.Context, handler EventHandler, message *streamMessage) {
+	// Extract trace context from message headers
+	propagator := propagation.TraceContext{}
+	msgCtx := propagator.Extract(ctx, NewHeaderCarrier(&message.headers))
+
+	msgCtx, span := tracing.StartSpan(msgCtx, "redis.consume")
+	defer span.End()
+
+	span.SetAttributes(tracing.RedisStreamAttributes(message.stream, message.id)...)
+
+	msgCtx = withHeaders(msgCtx, message.headers)
+
+	attempts, err := handleWithRetry(msgCtx, handler, message.key, message.value, c.maxAttempts, c.minBackoff, c.maxBackoff)
+	if err != nil {
+		// Shutting down - the entry is handled again on restart
+		if stopping(ctx) {
+			return
+		}
+
+		log.Error().Err(err).Int("attempts", attempts).Str("stream", message.stream).
+			Msg("message handler failed, sending to dead-letter stream")
+
+		if err := c.sendToDeadLetter(msgCtx, message, err, attempts); err != nil {
+			log.Error().Err(err).Msg("failed to send message to dead-letter stream")
+			return
+		}
+	}
+
+	c.ack(ctx, message.stream, message.id)
+}
+
+// processBatch runs the handler on the batch with retries and acknowledges it
+// once it succeeds. If the batch keeps failing, its messages are handled one at
+// a time so only the ones that fail are dead-lettered.
+func (c *RedisStreamConsumer) processBatch(ctx context.Context, topic string, handler BatchEventHandler, messages []*streamMessage) {
+	ctx, span := tracing.StartSpan(ctx, "redis.consumeBatch")
+	defer span.End()
+
+	span.SetAttributes(tracing.RedisStreamBatchAttributes(topic, len(messages))...)
+
+	records := make([]Record, len(messages))
+	ids := make([]string, len(messages))
+	for i, message := range messages {
+		records[i] = Record{Key: message.key, Value: message.value, Headers: message.headers}
+		ids[i] = message.id
+	}
+
+	batchHandler := func(ctx context.Context, _, _ []byte) error {
+		return handler(ctx, records)
+	}
+
+	attempts, err := handleWithRetry(ctx, batchHandler, nil, nil, c.maxAttempts, c.minBackoff, c.maxBackoff)
+	if err == nil {
+		c.ack(ctx, topic, ids...)
+		return
+	}
+
+	// Shutting down - the entries are handled again on restart
+	if stopping(ctx) {
+		return
+	}
+
+	log.Warn().Err(err).Int("attempts", attempts).Str("stream", topic).Int("messages", len(messages)).
+		Msg("batch handler failed, handling messages individually")
+
+	messageHandler := func(ctx context.Context, key, value []byte) error {
+		return handler(ctx, []Record{{Key: key, Value: value, Headers: messageHeaders(ctx)}})
+	}
+
+	for _, message := range messages {
+		if stopping(ctx) {
+			return
+		}
+
+		c.processMessage(ctx, messageHandler, message)
+	}
+}
+
+// sendToDeadLetter adds the message to "<stream>.dlq" with its original headers
+// plus headers describing the failure. The entry ID is recorded as its offset.
+func (c *RedisStreamConsumer) sendToDeadLetter(ctx context.Context, message *streamMessage, handlerErr error, attempts int) error {
+	dlqTopic := config.DeadLetterTopic(message.stream)
+
+	_, err := c.deadLetters.add(ctx, &kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: &dlqTopic},
+		Key:            message.key,
+		Value:          message.value,
+		Headers:        deadLetterHeaders(message.headers, message.stream, "0", message.id, handlerErr, attempts),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to publish to %s: %w", dlqTopic, err)
+	}
+
+	return nil
+}
+
+// ack acknowledges entries of a stream so they aren't handled again. Handled
+// entries are acknowledged even if the consumer is shutting down.
+func (c *RedisStreamConsumer) ack(ctx context.Context, stream string, ids ...string) {
+	if err := c.client.XAck(context.WithoutCancel(ctx), stream, c.group, ids...).Err(); err != nil {
+		log.Error().Err(err).Str("stream", stream).Msg("failed to acknowledge entries")
+	}
+}
+
+func (c *RedisStreamConsumer) Close() error {
+	err := c.client.Close()
+	if errors.Is(err, redis.ErrClosed) {
+		return nil
+	}
+	return err
+}
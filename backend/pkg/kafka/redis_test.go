@@ -0,0 +1,73 @@
+package kafka
+
+import (
+	"testing"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+// streamEntry returns the entry Redis would return for values
+func streamEntry(id string, values []any) redis.XMessage {
+	entry := redis.XMessage{ID: id, Values: make(map[string]any)}
+	for i := 0; i < len(values); i += 2 {
+		entry.Values[values[i].(string)] = values[i+1]
+	}
+	return entry
+}
+
+func TestStreamMessageRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     []byte
+		value   []byte
+		headers []kafka.Header
+	}{
+		{
+			name:  "message without headers",
+			key:   []byte("0xpool"),
+			value: []byte(`{"type":"io.tokenswap.trade"}`),
+		},
+		{
+			name:  "headers",
+			key:   []byte("0xpool"),
+			value: []byte{0x0a, 0x00, 0xff},
+			headers: []kafka.Header{
+				{Key: HeaderContentType, Value: []byte("application/x-protobuf")},
+				{Key: HeaderSchemaID, Value: []byte("3")},
+				{Key: "traceparent", Value: []byte("00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")},
+			},
+		},
+		{
+			name:  "no key",
+			value: []byte("value"),
+		},
+		{
+			name:    "header named like a field",
+			key:     []byte("key"),
+			value:   []byte("value"),
+			headers: []kafka.Header{{Key: "key", Value: []byte("header")}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entry := streamEntry("1700000000000-0", streamValues(tt.key, tt.value, tt.headers))
+
+			message := parseStreamMessage("trade-history", entry)
+
+			assert.Equal(t, &streamMessage{
+				stream:  "trade-history",
+				id:      "1700000000000-0",
+				key:     tt.key,
+				value:   tt.value,
+				headers: tt.headers,
+			}, message)
+		})
+	}
+}
+
+func TestParseStreamMessage_DeletedEntry(t *testing.T) {
+	assert.Nil(t, parseStreamMessage("trade-history", redis.XMessage{ID: "1700000000000-0"}))
+}
@@ -0,0 +1,236 @@
+package kafka
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sync"
+)
+
+// ErrIncompatibleSchema is returned when registering a schema that can't read
+// data written with an earlier schema of the same subject
+var ErrIncompatibleSchema = errors.New("incompatible schema")
+
+// ErrSchemaNotFound is returned when looking up an ID that isn't registered
+var ErrSchemaNotFound = errors.New("schema not found")
+
+// SchemaField is a field of a message schema
+type SchemaField struct {
+	Name   string `json:"name"`
+	Number int    `json:"number"`
+	Type   string `json:"type"`
+}
+
+// Schema describes the fields of a message encoded by the codecs
+type Schema struct {
+	Fields []SchemaField `json:"fields"`
+}
+
+// SchemaOf derives the schema of a struct from its protobuf and json tags
+func SchemaOf(v any) (*Schema, error) {
+	value := reflect.Indirect(reflect.ValueOf(v))
+	if !value.IsValid() {
+		return nil, fmt.Errorf("cannot derive schema of %T", v)
+	}
+
+	message, err := protoMessageOf(value.Type())
+	if err != nil {
+		return nil, err
+	}
+
+	schema := &Schema{Fields: make([]SchemaField, 0, len(message.fields))}
+	for _, field := range message.fields {
+		schema.Fields = append(schema.Fields, SchemaField{
+			Name:   field.name,
+			Number: int(field.number),
+			Type:   string(field.typ),
+		})
+	}
+
+	return schema, nil
+}
+
+// checkBackwardCompatible returns an error if data written with previous can't be
+// read with next. Fields may be added or removed, but a field number must keep
+// its name and type, and a name its number, so removed numbers aren't reused.
+func checkBackwardCompatible(previous, next *Schema) error {
+	for _, field := range next.Fields {
+		for _, old := range previous.Fields {
+			switch {
+			case old.Number == field.Number && old.Name != field.Name:
+				return fmt.Errorf("%w: field %d was %s, now %s", ErrIncompatibleSchema, field.Number, old.Name, field.Name)
+			case old.Number == field.Number && old.Type != field.Type:
+				return fmt.Errorf("%w: field %s changed type from %s to %s", ErrIncompatibleSchema, field.Name, old.Type, field.Type)
+			case old.Name == field.Name && old.Number != field.Number:
+				return fmt.Errorf("%w: field %s changed number from %d to %d", ErrIncompatibleSchema, field.Name, old.Number, field.Number)
+			}
+		}
+	}
+
+	return nil
+}
+
+// RegisteredSchema is a version of a subject's schema
+type RegisteredSchema struct {
+	ID      int    `json:"id"`
+	Subject string `json:"subject"`
+	Version int    `json:"version"`
+	Schema  Schema `json:"schema"`
+}
+
+// SchemaRegistry assigns IDs to schemas and rejects changes that aren't backward
+// compatible. It is a stand-in for a schema registry service, storing schemas
+// in a JSON file that every producer and consumer shares.
+type SchemaRegistry struct {
+	path string
+
+	mu      sync.Mutex
+	schemas []RegisteredSchema
+}
+
+// OpenSchemaRegistry loads the registry stored at path. The file, and its
+// directory, are created on the first registration if they don't exist.
+func OpenSchemaRegistry(path string) (*SchemaRegistry, error) {
+	registry := &SchemaRegistry{path: path}
+
+	schemas, err := registry.load()
+	if err != nil {
+		return nil, err
+	}
+	registry.schemas = schemas
+
+	return registry, nil
+}
+
+// load reads the schemas stored in the registry file
+func (r *SchemaRegistry) load() ([]RegisteredSchema, error) {
+	data, err := os.ReadFile(r.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema registry: %w", err)
+	}
+
+	var stored struct {
+		Schemas []RegisteredSchema `json:"schemas"`
+	}
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, fmt.Errorf("failed to parse schema registry %s: %w", r.path, err)
+	}
+
+	return stored.Schemas, nil
+}
+
+// Register returns the ID of schema under subject, adding it as the subject's
+// next version if it differs from the latest one. A schema that isn't backward
+// compatible with every earlier version of the subject is rejected.
+func (r *SchemaRegistry) Register(subject string, schema *Schema) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var latest *RegisteredSchema
+	for i := range r.schemas {
+		registered := &r.schemas[i]
+		if registered.Subject != subject {
+			continue
+		}
+
+		if err := checkBackwardCompatible(&registered.Schema, schema); err != nil {
+			return 0, fmt.Errorf("schema for %s is incompatible with version %d: %w", subject, registered.Version, err)
+		}
+		latest = registered
+	}
+
+	if latest != nil && slices.Equal(latest.Schema.Fields, schema.Fields) {
+		return latest.ID, nil
+	}
+
+	registered := RegisteredSchema{
+		ID:      len(r.schemas) + 1,
+		Subject: subject,
+		Version: 1,
+		Schema:  *schema,
+	}
+	if latest != nil {
+		registered.Version = latest.Version + 1
+	}
+
+	if err := r.save(append(slices.Clone(r.schemas), registered)); err != nil {
+		return 0, err
+	}
+	r.schemas = append(r.schemas, registered)
+
+	return registered.ID, nil
+}
+
+// Lookup returns the schema with the given ID. The registry file is read again
+// if it isn't known yet, as another process may have registered it since.
+func (r *SchemaRegistry) Lookup(id int) (*RegisteredSchema, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if registered := r.find(id); registered != nil {
+		return registered, nil
+	}
+
+	schemas, err := r.load()
+	if err != nil {
+		return nil, err
+	}
+	r.schemas = schemas
+
+	if registered := r.find(id); registered != nil {
+		return registered, nil
+	}
+
+	return nil, fmt.Errorf("%w: %d", ErrSchemaNotFound, id)
+}
+
+// find returns the loaded schema with the given ID, or nil. Must be called with
+// r.mu held.
+func (r *SchemaRegistry) find(id int) *RegisteredSchema {
+	for _, registered := range r.schemas {
+		if registered.ID == id {
+			return &registered
+		}
+	}
+	return nil
+}
+
+// save replaces the registry file, writing to a temporary file first so readers
+// never see a partial registry
+func (r *SchemaRegistry) save(schemas []RegisteredSchema) error {
+	data, err := json.MarshalIndent(map[string]any{"schemas": schemas}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal schema registry: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(r.path), 0o755); err != nil {
+		return fmt.Errorf("failed to create schema registry directory: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(r.path), filepath.Base(r.path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to write schema registry: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write schema registry: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write schema registry: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), r.path); err != nil {
+		return fmt.Errorf("failed to write schema registry: %w", err)
+	}
+
+	return nil
+}
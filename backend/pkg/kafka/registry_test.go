@@ -0,0 +1,208 @@
+package kafka
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"testing"
+
+	"github.com/murraystewart96/token-swap/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSchemaOf(t *testing.T) {
+	schema, err := SchemaOf(testMessageV2{})
+	require.NoError(t, err)
+
+	assert.Equal(t, []SchemaField{
+		{Name: "name", Number: 1, Type: "string"},
+		{Name: "count", Number: 2, Type: "uint64"},
+		{Name: "owner", Number: 9, Type: "string"},
+	}, schema.Fields)
+}
+
+var (
+	protoMessageRegexp = regexp.MustCompile(`(?s)message (\w+) \{(.*?)\n\}`)
+	protoFieldRegexp   = regexp.MustCompile(`(?m)^\s*((?:repeated )?[\w.]+) (\w+) = (\d+);`)
+)
+
+// parseProtoSchemas reads the fields of each message in a .proto file
+func parseProtoSchemas(t *testing.T, path string) map[string][]SchemaField {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	schemas := make(map[string][]SchemaField)
+	for _, message := range protoMessageRegexp.FindAllStringSubmatch(string(data), -1) {
+		fields := []SchemaField{}
+		for _, field := range protoFieldRegexp.FindAllStringSubmatch(message[2], -1) {
+			number, err := strconv.Atoi(field[3])
+			require.NoError(t, err)
+			fields = append(fields, SchemaField{Name: field[2], Number: number, Type: field[1]})
+		}
+		schemas[message[1]] = fields
+	}
+
+	return schemas
+}
+
+// The events are encoded from their struct tags, so events.proto has to be kept in step with them
+func TestSchemaOf_MatchesEventsProto(t *testing.T) {
+	protoSchemas := parseProtoSchemas(t, "../../proto/tokenswap/events.proto")
+
+	events := map[string]any{
+		"Envelope":     models.Envelope{},
+		"TradeEvent":   models.TradeEvent{},
+		"ReserveEvent": models.ReserveEvent{},
+		"ReorgEvent":   models.ReorgEvent{},
+	}
+	require.Len(t, protoSchemas, len(events), "every message in events.proto should be an event")
+
+	for name, event := range events {
+		t.Run(name, func(t *testing.T) {
+			fields, ok := protoSchemas[name]
+			require.True(t, ok, "message %s missing from events.proto", name)
+
+			schema, err := SchemaOf(event)
+			require.NoError(t, err)
+			assert.ElementsMatch(t, fields, schema.Fields)
+		})
+	}
+}
+
+func TestSchemaRegistry_Register(t *testing.T) {
+	v1 := &Schema{Fields: []SchemaField{
+		{Name: "name", Number: 1, Type: "string"},
+		{Name: "count", Number: 2, Type: "uint64"},
+		{Name: "delta", Number: 3, Type: "int64"},
+	}}
+
+	tests := []struct {
+		name            string
+		schema          *Schema
+		expectedID      int
+		expectedVersion int
+		expectError     bool
+	}{
+		{
+			name:            "unchanged schema keeps its id",
+			schema:          v1,
+			expectedID:      1,
+			expectedVersion: 1,
+		},
+		{
+			name: "adding and removing fields is compatible",
+			schema: &Schema{Fields: []SchemaField{
+				{Name: "name", Number: 1, Type: "string"},
+				{Name: "count", Number: 2, Type: "uint64"},
+				{Name: "owner", Number: 4, Type: "string"},
+			}},
+			expectedID:      2,
+			expectedVersion: 2,
+		},
+		{
+			name: "changing a field's type",
+			schema: &Schema{Fields: []SchemaField{
+				{Name: "name", Number: 1, Type: "string"},
+				{Name: "count", Number: 2, Type: "string"},
+			}},
+			expectError: true,
+		},
+		{
+			name: "renaming a field",
+			schema: &Schema{Fields: []SchemaField{
+				{Name: "label", Number: 1, Type: "string"},
+			}},
+			expectError: true,
+		},
+		{
+			name: "renumbering a field",
+			schema: &Schema{Fields: []SchemaField{
+				{Name: "name", Number: 5, Type: "string"},
+			}},
+			expectError: true,
+		},
+		{
+			name: "reusing a removed field's number",
+			schema: &Schema{Fields: []SchemaField{
+				{Name: "name", Number: 1, Type: "string"},
+				{Name: "price", Number: 3, Type: "int64"},
+			}},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry, err := OpenSchemaRegistry(filepath.Join(t.TempDir(), "schemas.json"))
+			require.NoError(t, err)
+
+			_, err = registry.Register("trade.v1", v1)
+			require.NoError(t, err)
+
+			id, err := registry.Register("trade.v1", tt.schema)
+			if tt.expectError {
+				assert.ErrorIs(t, err, ErrIncompatibleSchema)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectedID, id)
+
+			registered, err := registry.Lookup(id)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectedVersion, registered.Version)
+			assert.Equal(t, *tt.schema, registered.Schema)
+		})
+	}
+}
+
+func TestSchemaRegistry_PersistsSchemas(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "schemas.json")
+	schema := &Schema{Fields: []SchemaField{{Name: "name", Number: 1, Type: "string"}}}
+
+	registry, err := OpenSchemaRegistry(path)
+	require.NoError(t, err)
+
+	_, err = registry.Register("reserve.v1", schema)
+	require.NoError(t, err)
+	id, err := registry.Register("trade.v1", schema)
+	require.NoError(t, err)
+
+	// Subjects are checked independently, but IDs are unique across subjects
+	assert.Equal(t, 2, id)
+
+	reopened, err := OpenSchemaRegistry(path)
+	require.NoError(t, err)
+
+	registered, err := reopened.Lookup(id)
+	require.NoError(t, err)
+	assert.Equal(t, "trade.v1", registered.Subject)
+
+	_, err = reopened.Register("trade.v1", &Schema{Fields: []SchemaField{{Name: "name", Number: 1, Type: "bytes"}}})
+	assert.ErrorIs(t, err, ErrIncompatibleSchema)
+}
+
+func TestSchemaRegistry_LooksUpSchemasRegisteredSinceItWasOpened(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data", "schemas.json")
+	schema := &Schema{Fields: []SchemaField{{Name: "name", Number: 1, Type: "string"}}}
+
+	// The worker opens the registry before the listener registers its schemas
+	consumer, err := OpenSchemaRegistry(path)
+	require.NoError(t, err)
+
+	producer, err := OpenSchemaRegistry(path)
+	require.NoError(t, err)
+	id, err := producer.Register("trade.v1", schema)
+	require.NoError(t, err)
+
+	registered, err := consumer.Lookup(id)
+	require.NoError(t, err)
+	assert.Equal(t, "trade.v1", registered.Subject)
+
+	_, err = consumer.Lookup(id + 1)
+	assert.ErrorIs(t, err, ErrSchemaNotFound)
+}
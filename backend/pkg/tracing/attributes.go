@@ -22,10 +22,20 @@ const (
 	AttrKafkaTopic     = "kafka.topic"
 	AttrKafkaPartition = "kafka.partition"
 	AttrKafkaOffset    = "kafka.offset"
+	AttrKafkaBatchSize = "kafka.batch_size"
+
+	// Redis Streams attributes
+	AttrRedisStream    = "redis.stream"
+	AttrRedisEntryID   = "redis.entry_id"
+	AttrRedisBatchSize = "redis.batch_size"
 	
 	// Database attributes
 	AttrDBTable        = "db.table"
 	AttrDBOperation    = "db.operation"
+	AttrDBSystem       = "db.system"
+	AttrDBStatement    = "db.statement"
+	AttrDBRowsAffected = "db.rows_affected"
+	AttrDBBatchSize    = "db.batch_size"
 	
 	// Cache attributes
 	AttrCacheKey       = "cache.key"
@@ -55,4 +65,40 @@ func KafkaAttributes(topic string, partition int32, offset int64) []attribute.Ke
 		attribute.Int(AttrKafkaPartition, int(partition)),
 		attribute.Int64(AttrKafkaOffset, offset),
 	}
+}
+
+func KafkaBatchAttributes(topic string, batchSize int) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String(AttrKafkaTopic, topic),
+		attribute.Int(AttrKafkaBatchSize, batchSize),
+	}
+}
+
+func RedisStreamAttributes(stream, entryID string) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String(AttrRedisStream, stream),
+		attribute.String(AttrRedisEntryID, entryID),
+	}
+}
+
+func RedisStreamBatchAttributes(stream string, batchSize int) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String(AttrRedisStream, stream),
+		attribute.Int(AttrRedisBatchSize, batchSize),
+	}
+}
+
+func DBQueryAttributes(statement string) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String(AttrDBSystem, "postgresql"),
+		attribute.String(AttrDBOperation, DBOperation(statement)),
+		attribute.String(AttrDBStatement, statement),
+	}
+}
+
+func DBBatchAttributes(batchSize int) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String(AttrDBSystem, "postgresql"),
+		attribute.Int(AttrDBBatchSize, batchSize),
+	}
 }
\ No newline at end of file
@@ -0,0 +1,83 @@
+package tracing
+
+import (
+	"context"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	otelTrace "go.opentelemetry.io/otel/trace"
+)
+
+// PgxTracer traces the queries and batches pgx runs. Set it as the Tracer of a
+// pgx connection config so every query gets a "db.query" span (or a "db.batch"
+// span for batches) that is a child of the span in the query's context.
+type PgxTracer struct{}
+
+var (
+	_ pgx.QueryTracer = PgxTracer{}
+	_ pgx.BatchTracer = PgxTracer{}
+)
+
+func (PgxTracer) TraceQueryStart(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+	ctx, span := StartSpan(ctx, "db.query")
+	span.SetAttributes(DBQueryAttributes(data.SQL)...)
+
+	return ctx
+}
+
+func (PgxTracer) TraceQueryEnd(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryEndData) {
+	span := otelTrace.SpanFromContext(ctx)
+	defer span.End()
+
+	if data.Err != nil {
+		recordError(span, data.Err)
+		return
+	}
+	span.SetAttributes(attribute.Int64(AttrDBRowsAffected, data.CommandTag.RowsAffected()))
+}
+
+func (PgxTracer) TraceBatchStart(ctx context.Context, _ *pgx.Conn, data pgx.TraceBatchStartData) context.Context {
+	ctx, span := StartSpan(ctx, "db.batch")
+	span.SetAttributes(DBBatchAttributes(data.Batch.Len())...)
+
+	return ctx
+}
+
+// TraceBatchQuery records each query of a batch as an event of the batch's span
+func (PgxTracer) TraceBatchQuery(ctx context.Context, _ *pgx.Conn, data pgx.TraceBatchQueryData) {
+	span := otelTrace.SpanFromContext(ctx)
+
+	attributes := DBQueryAttributes(data.SQL)
+	if data.Err != nil {
+		attributes = append(attributes, attribute.String("error", data.Err.Error()))
+	} else {
+		attributes = append(attributes, attribute.Int64(AttrDBRowsAffected, data.CommandTag.RowsAffected()))
+	}
+	span.AddEvent("db.batch.query", otelTrace.WithAttributes(attributes...))
+}
+
+func (PgxTracer) TraceBatchEnd(ctx context.Context, _ *pgx.Conn, data pgx.TraceBatchEndData) {
+	span := otelTrace.SpanFromContext(ctx)
+	defer span.End()
+
+	if data.Err != nil {
+		recordError(span, data.Err)
+	}
+}
+
+// DBOperation returns the SQL command of a statement, e.g. "INSERT"
+func DBOperation(statement string) string {
+	fields := strings.Fields(statement)
+	if len(fields) == 0 {
+		return ""
+	}
+
+	return strings.ToUpper(fields[0])
+}
+
+func recordError(span otelTrace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
@@ -150,9 +150,11 @@ func (e *InMemoryExporter) AnalyzeTrace(traceID string) *TraceMetrics {
 		case "worker.handleTradeEvent", "worker.handleReserveEvent":
 			metrics.WorkerSpan = span
 			metrics.WorkerProcessingTime = duration
-		case "db.CreateTrade", "db.CreateReserve":
-			metrics.DatabaseSpan = span
-			metrics.DatabaseOperationTime = duration
+		case "db.query", "db.batch":
+			if metrics.DatabaseSpan == nil {
+				metrics.DatabaseSpan = span
+			}
+			metrics.DatabaseOperationTime += duration
 		case "cache.SetPrice", "cache.SetReserves":
 			metrics.CacheSpans = append(metrics.CacheSpans, span)
 			metrics.CacheOperationTime += duration
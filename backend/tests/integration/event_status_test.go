@@ -0,0 +1,211 @@
+package integration
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/murraystewart96/token-swap/internal/config"
+	"github.com/murraystewart96/token-swap/internal/models"
+	"github.com/murraystewart96/token-swap/internal/storage/postgres"
+	"github.com/murraystewart96/token-swap/tests/integration/testutils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// connectTestDB connects to the test database, closing it when the test ends
+func connectTestDB(t *testing.T) *postgres.DB {
+	db, err := postgres.NewDB(&config.DB{
+		Host:     testutils.GetEnvWithDefault("TEST_DB_HOST", "localhost"),
+		Port:     testutils.GetEnvWithDefault("TEST_DB_PORT", "5433"),
+		Name:     testutils.GetEnvWithDefault("TEST_DB_NAME", "tokenswap_test"),
+		User:     testutils.GetEnvWithDefault("TEST_DB_USER", "test_user"),
+		Password: testutils.GetEnvWithDefault("TEST_DB_PASSWORD", "test_password"),
+	})
+	require.NoError(t, err)
+	t.Cleanup(db.Close)
+
+	return db
+}
+
+// TestEventStatus_OrphanedEventsArePendingAgainWhenTheirBlockIsCanonicalAgain
+// checks events orphaned by a reorg are only stored as pending again once the
+// listener has marked their block canonical again and republished them
+func TestEventStatus_OrphanedEventsArePendingAgainWhenTheirBlockIsCanonicalAgain(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test in short mode")
+	}
+
+	db := connectTestDB(t)
+
+	ctx := t.Context()
+	id := time.Now().UnixNano()
+	poolAddr := fmt.Sprintf("0xpool%d", id)
+	block := &models.Block{Number: uint64(id), Hash: fmt.Sprintf("0xblock%d", id), ParentHash: "0xparent", Timestamp: 1700000000}
+	head := &models.Block{Number: block.Number + 1, Hash: fmt.Sprintf("0xhead%d", id)}
+
+	trade := &models.TradeEvent{
+		TxHash: fmt.Sprintf("0xtx%d", id), BlockNumber: block.Number, BlockHash: block.Hash, LogIndex: 1,
+		Timestamp: block.Timestamp, TokenIn: "MET", TokenOut: "YOU", AmountIn: "100", AmountOut: "90",
+		PoolAddress: poolAddr, EffectiveGasPrice: "1", TxFee: "21000",
+	}
+	reserve := &models.ReserveEvent{
+		TxHash: trade.TxHash, BlockNumber: block.Number, BlockHash: block.Hash, LogIndex: 2,
+		Timestamp: block.Timestamp, METReserve: "1000", YOUReserve: "900", PoolAddress: poolAddr,
+	}
+
+	statuses := func() (string, string) {
+		trades, err := db.GetTradesByCursor(ctx, poolAddr, []string{
+			models.EventStatusPending, models.EventStatusConfirmed, models.EventStatusOrphaned,
+		}, 0, 0, 0, 10)
+		require.NoError(t, err)
+		require.Len(t, trades, 1)
+
+		reserves, err := db.GetLatestReserve(ctx, poolAddr, []string{
+			models.EventStatusPending, models.EventStatusConfirmed, models.EventStatusOrphaned,
+		})
+		require.NoError(t, err)
+		require.NotNil(t, reserves)
+
+		return trades[0].Status, reserves.Status
+	}
+
+	require.NoError(t, db.SaveBlocks(ctx, []*models.Block{block}))
+
+	stored, err := db.CreateTrade(ctx, trade)
+	require.NoError(t, err)
+	assert.True(t, stored)
+	stored, err = db.CreateReserve(ctx, reserve)
+	require.NoError(t, err)
+	assert.True(t, stored)
+
+	// The block is reorganised out
+	require.NoError(t, db.OrphanEvents(ctx, []string{block.Hash}, block.Number, head))
+	require.NoError(t, db.OrphanBlocksFrom(ctx, block.Number))
+
+	tradeStatus, reserveStatus := statuses()
+	assert.Equal(t, models.EventStatusOrphaned, tradeStatus)
+	assert.Equal(t, models.EventStatusOrphaned, reserveStatus)
+
+	// Redelivered events from the orphaned block stay orphaned
+	stored, err = db.CreateTrade(ctx, trade)
+	require.NoError(t, err)
+	assert.False(t, stored)
+	stored, err = db.CreateReserve(ctx, reserve)
+	require.NoError(t, err)
+	assert.False(t, stored)
+
+	tradeStatus, reserveStatus = statuses()
+	assert.Equal(t, models.EventStatusOrphaned, tradeStatus)
+	assert.Equal(t, models.EventStatusOrphaned, reserveStatus)
+
+	// The block becomes canonical again and its events are republished
+	require.NoError(t, db.SaveBlocks(ctx, []*models.Block{block}))
+
+	stored, err = db.CreateTrade(ctx, trade)
+	require.NoError(t, err)
+	assert.True(t, stored)
+	created, err := db.CreateReserves(ctx, []*models.ReserveEvent{reserve})
+	require.NoError(t, err)
+	assert.Equal(t, 1, created)
+
+	tradeStatus, reserveStatus = statuses()
+	assert.Equal(t, models.EventStatusPending, tradeStatus)
+	assert.Equal(t, models.EventStatusPending, reserveStatus)
+
+	// Both changes of status are recorded
+	rows, err := db.GetConn().Query(ctx, `
+        SELECT t.event_table, t.from_status, t.to_status
+        FROM event_status_transitions t
+        LEFT JOIN trades ON t.event_table = 'trades' AND trades.id = t.event_id
+        LEFT JOIN reserves ON t.event_table = 'reserves' AND reserves.id = t.event_id
+        WHERE trades.pool_address = $1 OR reserves.pool_address = $1
+        ORDER BY t.id`, poolAddr)
+	require.NoError(t, err)
+	defer rows.Close()
+
+	var transitions []string
+	for rows.Next() {
+		var table, from, to string
+		require.NoError(t, rows.Scan(&table, &from, &to))
+		transitions = append(transitions, fmt.Sprintf("%s %s->%s", table, from, to))
+	}
+	require.NoError(t, rows.Err())
+
+	assert.Equal(t, []string{
+		"trades pending->orphaned",
+		"reserves pending->orphaned",
+		"trades orphaned->pending",
+		"reserves orphaned->pending",
+	}, transitions)
+}
+
+// TestEventStatus_EventsRetractedBeforeTheyAreStoredAreStoredOrphaned checks
+// events the worker stores after handling the retraction of their block, but
+// before the listener has orphaned the block, are stored orphaned
+func TestEventStatus_EventsRetractedBeforeTheyAreStoredAreStoredOrphaned(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test in short mode")
+	}
+
+	db := connectTestDB(t)
+
+	ctx := t.Context()
+	id := time.Now().UnixNano()
+	poolAddr := fmt.Sprintf("0xpool%d", id)
+	blockNumber := uint64(id)
+	storedHash := fmt.Sprintf("0xstored%d", id)
+	unstoredHash := fmt.Sprintf("0xunstored%d", id)
+	head := &models.Block{Number: blockNumber + 2, Hash: fmt.Sprintf("0xhead%d", id)}
+
+	// The listener has stored one of the blocks but not yet orphaned it
+	require.NoError(t, db.SaveBlocks(ctx, []*models.Block{
+		{Number: blockNumber, Hash: storedHash, ParentHash: "0xparent", Timestamp: 1700000000},
+	}))
+
+	// The worker handles the retraction before the events from the blocks
+	require.NoError(t, db.OrphanEvents(ctx, []string{storedHash, unstoredHash}, blockNumber, head))
+
+	stored, err := db.CreateTrade(ctx, &models.TradeEvent{
+		TxHash: fmt.Sprintf("0xtx%d", id), BlockNumber: blockNumber, BlockHash: storedHash, LogIndex: 1,
+		Timestamp: 1700000000, TokenIn: "MET", TokenOut: "YOU", AmountIn: "100", AmountOut: "90",
+		PoolAddress: poolAddr, EffectiveGasPrice: "1", TxFee: "21000",
+	})
+	require.NoError(t, err)
+	assert.True(t, stored)
+
+	created, err := db.CreateReserves(ctx, []*models.ReserveEvent{{
+		TxHash: fmt.Sprintf("0xtx%d", id), BlockNumber: blockNumber + 1, BlockHash: unstoredHash, LogIndex: 1,
+		Timestamp: 1700000012, METReserve: "1000", YOUReserve: "900", PoolAddress: poolAddr,
+	}})
+	require.NoError(t, err)
+	assert.Equal(t, 1, created)
+
+	trades, err := db.GetTradesByCursor(ctx, poolAddr, nil, 0, 0, 0, 10)
+	require.NoError(t, err)
+	assert.Empty(t, trades)
+
+	reserve, err := db.GetLatestReserve(ctx, poolAddr, nil)
+	require.NoError(t, err)
+	assert.Nil(t, reserve)
+
+	reserve, err = db.GetLatestReserve(ctx, poolAddr, []string{models.EventStatusOrphaned})
+	require.NoError(t, err)
+	require.NotNil(t, reserve)
+	assert.Equal(t, models.EventStatusOrphaned, reserve.Status)
+
+	start, end := time.Unix(1700000000, 0), time.Unix(1700000060, 0)
+	reserves, err := db.GetReservesByTimeRange(ctx, poolAddr, nil, start, end)
+	require.NoError(t, err)
+	assert.Empty(t, reserves)
+
+	trades, err = db.GetTradesByTimeRange(ctx, poolAddr, []string{models.EventStatusOrphaned}, start, end)
+	require.NoError(t, err)
+	require.Len(t, trades, 1)
+	assert.Equal(t, models.EventStatusOrphaned, trades[0].Status)
+
+	// Neither block is canonical, so the listener's later orphaning doesn't change anything
+	block, err := db.GetCanonicalBlock(ctx, blockNumber)
+	require.NoError(t, err)
+	assert.Nil(t, block)
+}
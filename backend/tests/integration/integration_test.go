@@ -103,7 +103,7 @@ func TestEventListener_EndToEndFlow(t *testing.T) {
 		reserveOk := verifyReserveInDatabase(t, infra.DB, swapTxHash.Hex())
 
 		// Verify price in cache matches blockchain
-		priceOk := verifyPriceInCache(t, testContracts.Pool, infra.PoolCache)
+		priceOk := verifyPriceInCache(t, testContracts.PoolAddr, testContracts.Pool, infra.PoolCache)
 
 		return tradeOk && reserveOk && priceOk
 	}, 20*time.Second, 1*time.Second)
@@ -294,7 +294,7 @@ func executeSwapTransaction(t *testing.T, client *ethclient.Client, testContract
 
 func verifyTradeInDatabase(t *testing.T, db storage.DB, expectedTxHash string) bool {
 	// Query trades table for the transaction hash
-	trades, err := db.GetTradesByTimeRange(time.Now().Add(-10*time.Minute), time.Now())
+	trades, err := db.GetTradesByTimeRange(t.Context(), "", nil, time.Now().Add(-10*time.Minute), time.Now())
 	require.NoError(t, err, "Failed to query trades from database")
 
 	// Look for our specific transaction
@@ -315,7 +315,7 @@ func verifyTradeInDatabase(t *testing.T, db storage.DB, expectedTxHash string) b
 
 func verifyReserveInDatabase(t *testing.T, db storage.DB, expectedTxHash string) bool {
 	// Query reserves table for the transaction hash
-	reserves, err := db.GetReservesByTimeRange(time.Now().Add(-10*time.Minute), time.Now())
+	reserves, err := db.GetReservesByTimeRange(t.Context(), "", nil, time.Now().Add(-10*time.Minute), time.Now())
 	require.NoError(t, err, "Failed to query reserves from database")
 
 	// Look for our specific transaction
@@ -334,9 +334,9 @@ func verifyReserveInDatabase(t *testing.T, db storage.DB, expectedTxHash string)
 	return expectedTxHash == foundReserve.TxHash
 }
 
-func verifyPriceInCache(t *testing.T, pool *contracts.Pool, poolCache storage.PoolCache) bool {
+func verifyPriceInCache(t *testing.T, poolAddr common.Address, pool *contracts.Pool, poolCache storage.PoolCache) bool {
 	// Get cached price as decimal
-	cachedPrice, err := poolCache.GetPrice(t.Context(), worker.MET_YOU_PAIR)
+	cachedPrice, err := poolCache.GetPrice(t.Context(), poolAddr.Hex(), worker.MET_YOU_PAIR)
 	if errors.Is(err, redis.Nil) {
 		return false // entry doesn't exist yet
 	} else {
@@ -355,7 +355,7 @@ func verifyPriceInCache(t *testing.T, pool *contracts.Pool, poolCache storage.Po
 
 	latestPrice := youReserve.Div(metReserve).StringFixed(6) // YOU per MET
 
-	return cachedPrice == latestPrice
+	return cachedPrice.Price == latestPrice
 }
 
 // TODO: BONUS TASKS (Optional)
@@ -181,10 +181,9 @@ func sendTradeEventWithTracing(t *testing.T, ctx context.Context, infra *testuti
 		tracing.BlockchainAttributes(tradeEvent.BlockNumber, tradeEvent.TxHash)...,
 	)
 
-	eventJSON, err := json.Marshal(tradeEvent)
-	require.NoError(t, err)
+	eventJSON := marshalEvent(t, models.EventTypeTrade, models.TradeEventVersion, tradeEvent)
 
-	err = infra.KafkaProducer.Produce(ctx, config.TradeHistoryTopic, []byte(tradeEvent.TxHash), eventJSON)
+	_, err := infra.KafkaProducer.Produce(ctx, config.TradeHistoryTopic, []byte(tradeEvent.TxHash), eventJSON)
 	require.NoError(t, err)
 }
 
@@ -201,10 +200,9 @@ func sendTradeEventWithoutTracing(t *testing.T, ctx context.Context, infra *test
 		Timestamp:        time.Now().Unix(),
 	}
 
-	eventJSON, err := json.Marshal(tradeEvent)
-	require.NoError(t, err)
+	eventJSON := marshalEvent(t, models.EventTypeTrade, models.TradeEventVersion, tradeEvent)
 
-	err = infra.KafkaProducer.Produce(ctx, config.TradeHistoryTopic, []byte(tradeEvent.TxHash), eventJSON)
+	_, err := infra.KafkaProducer.Produce(ctx, config.TradeHistoryTopic, []byte(tradeEvent.TxHash), eventJSON)
 	require.NoError(t, err)
 }
 
@@ -219,10 +217,9 @@ func sendReserveEventWithoutTracing(t *testing.T, ctx context.Context, infra *te
 		Timestamp:   time.Now().Unix(),
 	}
 
-	eventJSON, err := json.Marshal(reserveEvent)
-	require.NoError(t, err)
+	eventJSON := marshalEvent(t, models.EventTypeReserve, models.ReserveEventVersion, reserveEvent)
 
-	err = infra.KafkaProducer.Produce(ctx, config.ReserveHistoryTopic, []byte(reserveEvent.TxHash), eventJSON)
+	_, err := infra.KafkaProducer.Produce(ctx, config.ReserveHistoryTopic, []byte(reserveEvent.TxHash), eventJSON)
 	require.NoError(t, err)
 }
 
@@ -245,11 +242,25 @@ func sendReserveEventWithTracing(t *testing.T, ctx context.Context, infra *testu
 		tracing.BlockchainAttributes(reserveEvent.BlockNumber, reserveEvent.TxHash)...,
 	)
 
-	eventJSON, err := json.Marshal(reserveEvent)
+	eventJSON := marshalEvent(t, models.EventTypeReserve, models.ReserveEventVersion, reserveEvent)
+
+	_, err := infra.KafkaProducer.Produce(ctx, config.ReserveHistoryTopic, []byte(reserveEvent.TxHash), eventJSON)
 	require.NoError(t, err)
+}
 
-	err = infra.KafkaProducer.Produce(ctx, config.ReserveHistoryTopic, []byte(reserveEvent.TxHash), eventJSON)
+// marshalEvent wraps an event in the envelope the listener publishes events in
+func marshalEvent(t *testing.T, eventType string, schemaVersion int, event any) []byte {
+	data, err := json.Marshal(event)
 	require.NoError(t, err)
+
+	envelope := models.NewEnvelope(eventType, schemaVersion)
+	envelope.Data = data
+	envelope.Source = "0x1234567890123456789012345678901234567890"
+
+	eventJSON, err := json.Marshal(envelope)
+	require.NoError(t, err)
+
+	return eventJSON
 }
 
 func calculateAverage(durations []time.Duration) time.Duration {
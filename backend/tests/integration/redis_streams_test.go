@@ -0,0 +1,130 @@
+package integration
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/murraystewart96/token-swap/internal/config"
+	"github.com/murraystewart96/token-swap/pkg/kafka"
+	"github.com/murraystewart96/token-swap/tests/integration/testutils"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestRedisStreams_DeadLettersFailingMessages checks messages published to Redis
+// Streams reach the handler with their headers, and failing ones end up in the
+// dead-letter stream
+func TestRedisStreams_DeadLettersFailingMessages(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test in short mode")
+	}
+
+	redisCfg := &config.Redis{Addr: testutils.GetEnvWithDefault("TEST_REDIS_ADDR", "localhost:6380")}
+	stream := fmt.Sprintf("test-events-%d", time.Now().UnixNano())
+
+	producer := kafka.NewRedisStreamProducer(redisCfg, &config.KafkaProducer{})
+	defer producer.Close()
+
+	for _, value := range []string{"poison", "ok"} {
+		_, err := producer.Produce(t.Context(), stream, []byte("pool"), []byte(value),
+			kafka.Header{Key: kafka.HeaderContentType, Value: []byte("application/json")})
+		require.NoError(t, err)
+	}
+
+	handled := make(chan string, 2)
+	consumer := kafka.NewRedisStreamConsumer(redisCfg, &config.KafkaConsumer{GroupID: "worker", OffsetReset: "earliest", MaxAttempts: 1})
+	defer consumer.Close()
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	go consumer.StartConsuming(ctx, kafka.EventHandlers{
+		stream: func(ctx context.Context, _, value []byte) error {
+			if string(value) == "poison" {
+				return kafka.NonRetryable(errors.New("cannot process"))
+			}
+			handled <- kafka.MessageHeader(ctx, kafka.HeaderContentType)
+			return nil
+		},
+	})
+
+	select {
+	case contentType := <-handled:
+		assert.Equal(t, "application/json", contentType)
+	case <-time.After(10 * time.Second):
+		t.Fatal("message wasn't handled")
+	}
+
+	client := redis.NewClient(&redis.Options{Addr: redisCfg.Addr})
+	defer client.Close()
+
+	require.Eventually(t, func() bool {
+		entries, err := client.XRange(t.Context(), config.DeadLetterTopic(stream), "-", "+").Result()
+		return err == nil && len(entries) == 1 && entries[0].Values["value"] == "poison"
+	}, 10*time.Second, 100*time.Millisecond)
+
+	// Both entries were acknowledged
+	require.Eventually(t, func() bool {
+		pending, err := client.XPending(t.Context(), stream, "worker").Result()
+		return err == nil && pending.Count == 0
+	}, 10*time.Second, 100*time.Millisecond)
+}
+
+// TestRedisStreams_ClaimsEntriesOfCrashedConsumer checks entries another
+// consumer read but never acknowledged are handled once they've been idle
+func TestRedisStreams_ClaimsEntriesOfCrashedConsumer(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test in short mode")
+	}
+
+	redisCfg := &config.Redis{Addr: testutils.GetEnvWithDefault("TEST_REDIS_ADDR", "localhost:6380")}
+	stream := fmt.Sprintf("test-events-%d", time.Now().UnixNano())
+
+	client := redis.NewClient(&redis.Options{Addr: redisCfg.Addr})
+	defer client.Close()
+
+	producer := kafka.NewRedisStreamProducer(redisCfg, &config.KafkaProducer{})
+	defer producer.Close()
+
+	_, err := producer.Produce(t.Context(), stream, []byte("pool"), []byte("event"))
+	require.NoError(t, err)
+
+	// A consumer reads the entry and crashes before acknowledging it
+	require.NoError(t, client.XGroupCreateMkStream(t.Context(), stream, "worker", "0").Err())
+	_, err = client.XReadGroup(t.Context(), &redis.XReadGroupArgs{
+		Group:    "worker",
+		Consumer: "crashed",
+		Streams:  []string{stream, ">"},
+	}).Result()
+	require.NoError(t, err)
+
+	handled := make(chan string, 1)
+	consumer := kafka.NewRedisStreamConsumer(redisCfg, &config.KafkaConsumer{
+		GroupID:      "worker",
+		OffsetReset:  "earliest",
+		ClaimMinIdle: 200 * time.Millisecond,
+		ConsumerName: "survivor",
+	})
+	defer consumer.Close()
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	go consumer.StartConsuming(ctx, kafka.EventHandlers{
+		stream: func(_ context.Context, _, value []byte) error {
+			handled <- string(value)
+			return nil
+		},
+	})
+
+	select {
+	case value := <-handled:
+		assert.Equal(t, "event", value)
+	case <-time.After(10 * time.Second):
+		t.Fatal("entry of the crashed consumer wasn't claimed")
+	}
+}
@@ -112,11 +112,13 @@ func (ti *TestInfrastructure) resetDatabase() error {
 	query := `
 		TRUNCATE TABLE trades RESTART IDENTITY CASCADE;
 		TRUNCATE TABLE reserves RESTART IDENTITY CASCADE;
+		TRUNCATE TABLE listener_checkpoints;
+		TRUNCATE TABLE blocks;
 	`
 
 	// Execute the truncate query
 	// Note: This is simplified - you'll need to adapt based on your actual DB interface
-	return ti.DB.Exec(query)
+	return ti.DB.Exec(context.Background(), query)
 }
 
 // Cleanup closes all service connections